@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/history"
+	"github.com/ilievs/fibers/rules"
+	"github.com/ilievs/fibers/scene"
+	"github.com/ilievs/fibers/schedule"
+	"github.com/labstack/echo/v4"
+)
+
+// handleEvents streams device events as server-sent events. The stream can be
+// narrowed with the type, device (glob) and selector (labels) query
+// parameters, e.g. /events?type=state_changed&device=psu*&selector=rack=r1
+func handleEvents(deviceMan core.DeviceManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		selector, err := core.ParseSelector(c.QueryParam("selector"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		filter := core.EventFilter{
+			DevicePattern: c.QueryParam("device"),
+			Selector:      selector,
+		}
+		for _, t := range c.QueryParams()["type"] {
+			filter.Types = append(filter.Types, core.EventType(t))
+		}
+
+		// Slow clients are cut off rather than holding up the rest of the server
+		sub := deviceMan.SubscribeToEvents(c.Request().Context(), filter,
+			core.SubscriptionOptions{BufferSize: 256, Overflow: core.OverflowDisconnect})
+		defer sub.Close()
+
+		w := c.Response()
+		w.Header().Set(echo.HeaderContentType, "text/event-stream")
+		w.Header().Set(echo.HeaderCacheControl, "no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Flush()
+
+		for event := range sub.C() {
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type(), data); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+		return nil
+	}
+}
+
+// bindBody decodes the JSON body only. Unlike echo's Bind it doesn't mix
+// path parameters into maps.
+func bindBody(c echo.Context, v any) error {
+	return json.NewDecoder(c.Request().Body).Decode(v)
+}
+
+func handleSetLabels(deviceMan core.DeviceManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		labels := make(map[string]string)
+		if err := bindBody(c, &labels); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := deviceMan.SetDeviceLabels(c.Param("deviceId"), labels); err != nil {
+			return commandError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func groupError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, core.ErrGroupNotFound):
+		return c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, core.ErrInvalidGroup):
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return commandError(c, err)
+}
+
+func registerGroupRoutes(e *echo.Echo, groupMan *core.GroupManager) {
+	e.GET("/groups", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, groupMan.ListGroups())
+	})
+
+	e.GET("/groups/:groupId", func(c echo.Context) error {
+		group, err := groupMan.GetGroup(c.Param("groupId"))
+		if err != nil {
+			return groupError(c, err)
+		}
+		members, err := groupMan.Members(group.Id)
+		if err != nil {
+			return groupError(c, err)
+		}
+		return c.JSON(http.StatusOK, map[string]any{"group": group, "resolvedMembers": members})
+	})
+
+	e.PUT("/groups/:groupId", func(c echo.Context) error {
+		group := core.Group{}
+		if err := c.Bind(&group); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		group.Id = c.Param("groupId")
+		if err := groupMan.PutGroup(group); err != nil {
+			return groupError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	e.DELETE("/groups/:groupId", func(c echo.Context) error {
+		if err := groupMan.RemoveGroup(c.Param("groupId")); err != nil {
+			return groupError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	e.POST("/groups/:groupId/command", func(c echo.Context) error {
+		command := new(core.Command)
+		if err := c.Bind(command); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		ctx, cancel, err := commandContext(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		defer cancel()
+
+		var outcomes []core.GroupCommandOutcome
+		if _, wait := ctx.Deadline(); wait {
+			outcomes, err = groupMan.SendCommandToGroup(ctx, c.Param("groupId"), command)
+		} else {
+			outcomes, err = groupMan.SendCommandToGroupAsync(c.Param("groupId"), command)
+		}
+		if err != nil {
+			return groupError(c, err)
+		}
+		return c.JSON(http.StatusOK, outcomes)
+	})
+}
+
+func ruleError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, rules.ErrRuleNotFound):
+		return c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, rules.ErrInvalidRule):
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return c.String(http.StatusInternalServerError, err.Error())
+}
+
+func registerRuleRoutes(e *echo.Echo, ruleEngine *rules.Engine) {
+	e.GET("/rules", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, ruleEngine.ListRules())
+	})
+
+	e.GET("/rules/:ruleId", func(c echo.Context) error {
+		rule, err := ruleEngine.GetRule(c.Param("ruleId"))
+		if err != nil {
+			return ruleError(c, err)
+		}
+		return c.JSON(http.StatusOK, rule)
+	})
+
+	e.PUT("/rules/:ruleId", func(c echo.Context) error {
+		rule := rules.Rule{}
+		if err := c.Bind(&rule); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		rule.Id = c.Param("ruleId")
+		if err := ruleEngine.PutRule(rule); err != nil {
+			return ruleError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	e.DELETE("/rules/:ruleId", func(c echo.Context) error {
+		if err := ruleEngine.RemoveRule(c.Param("ruleId")); err != nil {
+			return ruleError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	for action, enabled := range map[string]bool{"enable": true, "disable": false} {
+		e.POST("/rules/:ruleId/"+action, func(c echo.Context) error {
+			if err := ruleEngine.SetEnabled(c.Param("ruleId"), enabled); err != nil {
+				return ruleError(c, err)
+			}
+			return c.NoContent(http.StatusNoContent)
+		})
+	}
+}
+
+func scheduleError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, schedule.ErrScheduleNotFound):
+		return c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, schedule.ErrInvalidSchedule):
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return c.String(http.StatusInternalServerError, err.Error())
+}
+
+func registerScheduleRoutes(e *echo.Echo, scheduler *schedule.Scheduler) {
+	e.GET("/schedules", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, scheduler.ListSchedules())
+	})
+
+	e.GET("/schedules/:scheduleId", func(c echo.Context) error {
+		s, err := scheduler.GetSchedule(c.Param("scheduleId"))
+		if err != nil {
+			return scheduleError(c, err)
+		}
+		return c.JSON(http.StatusOK, s)
+	})
+
+	e.PUT("/schedules/:scheduleId", func(c echo.Context) error {
+		s := schedule.Schedule{}
+		if err := c.Bind(&s); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		s.Id = c.Param("scheduleId")
+		if err := scheduler.PutSchedule(s); err != nil {
+			return scheduleError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	e.DELETE("/schedules/:scheduleId", func(c echo.Context) error {
+		if err := scheduler.RemoveSchedule(c.Param("scheduleId")); err != nil {
+			return scheduleError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	for action, enabled := range map[string]bool{"enable": true, "disable": false} {
+		e.POST("/schedules/:scheduleId/"+action, func(c echo.Context) error {
+			if err := scheduler.SetEnabled(c.Param("scheduleId"), enabled); err != nil {
+				return scheduleError(c, err)
+			}
+			return c.NoContent(http.StatusNoContent)
+		})
+	}
+
+	e.GET("/schedules/:scheduleId/runs", func(c echo.Context) error {
+		runs, err := scheduler.Runs(c.Param("scheduleId"))
+		if err != nil {
+			return scheduleError(c, err)
+		}
+		return c.JSON(http.StatusOK, runs)
+	})
+}
+
+func sceneError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, scene.ErrSceneNotFound), errors.Is(err, scene.ErrRunNotFound):
+		return c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, scene.ErrInvalidScene):
+		return c.String(http.StatusBadRequest, err.Error())
+	case errors.Is(err, scene.ErrRunFinished):
+		return c.String(http.StatusConflict, err.Error())
+	}
+	return c.String(http.StatusInternalServerError, err.Error())
+}
+
+func registerSceneRoutes(e *echo.Echo, runner *scene.Runner) {
+	e.GET("/scenes", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, runner.ListScenes())
+	})
+
+	e.GET("/scenes/:sceneId", func(c echo.Context) error {
+		s, err := runner.GetScene(c.Param("sceneId"))
+		if err != nil {
+			return sceneError(c, err)
+		}
+		return c.JSON(http.StatusOK, s)
+	})
+
+	e.PUT("/scenes/:sceneId", func(c echo.Context) error {
+		s := scene.Scene{}
+		if err := c.Bind(&s); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		s.Id = c.Param("sceneId")
+		if err := runner.PutScene(s); err != nil {
+			return sceneError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	e.DELETE("/scenes/:sceneId", func(c echo.Context) error {
+		if err := runner.RemoveScene(c.Param("sceneId")); err != nil {
+			return sceneError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	// The optional timeout query parameter waits for the run to finish
+	e.POST("/scenes/:sceneId/run", func(c echo.Context) error {
+		ctx, cancel, err := commandContext(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		defer cancel()
+		run, err := runner.Start(c.Param("sceneId"))
+		if err != nil {
+			return sceneError(c, err)
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			return c.JSON(http.StatusAccepted, run)
+		}
+		finished, err := runner.Wait(ctx, run.Id)
+		if err != nil {
+			run, _ = runner.GetRun(run.Id)
+			return c.JSON(http.StatusAccepted, run)
+		}
+		return c.JSON(http.StatusOK, finished)
+	})
+
+	e.GET("/scenes/:sceneId/runs", func(c echo.Context) error {
+		if _, err := runner.GetScene(c.Param("sceneId")); err != nil {
+			return sceneError(c, err)
+		}
+		return c.JSON(http.StatusOK, runner.ListRuns(c.Param("sceneId")))
+	})
+
+	e.GET("/scene-runs", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, runner.ListRuns(""))
+	})
+
+	e.GET("/scene-runs/:runId", func(c echo.Context) error {
+		run, err := runner.GetRun(c.Param("runId"))
+		if err != nil {
+			return sceneError(c, err)
+		}
+		return c.JSON(http.StatusOK, run)
+	})
+
+	e.POST("/scene-runs/:runId/cancel", func(c echo.Context) error {
+		if err := runner.Cancel(c.Param("runId")); err != nil {
+			return sceneError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+}
+
+// commandContext derives the context for a command request. The optional
+// timeout query parameter makes the request wait for the device results.
+func commandContext(c echo.Context) (context.Context, context.CancelFunc, error) {
+	ctx := c.Request().Context()
+	timeoutParam := c.QueryParam("timeout")
+	if timeoutParam == "" {
+		return ctx, func() {}, nil
+	}
+
+	timeout, err := time.ParseDuration(timeoutParam)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid timeout: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+func handleGetShadow(deviceMan core.DeviceManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		shadow, err := deviceMan.GetShadow(c.Param("deviceId"))
+		if err != nil {
+			return commandError(c, err)
+		}
+		return c.JSON(http.StatusOK, shadow)
+	}
+}
+
+// handleUpdateDesired merges the request body into the desired state. A
+// property set to null is removed from the desired state.
+func handleUpdateDesired(deviceMan core.DeviceManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		update := make(map[string]any)
+		if err := bindBody(c, &update); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		shadow, err := deviceMan.UpdateDesiredState(c.Param("deviceId"), update)
+		if err != nil {
+			return commandError(c, err)
+		}
+		return c.JSON(http.StatusOK, shadow)
+	}
+}
+
+func handleListErrors(deviceMan core.DeviceManager) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		deviceErrors, err := deviceMan.ListDeviceErrors(c.Param("deviceId"))
+		if err != nil {
+			return commandError(c, err)
+		}
+		return c.JSON(http.StatusOK, deviceErrors)
+	}
+}
+
+// handleHistory returns the points of a property between from and to, RFC 3339
+// times defaulting to the last 24 hours. With a step, e.g. step=5m, the points
+// are aggregated into buckets, as they are when from is older than the raw
+// points kept.
+func handleHistory(deviceMan core.DeviceManager, store *history.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		deviceId := c.Param("deviceId")
+		if _, err := deviceMan.GetDeviceRecord(deviceId); err != nil {
+			return commandError(c, err)
+		}
+		property := c.QueryParam("property")
+		if property == "" {
+			series, err := store.Series(deviceId)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, err.Error())
+			}
+			return c.JSON(http.StatusOK, map[string]any{"deviceId": deviceId, "properties": series})
+		}
+
+		to, err := timeParam(c, "to", time.Now())
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		from, err := timeParam(c, "from", to.Add(-24*time.Hour))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		response := map[string]any{"deviceId": deviceId, "property": property, "from": from, "to": to}
+		stepParam := c.QueryParam("step")
+		if stepParam == "" && store.Retains(from) {
+			points, err := store.Query(deviceId, property, from, to)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, err.Error())
+			}
+			response["points"] = points
+			return c.JSON(http.StatusOK, response)
+		}
+
+		var step time.Duration
+		if stepParam != "" {
+			if step, err = time.ParseDuration(stepParam); err != nil || step <= 0 {
+				return c.String(http.StatusBadRequest, "invalid step: "+stepParam)
+			}
+		}
+		buckets, step, err := store.Buckets(deviceId, property, from, to, step)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		response["step"] = step.String()
+		response["buckets"] = buckets
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func timeParam(c echo.Context, name string, fallback time.Time) (time.Time, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return t, nil
+}
@@ -1,50 +1,258 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"log"
 	"log/slog"
 	"net/http"
+	"time"
 
+	"github.com/ilievs/fibers/coap"
 	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/history"
+	"github.com/ilievs/fibers/httpdevice"
+	"github.com/ilievs/fibers/modbus"
 	"github.com/ilievs/fibers/mqtt"
+	"github.com/ilievs/fibers/rules"
+	"github.com/ilievs/fibers/scene"
+	"github.com/ilievs/fibers/schedule"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	mochi "github.com/mochi-mqtt/server/v2"
 )
 
+const (
+	registryFile = "data/devices.json"
+	groupsFile = "data/groups.json"
+	rulesFile = "data/rules.json"
+	scenesFile = "data/scenes.json"
+	schedulesFile = "data/schedules.json"
+	scheduleRunsFile = "data/schedule-runs.json"
+	historyDir = "data/history"
+	// modbusDevicesFile lists the devices polled over Modbus TCP, see modbus.DeviceConfig
+	modbusDevicesFile = "data/modbus-devices.json"
+	// httpDevicesFile lists the devices polled through their REST API, see httpdevice.PollConfig
+	httpDevicesFile = "data/http-devices.json"
+	// ingestDevicesFile lists the devices that push their state to /ingest/<id>, see httpdevice.IngestConfig
+	ingestDevicesFile = "data/ingest-devices.json"
+	// coapDevicesFile lists the CoAP devices allowed to register, with their tokens
+	coapDevicesFile = "data/coap-devices.json"
+)
+
 var credentials = map[string]interface{}{
 	"chicho:petyo": 1,
 }
 
 var sessions = map[string]interface{}{}
 
+// deviceTemplates describe devices that don't publish a descriptor of their own
+var deviceTemplates = map[string]*core.Descriptor{
+	mqtt.DefaultTemplate: {
+		Model: "relay",
+		DeviceType: "relay",
+		Commands: []core.CommandSpec{
+			{
+				Name: "power",
+				Args: []core.ArgSpec{
+					{Name: "state", Type: core.ArgString, Required: true, Enum: []any{"on", "off"}},
+				},
+			},
+		},
+	},
+}
+
+// topicMappings map legacy devices that publish each reading to a topic of its own
+var topicMappings = []mqtt.TopicMapping{
+	{
+		Name: "plant-psu",
+		DeviceId: "{line}-{psu}",
+		Descriptor: &core.Descriptor{
+			Model: "psu",
+			DeviceType: "psu",
+			Commands: []core.CommandSpec{
+				{
+					Name: "power",
+					Args: []core.ArgSpec{
+						{Name: "state", Type: core.ArgString, Required: true, Enum: []any{"on", "off"}},
+					},
+				},
+			},
+			Properties: []core.PropertySpec{
+				{Name: "voltage", Type: core.TypeNumber, Unit: "V"},
+				{Name: "current", Type: core.TypeNumber, Unit: "A"},
+				{Name: "output", Type: core.TypeString, Setter: &core.PropertySetter{Command: "power", Arg: "state"}},
+			},
+		},
+		State: []mqtt.StateMapping{
+			{Topic: "plant/{line}/{psu}/{property}", Property: "{property}"},
+		},
+		Commands: []mqtt.CommandMapping{
+			{Command: "power", Topic: "plant/{line}/{psu}/output/set", Payload: "{state}"},
+		},
+	},
+}
+
+// coapDevice is a CoAP device allowed to register
+type coapDevice struct {
+	Id string `json:"id"`
+	Token string `json:"token"`
+}
+
+// site is where sunrise and sunset schedules are computed for, in the local time zone
+var site = schedule.Site{Coordinates: &schedule.Coordinates{Latitude: 42.6977, Longitude: 23.3219}}
+
 // Handler
 func handleLogin(c echo.Context) error {
 
 	return c.String(http.StatusOK, "Hello, World!")
 }
 
-func RunApplication() {
+func commandError(c echo.Context, err error) error {
+	var validationErr *core.CommandValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return c.JSON(http.StatusBadRequest, validationErr)
+	case errors.Is(err, core.ErrDeviceNotFound):
+		return c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, core.ErrDeviceOffline):
+		return c.String(http.StatusConflict, err.Error())
+	case errors.Is(err, core.ErrCommandTimeout):
+		return c.String(http.StatusGatewayTimeout, err.Error())
+	}
+	return c.String(http.StatusInternalServerError, err.Error())
+}
+
+// RunApplication starts the broker and the HTTP server and returns a function
+// that shuts them down.
+func RunApplication() func() {
 	server := mochi.New(&mochi.Options{
 		InlineClient: true,
 	})
 
-	deviceMan := core.NewBasicDeviceManager()
+	deviceMan, err := core.NewPersistentDeviceManager(core.NewFileDeviceStore(registryFile))
+	if err != nil {
+		log.Fatal("failed to load device registry: ", err)
+	}
+	groupMan, err := core.NewGroupManager(deviceMan, core.NewFileStore[core.Group](groupsFile))
+	if err != nil {
+		log.Fatal("failed to load device groups: ", err)
+	}
+	sceneRunner, err := scene.NewRunner(deviceMan, groupMan, core.NewFileStore[scene.Scene](scenesFile))
+	if err != nil {
+		log.Fatal("failed to load scenes: ", err)
+	}
+	startScene := func(sceneId string) (string, error) {
+		run, err := sceneRunner.Start(sceneId)
+		return run.Id, err
+	}
+	ruleEngine, err := rules.NewEngine(deviceMan, core.NewFileStore[rules.Rule](rulesFile), rules.Options{
+		Publish: func(topic string, payload []byte, retain bool) error {
+			return server.Publish(topic, payload, retain, 0)
+		},
+		StartScene: func(sceneId string) error {
+			_, err := startScene(sceneId)
+			return err
+		},
+	})
+	if err != nil {
+		log.Fatal("failed to load rules: ", err)
+	}
+	scheduler, err := schedule.NewScheduler(deviceMan, groupMan, core.NewFileStore[schedule.Schedule](schedulesFile),
+		core.NewFileStore[schedule.Run](scheduleRunsFile), schedule.Options{Site: site, StartScene: startScene})
+	if err != nil {
+		log.Fatal("failed to load schedules: ", err)
+	}
+	historyStore, err := history.Open(historyDir, history.Options{})
+	if err != nil {
+		log.Fatal("failed to open device history: ", err)
+	}
 	mqttClient := mqtt.NewMochiClient(server)
-	
-	deviceStateCache := make(map[string]*core.State)
-
-	stateChangesChan := deviceMan.SubscribeToStateChanges()
-	go func() {
-		for dev := range stateChangesChan {
-			deviceStateCache[dev.Id()] = dev.GetState()
-		}
-	}()
 
 	broker := mqtt.NewMochiBroker(server)
 	broker.Start(
 		[]mochi.Hook{new(mqtt.AddNewDeviceHook)},
-		[]any{&mqtt.HookOptions{MqttClient: mqttClient, DeviceManager: deviceMan}})
+		[]any{&mqtt.HookOptions{
+			MqttClient: mqttClient,
+			DeviceManager: deviceMan,
+			Templates: deviceTemplates,
+		}})
+
+	ctx, stop := context.WithCancel(context.Background())
+
+	if err := mqtt.NewShadowBridge(server, deviceMan).Start(ctx); err != nil {
+		log.Fatal("failed to start shadow bridge: ", err)
+	}
+	if err := mqtt.NewSparkplugAdapter(server, deviceMan, mqtt.SparkplugOptions{}).Start(ctx); err != nil {
+		log.Fatal("failed to start sparkplug adapter: ", err)
+	}
+	if err := mqtt.NewHomeAssistantBridge(server, deviceMan, mqtt.HomeAssistantOptions{}).Start(ctx); err != nil {
+		log.Fatal("failed to start home assistant bridge: ", err)
+	}
+	if err := mqtt.NewHomieAdapter(server, deviceMan).Start(ctx); err != nil {
+		log.Fatal("failed to start homie adapter: ", err)
+	}
+	if err := mqtt.NewTopicMapper(server, deviceMan, topicMappings).Start(ctx); err != nil {
+		log.Fatal("failed to start topic mapper: ", err)
+	}
+	modbusDevices, err := core.NewFileStore[modbus.DeviceConfig](modbusDevicesFile).Load()
+	if err != nil {
+		log.Fatal("failed to load modbus devices: ", err)
+	}
+	if err := modbus.NewDriver(deviceMan, modbusDevices).Start(ctx); err != nil {
+		log.Fatal("failed to start modbus driver: ", err)
+	}
+	httpDevices, err := core.NewFileStore[httpdevice.PollConfig](httpDevicesFile).Load()
+	if err != nil {
+		log.Fatal("failed to load http devices: ", err)
+	}
+	if err := httpdevice.NewPoller(deviceMan, httpDevices).Start(ctx); err != nil {
+		log.Fatal("failed to start http poller: ", err)
+	}
+	ingestDevices, err := core.NewFileStore[httpdevice.IngestConfig](ingestDevicesFile).Load()
+	if err != nil {
+		log.Fatal("failed to load ingest devices: ", err)
+	}
+	ingest, err := httpdevice.NewIngest(deviceMan, ingestDevices)
+	if err != nil {
+		log.Fatal("failed to configure ingest devices: ", err)
+	}
+	coapDevices, err := core.NewFileStore[coapDevice](coapDevicesFile).Load()
+	if err != nil {
+		log.Fatal("failed to load coap devices: ", err)
+	}
+	coapTokens := make(map[string]string, len(coapDevices))
+	for _, dev := range coapDevices {
+		coapTokens[dev.Id] = dev.Token
+	}
+	coapServer := coap.NewServer(deviceMan, coap.ServerOptions{Tokens: coapTokens, Templates: deviceTemplates})
+	if err := coapServer.Start(ctx, ":5683"); err != nil {
+		log.Fatal("failed to start coap server: ", err)
+	}
+	go mqtt.NewPresenceWatchdog(server, deviceMan, mqtt.WatchdogOptions{
+		DeviceTypes: map[string]mqtt.HeartbeatTimeout{
+			// Tasmota only reports telemetry every 5 minutes by default
+			mqtt.TasmotaDeviceType: {StaleAfter: 11 * time.Minute, OfflineAfter: 30 * time.Minute},
+			// Homie devices only publish changes, their $state tells whether they are online
+			mqtt.HomieDeviceType: {Disabled: true},
+			// Sparkplug reports by exception, NDEATH and DDEATH take devices offline
+			mqtt.SparkplugNodeType:   {Disabled: true},
+			mqtt.SparkplugDeviceType: {Disabled: true},
+		},
+	}).Run(ctx)
+	go historyStore.Run(ctx)
+	go historyStore.Record(ctx, deviceMan)
+	go ruleEngine.Run(ctx)
+	go scheduler.Run(ctx)
+	go core.NewReconciler(deviceMan, core.ReconcilerOptions{}).Run(ctx)
+	go deviceMan.PersistEvery(ctx, core.DefaultPersistInterval)
+
+	errorSub := deviceMan.SubscribeToErrors(ctx, core.SubscriptionOptions{Overflow: core.OverflowDropOldest})
+	go func() {
+		for err := range errorSub.C() {
+			slog.Warn("device error", "error", err)
+		}
+	}()
 
 	e := echo.New()
 
@@ -54,26 +262,111 @@ func RunApplication() {
 
 	// Routes
 	e.GET("/login", handleLogin)
+	e.GET("/devices", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, deviceMan.ListDeviceRecords())
+	})
+	e.GET("/devices/:deviceId", func(c echo.Context) error {
+		record, err := deviceMan.GetDeviceRecord(c.Param("deviceId"))
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return c.JSON(http.StatusOK, record)
+	})
+	e.DELETE("/devices/:deviceId", func(c echo.Context) error {
+		if err := deviceMan.RemoveDevice(c.Param("deviceId")); err != nil {
+			return commandError(c, err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+	e.PUT("/devices/:deviceId/labels", handleSetLabels(deviceMan))
+	e.GET("/devices/:deviceId/errors", handleListErrors(deviceMan))
+	e.GET("/devices/:deviceId/history", handleHistory(deviceMan, historyStore))
+	e.GET("/devices/:deviceId/shadow", handleGetShadow(deviceMan))
+	e.PATCH("/devices/:deviceId/shadow/desired", handleUpdateDesired(deviceMan))
+	registerGroupRoutes(e, groupMan)
+	registerRuleRoutes(e, ruleEngine)
+	registerScheduleRoutes(e, scheduler)
+	registerSceneRoutes(e, sceneRunner)
+	ingest.RegisterRoutes(e)
+	e.GET("/events", handleEvents(deviceMan))
+	e.GET("/devices/:deviceId/commands", func(c echo.Context) error {
+		dev, err := deviceMan.GetDevice(c.Param("deviceId"))
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		specs, err := dev.ListCommands()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, specs)
+	})
 	e.GET("/devices/:deviceId/stats", func(c echo.Context) error {
 		deviceId := c.Param("deviceId")
-		return c.JSON(http.StatusOK, deviceStateCache[deviceId])
+		record, err := deviceMan.GetDeviceRecord(deviceId)
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if record.LastState == nil {
+			return c.String(http.StatusNotFound, "no state reported for device " + deviceId)
+		}
+		return c.JSON(http.StatusOK, record.LastState)
 	})
 
 	e.POST("/devices/:deviceId/command", func (c echo.Context) error {
 		deviceId := c.Param("deviceId")
 		command := new(core.Command)
-		c.Bind(command)
-		err := deviceMan.SendCommand(deviceId, command)
+		if err := c.Bind(command); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		ctx, cancel, err := commandContext(c)
 		if err != nil {
 			return c.String(http.StatusBadRequest, err.Error())
 		}
+		defer cancel()
 
-		return c.NoContent(http.StatusOK)
+		if _, wait := ctx.Deadline(); !wait {
+			if err := deviceMan.SendCommandAsync(deviceId, command); err != nil {
+				return commandError(c, err)
+			}
+			return c.JSON(http.StatusAccepted, map[string]string{"correlationId": command.CorrelationId})
+		}
+		result, err := deviceMan.SendCommand(ctx, deviceId, command)
+		if err != nil {
+			return commandError(c, err)
+		}
+
+		if result == nil {
+			return c.JSON(http.StatusAccepted, map[string]string{"correlationId": command.CorrelationId})
+		}
+		if !result.Success {
+			return c.JSON(http.StatusBadGateway, result)
+		}
+		return c.JSON(http.StatusOK, result)
 	})
 
 	// Start server
-	if err := e.Start(":8080"); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		slog.Error("failed to start server", "error", err)
+	go func() {
+		if err := e.Start(":8080"); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to start server", "error", err)
+		}
+	}()
+
+	return func() {
+		stop()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			slog.Error("failed to stop server", "error", err)
+		}
+		if err := server.Close(); err != nil {
+			slog.Error("failed to stop broker", "error", err)
+		}
+		if err := deviceMan.Flush(); err != nil {
+			slog.Error("failed to save device registry", "error", err)
+		}
+		if err := historyStore.Close(); err != nil {
+			slog.Error("failed to save device history", "error", err)
+		}
 	}
-	
 }
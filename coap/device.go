@@ -0,0 +1,219 @@
+package coap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+// maxTransmitWait bounds the delivery of a command, as MAX_TRANSMIT_WAIT in
+// RFC 7252.
+const maxTransmitWait = 93 * time.Second
+
+// Device is a CoAP device whose /state resource is observed. Commands are
+// POSTed to its /command resource and answered with a command result, or just
+// a response code.
+type Device struct {
+	id          string
+	server      *Server
+	addr        *net.UDPAddr
+	descriptor  *core.Descriptor
+	codec       core.Codec
+	token       []byte
+	state       *core.State
+	stateMutex  sync.RWMutex
+	lastObserve uint32
+	lastNotify  time.Time
+	states      core.Broadcaster[*core.State]
+	errors      core.Broadcaster[error]
+}
+
+func newDevice(server *Server, deviceId string, addr *net.UDPAddr, descriptor *core.Descriptor) (*Device, error) {
+	codec, err := core.CodecFor(descriptor.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+	}
+	return &Device{
+		id:         deviceId,
+		server:     server,
+		addr:       addr,
+		descriptor: descriptor,
+		codec:      codec,
+		token:      newToken(),
+		state:      core.NewState(time.Now()),
+	}, nil
+}
+
+// observe registers for notifications of the device's state.
+func (d *Device) observe() {
+	msg := &Message{Code: GET, Token: d.token}
+	msg.SetUintOption(OptionObserve, 0)
+	msg.SetPath("state")
+
+	d.server.observe(d.token, d)
+	ctx, cancel := context.WithTimeout(context.Background(), maxTransmitWait)
+	defer cancel()
+	response, err := d.server.request(ctx, d.addr, msg)
+	if err != nil {
+		d.server.forget(d.token)
+		log.Println("Failed to observe coap device", d.id, "-", err)
+		d.errors.Publish(core.NewDeviceError(d.id, core.ErrorPublishFailed, err))
+		return
+	}
+	if response.Code != Empty {
+		d.notify(response)
+	}
+}
+
+// notify takes a response to the observation. Notifications can overtake each
+// other, older ones are dropped as in RFC 7641 section 3.4.
+func (d *Device) notify(msg *Message) {
+	if !msg.Code.IsSuccess() {
+		d.server.forget(d.token)
+		d.errors.Publish(&core.DeviceError{
+			DeviceId: d.id,
+			Kind:     core.ErrorFault,
+			Code:     msg.Code.String(),
+			Message:  "observation of /state refused: " + string(msg.Payload),
+			Time:     time.Now(),
+		})
+		return
+	}
+	observe, observed := msg.UintOption(OptionObserve)
+	if !observed {
+		d.server.forget(d.token)
+	}
+
+	codec, err := codecOf(msg, d.codec)
+	var payload []byte
+	if err == nil {
+		payload, err = core.ToJSON(codec, msg.Payload)
+	}
+	var state *core.State
+	if err == nil {
+		state, err = core.ParseState(payload, time.Now())
+	}
+	if err != nil {
+		log.Println("failed to parse state from coap device", d.id, "error", err)
+		d.errors.Publish(core.NewMalformedPayloadError(d.id, "/state", msg.Payload, err))
+		return
+	}
+	for name, p := range state.Properties {
+		if p.Unit == "" {
+			p.Unit = d.descriptor.PropertyUnit(name)
+			state.Properties[name] = p
+		}
+	}
+
+	d.stateMutex.Lock()
+	if observed && !d.lastNotify.IsZero() && !newer(d.lastObserve, observe) && time.Since(d.lastNotify) < 128*time.Second {
+		d.stateMutex.Unlock()
+		return
+	}
+	d.lastObserve, d.lastNotify = observe, time.Now()
+	d.state = state
+	d.stateMutex.Unlock()
+	d.states.Publish(state)
+}
+
+// newer compares the 24 bit Observe sequence numbers of two notifications.
+func newer(v1 uint32, v2 uint32) bool {
+	return (v1 < v2 && v2-v1 < 1<<23) || (v1 > v2 && v1-v2 > 1<<23)
+}
+
+func (d *Device) Id() string {
+	return d.id
+}
+
+func (d *Device) Descriptor() *core.Descriptor {
+	return d.descriptor
+}
+
+func (d *Device) ListCommands() ([]core.CommandSpec, error) {
+	return d.descriptor.Commands, nil
+}
+
+func (d *Device) GetState() *core.State {
+	d.stateMutex.RLock()
+	defer d.stateMutex.RUnlock()
+	return d.state
+}
+
+func (d *Device) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	if command.CorrelationId == "" {
+		command.CorrelationId = core.NewCorrelationId()
+	}
+	payload, err := json.Marshal(command)
+	if err == nil {
+		payload, err = core.FromJSON(d.codec, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{Code: POST, Token: newToken(), Payload: payload}
+	msg.SetPath("command")
+	if format, ok := contentFormatFor(d.codec.ContentType()); ok {
+		msg.SetUintOption(OptionContentFormat, uint32(format))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, maxTransmitWait)
+	defer cancel()
+	return d.deliver(ctx, command, msg)
+}
+
+func (d *Device) deliver(ctx context.Context, command *core.Command, msg *Message) (*core.CommandResult, error) {
+	response, err := d.server.request(ctx, d.addr, msg)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, core.ErrCommandTimeout
+	case err != nil:
+		deviceErr := core.NewDeviceError(d.id, core.ErrorPublishFailed, err)
+		deviceErr.Topic = "/command"
+		d.errors.Publish(deviceErr)
+		return nil, deviceErr
+	}
+
+	result := &core.CommandResult{Success: response.Code.IsSuccess()}
+	if !result.Success {
+		result.Error = fmt.Sprintf("%s %s", response.Code, response.Payload)
+	} else if len(response.Payload) > 0 {
+		codec, err := codecOf(response, d.codec)
+		var payload []byte
+		if err == nil {
+			payload, err = core.ToJSON(codec, response.Payload)
+		}
+		if err == nil {
+			err = json.Unmarshal(payload, result)
+		}
+		if err != nil {
+			d.errors.Publish(core.NewMalformedPayloadError(d.id, "/command", response.Payload, err))
+			return nil, err
+		}
+	}
+	result.CorrelationId = command.CorrelationId
+	return result, nil
+}
+
+func (d *Device) SubscribeToStateChanges(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[*core.State], error) {
+	return d.states.Subscribe(ctx, opts), nil
+}
+
+func (d *Device) SubscribeToErrors(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[error], error) {
+	return d.errors.Subscribe(ctx, opts), nil
+}
+
+// Close stops observing the device. Its next notification is answered with a
+// reset, which cancels the observation on the device.
+func (d *Device) Close() error {
+	d.server.forget(d.token)
+	d.states.Close()
+	d.errors.Close()
+	return nil
+}
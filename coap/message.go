@@ -0,0 +1,252 @@
+// Package coap serves constrained devices over CoAP (RFC 7252). Devices
+// register with a POST, fibers observes their state (RFC 7641) and delivers
+// commands as confirmable requests.
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Type uint8
+
+const (
+	Confirmable     Type = 0
+	NonConfirmable  Type = 1
+	Acknowledgement Type = 2
+	Reset           Type = 3
+)
+
+// Code is a request method or a response code, class.detail packed as in the header.
+type Code uint8
+
+const (
+	Empty  Code = 0
+	GET    Code = 0x01
+	POST   Code = 0x02
+	PUT    Code = 0x03
+	DELETE Code = 0x04
+
+	Created             Code = 0x41
+	Deleted             Code = 0x42
+	Changed             Code = 0x44
+	Content             Code = 0x45
+	BadRequest          Code = 0x80
+	Unauthorized        Code = 0x81
+	Forbidden           Code = 0x83
+	NotFound            Code = 0x84
+	MethodNotAllowed    Code = 0x85
+	UnsupportedFormat   Code = 0x8F
+	InternalServerError Code = 0xA0
+	ServiceUnavailable  Code = 0xA3
+)
+
+func (c Code) IsRequest() bool {
+	return c > Empty && c < 0x20
+}
+
+func (c Code) IsSuccess() bool {
+	return c>>5 == 2
+}
+
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1F)
+}
+
+const (
+	OptionObserve       uint16 = 6
+	OptionUriPath       uint16 = 11
+	OptionContentFormat uint16 = 12
+	OptionUriQuery      uint16 = 15
+)
+
+// contentFormats are the CoAP content format numbers of the codecs fibers knows.
+var contentFormats = map[uint16]string{
+	0:  "text/plain",
+	50: "application/json",
+	60: "application/cbor",
+}
+
+func contentFormatFor(contentType string) (uint16, bool) {
+	for format, name := range contentFormats {
+		if name == contentType {
+			return format, true
+		}
+	}
+	return 0, false
+}
+
+var ErrInvalidMessage = errors.New("invalid coap message")
+
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageId uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+func (m *Message) Option(number uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Message) UintOption(number uint16) (uint32, bool) {
+	value, ok := m.Option(number)
+	if !ok || len(value) > 4 {
+		return 0, false
+	}
+	var v uint32
+	for _, b := range value {
+		v = v<<8 | uint32(b)
+	}
+	return v, true
+}
+
+func (m *Message) SetUintOption(number uint16, v uint32) {
+	var value []byte
+	for v > 0 {
+		value = append([]byte{byte(v)}, value...)
+		v >>= 8
+	}
+	m.Options = append(m.Options, Option{number, value})
+}
+
+// Path joins the Uri-Path options.
+func (m *Message) Path() string {
+	var segments []string
+	for _, o := range m.Options {
+		if o.Number == OptionUriPath {
+			segments = append(segments, string(o.Value))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func (m *Message) SetPath(path string) {
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		m.Options = append(m.Options, Option{OptionUriPath, []byte(segment)})
+	}
+}
+
+// Query returns the value of a key=value Uri-Query option.
+func (m *Message) Query(key string) string {
+	for _, o := range m.Options {
+		if o.Number == OptionUriQuery {
+			if k, v, _ := strings.Cut(string(o.Value), "="); k == key {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, fmt.Errorf("%w: token longer than 8 bytes", ErrInvalidMessage)
+	}
+	buf := []byte{1<<6 | byte(m.Type)<<4 | byte(len(m.Token)), byte(m.Code)}
+	buf = binary.BigEndian.AppendUint16(buf, m.MessageId)
+	buf = append(buf, m.Token...)
+
+	options := append([]Option(nil), m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+	previous := uint16(0)
+	for _, o := range options {
+		delta, deltaExt := optionNibble(int(o.Number - previous))
+		length, lengthExt := optionNibble(len(o.Value))
+		buf = append(buf, delta<<4|length)
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, o.Value...)
+		previous = o.Number
+	}
+
+	if len(m.Payload) > 0 {
+		buf = append(buf, 0xFF)
+		buf = append(buf, m.Payload...)
+	}
+	return buf, nil
+}
+
+// optionNibble encodes an option delta or length, values over 12 take extra bytes.
+func optionNibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		return 14, binary.BigEndian.AppendUint16(nil, uint16(v-269))
+	}
+}
+
+func ParseMessage(data []byte) (*Message, error) {
+	if len(data) < 4 || data[0]>>6 != 1 {
+		return nil, ErrInvalidMessage
+	}
+	tokenLength := int(data[0] & 0x0F)
+	if tokenLength > 8 || len(data) < 4+tokenLength {
+		return nil, ErrInvalidMessage
+	}
+	m := &Message{
+		Type:      Type(data[0] >> 4 & 0x03),
+		Code:      Code(data[1]),
+		MessageId: binary.BigEndian.Uint16(data[2:]),
+		Token:     append([]byte(nil), data[4:4+tokenLength]...),
+	}
+
+	rest := data[4+tokenLength:]
+	number := 0
+	for len(rest) > 0 {
+		if rest[0] == 0xFF {
+			if len(rest) == 1 {
+				return nil, fmt.Errorf("%w: payload marker without payload", ErrInvalidMessage)
+			}
+			m.Payload = append([]byte(nil), rest[1:]...)
+			break
+		}
+		header := rest[0]
+		rest = rest[1:]
+		var delta, length int
+		var err error
+		if delta, rest, err = readNibble(header>>4, rest); err != nil {
+			return nil, err
+		}
+		if length, rest, err = readNibble(header&0x0F, rest); err != nil {
+			return nil, err
+		}
+		if len(rest) < length {
+			return nil, fmt.Errorf("%w: truncated option", ErrInvalidMessage)
+		}
+		number += delta
+		m.Options = append(m.Options, Option{uint16(number), append([]byte(nil), rest[:length]...)})
+		rest = rest[length:]
+	}
+	return m, nil
+}
+
+func readNibble(nibble byte, rest []byte) (int, []byte, error) {
+	switch {
+	case nibble < 13:
+		return int(nibble), rest, nil
+	case nibble == 13 && len(rest) >= 1:
+		return int(rest[0]) + 13, rest[1:], nil
+	case nibble == 14 && len(rest) >= 2:
+		return int(binary.BigEndian.Uint16(rest)) + 269, rest[2:], nil
+	}
+	return 0, nil, fmt.Errorf("%w: bad option header", ErrInvalidMessage)
+}
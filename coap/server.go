@@ -0,0 +1,442 @@
+package coap
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	DefaultAckTimeout = 2 * time.Second
+	maxRetransmit     = 4
+	exchangeLifetime  = 247 * time.Second
+	// DefaultTemplate is the template used when a device registers without a
+	// descriptor or a model of its own, as for MQTT devices.
+	DefaultTemplate = "default"
+	maxMessageSize  = 1152
+	// DefaultReportInterval matches the default Max-Age of a notification.
+	DefaultReportInterval = 60 * time.Second
+)
+
+var (
+	ErrDeviceTaken  = errors.New("device is registered through another transport")
+	ErrReset        = errors.New("coap message reset by the device")
+	ErrNoAck        = errors.New("coap message not acknowledged")
+	ErrServerClosed = errors.New("coap server closed")
+)
+
+type ServerOptions struct {
+	// Tokens are the devices allowed to register, keyed by device id, with
+	// the token each one sends in the token query parameter.
+	Tokens map[string]string
+	// Templates are used for devices that register without a descriptor, keyed
+	// by the model query parameter.
+	Templates map[string]*core.Descriptor
+	// AckTimeout is how long to wait before resending a confirmable message,
+	// it doubles with every attempt.
+	AckTimeout time.Duration
+	// ReportInterval is assumed for devices whose descriptor doesn't say how
+	// often they report.
+	ReportInterval time.Duration
+}
+
+// Server is the CoAP endpoint of fibers. Devices register with
+// POST /devices/<id>?token=<token>, carrying their descriptor, and leave with
+// DELETE /devices/<id>?token=<token>. Once registered, their /state resource is
+// observed and commands are POSTed to their /command resource.
+type Server struct {
+	devMan    core.DeviceManager
+	opts      ServerOptions
+	conn      *net.UDPConn
+	mutex     sync.Mutex
+	messageId uint16
+	acks      map[uint16]chan *Message
+	responses map[string]chan *Message
+	observers map[string]*Device
+	seen      map[string]seenMessage
+}
+
+// seenMessage is the reply to a confirmable message, resent if the message is.
+type seenMessage struct {
+	reply []byte
+	at    time.Time
+}
+
+func NewServer(devMan core.DeviceManager, opts ServerOptions) *Server {
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = DefaultAckTimeout
+	}
+	if opts.ReportInterval <= 0 {
+		opts.ReportInterval = DefaultReportInterval
+	}
+	return &Server{
+		devMan:    devMan,
+		opts:      opts,
+		acks:      make(map[uint16]chan *Message),
+		responses: make(map[string]chan *Message),
+		observers: make(map[string]*Device),
+		seen:      make(map[string]seenMessage),
+	}
+}
+
+// Start listens on address, :5683 being the CoAP port, until ctx is done.
+func (s *Server) Start(ctx context.Context, address string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go s.receive()
+	return nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Server) receive() {
+	buf := make([]byte, maxMessageSize)
+	lastSweep := time.Now()
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("coap server stopped receiving:", err)
+			}
+			return
+		}
+		msg, err := ParseMessage(buf[:n])
+		if err != nil {
+			log.Println("dropping coap message from", addr, "-", err)
+			continue
+		}
+		s.handle(addr, msg)
+
+		if time.Since(lastSweep) > time.Minute {
+			s.sweep()
+			lastSweep = time.Now()
+		}
+	}
+}
+
+// sweep forgets the messages that can no longer be retransmitted.
+func (s *Server) sweep() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, m := range s.seen {
+		if time.Since(m.at) > exchangeLifetime {
+			delete(s.seen, key)
+		}
+	}
+}
+
+func (s *Server) handle(addr *net.UDPAddr, msg *Message) {
+	switch {
+	case msg.Type == Acknowledgement || msg.Type == Reset:
+		s.mutex.Lock()
+		ch, ok := s.acks[msg.MessageId]
+		s.mutex.Unlock()
+		if ok {
+			select {
+			case ch <- msg:
+			default:
+			}
+		}
+	case msg.Code == Empty:
+		// A CoAP ping
+		s.reply(addr, msg, &Message{Type: Reset, MessageId: msg.MessageId})
+	case s.duplicate(addr, msg):
+	case msg.Code.IsRequest():
+		response := s.serve(addr, msg)
+		response.Token = msg.Token
+		if msg.Type == Confirmable {
+			response.Type, response.MessageId = Acknowledgement, msg.MessageId
+		} else {
+			response.Type, response.MessageId = NonConfirmable, s.nextMessageId()
+		}
+		s.reply(addr, msg, response)
+	default:
+		s.receiveResponse(addr, msg)
+	}
+}
+
+// duplicate resends the reply to a confirmable message seen before.
+func (s *Server) duplicate(addr *net.UDPAddr, msg *Message) bool {
+	if msg.Type != Confirmable {
+		return false
+	}
+	s.mutex.Lock()
+	seen, ok := s.seen[seenKey(addr, msg.MessageId)]
+	s.mutex.Unlock()
+	if ok {
+		s.conn.WriteToUDP(seen.reply, addr)
+	}
+	return ok
+}
+
+func seenKey(addr *net.UDPAddr, messageId uint16) string {
+	return fmt.Sprintf("%s/%d", addr, messageId)
+}
+
+func (s *Server) reply(addr *net.UDPAddr, msg *Message, reply *Message) {
+	data, err := reply.Marshal()
+	if err != nil {
+		log.Println("failed to marshal coap reply to", addr, "-", err)
+		return
+	}
+	if msg.Type == Confirmable {
+		s.mutex.Lock()
+		s.seen[seenKey(addr, msg.MessageId)] = seenMessage{data, time.Now()}
+		s.mutex.Unlock()
+	}
+	if _, err := s.conn.WriteToUDP(data, addr); err != nil {
+		log.Println("failed to send coap reply to", addr, "-", err)
+	}
+}
+
+// receiveResponse takes a separate response or a notification, which are
+// matched to our requests by their token.
+func (s *Server) receiveResponse(addr *net.UDPAddr, msg *Message) {
+	s.mutex.Lock()
+	ch, isResponse := s.responses[string(msg.Token)]
+	dev, isNotification := s.observers[string(msg.Token)]
+	s.mutex.Unlock()
+
+	if !isResponse && !isNotification {
+		// Tells the device to stop sending notifications we no longer observe
+		s.reply(addr, msg, &Message{Type: Reset, MessageId: msg.MessageId})
+		return
+	}
+	if msg.Type == Confirmable {
+		s.reply(addr, msg, &Message{Type: Acknowledgement, MessageId: msg.MessageId})
+	}
+	if isResponse {
+		select {
+		case ch <- msg:
+		default:
+		}
+	} else {
+		dev.notify(msg)
+	}
+}
+
+func (s *Server) serve(addr *net.UDPAddr, msg *Message) *Message {
+	segments := strings.Split(msg.Path(), "/")
+	if len(segments) != 2 || segments[0] != "devices" || segments[1] == "" {
+		return &Message{Code: NotFound}
+	}
+	deviceId := segments[1]
+	// Unknown devices get the same answer as wrong tokens
+	token, ok := s.opts.Tokens[deviceId]
+	if !ok || subtle.ConstantTimeCompare([]byte(msg.Query("token")), []byte(token)) != 1 {
+		log.Println("Refused unauthorized coap request for device", deviceId, "from", addr)
+		return &Message{Code: Unauthorized}
+	}
+
+	switch msg.Code {
+	case POST:
+		if err := s.register(addr, deviceId, msg); err != nil {
+			log.Println("Failed to add coap device", deviceId, "- Error:", err)
+			s.devMan.ReportError(core.NewDeviceError(deviceId, core.ErrorRegistration, err))
+			if errors.Is(err, ErrDeviceTaken) {
+				return &Message{Code: Forbidden, Payload: []byte(err.Error())}
+			}
+			return &Message{Code: BadRequest, Payload: []byte(err.Error())}
+		}
+		return &Message{Code: Created}
+	case DELETE:
+		// Only devices registered here can leave through here
+		if dev, err := s.devMan.GetDevice(deviceId); err != nil || !s.registered(dev) {
+			return &Message{Code: NotFound}
+		}
+		if err := s.devMan.SetDeviceOffline(deviceId, "deregistered"); err != nil {
+			return &Message{Code: NotFound}
+		}
+		return &Message{Code: Deleted}
+	}
+	return &Message{Code: MethodNotAllowed}
+}
+
+// registered tells whether dev was registered with this server.
+func (s *Server) registered(dev core.SimpleDevice) bool {
+	d, ok := dev.(*Device)
+	return ok && d.server == s
+}
+
+func (s *Server) register(addr *net.UDPAddr, deviceId string, msg *Message) error {
+	if live, err := s.devMan.GetDevice(deviceId); err == nil && !s.registered(live) {
+		return fmt.Errorf("%w: %s", ErrDeviceTaken, deviceId)
+	}
+	var descriptor *core.Descriptor
+	if len(msg.Payload) > 0 {
+		codec, err := codecOf(msg, core.JSONCodec)
+		if err != nil {
+			return fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+		}
+		payload, err := core.ToJSON(codec, msg.Payload)
+		if err != nil {
+			return fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+		}
+		if descriptor, err = core.ParseDescriptor(payload); err != nil {
+			return err
+		}
+	} else if t, ok := s.opts.Templates[msg.Query("model")]; ok {
+		descriptor = t
+	} else if t, ok := s.opts.Templates[DefaultTemplate]; ok {
+		descriptor = t
+	} else {
+		return fmt.Errorf("%w: no descriptor and no template", core.ErrInvalidDescriptor)
+	}
+	if descriptor.ReportInterval == 0 {
+		// Templates are shared between devices
+		described := *descriptor
+		described.SetReportInterval(s.opts.ReportInterval)
+		descriptor = &described
+	}
+
+	dev, err := newDevice(s, deviceId, addr, descriptor)
+	if err != nil {
+		return err
+	}
+	if err := s.devMan.AddDevice(dev); err != nil {
+		return err
+	}
+	log.Println("New coap device added", deviceId, "at", addr)
+
+	// The registration must be answered before the device can serve our request
+	go dev.observe()
+	return nil
+}
+
+// codecOf returns the codec of the message's Content-Format, or fallback.
+func codecOf(msg *Message, fallback core.Codec) (core.Codec, error) {
+	format, ok := msg.UintOption(OptionContentFormat)
+	if !ok {
+		return fallback, nil
+	}
+	contentType, ok := contentFormats[uint16(format)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content format %d", format)
+	}
+	return core.CodecFor(contentType)
+}
+
+func (s *Server) nextMessageId() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messageId++
+	return s.messageId
+}
+
+func newToken() []byte {
+	token := make([]byte, 8)
+	rand.Read(token)
+	return token
+}
+
+// request sends a confirmable request and returns its response, piggybacked on
+// the acknowledgement or sent separately. A token of a message handled
+// elsewhere, like an observation, leaves the separate response to its owner
+// and returns the empty acknowledgement.
+func (s *Server) request(ctx context.Context, addr *net.UDPAddr, msg *Message) (*Message, error) {
+	responses := make(chan *Message, 1)
+	s.mutex.Lock()
+	_, observed := s.observers[string(msg.Token)]
+	if !observed {
+		s.responses[string(msg.Token)] = responses
+	}
+	s.mutex.Unlock()
+	defer func() {
+		if !observed {
+			s.mutex.Lock()
+			delete(s.responses, string(msg.Token))
+			s.mutex.Unlock()
+		}
+	}()
+
+	ack, err := s.exchange(ctx, addr, msg)
+	if err != nil || ack.Code != Empty || observed {
+		return ack, err
+	}
+	select {
+	case response := <-responses:
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// exchange sends a confirmable message until it is acknowledged, backing off
+// exponentially as in RFC 7252 section 4.2.
+func (s *Server) exchange(ctx context.Context, addr *net.UDPAddr, msg *Message) (*Message, error) {
+	msg.Type, msg.MessageId = Confirmable, s.nextMessageId()
+	data, err := msg.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	acks := make(chan *Message, 1)
+	s.mutex.Lock()
+	s.acks[msg.MessageId] = acks
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.acks, msg.MessageId)
+		s.mutex.Unlock()
+	}()
+
+	timeout := s.opts.AckTimeout
+	for attempt := 0; attempt <= maxRetransmit; attempt++ {
+		if _, err := s.conn.WriteToUDP(data, addr); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil, ErrServerClosed
+			}
+			return nil, err
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case ack := <-acks:
+			timer.Stop()
+			if ack.Type == Reset {
+				return nil, ErrReset
+			}
+			return ack, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		timeout *= 2
+	}
+	return nil, ErrNoAck
+}
+
+func (s *Server) observe(token []byte, dev *Device) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.observers[string(token)] = dev
+}
+
+func (s *Server) forget(token []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.observers, string(token))
+}
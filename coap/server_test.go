@@ -0,0 +1,162 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/devicetest"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := &Message{Type: Confirmable, Code: POST, MessageId: 7, Token: []byte{1, 2}, Payload: []byte("{}")}
+	msg.SetPath("devices/sensor-with-a-long-name-1")
+	msg.SetUintOption(OptionContentFormat, 60)
+	msg.Options = append(msg.Options, Option{OptionUriQuery, []byte("model=th1")})
+	msg.Options = append(msg.Options, Option{2048, []byte("x")})
+
+	data, err := msg.Marshal()
+	if err != nil {
+		t.Fatal("Expected a message, but got", err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal("Expected the message to parse, but got", err)
+	}
+	if parsed.Path() != "devices/sensor-with-a-long-name-1" || parsed.Query("model") != "th1" || parsed.MessageId != 7 {
+		t.Fatal("Expected the same message, but got", parsed)
+	}
+	if format, _ := parsed.UintOption(OptionContentFormat); format != 60 {
+		t.Fatal("Expected content format 60, but got", format)
+	}
+	if v, _ := parsed.Option(2048); string(v) != "x" || !bytes.Equal(parsed.Payload, msg.Payload) {
+		t.Fatal("Expected option 2048 and the payload, but got", parsed)
+	}
+}
+
+// fakeDevice answers the observation of /state and the commands POSTed to /command.
+type fakeDevice struct {
+	t          *testing.T
+	conn       *net.UDPConn
+	server     *net.UDPAddr
+	observer   chan *Message
+	registered chan *Message
+}
+
+func newFakeDevice(t *testing.T, server net.Addr) *fakeDevice {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Expected a socket, but got", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	d := &fakeDevice{t, conn, server.(*net.UDPAddr), make(chan *Message, 1), make(chan *Message, 1)}
+	go d.serve()
+	return d
+}
+
+func (d *fakeDevice) send(msg *Message) {
+	data, _ := msg.Marshal()
+	d.conn.WriteToUDP(data, d.server)
+}
+
+func (d *fakeDevice) serve() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, _, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg, _ := ParseMessage(buf[:n])
+		switch {
+		case msg.Type == Acknowledgement:
+			d.registered <- msg
+		case msg.Path() == "state":
+			reply := &Message{Type: Acknowledgement, Code: Content, MessageId: msg.MessageId, Token: msg.Token, Payload: []byte(`{"temperature": 21}`)}
+			reply.SetUintOption(OptionObserve, 1)
+			d.send(reply)
+			d.observer <- msg
+		case msg.Path() == "command":
+			d.send(&Message{Type: Acknowledgement, Code: Changed, MessageId: msg.MessageId, Token: msg.Token,
+				Payload: []byte(`{"success": true, "payload": {"echo": true}}`)})
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	devMan := core.NewBasicDeviceManager()
+	server := NewServer(devMan, ServerOptions{
+		AckTimeout: 50 * time.Millisecond,
+		Tokens:     map[string]string{"th-1": "secret", "psu1": "secret"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := server.Start(ctx, "127.0.0.1:0"); err != nil {
+		t.Fatal("Expected the server to start, but got", err)
+	}
+	device := newFakeDevice(t, server.Addr())
+	request := func(messageId uint16, code Code, path string, token string, payload string) Code {
+		msg := &Message{Type: Confirmable, Code: code, MessageId: messageId, Token: []byte{9}, Payload: []byte(payload)}
+		msg.SetPath(path)
+		msg.Options = append(msg.Options, Option{OptionUriQuery, []byte("token=" + token)})
+		device.send(msg)
+		return (<-device.registered).Code
+	}
+	descriptor := `{"model": "th1", "commands": [{"name": "blink"}], "properties": [{"name": "temperature", "type": "number", "unit": "°C"}]}`
+
+	if code := request(1, POST, "devices/th-1", "guess", descriptor); code != Unauthorized {
+		t.Fatal("Expected 4.01, but got", code)
+	}
+	// Devices registered through another transport can't be taken over
+	devMan.AddDevice(devicetest.NewDevice("psu1", nil))
+	if code := request(2, POST, "devices/psu1", "secret", descriptor); code != Forbidden {
+		t.Fatal("Expected 4.03, but got", code)
+	}
+	if code := request(3, DELETE, "devices/psu1", "secret", ""); code != NotFound {
+		t.Fatal("Expected 4.04, but got", code)
+	}
+
+	if code := request(4, POST, "devices/th-1", "secret", descriptor); code != Created {
+		t.Fatal("Expected 2.01, but got", code)
+	}
+
+	observation := <-device.observer
+	dev, err := devMan.GetDevice("th-1")
+	if err != nil {
+		t.Fatal("Expected device th-1, but got", err)
+	}
+	// The first state is piggybacked on the acknowledgement of the observation
+	devicetest.WaitFor(t, "temperature 21", func() bool {
+		p, _ := dev.GetState().Get("temperature")
+		return p.Value == 21.0
+	})
+
+	// Notifications are acknowledged, an older one is dropped
+	for i, temperature := range []string{"23", "22"} {
+		notification := &Message{Type: Confirmable, Code: Content, MessageId: uint16(10 + i), Token: observation.Token, Payload: []byte(`{"temperature": ` + temperature + `}`)}
+		notification.SetUintOption(OptionObserve, uint32(3-i))
+		device.send(notification)
+		if ack := <-device.registered; ack.MessageId != notification.MessageId {
+			t.Fatal("Expected an acknowledgement of", notification.MessageId, ", but got", ack.MessageId)
+		}
+	}
+	if p, _ := dev.GetState().Get("temperature"); p.Value != 23.0 || p.Unit != "°C" {
+		t.Fatal("Expected temperature 23 °C, but got", p)
+	}
+
+	cmdCtx, cmdCancel := context.WithTimeout(ctx, time.Second)
+	defer cmdCancel()
+	result, err := devMan.SendCommand(cmdCtx, "th-1", &core.Command{Name: "blink"})
+	if err != nil || !result.Success || string(result.Payload) != `{"echo": true}` {
+		t.Fatal("Expected a successful result, but got", result, err)
+	}
+
+	if code := request(5, DELETE, "devices/th-1", "secret", ""); code != Deleted {
+		t.Fatal("Expected 2.02, but got", code)
+	}
+	if record, _ := devMan.GetDeviceRecord("th-1"); record.Presence.Status != core.StatusOffline {
+		t.Fatal("Expected th-1 offline, but got", record.Presence.Status)
+	}
+}
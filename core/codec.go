@@ -0,0 +1,302 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Codec encodes and decodes device payloads. Values are generic trees of
+// maps, slices and scalars, or structs with json tags.
+type Codec interface {
+	// ContentType is sent as the MQTT 5 content type of published payloads.
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var ErrUnknownCodec = errors.New("unknown codec")
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	CBORCodec     Codec = newCborCodec()
+	MsgpackCodec  Codec = msgpackCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[string]Codec{}
+)
+
+func init() {
+	RegisterCodec(JSONCodec, "json", "text/json")
+	RegisterCodec(CBORCodec, "cbor")
+	RegisterCodec(MsgpackCodec, "msgpack", "application/x-msgpack", "application/vnd.msgpack")
+	RegisterCodec(ProtobufCodec, "protobuf", "application/protobuf")
+}
+
+// RegisterCodec makes codec selectable by its content type and any aliases.
+func RegisterCodec(codec Codec, aliases ...string) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	for _, name := range append([]string{codec.ContentType()}, aliases...) {
+		codecs[strings.ToLower(name)] = codec
+	}
+}
+
+// CodecFor looks a codec up by content type or alias. Content type
+// parameters such as "; charset=utf-8" are ignored, except for the
+// messageType of protobuf.
+func CodecFor(contentType string) (Codec, error) {
+	name, _, _ := strings.Cut(contentType, ";")
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return JSONCodec, nil
+	}
+
+	codecsMutex.RLock()
+	codec, ok := codecs[name]
+	codecsMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+	if codec == ProtobufCodec {
+		if _, params, err := mime.ParseMediaType(contentType); err == nil && params["messagetype"] != "" {
+			return newProtobufMessageCodec(params["messagetype"])
+		}
+	}
+	return codec, nil
+}
+
+// ToJSON transcodes a payload to JSON, so it can be parsed like one sent by
+// a JSON device.
+func ToJSON(codec Codec, payload []byte) ([]byte, error) {
+	if codec == JSONCodec {
+		return payload, nil
+	}
+	var v any
+	if err := codec.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// FromJSON transcodes a JSON payload for a device that uses codec.
+func FromJSON(codec Codec, payload []byte) ([]byte, error) {
+	if codec == JSONCodec {
+		return payload, nil
+	}
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	return codec.Marshal(v)
+}
+
+// viaJSON converts between a generic tree and a struct using its json tags,
+// for codecs that only understand generic values.
+func viaJSON(from any, to any) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return "application/json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCborCodec() cborCodec {
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	// Decode maps the way encoding/json does, so they can be transcoded
+	dec, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any{})}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc, dec}
+}
+
+func (cborCodec) ContentType() string                  { return "application/cbor" }
+func (c cborCodec) Marshal(v any) ([]byte, error)      { return c.enc.Marshal(v) }
+func (c cborCodec) Unmarshal(data []byte, v any) error { return c.dec.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// protobufCodec carries payloads as a google.protobuf.Struct, so devices can
+// use the well-known type instead of a schema per product. A product with a
+// schema of its own names its message type in the encoding, as in
+// "application/x-protobuf; messageType=acme.psu.v1.Report". The type must be
+// in the global registry, which compiled-in .proto files are, and its fields
+// carry the JSON payload by their JSON names. States and commands use the same
+// type, so it needs the fields of both.
+type protobufCodec struct {
+	messageType protoreflect.MessageType
+}
+
+func newProtobufMessageCodec(name string) (Codec, error) {
+	messageType, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: protobuf message type %s: %v", ErrUnknownCodec, name, err)
+	}
+	return protobufCodec{messageType}, nil
+}
+
+func (c protobufCodec) ContentType() string {
+	if c.messageType != nil {
+		return "application/x-protobuf; messageType=" + string(c.messageType.Descriptor().FullName())
+	}
+	return "application/x-protobuf"
+}
+
+func (c protobufCodec) Marshal(v any) ([]byte, error) {
+	if c.messageType != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		m := c.messageType.New().Interface()
+		if err := protojson.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+		return proto.Marshal(m)
+	}
+
+	fields, ok := v.(map[string]any)
+	if !ok {
+		fields = make(map[string]any)
+		if err := viaJSON(v, &fields); err != nil {
+			return nil, err
+		}
+	}
+	s, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(s)
+}
+
+func (c protobufCodec) Unmarshal(data []byte, v any) error {
+	if c.messageType != nil {
+		m := c.messageType.New().Interface()
+		if err := proto.Unmarshal(data, m); err != nil {
+			return err
+		}
+		// Zero values are part of the state, fields with presence are only
+		// emitted when set
+		payload, err := protojson.MarshalOptions{EmitDefaultValues: true}.Marshal(m)
+		if err != nil {
+			return err
+		}
+		var tree any
+		if err := json.Unmarshal(payload, &tree); err != nil {
+			return err
+		}
+		unquoteInt64s(tree, c.messageType.Descriptor())
+		if p, ok := v.(*any); ok {
+			*p = tree
+			return nil
+		}
+		return viaJSON(tree, v)
+	}
+
+	s := &structpb.Struct{}
+	if err := proto.Unmarshal(data, s); err != nil {
+		return err
+	}
+	if p, ok := v.(*any); ok {
+		*p = s.AsMap()
+		return nil
+	}
+	return viaJSON(s.AsMap(), v)
+}
+
+// unquoteInt64s turns the 64 bit integers protojson writes as strings back
+// into numbers, as the other codecs decode them.
+func unquoteInt64s(tree any, message protoreflect.MessageDescriptor) {
+	obj, ok := tree.(map[string]any)
+	if !ok {
+		return
+	}
+	for name, value := range obj {
+		field := message.Fields().ByJSONName(name)
+		if field == nil {
+			continue
+		}
+		switch {
+		case field.IsList():
+			if items, ok := value.([]any); ok {
+				for i, item := range items {
+					items[i] = unquoteInt64(item, field)
+				}
+			}
+		case field.IsMap():
+			if entries, ok := value.(map[string]any); ok {
+				for key, entry := range entries {
+					entries[key] = unquoteInt64(entry, field.MapValue())
+				}
+			}
+		default:
+			obj[name] = unquoteInt64(value, field)
+		}
+	}
+}
+
+func unquoteInt64(value any, field protoreflect.FieldDescriptor) any {
+	switch field.Kind() {
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if s, ok := value.(string); ok {
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				return n
+			}
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		unquoteInt64s(value, field.Message())
+	}
+	return value
+}
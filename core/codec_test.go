@@ -0,0 +1,158 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var testCodecs = []Codec{JSONCodec, CBORCodec, MsgpackCodec, ProtobufCodec}
+
+func TestCodecRoundTrip(t *testing.T) {
+	command := Command{
+		Name:          "set_voltage",
+		Args:          map[string]any{"volts": 12.5, "channel": "a", "enabled": true},
+		CorrelationId: "42",
+	}
+
+	for _, codec := range testCodecs {
+		payload, err := codec.Marshal(command)
+		if err != nil {
+			t.Fatal("Expected", codec.ContentType(), "to encode the command, but got", err)
+		}
+		decoded := Command{}
+		if err := codec.Unmarshal(payload, &decoded); err != nil {
+			t.Fatal("Expected", codec.ContentType(), "to decode the command, but got", err)
+		}
+		if !reflect.DeepEqual(decoded, command) {
+			t.Fatal("Expected", command, ", but got", decoded, "from", codec.ContentType())
+		}
+	}
+}
+
+func TestCodecTranscodesState(t *testing.T) {
+	envelope := []byte(`{"timestamp": 1714557600000, "properties": {"voltage": 12.5, "output": true, "channels": [{"current": 0.5}]}, "units": {"voltage": "V"}}`)
+
+	for _, codec := range testCodecs {
+		payload, err := FromJSON(codec, envelope)
+		if err != nil {
+			t.Fatal("Expected", codec.ContentType(), "to encode the state, but got", err)
+		}
+		decoded, err := ToJSON(codec, payload)
+		if err != nil {
+			t.Fatal("Expected", codec.ContentType(), "to decode the state, but got", err)
+		}
+		state, err := ParseState(decoded, time.Now())
+		if err != nil {
+			t.Fatal("Expected a valid state from", codec.ContentType(), ", but got", err)
+		}
+
+		if p, _ := state.Get("voltage"); p.Value != 12.5 || p.Unit != "V" {
+			t.Fatal("Expected voltage 12.5 V, but got", p, "from", codec.ContentType())
+		}
+		if p, _ := state.Get("channels"); p.Type != TypeArray {
+			t.Fatal("Expected channels to be an array, but got", p, "from", codec.ContentType())
+		}
+		if state.ReportedAt == nil || state.ReportedAt.UnixMilli() != 1714557600000 {
+			t.Fatal("Expected the reported timestamp, but got", state.ReportedAt, "from", codec.ContentType())
+		}
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	cases := map[string]Codec{
+		"":                                JSONCodec,
+		"application/json; charset=utf-8": JSONCodec,
+		"CBOR":                            CBORCodec,
+		"application/x-msgpack":           MsgpackCodec,
+		"protobuf":                        ProtobufCodec,
+	}
+	for name, expected := range cases {
+		if codec, err := CodecFor(name); err != nil || codec != expected {
+			t.Fatal("Expected", expected.ContentType(), "for", name, ", but got", codec, err)
+		}
+	}
+
+	if _, err := CodecFor("application/xml"); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatal("Expected", ErrUnknownCodec, ", but got", err)
+	}
+	if _, err := ParseDescriptor(json.RawMessage(`{"model": "x", "encoding": "yaml"}`)); !errors.Is(err, ErrInvalidDescriptor) {
+		t.Fatal("Expected", ErrInvalidDescriptor, ", but got", err)
+	}
+}
+
+// registerPsuState registers fibers.test.PsuState like a compiled-in .proto
+// file would.
+func registerPsuState(t *testing.T) {
+	if _, err := protoregistry.GlobalTypes.FindMessageByName("fibers.test.PsuState"); err == nil {
+		return
+	}
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   kind.Enum(),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+	}
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("fibers/test/psu.proto"),
+		Package: proto.String("fibers.test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("PsuState"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("voltage", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				field("output", 2, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+				field("energy_wh", 3, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+			},
+		}},
+	}, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := protoregistry.GlobalTypes.RegisterMessage(dynamicpb.NewMessageType(file.Messages().Get(0))); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+}
+
+func TestProtobufMessageType(t *testing.T) {
+	registerPsuState(t)
+	codec, err := CodecFor("application/x-protobuf; messageType=fibers.test.PsuState")
+	if err != nil {
+		t.Fatal("Expected a codec for the message type, but got", err)
+	}
+	if codec.ContentType() != "application/x-protobuf; messageType=fibers.test.PsuState" {
+		t.Fatal("Expected the message type in the content type, but got", codec.ContentType())
+	}
+
+	payload, err := FromJSON(codec, []byte(`{"voltage": 12.5, "output": false, "energyWh": 1234}`))
+	if err != nil {
+		t.Fatal("Expected the state to be encoded, but got", err)
+	}
+	decoded, err := ToJSON(codec, payload)
+	if err != nil {
+		t.Fatal("Expected the state to be decoded, but got", err)
+	}
+	state, err := ParseState(decoded, time.Now())
+	if err != nil {
+		t.Fatal("Expected a valid state, but got", err)
+	}
+	for name, expected := range map[string]any{"voltage": 12.5, "output": false, "energyWh": 1234.0} {
+		if p, _ := state.Get(name); p.Value != expected {
+			t.Fatal("Expected", name, expected, ", but got", p)
+		}
+	}
+
+	if _, err := CodecFor("protobuf; messageType=fibers.test.Missing"); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatal("Expected", ErrUnknownCodec, ", but got", err)
+	}
+}
@@ -0,0 +1,321 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Command struct {
+	Name          string         `json:"name"`
+	Args          map[string]any `json:"args,omitempty"`
+	CorrelationId string         `json:"correlationId,omitempty"`
+}
+
+// CommandResult is what a device reports back after executing a command.
+type CommandResult struct {
+	CorrelationId string          `json:"correlationId"`
+	Success       bool            `json:"success"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+type ArgType string
+
+const (
+	ArgString  ArgType = "string"
+	ArgNumber  ArgType = "number"
+	ArgInteger ArgType = "integer"
+	ArgBool    ArgType = "bool"
+)
+
+type ArgSpec struct {
+	Name        string   `json:"name"`
+	Type        ArgType  `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+	Default     any      `json:"default,omitempty"`
+	Enum        []any    `json:"enum,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+}
+
+type CommandSpec struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Args        []ArgSpec `json:"args,omitempty"`
+}
+
+var (
+	ErrDeviceNotFound = errors.New("device not found")
+	ErrCommandTimeout = errors.New("timed out waiting for command result")
+)
+
+// CommandFailedError wraps a result in which the device reported a failure.
+type CommandFailedError struct {
+	Result CommandResult
+}
+
+func (e *CommandFailedError) Error() string {
+	if e.Result.Error == "" {
+		return "command failed"
+	}
+	return "command failed: " + e.Result.Error
+}
+
+func NewCorrelationId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// pendingResultTTL is how long the result of a command is expected, also
+// after the sender stopped waiting, so that late results are still published.
+const pendingResultTTL = 10 * time.Minute
+
+type pendingCommand struct {
+	deviceId string
+	command  Command
+	sentAt   time.Time
+	// result is nil once nobody waits for the result
+	result chan *CommandResult
+}
+
+// pendingResults matches the command results reported by devices to the
+// commands they were sent.
+type pendingResults struct {
+	mutex    sync.Mutex
+	commands map[string]*pendingCommand
+}
+
+func (p *pendingResults) add(deviceId string, command Command, wait bool) *pendingCommand {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	if p.commands == nil {
+		p.commands = make(map[string]*pendingCommand)
+	}
+	for id, pending := range p.commands {
+		if now.Sub(pending.sentAt) > pendingResultTTL {
+			delete(p.commands, id)
+		}
+	}
+	pending := &pendingCommand{deviceId: deviceId, command: command, sentAt: now}
+	if wait {
+		pending.result = make(chan *CommandResult, 1)
+	}
+	p.commands[command.CorrelationId] = pending
+	return pending
+}
+
+func (p *pendingResults) remove(correlationId string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.commands, correlationId)
+}
+
+// abandon stops delivering the result to the sender, it is still published
+// if it comes.
+func (p *pendingResults) abandon(correlationId string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if pending, ok := p.commands[correlationId]; ok {
+		pending.result = nil
+	}
+}
+
+// resolve delivers result to its sender, if still waiting, and returns the
+// command it belongs to. Results of other devices' commands don't match.
+func (p *pendingResults) resolve(deviceId string, result *CommandResult) (*pendingCommand, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pending, ok := p.commands[result.CorrelationId]
+	if !ok || pending.deviceId != deviceId {
+		return nil, false
+	}
+	delete(p.commands, result.CorrelationId)
+	if pending.result != nil {
+		pending.result <- result
+	}
+	return pending, true
+}
+
+type ArgError struct {
+	Arg     string `json:"arg,omitempty"`
+	Message string `json:"message"`
+}
+
+// CommandValidationError lists everything that is wrong with a command, so
+// callers can report all problems at once rather than one per request.
+type CommandValidationError struct {
+	Command string     `json:"command"`
+	Errors  []ArgError `json:"errors"`
+}
+
+func (e *CommandValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, argErr := range e.Errors {
+		if argErr.Arg == "" {
+			msgs = append(msgs, argErr.Message)
+		} else {
+			msgs = append(msgs, argErr.Arg+": "+argErr.Message)
+		}
+	}
+	return fmt.Sprintf("invalid command %q: %s", e.Command, strings.Join(msgs, "; "))
+}
+
+// NewUnknownCommandError reports a command the device doesn't have.
+func NewUnknownCommandError(command string) *CommandValidationError {
+	return &CommandValidationError{Command: command, Errors: []ArgError{{Message: "unknown command"}}}
+}
+
+func FindCommandSpec(specs []CommandSpec, name string) (*CommandSpec, bool) {
+	for i := range specs {
+		if specs[i].Name == name {
+			return &specs[i], true
+		}
+	}
+	return nil, false
+}
+
+// ValidateCommand checks command against the matching spec in specs and fills
+// in defaults for omitted optional arguments.
+func ValidateCommand(specs []CommandSpec, command *Command) error {
+	spec, ok := FindCommandSpec(specs, command.Name)
+	if !ok {
+		return NewUnknownCommandError(command.Name)
+	}
+	return spec.Validate(command)
+}
+
+func (s *CommandSpec) Validate(command *Command) error {
+	validationErr := &CommandValidationError{Command: command.Name}
+	if command.Args == nil {
+		command.Args = make(map[string]any)
+	}
+
+	for name := range command.Args {
+		if !slices.ContainsFunc(s.Args, func(a ArgSpec) bool { return a.Name == name }) {
+			validationErr.Errors = append(validationErr.Errors, ArgError{name, "unknown argument"})
+		}
+	}
+
+	for _, argSpec := range s.Args {
+		value, ok := command.Args[argSpec.Name]
+		if !ok || value == nil {
+			if argSpec.Default != nil {
+				command.Args[argSpec.Name] = argSpec.Default
+			} else if argSpec.Required {
+				validationErr.Errors = append(validationErr.Errors, ArgError{argSpec.Name, "required"})
+			}
+			continue
+		}
+
+		normalized, err := argSpec.check(value)
+		if err != nil {
+			validationErr.Errors = append(validationErr.Errors, ArgError{argSpec.Name, err.Error()})
+			continue
+		}
+		command.Args[argSpec.Name] = normalized
+	}
+
+	if len(validationErr.Errors) > 0 {
+		return validationErr
+	}
+	return nil
+}
+
+// ParseArg converts the text form of an argument, as sent by protocols
+// without typed payloads, and checks it against the spec.
+func (a *ArgSpec) ParseArg(text string) (any, error) {
+	var value any = text
+	switch a.Type {
+	case ArgBool:
+		b, err := strconv.ParseBool(strings.ToLower(strings.TrimSpace(text)))
+		if err != nil {
+			return nil, fmt.Errorf("expected a bool")
+		}
+		value = b
+	case ArgNumber, ArgInteger:
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number")
+		}
+		value = f
+	}
+	return a.check(value)
+}
+
+func (a *ArgSpec) check(value any) (any, error) {
+	switch a.Type {
+	case ArgString:
+		if _, ok := value.(string); !ok {
+			return nil, fmt.Errorf("expected a string")
+		}
+	case ArgBool:
+		if _, ok := value.(bool); !ok {
+			return nil, fmt.Errorf("expected a bool")
+		}
+	case ArgNumber, ArgInteger:
+		f, ok := toFloat(value)
+		if !ok {
+			return nil, fmt.Errorf("expected a number")
+		}
+		if a.Type == ArgInteger && f != math.Trunc(f) {
+			return nil, fmt.Errorf("expected an integer")
+		}
+		if a.Min != nil && f < *a.Min {
+			return nil, fmt.Errorf("must be >= %v", *a.Min)
+		}
+		if a.Max != nil && f > *a.Max {
+			return nil, fmt.Errorf("must be <= %v", *a.Max)
+		}
+		value = f
+	default:
+		return nil, fmt.Errorf("unsupported argument type %q", a.Type)
+	}
+
+	if len(a.Enum) > 0 && !slices.ContainsFunc(a.Enum, func(e any) bool { return valuesEqual(e, value) }) {
+		return nil, fmt.Errorf("must be one of %v", a.Enum)
+	}
+	return value, nil
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func valuesEqual(a, b any) bool {
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if okA && okB {
+		return fa == fb
+	}
+	return a == b
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+var testSpecs = []CommandSpec{
+	{
+		Name: "power",
+		Args: []ArgSpec{
+			{Name: "state", Type: ArgString, Required: true, Enum: []any{"on", "off"}},
+		},
+	},
+	{
+		Name: "set_voltage",
+		Args: []ArgSpec{
+			{Name: "volts", Type: ArgNumber, Required: true, Min: ptr(0.0), Max: ptr(30.0)},
+			{Name: "channel", Type: ArgInteger, Default: 1.0},
+		},
+	},
+}
+
+func TestValidateCommand(t *testing.T) {
+	cmd := &Command{Name: "set_voltage", Args: map[string]any{"volts": 12}}
+	if err := ValidateCommand(testSpecs, cmd); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if cmd.Args["channel"] != 1.0 || cmd.Args["volts"] != 12.0 {
+		t.Fatal("Expected defaults and normalized numbers, but got", cmd.Args)
+	}
+}
+
+func TestValidateCommandErrors(t *testing.T) {
+	cases := []struct {
+		cmd        Command
+		errorCount int
+	}{
+		{Command{Name: "reboot"}, 1},
+		{Command{Name: "power"}, 1},
+		{Command{Name: "power", Args: map[string]any{"state": "maybe"}}, 1},
+		{Command{Name: "set_voltage", Args: map[string]any{"volts": 31.0, "channel": 1.5}}, 2},
+		{Command{Name: "set_voltage", Args: map[string]any{"volts": "12", "extra": true}}, 2},
+	}
+
+	for _, c := range cases {
+		err := ValidateCommand(testSpecs, &c.cmd)
+		var validationErr *CommandValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatal("Expected a validation error for", c.cmd, ", but got", err)
+		}
+		if len(validationErr.Errors) != c.errorCount {
+			t.Fatal("Expected", c.errorCount, "errors for", c.cmd, ", but got", validationErr.Errors)
+		}
+	}
+}
+
+func TestParseArg(t *testing.T) {
+	volts := testSpecs[1].Args[0]
+	if v, err := volts.ParseArg(" 12.5"); err != nil || v != 12.5 {
+		t.Fatal("Expected 12.5, but got", v, err)
+	}
+	if _, err := volts.ParseArg("31"); err == nil {
+		t.Fatal("Expected the maximum to be checked")
+	}
+	enabled := ArgSpec{Name: "enabled", Type: ArgBool}
+	if v, err := enabled.ParseArg("TRUE"); err != nil || v != true {
+		t.Fatal("Expected true, but got", v, err)
+	}
+	if _, err := enabled.ParseArg("yes"); err == nil {
+		t.Fatal("Expected an error for a non-bool value")
+	}
+}
+
+// replyingDevice reports the results of its commands after a delay.
+type replyingDevice struct {
+	EmptyDevice
+	delay   time.Duration
+	results Broadcaster[*CommandResult]
+}
+
+func (d *replyingDevice) ListCommands() ([]CommandSpec, error) {
+	return testSpecs, nil
+}
+
+func (d *replyingDevice) SendCommand(ctx context.Context, command *Command) (*CommandResult, error) {
+	correlationId := command.CorrelationId
+	time.AfterFunc(d.delay, func() {
+		d.results.Publish(&CommandResult{CorrelationId: correlationId, Success: true})
+	})
+	return nil, nil
+}
+
+func (d *replyingDevice) ReportsResult(command *Command) bool {
+	return true
+}
+
+func (d *replyingDevice) SubscribeToResults(ctx context.Context, opts SubscriptionOptions) (*Subscription[*CommandResult], error) {
+	return d.results.Subscribe(ctx, opts), nil
+}
+
+func TestCommandResults(t *testing.T) {
+	devManager := NewBasicDeviceManager()
+	dev := &replyingDevice{EmptyDevice: EmptyDevice{IdField: "psu1"}, delay: 10 * time.Millisecond}
+	devManager.AddDevice(dev)
+	results := SubscribeEvents[CommandResultEvent](&devManager.events, context.Background(), EventFilter{}, SubscriptionOptions{})
+	failures := SubscribeEvents[CommandFailedEvent](&devManager.events, context.Background(), EventFilter{}, SubscriptionOptions{})
+	nextResult := func() CommandResultEvent {
+		select {
+		case e := <-results.C():
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("Expected a command result event")
+		}
+		return CommandResultEvent{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	command := &Command{Name: "power", Args: map[string]any{"state": "on"}}
+	result, err := devManager.SendCommand(ctx, "psu1", command)
+	if err != nil || !result.Success || result.CorrelationId != command.CorrelationId {
+		t.Fatal("Expected the result of the command, but got", result, err)
+	}
+	nextResult()
+
+	command = &Command{Name: "power", Args: map[string]any{"state": "off"}}
+	if err := devManager.SendCommandAsync("psu1", command); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextResult(); e.Command.CorrelationId != command.CorrelationId || e.Command.Args["state"] != "off" {
+		t.Fatal("Expected the result of the async command, but got", e)
+	}
+
+	// A result that comes after the sender gave up is still published
+	dev.delay = 100 * time.Millisecond
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer shortCancel()
+	command = &Command{Name: "power", Args: map[string]any{"state": "on"}}
+	if _, err := devManager.SendCommand(shortCtx, "psu1", command); !errors.Is(err, ErrCommandTimeout) {
+		t.Fatal("Expected", ErrCommandTimeout, ", but got", err)
+	}
+	if failed := drain(failures); len(failed) != 1 || failed[0].Command.CorrelationId != command.CorrelationId {
+		t.Fatal("Expected a command failed event, but got", failed)
+	}
+	if e := nextResult(); e.Result.CorrelationId != command.CorrelationId {
+		t.Fatal("Expected the late result, but got", e)
+	}
+
+	// Results of unknown commands are dropped
+	dev.results.Publish(&CommandResult{CorrelationId: "spoofed", Success: true})
+	time.Sleep(20 * time.Millisecond)
+	if len(results.C()) > 0 {
+		t.Fatal("Expected no event for an unknown result, but got", <-results.C())
+	}
+}
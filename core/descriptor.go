@@ -0,0 +1,138 @@
+package core
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type PropertySpec struct {
+	Name        string          `json:"name"`
+	Type        ValueType       `json:"type"`
+	Unit        string          `json:"unit,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Setter      *PropertySetter `json:"setter,omitempty"`
+}
+
+// PropertySetter names the command, and the argument of that command, that
+// changes a property. It lets the reconciler drive a device to its desired state.
+type PropertySetter struct {
+	Command string `json:"command"`
+	Arg     string `json:"arg"`
+}
+
+// Descriptor is the self-description a device publishes when it connects.
+type Descriptor struct {
+	Model      string         `json:"model"`
+	Firmware   string         `json:"firmware,omitempty"`
+	DeviceType string         `json:"deviceType,omitempty"`
+	Commands   []CommandSpec  `json:"commands"`
+	Properties []PropertySpec `json:"properties,omitempty"`
+	// Encoding is the content type, or codec name, of the device's state and
+	// command payloads. JSON is used when empty.
+	Encoding string `json:"encoding,omitempty"`
+	// Topics overrides the default devices/{id}/... topic layout.
+	Topics *TopicLayout `json:"topics,omitempty"`
+	// ReportInterval is how often, in seconds, the device reports its state
+	// when nothing changes. The presence watchdog derives its timeouts from it.
+	ReportInterval int `json:"reportInterval,omitempty"`
+}
+
+// TopicLayout holds the topics a device uses, with {id} standing for the
+// device id. Empty topics keep their default.
+type TopicLayout struct {
+	State   string `json:"state,omitempty"`
+	Command string `json:"command,omitempty"`
+	Result  string `json:"result,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+var DefaultTopicLayout = TopicLayout{
+	State:   "devices/{id}/state",
+	Command: "devices/{id}/command",
+	Result:  "devices/{id}/command/result",
+	Error:   "devices/{id}/error",
+}
+
+// Resolve fills in the defaults and the device id.
+func (l *TopicLayout) Resolve(deviceId string) TopicLayout {
+	resolved := DefaultTopicLayout
+	if l != nil {
+		resolved.State = cmp.Or(l.State, resolved.State)
+		resolved.Command = cmp.Or(l.Command, resolved.Command)
+		resolved.Result = cmp.Or(l.Result, resolved.Result)
+		resolved.Error = cmp.Or(l.Error, resolved.Error)
+	}
+	for _, topic := range []*string{&resolved.State, &resolved.Command, &resolved.Result, &resolved.Error} {
+		*topic = strings.ReplaceAll(*topic, "{id}", deviceId)
+	}
+	return resolved
+}
+
+var ErrInvalidDescriptor = errors.New("invalid device descriptor")
+
+func ParseDescriptor(payload []byte) (*Descriptor, error) {
+	descriptor := &Descriptor{}
+	if err := json.Unmarshal(payload, descriptor); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDescriptor, err)
+	}
+	if descriptor.Model == "" {
+		return nil, fmt.Errorf("%w: missing model", ErrInvalidDescriptor)
+	}
+	if _, err := CodecFor(descriptor.Encoding); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDescriptor, err)
+	}
+	if descriptor.ReportInterval < 0 {
+		return nil, fmt.Errorf("%w: negative report interval", ErrInvalidDescriptor)
+	}
+	if t := descriptor.Topics; t != nil {
+		for _, topic := range []string{t.State, t.Command, t.Result, t.Error} {
+			if strings.ContainsAny(topic, "+#") {
+				return nil, fmt.Errorf("%w: wildcard in topic %s", ErrInvalidDescriptor, topic)
+			}
+		}
+	}
+	for _, cmd := range descriptor.Commands {
+		if cmd.Name == "" {
+			return nil, fmt.Errorf("%w: command without a name", ErrInvalidDescriptor)
+		}
+	}
+	return descriptor, nil
+}
+
+// SetReportInterval sets the report interval, rounded up to whole seconds.
+func (d *Descriptor) SetReportInterval(interval time.Duration) {
+	d.ReportInterval = int((interval + time.Second - 1) / time.Second)
+}
+
+// ParseDuration reads a configured duration such as "10s", or returns fallback
+// if it is empty.
+func ParseDuration(name string, value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+func (d *Descriptor) PropertyUnit(name string) string {
+	if p, ok := d.Property(name); ok {
+		return p.Unit
+	}
+	return ""
+}
+
+func (d *Descriptor) Property(name string) (*PropertySpec, bool) {
+	for i := range d.Properties {
+		if d.Properties[i].Name == name {
+			return &d.Properties[i], true
+		}
+	}
+	return nil, false
+}
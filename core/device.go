@@ -1,19 +1,30 @@
 package core
 
-type Command struct {
-	Name      string	`json:"name"`
-	Arguments []string	`json:"args"`
-}
-
-type State struct {
-	Properties map[string]string
-}
+import "context"
 
 type SimpleDevice interface {
 	Id() string
-	ListCommands() ([]Command, error)
-	SendCommand(command *Command) error
+	ListCommands() ([]CommandSpec, error)
+	// SendCommand delivers command to the device, within ctx. It returns the
+	// result if the device answers as part of the delivery, as HTTP and CoAP
+	// devices do, and a nil result otherwise: the result is either reported
+	// later by a ResultReporter, or the device doesn't confirm commands.
+	SendCommand(ctx context.Context, command *Command) (*CommandResult, error)
 	GetState() *State
-	SubcribeToStateChanges() (chan *State, error)
-	SubcribeToErrorChanges() (chan error, error)
+	SubscribeToStateChanges(ctx context.Context, opts SubscriptionOptions) (*Subscription[*State], error)
+	SubscribeToErrors(ctx context.Context, opts SubscriptionOptions) (*Subscription[error], error)
+}
+
+// DescribedDevice is implemented by devices that know their own descriptor.
+type DescribedDevice interface {
+	Descriptor() *Descriptor
+}
+
+// ResultReporter is implemented by devices that report command results after
+// SendCommand returned, such as MQTT devices with a result topic. Results
+// carry the correlation id of their command.
+type ResultReporter interface {
+	// ReportsResult tells whether a result will be reported for command.
+	ReportsResult(command *Command) bool
+	SubscribeToResults(ctx context.Context, opts SubscriptionOptions) (*Subscription[*CommandResult], error)
 }
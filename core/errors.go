@@ -0,0 +1,108 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type ErrorKind string
+
+const (
+	// ErrorFault is a fault reported by the device itself.
+	ErrorFault ErrorKind = "fault"
+	// ErrorMalformedPayload is a message from the device that could not be decoded.
+	ErrorMalformedPayload ErrorKind = "malformed_payload"
+	// ErrorPublishFailed is a message to the device that could not be published.
+	ErrorPublishFailed ErrorKind = "publish_failed"
+	// ErrorRegistration is a device that failed to register.
+	ErrorRegistration ErrorKind = "registration"
+	// ErrorPollFailed is a device that could not be polled for its state.
+	ErrorPollFailed ErrorKind = "poll_failed"
+	// ErrorAlert is an alert raised by a rule on the state of the device.
+	ErrorAlert ErrorKind = "alert"
+)
+
+// maxPayloadExcerpt limits how much of an offending payload is kept in an error.
+const maxPayloadExcerpt = 256
+
+type DeviceError struct {
+	DeviceId string    `json:"deviceId"`
+	Kind     ErrorKind `json:"kind"`
+	Code     string    `json:"code,omitempty"`
+	Message  string    `json:"message"`
+	Topic    string    `json:"topic,omitempty"`
+	Payload  string    `json:"payload,omitempty"`
+	Time     time.Time `json:"time"`
+	Err      error     `json:"-"`
+}
+
+func (e *DeviceError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("device %s: %s %s: %s", e.DeviceId, e.Kind, e.Code, e.Message)
+	}
+	return fmt.Sprintf("device %s: %s: %s", e.DeviceId, e.Kind, e.Message)
+}
+
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
+
+func NewDeviceError(deviceId string, kind ErrorKind, err error) *DeviceError {
+	return &DeviceError{
+		DeviceId: deviceId,
+		Kind:     kind,
+		Message:  err.Error(),
+		Time:     time.Now(),
+		Err:      err,
+	}
+}
+
+// NewMalformedPayloadError describes a payload received on topic that could not be decoded.
+func NewMalformedPayloadError(deviceId, topic string, payload []byte, err error) *DeviceError {
+	deviceErr := NewDeviceError(deviceId, ErrorMalformedPayload, err)
+	deviceErr.Topic = topic
+	deviceErr.Payload = string(payload[:min(len(payload), maxPayloadExcerpt)])
+	return deviceErr
+}
+
+// ParseFault decodes a fault published by a device:
+//
+//	{"code": "overtemp", "message": "heatsink at 95C", "timestamp": "2024-05-01T10:00:00Z"}
+func ParseFault(deviceId string, payload []byte) (*DeviceError, error) {
+	fault := struct {
+		Code      string          `json:"code"`
+		Message   string          `json:"message"`
+		Timestamp json.RawMessage `json:"timestamp"`
+	}{}
+	if err := json.Unmarshal(payload, &fault); err != nil {
+		return nil, err
+	}
+
+	deviceErr := &DeviceError{
+		DeviceId: deviceId,
+		Kind:     ErrorFault,
+		Code:     fault.Code,
+		Message:  fault.Message,
+		Time:     time.Now(),
+	}
+	if len(fault.Timestamp) > 0 {
+		if ts, err := parseTimestamp(fault.Timestamp); err == nil {
+			deviceErr.Time = ts
+		}
+	}
+	return deviceErr, nil
+}
+
+// errorHistory is a bounded, oldest-first log of device errors.
+type errorHistory struct {
+	errors []DeviceError
+	limit  int
+}
+
+func (h *errorHistory) add(err DeviceError) {
+	if len(h.errors) >= h.limit {
+		h.errors = append(h.errors[:0], h.errors[len(h.errors)-h.limit+1:]...)
+	}
+	h.errors = append(h.errors, err)
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestErrorHistoryIsBounded(t *testing.T) {
+	devManager := NewBasicDeviceManager()
+	devManager.AddDevice(NewEmptyDeviceWithId("psu1"))
+	sub := devManager.SubscribeToErrors(context.Background(), SubscriptionOptions{BufferSize: errorHistoryLimit + 10})
+
+	for i := range errorHistoryLimit + 10 {
+		devManager.ReportError(NewDeviceError("psu1", ErrorFault, errors.New(strconv.Itoa(i))))
+	}
+
+	history, err := devManager.ListDeviceErrors("psu1")
+	if err != nil || len(history) != errorHistoryLimit {
+		t.Fatal("Expected", errorHistoryLimit, "errors, but got", len(history), err)
+	}
+	if history[0].Message != "10" || history[len(history)-1].Message != strconv.Itoa(errorHistoryLimit+9) {
+		t.Fatal("Expected the oldest errors to be dropped, but got", history[0], history[len(history)-1])
+	}
+
+	published := drain(sub)
+	var deviceErr *DeviceError
+	if len(published) != errorHistoryLimit+10 || !errors.As(published[0], &deviceErr) {
+		t.Fatal("Expected every error to be published, but got", len(published))
+	}
+
+	// Unknown devices get their errors published but don't keep a history
+	devManager.ReportError(NewDeviceError("spoofed", ErrorFault, errors.New("boom")))
+	if published := drain(sub); len(published) != 1 {
+		t.Fatal("Expected the error to be published, but got", published)
+	}
+	if _, err := devManager.ListDeviceErrors("spoofed"); err != ErrDeviceNotFound {
+		t.Fatal("Expected", ErrDeviceNotFound, ", but got", err)
+	}
+	if len(devManager.errorsById) != 1 {
+		t.Fatal("Expected a single error history, but got", len(devManager.errorsById))
+	}
+}
+
+func TestParseFault(t *testing.T) {
+	fault, err := ParseFault("psu1", []byte(`{"code": "overtemp", "message": "too hot", "timestamp": 1714557600000}`))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if fault.Kind != ErrorFault || fault.Code != "overtemp" || fault.Time.UnixMilli() != 1714557600000 {
+		t.Fatal("Unexpected fault", fault)
+	}
+	if _, err := ParseFault("psu1", []byte(`not json`)); err == nil {
+		t.Fatal("Expected an error for a malformed fault")
+	}
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventDeviceAdded         EventType = "device_added"
+	EventDeviceRemoved       EventType = "device_removed"
+	EventDeviceConnected     EventType = "device_connected"
+	EventDeviceDisconnected  EventType = "device_disconnected"
+	EventStateChanged        EventType = "state_changed"
+	EventCommandSent         EventType = "command_sent"
+	EventCommandResult       EventType = "command_result"
+	EventCommandFailed       EventType = "command_failed"
+	EventDeviceError         EventType = "device_error"
+	EventDesiredStateChanged EventType = "desired_state_changed"
+	EventDeviceStale         EventType = "device_stale"
+	EventDeviceRecovered     EventType = "device_recovered"
+)
+
+type Event interface {
+	Type() EventType
+	DeviceId() string
+	DeviceLabels() map[string]string
+	Time() time.Time
+}
+
+// EventMeta holds the fields common to all events.
+type EventMeta struct {
+	Device string            `json:"deviceId"`
+	Labels map[string]string `json:"labels,omitempty"`
+	At     time.Time         `json:"time"`
+}
+
+func (m EventMeta) DeviceId() string                { return m.Device }
+func (m EventMeta) DeviceLabels() map[string]string { return m.Labels }
+func (m EventMeta) Time() time.Time                 { return m.At }
+
+// DeviceAddedEvent is emitted when a device is registered for the first time.
+type DeviceAddedEvent struct {
+	EventMeta
+	Device     SimpleDevice `json:"-"`
+	Descriptor *Descriptor  `json:"descriptor,omitempty"`
+}
+
+// DeviceRemovedEvent is emitted when a device is decommissioned.
+type DeviceRemovedEvent struct {
+	EventMeta
+}
+
+type DeviceConnectedEvent struct {
+	EventMeta
+	Device SimpleDevice `json:"-"`
+}
+
+type DeviceDisconnectedEvent struct {
+	EventMeta
+	Reason string `json:"reason,omitempty"`
+}
+
+// DeviceStaleEvent is emitted when a connected device stops reporting state.
+type DeviceStaleEvent struct {
+	EventMeta
+	LastSeen time.Time `json:"lastSeen"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// DeviceRecoveredEvent is emitted when a stale device reports state again.
+type DeviceRecoveredEvent struct {
+	EventMeta
+}
+
+type StateChangedEvent struct {
+	EventMeta
+	Device   SimpleDevice `json:"-"`
+	OldState *State       `json:"oldState,omitempty"`
+	NewState *State       `json:"newState"`
+	// Changed lists the properties whose value differs between the two states.
+	Changed []string `json:"changed"`
+}
+
+type CommandSentEvent struct {
+	EventMeta
+	Command Command `json:"command"`
+}
+
+type CommandResultEvent struct {
+	EventMeta
+	Command Command       `json:"command"`
+	Result  CommandResult `json:"result"`
+}
+
+// CommandFailedEvent is emitted when a command couldn't be delivered or its
+// result didn't come in time. A late result is still published.
+type CommandFailedEvent struct {
+	EventMeta
+	Command Command `json:"command"`
+	Error   string  `json:"error"`
+}
+
+type DeviceErrorEvent struct {
+	EventMeta
+	Err *DeviceError `json:"error"`
+}
+
+func (DeviceAddedEvent) Type() EventType        { return EventDeviceAdded }
+func (DeviceRemovedEvent) Type() EventType      { return EventDeviceRemoved }
+func (DeviceConnectedEvent) Type() EventType    { return EventDeviceConnected }
+func (DeviceDisconnectedEvent) Type() EventType { return EventDeviceDisconnected }
+func (DeviceStaleEvent) Type() EventType        { return EventDeviceStale }
+func (DeviceRecoveredEvent) Type() EventType    { return EventDeviceRecovered }
+func (StateChangedEvent) Type() EventType       { return EventStateChanged }
+func (CommandSentEvent) Type() EventType        { return EventCommandSent }
+func (CommandResultEvent) Type() EventType      { return EventCommandResult }
+func (CommandFailedEvent) Type() EventType      { return EventCommandFailed }
+func (DeviceErrorEvent) Type() EventType        { return EventDeviceError }
+
+// changedProperties lists the properties that were added, removed or whose
+// value changed from old to new.
+func changedProperties(old, new *State) []string {
+	changed := make([]string, 0)
+	for name, p := range new.Properties {
+		oldProp, ok := old.Get(name)
+		if !ok || !reflect.DeepEqual(oldProp.Value, p.Value) {
+			changed = append(changed, name)
+		}
+	}
+	if old != nil {
+		for name := range old.Properties {
+			if _, ok := new.Properties[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// EventFilter selects events. Empty fields match everything.
+type EventFilter struct {
+	Types []EventType
+	// DevicePattern is a glob as understood by path.Match, e.g. "psu-*".
+	DevicePattern string
+	// Selector must match the labels of the event's device.
+	Selector Selector
+}
+
+func (f EventFilter) Matches(e Event) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type()) {
+		return false
+	}
+	if f.DevicePattern != "" {
+		if ok, _ := path.Match(f.DevicePattern, e.DeviceId()); !ok {
+			return false
+		}
+	}
+	return f.Selector.Matches(e.DeviceLabels())
+}
+
+// EventBus delivers device events to filtered subscriptions. The zero value
+// is ready to use.
+type EventBus struct {
+	events Broadcaster[Event]
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.events.Publish(e)
+}
+
+func (b *EventBus) Subscribe(ctx context.Context, filter EventFilter, opts SubscriptionOptions) *Subscription[Event] {
+	return SubscribeFunc(&b.events, ctx, opts, func(e Event) (Event, bool) {
+		return e, filter.Matches(e)
+	})
+}
+
+func (b *EventBus) Close() {
+	b.events.Close()
+}
+
+// SubscribeEvents subscribes to the events of concrete type E, e.g.
+//
+//	sub := SubscribeEvents[StateChangedEvent](bus, ctx, EventFilter{DevicePattern: "psu*"}, opts)
+func SubscribeEvents[E Event](b *EventBus, ctx context.Context, filter EventFilter, opts SubscriptionOptions) *Subscription[E] {
+	return SubscribeFunc(&b.events, ctx, opts, func(e Event) (E, bool) {
+		typed, ok := e.(E)
+		return typed, ok && filter.Matches(e)
+	})
+}
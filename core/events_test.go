@@ -0,0 +1,116 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventFilter(t *testing.T) {
+	event := DeviceDisconnectedEvent{EventMeta{Device: "psu-7", Labels: map[string]string{"rack": "r1", "site": "a"}, At: time.Now()}, "eof"}
+	selector := func(s string) Selector {
+		selector, _ := ParseSelector(s)
+		return selector
+	}
+
+	cases := []struct {
+		filter  EventFilter
+		matches bool
+	}{
+		{EventFilter{}, true},
+		{EventFilter{Types: []EventType{EventDeviceDisconnected}}, true},
+		{EventFilter{Types: []EventType{EventStateChanged}}, false},
+		{EventFilter{DevicePattern: "psu-*"}, true},
+		{EventFilter{DevicePattern: "relay-*"}, false},
+		{EventFilter{Selector: selector("rack=r1,site")}, true},
+		{EventFilter{Selector: selector("rack=r2")}, false},
+	}
+
+	for _, c := range cases {
+		if c.filter.Matches(event) != c.matches {
+			t.Fatal("Expected filter", c.filter, "to match:", c.matches)
+		}
+	}
+}
+
+func TestManagerPublishesLifecycleEvents(t *testing.T) {
+	devManager := NewBasicDeviceManager()
+	sub := SubscribeEvents[DeviceAddedEvent](&devManager.events, context.Background(), EventFilter{}, SubscriptionOptions{})
+	all := devManager.SubscribeToEvents(context.Background(), EventFilter{}, SubscriptionOptions{})
+	newDevices := devManager.SubscribeToNewDeviceAdded(context.Background(), SubscriptionOptions{})
+
+	devManager.AddDevice(NewEmptyDeviceWithId("psu1"))
+	devManager.SetDeviceOffline("psu1", "eof")
+	devManager.AddDevice(NewEmptyDeviceWithId("psu1"))
+	devManager.RemoveDevice("psu1")
+
+	if added := drain(sub); len(added) != 1 || added[0].DeviceId() != "psu1" {
+		t.Fatal("Expected a single DeviceAddedEvent, but got", added)
+	}
+	if devices := drain(newDevices); len(devices) != 1 {
+		t.Fatal("Expected a reconnect not to count as a new device, but got", devices)
+	}
+
+	expected := []EventType{EventDeviceAdded, EventDeviceConnected, EventDeviceDisconnected,
+		EventDeviceConnected, EventDeviceRemoved}
+	events := drain(all)
+	if len(events) != len(expected) {
+		t.Fatal("Expected events", expected, ", but got", events)
+	}
+	for i, e := range events {
+		if e.Type() != expected[i] {
+			t.Fatal("Expected events", expected, ", but got", events)
+		}
+	}
+}
+
+type reportingDevice struct {
+	EmptyDevice
+	states Broadcaster[*State]
+}
+
+func (d *reportingDevice) SubscribeToStateChanges(ctx context.Context, opts SubscriptionOptions) (*Subscription[*State], error) {
+	return d.states.Subscribe(ctx, opts), nil
+}
+
+func TestStaleDeviceRecovers(t *testing.T) {
+	devManager := NewBasicDeviceManager()
+	dev := &reportingDevice{EmptyDevice: EmptyDevice{IdField: "psu1"}}
+	devManager.AddDevice(dev)
+	sub := devManager.SubscribeToEvents(context.Background(), EventFilter{
+		Types: []EventType{EventDeviceStale, EventDeviceRecovered, EventDeviceDisconnected},
+	}, SubscriptionOptions{})
+
+	devManager.MarkDeviceStale("psu1", "no state")
+	devManager.MarkDeviceStale("psu1", "no state")
+	if record, _ := devManager.GetDeviceRecord("psu1"); record.Presence.Status != StatusStale {
+		t.Fatal("Expected status", StatusStale, ", but got", record.Presence.Status)
+	}
+
+	dev.states.Publish(NewState(time.Now()))
+	select {
+	case e := <-sub.C():
+		if e.Type() != EventDeviceStale {
+			t.Fatal("Expected", EventDeviceStale, ", but got", e.Type())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a stale event")
+	}
+	select {
+	case e := <-sub.C():
+		if e.Type() != EventDeviceRecovered {
+			t.Fatal("Expected", EventDeviceRecovered, ", but got", e.Type())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a recovered event")
+	}
+	if record, _ := devManager.GetDeviceRecord("psu1"); record.Presence.Status != StatusOnline {
+		t.Fatal("Expected status", StatusOnline, ", but got", record.Presence.Status)
+	}
+
+	devManager.SetDeviceOffline("psu1", "last will")
+	devManager.SetDeviceOffline("psu1", "eof")
+	if events := drain(sub); len(events) != 1 || events[0].Type() != EventDeviceDisconnected {
+		t.Fatal("Expected a single disconnect event, but got", events)
+	}
+}
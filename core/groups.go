@@ -0,0 +1,217 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Group is a set of devices. Members are listed explicitly, selected by a
+// label query, or both.
+type Group struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	Members  []string `json:"members,omitempty"`
+	Selector string   `json:"selector,omitempty"`
+}
+
+type GroupStore = Store[Group]
+
+var (
+	ErrGroupNotFound = errors.New("group not found")
+	ErrInvalidGroup  = errors.New("invalid group")
+)
+
+// GroupCommandOutcome is the result of a group command for one member.
+type GroupCommandOutcome struct {
+	DeviceId      string         `json:"deviceId"`
+	CorrelationId string         `json:"correlationId,omitempty"`
+	Success       bool           `json:"success"`
+	Result        *CommandResult `json:"result,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+// maxGroupCommandConcurrency bounds how many devices a group command talks to at once.
+const maxGroupCommandConcurrency = 32
+
+type GroupManager struct {
+	devices    DeviceManager
+	store      GroupStore
+	groupsById map[string]*Group
+	mutex      sync.RWMutex
+}
+
+func NewGroupManager(devices DeviceManager, store GroupStore) (*GroupManager, error) {
+	g := &GroupManager{
+		devices:    devices,
+		store:      store,
+		groupsById: make(map[string]*Group),
+	}
+	if store == nil {
+		return g, nil
+	}
+
+	groups, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		g.groupsById[group.Id] = &group
+	}
+	return g, nil
+}
+
+// persist must be called with mutex held
+func (g *GroupManager) persist() error {
+	if g.store == nil {
+		return nil
+	}
+	return g.store.Save(g.snapshot())
+}
+
+// snapshot must be called with mutex held
+func (g *GroupManager) snapshot() []Group {
+	groups := make([]Group, 0, len(g.groupsById))
+	for _, group := range g.groupsById {
+		groups = append(groups, *group)
+	}
+	slices.SortFunc(groups, func(a, b Group) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return groups
+}
+
+// PutGroup creates or replaces a group.
+func (g *GroupManager) PutGroup(group Group) error {
+	if group.Id == "" {
+		return errors.Join(ErrInvalidGroup, errors.New("missing id"))
+	}
+	selector, err := ParseSelector(group.Selector)
+	if err != nil {
+		return errors.Join(ErrInvalidGroup, err)
+	}
+	// A selector that selects every device is most likely a typo
+	if group.Selector != "" && selector.Empty() {
+		return errors.Join(ErrInvalidGroup, errors.New("selector without requirements"))
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	group.Members = slices.Compact(slices.Sorted(slices.Values(group.Members)))
+	g.groupsById[group.Id] = &group
+	return g.persist()
+}
+
+func (g *GroupManager) GetGroup(id string) (Group, error) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	group, ok := g.groupsById[id]
+	if !ok {
+		return Group{}, ErrGroupNotFound
+	}
+	return *group, nil
+}
+
+func (g *GroupManager) ListGroups() []Group {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.snapshot()
+}
+
+func (g *GroupManager) RemoveGroup(id string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.groupsById[id]; !ok {
+		return ErrGroupNotFound
+	}
+	delete(g.groupsById, id)
+	return g.persist()
+}
+
+// Members resolves the IDs of the devices in a group. Static members are
+// included even if they are not registered (yet).
+func (g *GroupManager) Members(id string) ([]string, error) {
+	group, err := g.GetGroup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]struct{})
+	for _, m := range group.Members {
+		members[m] = struct{}{}
+	}
+
+	if group.Selector != "" {
+		selector, err := ParseSelector(group.Selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range g.devices.ListDeviceRecords() {
+			if selector.Matches(r.Labels) {
+				members[r.Id] = struct{}{}
+			}
+		}
+	}
+
+	return slices.Sorted(maps.Keys(members)), nil
+}
+
+// SendCommandToGroup sends command to every member of the group concurrently,
+// waits for the results until ctx is done and reports the outcome per device.
+// A failure on one device does not stop the others.
+func (g *GroupManager) SendCommandToGroup(ctx context.Context, groupId string, command *Command) ([]GroupCommandOutcome, error) {
+	return g.fanOut(groupId, command, func(deviceId string, command *Command) (*CommandResult, error) {
+		return g.devices.SendCommand(ctx, deviceId, command)
+	})
+}
+
+// SendCommandToGroupAsync hands command off to every member of the group
+// without waiting. Success in an outcome only means the command was handed
+// off, the results are published as events.
+func (g *GroupManager) SendCommandToGroupAsync(groupId string, command *Command) ([]GroupCommandOutcome, error) {
+	return g.fanOut(groupId, command, func(deviceId string, command *Command) (*CommandResult, error) {
+		return nil, g.devices.SendCommandAsync(deviceId, command)
+	})
+}
+
+func (g *GroupManager) fanOut(groupId string, command *Command,
+	send func(deviceId string, command *Command) (*CommandResult, error)) ([]GroupCommandOutcome, error) {
+
+	members, err := g.Members(groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	outcomes := make([]GroupCommandOutcome, len(members))
+	semaphore := make(chan struct{}, maxGroupCommandConcurrency)
+	wg := sync.WaitGroup{}
+	for i, deviceId := range members {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			// Every device gets its own copy, validation fills in defaults per device
+			deviceCommand := &Command{Name: command.Name, Args: maps.Clone(command.Args)}
+			result, err := send(deviceId, deviceCommand)
+
+			outcome := GroupCommandOutcome{DeviceId: deviceId, CorrelationId: deviceCommand.CorrelationId, Result: result}
+			switch {
+			case err != nil:
+				outcome.Error = err.Error()
+			case result != nil && !result.Success:
+				outcome.Error = result.Error
+			default:
+				outcome.Success = true
+			}
+			outcomes[i] = outcome
+		}()
+	}
+	wg.Wait()
+
+	return outcomes, nil
+}
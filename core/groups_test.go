@@ -0,0 +1,147 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"site": "sofia", "rack": "r2", "psu": ""}
+
+	cases := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"site=sofia", true},
+		{"site==sofia,rack=r2", true},
+		{"site=plovdiv", false},
+		{"site!=plovdiv", true},
+		{"rack in (r1, r2)", true},
+		{"rack notin (r1,r2)", false},
+		{"psu", true},
+		{"!psu", false},
+		{"!maintenance,site in (sofia),rack", true},
+	}
+
+	for _, c := range cases {
+		selector, err := ParseSelector(c.selector)
+		if err != nil {
+			t.Fatal("Unexpected error for", c.selector, err)
+		}
+		if selector.Matches(labels) != c.matches {
+			t.Fatal("Expected selector", c.selector, "to match:", c.matches)
+		}
+	}
+
+	if _, err := ParseSelector("rack in r1"); err == nil {
+		t.Fatal("Expected an error for a value list without parentheses")
+	}
+	for _, s := range []string{"!", "=r1", "!=r1", " in (r1)", "site,!"} {
+		if _, err := ParseSelector(s); !errors.Is(err, ErrInvalidSelector) {
+			t.Fatal("Expected", ErrInvalidSelector, "for", s, ", but got", err)
+		}
+	}
+}
+
+func TestGroupMembersAndCommands(t *testing.T) {
+	devManager := NewBasicDeviceManager()
+	for _, id := range []string{"psu1", "psu2", "psu3"} {
+		devManager.AddDevice(NewEmptyDeviceWithId(id))
+	}
+	devManager.SetDeviceLabels("psu1", map[string]string{"rack": "r1"})
+	devManager.SetDeviceLabels("psu2", map[string]string{"rack": "r1"})
+
+	groupMan, _ := NewGroupManager(devManager, nil)
+	if err := groupMan.PutGroup(Group{Id: "rack1", Members: []string{"psu3"}, Selector: "rack=r1"}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	for _, selector := range []string{" ", ",", "!"} {
+		if err := groupMan.PutGroup(Group{Id: "all", Selector: selector}); !errors.Is(err, ErrInvalidGroup) {
+			t.Fatal("Expected", ErrInvalidGroup, "for selector", selector, ", but got", err)
+		}
+	}
+
+	members, err := groupMan.Members("rack1")
+	if err != nil || !slices.Equal(members, []string{"psu1", "psu2", "psu3"}) {
+		t.Fatal("Expected [psu1 psu2 psu3], but got", members, err)
+	}
+
+	devManager.SetDeviceOffline("psu2", "eof")
+	outcomes, err := groupMan.SendCommandToGroup(context.Background(), "rack1", &Command{Name: "noop"})
+	if err != nil || len(outcomes) != 3 {
+		t.Fatal("Expected 3 outcomes, but got", outcomes, err)
+	}
+	for _, o := range outcomes {
+		// EmptyDevice lists no commands, so every member must report a failure
+		if o.Success || o.Error == "" {
+			t.Fatal("Expected a failed outcome, but got", o)
+		}
+	}
+
+	if _, err := groupMan.Members("missing"); err != ErrGroupNotFound {
+		t.Fatal("Expected ErrGroupNotFound, but got", err)
+	}
+}
+
+func TestGroupCommandFanOut(t *testing.T) {
+	devManager := NewBasicDeviceManager()
+	setters := []*setterDevice{
+		{EmptyDevice: EmptyDevice{"psu1"}},
+		{EmptyDevice: EmptyDevice{"psu2"}},
+	}
+	for _, dev := range setters {
+		devManager.AddDevice(dev)
+		devManager.SetDeviceLabels(dev.Id(), map[string]string{"rack": "r1"})
+	}
+	// psu3 confirms its commands later, through its results
+	devManager.AddDevice(&replyingDevice{EmptyDevice: EmptyDevice{IdField: "psu3"}, delay: 10 * time.Millisecond})
+	devManager.SetDeviceLabels("psu3", map[string]string{"rack": "r1"})
+
+	groupMan, _ := NewGroupManager(devManager, nil)
+	groupMan.PutGroup(Group{Id: "rack1", Selector: "rack=r1"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outcomes, err := groupMan.SendCommandToGroup(ctx, "rack1", &Command{Name: "set_voltage", Args: map[string]any{"volts": 12.0}})
+	if err != nil || len(outcomes) != 3 {
+		t.Fatal("Expected 3 outcomes, but got", outcomes, err)
+	}
+	correlationIds := make(map[string]bool)
+	for _, o := range outcomes {
+		if !o.Success || o.Result == nil || o.Result.CorrelationId != o.CorrelationId {
+			t.Fatal("Expected a confirmed outcome, but got", o)
+		}
+		correlationIds[o.CorrelationId] = true
+	}
+	if len(correlationIds) != 3 {
+		t.Fatal("Expected a command per device, but got", correlationIds)
+	}
+	for _, dev := range setters {
+		if len(dev.commands) != 1 || dev.commands[0].Args["volts"] != 12.0 {
+			t.Fatal("Expected a single set_voltage 12 command, but got", dev.commands)
+		}
+	}
+
+	results := SubscribeEvents[CommandResultEvent](&devManager.events, context.Background(), EventFilter{}, SubscriptionOptions{})
+	outcomes, err = groupMan.SendCommandToGroupAsync("rack1", &Command{Name: "set_voltage", Args: map[string]any{"volts": 5.0}})
+	if err != nil || len(outcomes) != 3 {
+		t.Fatal("Expected 3 outcomes, but got", outcomes, err)
+	}
+	for _, o := range outcomes {
+		if !o.Success || o.Result != nil {
+			t.Fatal("Expected a handed off outcome, but got", o)
+		}
+	}
+	for range 3 {
+		select {
+		case <-results.C():
+		case <-time.After(time.Second):
+			t.Fatal("Expected a result event per device")
+		}
+	}
+}
@@ -1,49 +1,304 @@
 package core
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/ilievs/fibers/util"
 )
 
 type BasicDeviceManager struct {
 	devicesById map[string]SimpleDevice
+	recordsById map[string]*DeviceRecord
+	detachById map[string]context.CancelFunc
+	errorsById map[string]*errorHistory
+	pending pendingResults
+	store DeviceStore
+	// dirty tells that the registry changed since it was last written
+	dirty bool
 	devicesMutex sync.RWMutex
-	subscribersMutex sync.RWMutex
-	deviceAddedChannels []chan SimpleDevice
-	stateChangeChannels []chan SimpleDevice
-	errorChannels []chan error
+	// persistMutex keeps the registry writes in the order of their snapshots
+	persistMutex sync.Mutex
+	events EventBus
 }
 
 func NewBasicDeviceManager() *BasicDeviceManager {
 	return &BasicDeviceManager{
 		devicesById: make(map[string]SimpleDevice),
-		deviceAddedChannels: make([]chan SimpleDevice, 10),
-		stateChangeChannels: make([]chan SimpleDevice, 10),
-		errorChannels: make([]chan error, 10),
+		recordsById: make(map[string]*DeviceRecord),
+		detachById: make(map[string]context.CancelFunc),
+		errorsById: make(map[string]*errorHistory),
 	}
 }
 
-func (m *BasicDeviceManager) AddDevice(d SimpleDevice) error {
+// errorHistoryLimit is how many errors are kept per device
+const errorHistoryLimit = 100
+
+// NewPersistentDeviceManager creates a manager whose device registry is kept in
+// store. Devices loaded from the store start offline until they reconnect.
+func NewPersistentDeviceManager(store DeviceStore) (*BasicDeviceManager, error) {
+	m := NewBasicDeviceManager()
+	m.store = store
+
+	records, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, r := range records {
+		if r.Presence.Status != StatusOffline {
+			r.markOffline(now, "server restarted")
+		}
+		m.recordsById[r.Id] = &r
+	}
+	return m, nil
+}
+
+// DefaultPersistInterval is how often PersistEvery writes a changed registry.
+const DefaultPersistInterval = 10 * time.Second
+
+// persist writes the registry to the store. It must be called without
+// devicesMutex held, the mutex is only taken to snapshot the records.
+func (m *BasicDeviceManager) persist() error {
+	if m.store == nil {
+		return nil
+	}
+	m.persistMutex.Lock()
+	defer m.persistMutex.Unlock()
 	m.devicesMutex.Lock()
-	defer m.devicesMutex.Unlock()
-	m.devicesById[d.Id()] = d
-	stateChan, err := d.SubcribeToStateChanges()
+	records := m.snapshotRecords()
+	m.dirty = false
+	m.devicesMutex.Unlock()
+
+	err := m.store.Save(records)
 	if err != nil {
-		return err
+		log.Println("failed to persist device registry:", err)
+		m.devicesMutex.Lock()
+		m.dirty = true
+		m.devicesMutex.Unlock()
 	}
+	return err
+}
 
-	go func() {
-		for range stateChan {
-			for _, ch := range m.stateChangeChannels {
-				go func() {
-					ch <- d
-				}()
+// PersistEvery writes the registry every interval while it has unsaved
+// changes, such as the devices' last known state, until ctx is done.
+func (m *BasicDeviceManager) PersistEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.devicesMutex.RLock()
+			dirty := m.dirty
+			m.devicesMutex.RUnlock()
+			if dirty {
+				m.persist()
 			}
 		}
-	}()
+	}
+}
 
-	return nil
+// snapshotRecords must be called with devicesMutex held
+func (m *BasicDeviceManager) snapshotRecords() []DeviceRecord {
+	records := make([]DeviceRecord, 0, len(m.recordsById))
+	for _, r := range m.recordsById {
+		records = append(records, *r)
+	}
+	slices.SortFunc(records, func(a, b DeviceRecord) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return records
+}
+
+// Flush writes the registry, including the devices' last known state, to the store.
+func (m *BasicDeviceManager) Flush() error {
+	return m.persist()
+}
+
+func (m *BasicDeviceManager) AddDevice(d SimpleDevice) error {
+	m.devicesMutex.Lock()
+	m.detach(d.Id(), d)
+	m.devicesById[d.Id()] = d
+
+	now := time.Now()
+	record, existed := m.recordsById[d.Id()]
+	if !existed {
+		record = &DeviceRecord{Id: d.Id(), RegisteredAt: now}
+		m.recordsById[d.Id()] = record
+	}
+	if described, ok := d.(DescribedDevice); ok {
+		record.Descriptor = described.Descriptor()
+	}
+	record.markOnline(now)
+	m.dirty = true
+	meta := m.eventMeta(record, now)
+	descriptor := record.Descriptor
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.detachById[d.Id()] = cancel
+	stateSub, stateErr := d.SubscribeToStateChanges(ctx, SubscriptionOptions{Overflow: OverflowDropOldest})
+	errorSub, errorErr := d.SubscribeToErrors(ctx, SubscriptionOptions{Overflow: OverflowDropOldest})
+	var resultSub *Subscription[*CommandResult]
+	var resultErr error
+	if reporter, ok := d.(ResultReporter); ok {
+		resultSub, resultErr = reporter.SubscribeToResults(ctx, SubscriptionOptions{Overflow: OverflowDropOldest})
+	}
+	m.devicesMutex.Unlock()
+
+	if !existed {
+		m.persist()
+		m.events.Publish(DeviceAddedEvent{meta, d, descriptor})
+	}
+	m.events.Publish(DeviceConnectedEvent{meta, d})
+
+	// A device may have state from before it was registered, such as a birth
+	// certificate, the registry starts out with it
+	if state := d.GetState(); state != nil && len(state.Properties) > 0 {
+		m.recordState(d, record, state)
+	}
+	if stateSub != nil {
+		go m.forwardState(d, record, stateSub)
+	}
+	if errorSub != nil {
+		go m.forwardErrors(d, errorSub)
+	}
+	if resultSub != nil {
+		go m.forwardResults(d, resultSub)
+	}
+
+	return errors.Join(stateErr, errorErr, resultErr)
+}
+
+// forwardResults hands the results a device reports to the senders waiting
+// for them and publishes them, also when nobody waits anymore.
+func (m *BasicDeviceManager) forwardResults(d SimpleDevice, sub *Subscription[*CommandResult]) {
+	for result := range sub.C() {
+		pending, ok := m.pending.resolve(d.Id(), result)
+		if !ok {
+			log.Println("received result for unknown command", result.CorrelationId, "from device", d.Id())
+			continue
+		}
+		m.events.Publish(CommandResultEvent{m.commandEventMeta(d.Id()), pending.command, *result})
+	}
+}
+
+func (m *BasicDeviceManager) forwardErrors(d SimpleDevice, sub *Subscription[error]) {
+	for err := range sub.C() {
+		var deviceErr *DeviceError
+		if !errors.As(err, &deviceErr) {
+			deviceErr = NewDeviceError(d.Id(), ErrorFault, err)
+		}
+		m.ReportError(deviceErr)
+	}
+}
+
+// ReportError records an error in the device's error history and publishes it.
+// Only registered devices keep a history, errors about unknown ids, such as
+// a rejected registration, are just published.
+func (m *BasicDeviceManager) ReportError(deviceErr *DeviceError) {
+	m.devicesMutex.Lock()
+	meta := EventMeta{Device: deviceErr.DeviceId, At: deviceErr.Time}
+	if r, ok := m.recordsById[deviceErr.DeviceId]; ok {
+		history, ok := m.errorsById[deviceErr.DeviceId]
+		if !ok {
+			history = &errorHistory{limit: errorHistoryLimit}
+			m.errorsById[deviceErr.DeviceId] = history
+		}
+		history.add(*deviceErr)
+		meta = m.eventMeta(r, deviceErr.Time)
+	}
+	m.devicesMutex.Unlock()
+
+	m.events.Publish(DeviceErrorEvent{meta, deviceErr})
+}
+
+// ListDeviceErrors returns the recent errors of a device, oldest first.
+func (m *BasicDeviceManager) ListDeviceErrors(id string) ([]DeviceError, error) {
+	m.devicesMutex.RLock()
+	defer m.devicesMutex.RUnlock()
+	history, ok := m.errorsById[id]
+	if !ok {
+		if _, ok := m.recordsById[id]; !ok {
+			return nil, ErrDeviceNotFound
+		}
+		return []DeviceError{}, nil
+	}
+	return slices.Clone(history.errors), nil
+}
+
+func (m *BasicDeviceManager) forwardState(d SimpleDevice, record *DeviceRecord, sub *Subscription[*State]) {
+	for state := range sub.C() {
+		m.recordState(d, record, state)
+	}
+}
+
+// recordState makes state the last known state of the device and publishes
+// the change.
+func (m *BasicDeviceManager) recordState(d SimpleDevice, record *DeviceRecord, state *State) {
+	m.devicesMutex.Lock()
+	// The state the device was registered with can be reported again
+	if m.devicesById[d.Id()] != d || record.LastState == state {
+		m.devicesMutex.Unlock()
+		return
+	}
+	oldState := record.LastState
+	record.LastState = state
+	m.dirty = true
+	if state.ReceivedAt.After(record.Presence.LastSeen) {
+		record.Presence.LastSeen = state.ReceivedAt
+	}
+	recovered := record.Presence.Status == StatusStale
+	if recovered {
+		record.Presence.Status = StatusOnline
+	}
+	meta := m.eventMeta(record, state.ReceivedAt)
+	m.devicesMutex.Unlock()
+
+	if recovered {
+		m.events.Publish(DeviceRecoveredEvent{meta})
+	}
+	m.events.Publish(StateChangedEvent{
+		EventMeta: meta,
+		Device:    d,
+		OldState:  oldState,
+		NewState:  state,
+		Changed:   changedProperties(oldState, state),
+	})
+}
+
+// eventMeta must be called with devicesMutex held
+func (m *BasicDeviceManager) eventMeta(record *DeviceRecord, at time.Time) EventMeta {
+	return EventMeta{Device: record.Id, Labels: maps.Clone(record.Labels), At: at}
+}
+
+// detach stops listening to the live device with the given id and closes it
+// unless it is being re-added. Must be called with devicesMutex held.
+func (m *BasicDeviceManager) detach(id string, replacement SimpleDevice) {
+	if cancel, ok := m.detachById[id]; ok {
+		cancel()
+		delete(m.detachById, id)
+	}
+
+	d, ok := m.devicesById[id]
+	if !ok || d == replacement {
+		return
+	}
+	delete(m.devicesById, id)
+	if closer, ok := d.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println("failed to close device", id, "error", err)
+		}
+	}
 }
 
 func (m *BasicDeviceManager) ListDevices() []SimpleDevice {
@@ -53,36 +308,265 @@ func (m *BasicDeviceManager) ListDevices() []SimpleDevice {
 	return util.Values(m.devicesById)
 }
 
-func (m *BasicDeviceManager) RemoveDevice(id string) {
+func (m *BasicDeviceManager) GetDevice(id string) (SimpleDevice, error) {
+	m.devicesMutex.RLock()
+	defer m.devicesMutex.RUnlock()
+	d, ok := m.devicesById[id]
+	if ok {
+		return d, nil
+	}
+	if _, ok := m.recordsById[id]; ok {
+		return nil, ErrDeviceOffline
+	}
+	return nil, ErrDeviceNotFound
+}
+
+func (m *BasicDeviceManager) ListDeviceRecords() []DeviceRecord {
+	m.devicesMutex.RLock()
+	defer m.devicesMutex.RUnlock()
+	return m.snapshotRecords()
+}
+
+func (m *BasicDeviceManager) GetDeviceRecord(id string) (DeviceRecord, error) {
+	m.devicesMutex.RLock()
+	defer m.devicesMutex.RUnlock()
+	r, ok := m.recordsById[id]
+	if !ok {
+		return DeviceRecord{}, ErrDeviceNotFound
+	}
+	return *r, nil
+}
+
+func (m *BasicDeviceManager) SetDeviceOffline(id string, reason string) error {
 	m.devicesMutex.Lock()
-	defer m.devicesMutex.Unlock()
-	delete(m.devicesById, id)
+	r, ok := m.recordsById[id]
+	if !ok {
+		m.devicesMutex.Unlock()
+		return ErrDeviceNotFound
+	}
+	if r.Presence.Status == StatusOffline {
+		m.devicesMutex.Unlock()
+		return nil
+	}
+	m.detach(id, nil)
+	now := time.Now()
+	r.markOffline(now, reason)
+	m.dirty = true
+	meta := m.eventMeta(r, now)
+	m.devicesMutex.Unlock()
+
+	m.events.Publish(DeviceDisconnectedEvent{meta, reason})
+	return nil
+}
+
+// MarkDeviceStale flags a connected device that stopped reporting state. The
+// device recovers with its next state report.
+func (m *BasicDeviceManager) MarkDeviceStale(id string, reason string) error {
+	m.devicesMutex.Lock()
+	r, ok := m.recordsById[id]
+	if !ok {
+		m.devicesMutex.Unlock()
+		return ErrDeviceNotFound
+	}
+	if r.Presence.Status != StatusOnline {
+		m.devicesMutex.Unlock()
+		return nil
+	}
+	r.Presence.Status = StatusStale
+	meta := m.eventMeta(r, time.Now())
+	lastSeen := r.Presence.LastSeen
+	m.devicesMutex.Unlock()
+
+	m.events.Publish(DeviceStaleEvent{meta, lastSeen, reason})
+	return nil
+}
+
+// SetDeviceLabels replaces the labels of a device.
+func (m *BasicDeviceManager) SetDeviceLabels(id string, labels map[string]string) error {
+	m.devicesMutex.Lock()
+	r, ok := m.recordsById[id]
+	if !ok {
+		m.devicesMutex.Unlock()
+		return ErrDeviceNotFound
+	}
+	r.Labels = maps.Clone(labels)
+	m.dirty = true
+	m.devicesMutex.Unlock()
+	return m.persist()
+}
+
+func (m *BasicDeviceManager) GetShadow(id string) (Shadow, error) {
+	m.devicesMutex.RLock()
+	defer m.devicesMutex.RUnlock()
+	r, ok := m.recordsById[id]
+	if !ok {
+		return Shadow{}, ErrDeviceNotFound
+	}
+	return newShadow(r), nil
+}
+
+// UpdateDesiredState merges update into the desired state of the device.
+// Properties set to nil are removed from the desired state.
+func (m *BasicDeviceManager) UpdateDesiredState(id string, update map[string]any) (Shadow, error) {
+	m.devicesMutex.Lock()
+	r, ok := m.recordsById[id]
+	if !ok {
+		m.devicesMutex.Unlock()
+		return Shadow{}, ErrDeviceNotFound
+	}
+	now := time.Now()
+	r.Desired.merge(update, now)
+	m.dirty = true
+	shadow := newShadow(r)
+	meta := m.eventMeta(r, now)
+	m.devicesMutex.Unlock()
+
+	err := m.persist()
+	m.events.Publish(DesiredStateChangedEvent{meta, maps.Clone(shadow.Desired), shadow.Version})
+	return shadow, err
+}
+
+// RemoveDevice decommissions the device, deleting its registry record.
+func (m *BasicDeviceManager) RemoveDevice(id string) error {
+	m.devicesMutex.Lock()
+	r, ok := m.recordsById[id]
+	if !ok {
+		m.devicesMutex.Unlock()
+		return ErrDeviceNotFound
+	}
+	m.detach(id, nil)
+	delete(m.recordsById, id)
+	delete(m.errorsById, id)
+	m.dirty = true
+	meta := m.eventMeta(r, time.Now())
+	m.devicesMutex.Unlock()
+
+	err := m.persist()
+	m.events.Publish(DeviceRemovedEvent{meta})
+	return err
+}
+
+func (m *BasicDeviceManager) SubscribeToEvents(ctx context.Context, filter EventFilter, opts SubscriptionOptions) *Subscription[Event] {
+	return m.events.Subscribe(ctx, filter, opts)
 }
 
-func (m *BasicDeviceManager) SubscribeToNewDeviceAdded() chan SimpleDevice {
-	m.subscribersMutex.Lock()
-	defer m.subscribersMutex.Unlock()
-	newStateChan := make(chan SimpleDevice)
-	m.deviceAddedChannels = append(m.deviceAddedChannels, newStateChan)
-	return newStateChan
+func (m *BasicDeviceManager) SubscribeToNewDeviceAdded(ctx context.Context, opts SubscriptionOptions) *Subscription[SimpleDevice] {
+	return SubscribeFunc(&m.events.events, ctx, opts, func(e Event) (SimpleDevice, bool) {
+		added, ok := e.(DeviceAddedEvent)
+		return added.Device, ok
+	})
 }
 
-func (m *BasicDeviceManager) SubscribeToStateChanges() chan SimpleDevice {
-	m.subscribersMutex.Lock()
-	defer m.subscribersMutex.Unlock()
-	newStateChangeChan := make(chan SimpleDevice)
-	m.stateChangeChannels = append(m.stateChangeChannels, newStateChangeChan)
-	return newStateChangeChan
+func (m *BasicDeviceManager) SubscribeToStateChanges(ctx context.Context, opts SubscriptionOptions) *Subscription[SimpleDevice] {
+	return SubscribeFunc(&m.events.events, ctx, opts, func(e Event) (SimpleDevice, bool) {
+		changed, ok := e.(StateChangedEvent)
+		return changed.Device, ok
+	})
 }
 
-func (m *BasicDeviceManager) SubscribeToErrors() chan error {
-	m.subscribersMutex.Lock()
-	defer m.subscribersMutex.Unlock()
-	newErrorChan := make(chan error)
-	m.errorChannels = append(m.errorChannels, newErrorChan)
-	return newErrorChan
+func (m *BasicDeviceManager) SubscribeToErrors(ctx context.Context, opts SubscriptionOptions) *Subscription[error] {
+	return SubscribeFunc(&m.events.events, ctx, opts, func(e Event) (error, bool) {
+		deviceErr, ok := e.(DeviceErrorEvent)
+		return deviceErr.Err, ok && deviceErr.Err != nil
+	})
+}
+
+// SendCommand sends a command and waits for its result until ctx is done. The
+// result is nil if the device doesn't confirm commands. A result that comes
+// after ctx is done is still published as a CommandResultEvent.
+func (m *BasicDeviceManager) SendCommand(ctx context.Context, deviceId string, command *Command) (*CommandResult, error) {
+	d, pending, err := m.prepareCommand(deviceId, command, true)
+	if err != nil {
+		return nil, err
+	}
+	result, err := m.deliverCommand(ctx, d, command)
+	if err != nil || result != nil || pending == nil {
+		return result, err
+	}
+
+	select {
+	case result := <-pending.result:
+		return result, nil
+	case <-ctx.Done():
+		m.pending.abandon(command.CorrelationId)
+		err := ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = ErrCommandTimeout
+		}
+		m.events.Publish(CommandFailedEvent{m.commandEventMeta(deviceId), *command, err.Error()})
+		return nil, err
+	}
 }
 
-func (m *BasicDeviceManager) SendCommand(deviceId string, command *Command) error {
-	return m.devicesById[deviceId].SendCommand(command)
+// AsyncCommandTimeout bounds the delivery of commands sent with SendCommandAsync.
+const AsyncCommandTimeout = time.Minute
+
+// SendCommandAsync validates a command and hands it off to the device without
+// waiting. Its result, if any, is published as a CommandResultEvent.
+func (m *BasicDeviceManager) SendCommandAsync(deviceId string, command *Command) error {
+	d, _, err := m.prepareCommand(deviceId, command, false)
+	if err != nil {
+		return err
+	}
+	sent := *command
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), AsyncCommandTimeout)
+		defer cancel()
+		if _, err := m.deliverCommand(ctx, d, &sent); err != nil {
+			log.Println("failed to send command", sent.Name, "to device", deviceId, "error", err)
+		}
+	}()
+	return nil
+}
+
+// prepareCommand validates a command and, if the device will report its
+// result, starts expecting it.
+func (m *BasicDeviceManager) prepareCommand(deviceId string, command *Command, wait bool) (SimpleDevice, *pendingCommand, error) {
+	d, err := m.GetDevice(deviceId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	specs, err := d.ListCommands()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ValidateCommand(specs, command); err != nil {
+		return nil, nil, err
+	}
+
+	if command.CorrelationId == "" {
+		command.CorrelationId = NewCorrelationId()
+	}
+	var pending *pendingCommand
+	if reporter, ok := d.(ResultReporter); ok && reporter.ReportsResult(command) {
+		pending = m.pending.add(deviceId, *command, wait)
+	}
+	return d, pending, nil
+}
+
+// deliverCommand sends a prepared command to the device and publishes the
+// result it answered with, if any, or its failure.
+func (m *BasicDeviceManager) deliverCommand(ctx context.Context, d SimpleDevice, command *Command) (*CommandResult, error) {
+	m.events.Publish(CommandSentEvent{m.commandEventMeta(d.Id()), *command})
+	result, err := d.SendCommand(ctx, command)
+	if err != nil || result != nil {
+		m.pending.remove(command.CorrelationId)
+	}
+	switch {
+	case err != nil:
+		m.events.Publish(CommandFailedEvent{m.commandEventMeta(d.Id()), *command, err.Error()})
+	case result != nil:
+		m.events.Publish(CommandResultEvent{m.commandEventMeta(d.Id()), *command, *result})
+	}
+	return result, err
+}
+
+func (m *BasicDeviceManager) commandEventMeta(deviceId string) EventMeta {
+	m.devicesMutex.RLock()
+	defer m.devicesMutex.RUnlock()
+	if r, ok := m.recordsById[deviceId]; ok {
+		return m.eventMeta(r, time.Now())
+	}
+	return EventMeta{Device: deviceId, At: time.Now()}
 }
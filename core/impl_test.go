@@ -2,6 +2,7 @@ package core
 
 import (
 	"cmp"
+	"context"
 	"math/rand/v2"
 	"slices"
 	"strconv"
@@ -25,23 +26,23 @@ func (d* EmptyDevice) Id() string {
 	return d.IdField
 }
 
-func (d* EmptyDevice) ListCommands() ([]Command, error) {
+func (d* EmptyDevice) ListCommands() ([]CommandSpec, error) {
 	return nil, nil
 }
 
-func (d* EmptyDevice) SendCommand(command *Command) error {
-	return nil
+func (d* EmptyDevice) SendCommand(ctx context.Context, command *Command) (*CommandResult, error) {
+	return nil, nil
 }
 
 func (d* EmptyDevice) GetState() *State {
 	return nil
 }
 
-func (d* EmptyDevice) SubcribeToStateChanges() (chan *State, error) {
+func (d* EmptyDevice) SubscribeToStateChanges(ctx context.Context, opts SubscriptionOptions) (*Subscription[*State], error) {
 	return nil, nil
 }
 
-func (d* EmptyDevice) SubcribeToErrorChanges() (chan error, error) {
+func (d* EmptyDevice) SubscribeToErrors(ctx context.Context, opts SubscriptionOptions) (*Subscription[error], error) {
 	return nil, nil
 }
 
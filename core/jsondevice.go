@@ -1,11 +1,14 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	mochi "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/packets"
@@ -17,92 +20,238 @@ type OnErrorCallback func(err error)
 type JsonCommDevice struct {
 	id string
 	mqttClient *mochi.Server
-	availableCommands []Command
+	publisher *mochi.Client
+	descriptor *Descriptor
+	codec Codec
 	stateTopic string
 	commandTopic string
+	resultTopic string
+	errorTopic string
 	state *State
-	subscriberIdCounter atomic.Uint32
-	subscribersMutex sync.RWMutex
-	stateChannels []chan *State
-	errorChannels []chan error
+	stateSubscriptionId int
+	resultSubscriptionId int
+	errorSubscriptionId int
+	stateMutex sync.RWMutex
+	states Broadcaster[*State]
+	errors Broadcaster[error]
+	results Broadcaster[*CommandResult]
 }
 
-func NewRelayDevice(mqttClient *mochi.Server, deviceId string, deviceCommand []Command) (*JsonCommDevice, error) {
+// subscriptionIds hands out inline subscription IDs. They must be unique per
+// topic filter, otherwise a replaced device would unsubscribe its successor.
+var subscriptionIds atomic.Int32
+
+func nextSubscriptionId() int {
+	return int(subscriptionIds.Add(1))
+}
+
+func NewJsonCommDevice(mqttClient *mochi.Server, deviceId string, descriptor *Descriptor) (*JsonCommDevice, error) {
 	
-	stateTopic := fmt.Sprintf("devices/%s/state", deviceId)
-	commandTopic := fmt.Sprintf("devices/%s/command", deviceId)
+	if descriptor == nil {
+		return nil, ErrInvalidDescriptor
+	}
+	codec, err := CodecFor(descriptor.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDescriptor, err)
+	}
+
+	topics := descriptor.Topics.Resolve(deviceId)
+	stateTopic := topics.State
+	commandTopic := topics.Command
+	resultTopic := topics.Result
+	errorTopic := topics.Error
+
+	// A dedicated inline client lets us attach MQTT 5 properties to published commands
+	publisher := mqttClient.NewClient(nil, "local", "fibers-"+deviceId, true)
+	publisher.Properties.ProtocolVersion = 5
 
 	dev := &JsonCommDevice{
 		id: deviceId,
 		mqttClient: mqttClient,
-		availableCommands: deviceCommand,
+		publisher: publisher,
+		descriptor: descriptor,
+		codec: codec,
 		stateTopic: stateTopic,
 		commandTopic: commandTopic,
-		state: &State{},
+		resultTopic: resultTopic,
+		errorTopic: errorTopic,
+		state: NewState(time.Now()),
+		stateSubscriptionId: nextSubscriptionId(),
+		resultSubscriptionId: nextSubscriptionId(),
+		errorSubscriptionId: nextSubscriptionId(),
 	}
 	
 	go func() {
 		// Subscribe to the divice's state filter and fanout the state to the subscribers
-		_ = mqttClient.Subscribe(stateTopic, int(dev.subscriberIdCounter.Add(1)), dev.fanoutState)
+		_ = mqttClient.Subscribe(stateTopic, dev.stateSubscriptionId, dev.fanoutState)
+		_ = mqttClient.Subscribe(resultTopic, dev.resultSubscriptionId, dev.receiveResult)
+		_ = mqttClient.Subscribe(errorTopic, dev.errorSubscriptionId, dev.receiveFault)
 	}()
 	
 	return dev, nil
 }
 
+// decode transcodes an incoming payload to JSON. An MQTT 5 content type takes
+// precedence over the encoding in the descriptor.
+func (d *JsonCommDevice) decode(pk packets.Packet) ([]byte, error) {
+	codec := d.codec
+	if pk.Properties.ContentType != "" {
+		var err error
+		if codec, err = CodecFor(pk.Properties.ContentType); err != nil {
+			return nil, err
+		}
+	}
+	return ToJSON(codec, pk.Payload)
+}
+
 func (d *JsonCommDevice) fanoutState(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
 	
-	stateProperties := make(map[string]string)
-	json.Unmarshal(pk.Payload, &stateProperties)
+	payload, err := d.decode(pk)
+	if err != nil {
+		log.Println("failed to decode state from client", cl.ID, "error", err)
+		d.errors.Publish(NewMalformedPayloadError(d.id, pk.TopicName, pk.Payload, err))
+		return
+	}
+	state, err := ParseState(payload, time.Now())
+	if err != nil {
+		log.Println("failed to parse state from client", cl.ID,
+			"topic", pk.TopicName,
+			"error", err)
+		d.errors.Publish(NewMalformedPayloadError(d.id, pk.TopicName, pk.Payload, err))
+		return
+	}
+	for name, p := range state.Properties {
+		if p.Unit == "" {
+			p.Unit = d.descriptor.PropertyUnit(name)
+			state.Properties[name] = p
+		}
+	}
 
 	log.Println("received message from client", cl.ID,
 		"subscriptionId", sub.Identifier,
 		"topic", pk.TopicName,
-		"state", stateProperties)
+		"state", state.Properties)
 	
-	d.subscribersMutex.RLock()
-	d.state = &State{stateProperties}
-	for _, c := range d.stateChannels {
-		go func() {
-			c <- d.state
-		}()
-	}
-	d.subscribersMutex.RUnlock()
+	d.stateMutex.Lock()
+	d.state = state
+	d.stateMutex.Unlock()
+	d.states.Publish(state)
 }
 
 func (d *JsonCommDevice) Id() string {
 	return d.id
 }
 
-func (d *JsonCommDevice) ListCommands() ([]Command, error) {
-	return d.availableCommands, nil
+func (d *JsonCommDevice) Descriptor() *Descriptor {
+	return d.descriptor
+}
+
+func (d *JsonCommDevice) ListCommands() ([]CommandSpec, error) {
+	return d.descriptor.Commands, nil
+}
+
+func (d *JsonCommDevice) receiveResult(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+	result := &CommandResult{}
+	payload, err := d.decode(pk)
+	if err == nil {
+		err = json.Unmarshal(payload, result)
+	}
+	if err != nil {
+		log.Println("failed to parse command result from client", cl.ID, "error", err)
+		d.errors.Publish(NewMalformedPayloadError(d.id, pk.TopicName, pk.Payload, err))
+		return
+	}
+
+	// MQTT 5 devices echo the correlation data, older ones put it in the payload
+	if len(pk.Properties.CorrelationData) > 0 {
+		result.CorrelationId = string(pk.Properties.CorrelationData)
+	}
+
+	d.results.Publish(result)
+}
+
+func (d *JsonCommDevice) receiveFault(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+	payload, err := d.decode(pk)
+	if err != nil {
+		log.Println("failed to decode fault from client", cl.ID, "error", err)
+		d.errors.Publish(NewMalformedPayloadError(d.id, pk.TopicName, pk.Payload, err))
+		return
+	}
+	fault, err := ParseFault(d.id, payload)
+	if err != nil {
+		log.Println("failed to parse fault from client", cl.ID, "error", err)
+		d.errors.Publish(NewMalformedPayloadError(d.id, pk.TopicName, pk.Payload, err))
+		return
+	}
+	fault.Topic = pk.TopicName
+	d.errors.Publish(fault)
 }
 
-func (d *JsonCommDevice) SendCommand(command *Command) error {
+func (d *JsonCommDevice) SendCommand(ctx context.Context, command *Command) (*CommandResult, error) {
+	if command.CorrelationId == "" {
+		command.CorrelationId = NewCorrelationId()
+	}
+
 	payload, err := json.Marshal(command)
+	if err == nil {
+		payload, err = FromJSON(d.codec, payload)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = d.mqttClient.Publish(d.commandTopic, payload, true, 0)
-	return err
+	err = d.mqttClient.InjectPacket(d.publisher, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: d.commandTopic,
+		Payload: payload,
+		Properties: packets.Properties{
+			ContentType: d.codec.ContentType(),
+			ResponseTopic: d.resultTopic,
+			CorrelationData: []byte(command.CorrelationId),
+		},
+	})
+	if err != nil {
+		deviceErr := NewDeviceError(d.id, ErrorPublishFailed, err)
+		deviceErr.Topic = d.commandTopic
+		d.errors.Publish(deviceErr)
+		return nil, deviceErr
+	}
+	return nil, nil
+}
+
+// ReportsResult is true for all commands, devices publish their results.
+func (d *JsonCommDevice) ReportsResult(command *Command) bool {
+	return true
+}
+
+func (d *JsonCommDevice) SubscribeToResults(ctx context.Context, opts SubscriptionOptions) (*Subscription[*CommandResult], error) {
+	return d.results.Subscribe(ctx, opts), nil
 }
 
 func (d *JsonCommDevice) GetState() *State {
+	d.stateMutex.RLock()
+	defer d.stateMutex.RUnlock()
 	return d.state
 }
 
-func (d *JsonCommDevice) SubcribeToStateChanges() (chan *State, error) {
-	d.subscribersMutex.Lock()
-	newStateChan := make(chan *State)
-	d.stateChannels = append(d.stateChannels, newStateChan)
-	d.subscribersMutex.Unlock()
-	return newStateChan, nil
+func (d *JsonCommDevice) SubscribeToStateChanges(ctx context.Context, opts SubscriptionOptions) (*Subscription[*State], error) {
+	return d.states.Subscribe(ctx, opts), nil
 }
 
-func (d *JsonCommDevice) SubcribeToErrorChanges() (chan error, error) {
-	d.subscribersMutex.Lock()
-	newErrorChan := make(chan error)
-	d.errorChannels = append(d.errorChannels, newErrorChan)
-	d.subscribersMutex.Unlock()
-	return newErrorChan, nil
+func (d *JsonCommDevice) SubscribeToErrors(ctx context.Context, opts SubscriptionOptions) (*Subscription[error], error) {
+	return d.errors.Subscribe(ctx, opts), nil
+}
+
+// Close detaches the device from the broker and closes all its subscriptions.
+func (d *JsonCommDevice) Close() error {
+	err := errors.Join(
+		d.mqttClient.Unsubscribe(d.stateTopic, d.stateSubscriptionId),
+		d.mqttClient.Unsubscribe(d.resultTopic, d.resultSubscriptionId),
+		d.mqttClient.Unsubscribe(d.errorTopic, d.errorSubscriptionId))
+	d.states.Close()
+	d.errors.Close()
+	d.results.Close()
+	return err
 }
@@ -1,18 +1,55 @@
 package core
 
+import "context"
+
 type DeviceManager interface {
 
 	AddDevice(d SimpleDevice) error
 
 	ListDevices() []SimpleDevice
 
-	RemoveDevice(id string)
+	GetDevice(id string) (SimpleDevice, error)
+
+	ListDeviceRecords() []DeviceRecord
+
+	GetDeviceRecord(id string) (DeviceRecord, error)
+
+	SetDeviceOffline(id string, reason string) error
+
+	MarkDeviceStale(id string, reason string) error
+
+	SetDeviceLabels(id string, labels map[string]string) error
+
+	GetShadow(id string) (Shadow, error)
 
-	SubscribeToNewDeviceAdded() chan SimpleDevice
+	UpdateDesiredState(id string, update map[string]any) (Shadow, error)
 
-	SubscribeToStateChanges() chan SimpleDevice
+	// ReportError records an error against a registered device and
+	// publishes it to the error subscribers.
+	ReportError(err *DeviceError)
+
+	ListDeviceErrors(id string) ([]DeviceError, error)
+
+	// RemoveDevice decommissions a device. It is the only way a device
+	// leaves the registry; disconnected devices are merely marked offline.
+	RemoveDevice(id string) error
+
+	// The subscriptions below end when ctx is done or when closed explicitly.
+
+	SubscribeToEvents(ctx context.Context, filter EventFilter, opts SubscriptionOptions) *Subscription[Event]
+
+	// SubscribeToNewDeviceAdded yields devices registered for the first time,
+	// not reconnecting ones.
+	SubscribeToNewDeviceAdded(ctx context.Context, opts SubscriptionOptions) *Subscription[SimpleDevice]
+
+	SubscribeToStateChanges(ctx context.Context, opts SubscriptionOptions) *Subscription[SimpleDevice]
 	
-	SubscribeToErrors() chan error
+	SubscribeToErrors(ctx context.Context, opts SubscriptionOptions) *Subscription[error]
+
+	// SendCommand waits for the result of the command until ctx is done.
+	SendCommand(ctx context.Context, deviceId string, command *Command) (*CommandResult, error)
 
-	SendCommand(deviceId string, command *Command) error
+	// SendCommandAsync hands a command off without waiting, its result is
+	// published as an event.
+	SendCommandAsync(deviceId string, command *Command) error
 }
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+)
+
+// PolledDevice is a device that is read periodically rather than reporting
+// its state by itself.
+type PolledDevice interface {
+	SimpleDevice
+	io.Closer
+	// Poll reads the device once and publishes its state.
+	Poll(ctx context.Context) error
+	PollInterval() time.Duration
+}
+
+// Poller registers the configured devices and polls them. Devices are closed
+// when they go offline, so one that answers again is registered anew.
+type Poller[C any] struct {
+	devMan    DeviceManager
+	kind      string
+	configs   []C
+	newDevice func(config C) (PolledDevice, error)
+}
+
+// NewPoller creates a poller for the devices of a transport, kind names the
+// transport in logs.
+func NewPoller[C any](devMan DeviceManager, kind string, configs []C,
+	newDevice func(config C) (PolledDevice, error)) *Poller[C] {
+	return &Poller[C]{devMan, kind, configs, newDevice}
+}
+
+// Start checks all configurations before registering any device.
+func (p *Poller[C]) Start(ctx context.Context) error {
+	devices := make([]PolledDevice, 0, len(p.configs))
+	for _, config := range p.configs {
+		dev, err := p.newDevice(config)
+		if err != nil {
+			return err
+		}
+		devices = append(devices, dev)
+	}
+
+	for i, dev := range devices {
+		if err := p.devMan.AddDevice(dev); err != nil {
+			return err
+		}
+		go p.poll(ctx, p.configs[i], dev)
+	}
+	return nil
+}
+
+// poll polls a device until ctx is done or the device is removed. A failing
+// device is reported once, when it starts failing; the watchdog takes it
+// offline if it keeps failing. The manager closes a device that goes offline,
+// so a new one is polled in its place and registered once it answers.
+func (p *Poller[C]) poll(ctx context.Context, config C, dev PolledDevice) {
+	ticker := time.NewTicker(dev.PollInterval())
+	defer ticker.Stop()
+	failing, offline := false, false
+	for {
+		record, err := p.devMan.GetDeviceRecord(dev.Id())
+		switch {
+		case errors.Is(err, ErrDeviceNotFound):
+			log.Println(p.kind, "device", dev.Id(), "was removed, stopped polling")
+			// The manager closed it, unless it wasn't registered again yet
+			dev.Close()
+			return
+		case err == nil && record.Presence.Status == StatusOffline && !offline:
+			replacement, err := p.newDevice(config)
+			if err != nil {
+				log.Println("Failed to create", p.kind, "device", dev.Id(), "- Error:", err)
+				if !wait(ctx, ticker) {
+					return
+				}
+				continue
+			}
+			dev.Close()
+			dev, offline = replacement, true
+		}
+
+		if err := dev.Poll(ctx); err != nil {
+			// Malformed states were reported as such by the device
+			if !failing && ctx.Err() == nil && !errors.Is(err, ErrInvalidState) {
+				log.Println("Failed to poll", p.kind, "device", dev.Id(), "-", err)
+				p.devMan.ReportError(NewDeviceError(dev.Id(), ErrorPollFailed, err))
+			}
+			failing = true
+		} else {
+			failing = false
+			if offline {
+				// The device answered, register it again
+				if err := p.devMan.AddDevice(dev); err != nil {
+					log.Println("Failed to add", p.kind, "device", dev.Id(), "- Error:", err)
+				} else {
+					offline = false
+				}
+			}
+		}
+
+		if !wait(ctx, ticker) {
+			dev.Close()
+			return
+		}
+	}
+}
+
+// wait waits for the next tick, it is false if ctx is done first.
+func wait(ctx context.Context, ticker *time.Ticker) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-ticker.C:
+		return true
+	}
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// polledDevice answers its polls while reachable is set and counts the polls
+// made after it was closed.
+type polledDevice struct {
+	EmptyDevice
+	reachable   *atomic.Bool
+	mutex       sync.Mutex
+	closed      bool
+	closedPolls int
+}
+
+func (d *polledDevice) PollInterval() time.Duration { return 5 * time.Millisecond }
+
+func (d *polledDevice) Poll(ctx context.Context) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		d.closedPolls++
+	}
+	if !d.reachable.Load() {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+func (d *polledDevice) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.closed = true
+	return nil
+}
+
+func (d *polledDevice) status() (bool, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.closed, d.closedPolls
+}
+
+func TestPollerReplacesOfflineDevices(t *testing.T) {
+	devMan := NewBasicDeviceManager()
+	reachable := &atomic.Bool{}
+	reachable.Store(true)
+	created := make(chan *polledDevice, 10)
+	poller := NewPoller(devMan, "test", []string{"meter"}, func(id string) (PolledDevice, error) {
+		dev := &polledDevice{EmptyDevice: EmptyDevice{IdField: id}, reachable: reachable}
+		created <- dev
+		return dev, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := SubscribeEvents[DeviceErrorEvent](&devMan.events, ctx, EventFilter{}, SubscriptionOptions{})
+	if err := poller.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := <-created
+
+	// The device stops answering and the watchdog takes it offline
+	reachable.Store(false)
+	<-errs.C()
+	connected := SubscribeEvents[DeviceConnectedEvent](&devMan.events, ctx, EventFilter{}, SubscriptionOptions{})
+	devMan.SetDeviceOffline("meter", "test")
+	var second *polledDevice
+	select {
+	case second = <-created:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a new device to be polled")
+	}
+	if len(connected.C()) > 0 {
+		t.Fatal("Expected the new device to be registered only once it answers")
+	}
+
+	reachable.Store(true)
+	select {
+	case <-connected.C():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the new device to be registered")
+	}
+	if dev, _ := devMan.GetDevice("meter"); dev != second {
+		t.Fatal("Expected the new device to be registered, but got", dev)
+	}
+	if closed, polls := first.status(); !closed || polls > 0 {
+		t.Fatal("Expected the first device to be closed and left alone, but got", closed, polls)
+	}
+}
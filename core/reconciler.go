@@ -0,0 +1,191 @@
+package core
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+type ReconcilerOptions struct {
+	// CommandTimeout bounds how long to wait for a device to execute a setter command.
+	CommandTimeout time.Duration
+	// RetryInterval is the initial delay before an unconverged property is
+	// retried. It doubles with every failed attempt up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+}
+
+func (o *ReconcilerOptions) setDefaults() {
+	if o.CommandTimeout <= 0 {
+		o.CommandTimeout = 10 * time.Second
+	}
+	if o.RetryInterval <= 0 {
+		o.RetryInterval = 5 * time.Second
+	}
+	if o.MaxRetryInterval <= 0 {
+		o.MaxRetryInterval = 5 * time.Minute
+	}
+}
+
+type attempt struct {
+	value    any
+	at       time.Time
+	failures int
+}
+
+// Reconciler sends setter commands to devices until their reported state
+// matches the desired state of their shadow.
+type Reconciler struct {
+	devices DeviceManager
+	opts    ReconcilerOptions
+	mutex   sync.Mutex
+	// attempts tracks the last command per device and property
+	attempts map[string]map[string]*attempt
+	busy     map[string]bool
+}
+
+func NewReconciler(devices DeviceManager, opts ReconcilerOptions) *Reconciler {
+	opts.setDefaults()
+	return &Reconciler{
+		devices:  devices,
+		opts:     opts,
+		attempts: make(map[string]map[string]*attempt),
+		busy:     make(map[string]bool),
+	}
+}
+
+// Run reconciles devices whenever their state, desired state or connection
+// changes, and retries unconverged devices periodically, until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	sub := r.devices.SubscribeToEvents(ctx, EventFilter{
+		Types: []EventType{EventStateChanged, EventDesiredStateChanged, EventDeviceConnected, EventDeviceRemoved},
+	}, SubscriptionOptions{BufferSize: 256, Overflow: OverflowDropOldest})
+	defer sub.Close()
+
+	ticker := time.NewTicker(r.opts.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			switch e.Type() {
+			case EventDeviceRemoved:
+				r.forget(e.DeviceId())
+				continue
+			case EventDeviceConnected, EventDesiredStateChanged:
+				// Give the device a fresh start instead of waiting out the backoff
+				r.forget(e.DeviceId())
+			}
+			r.trigger(ctx, e.DeviceId())
+		case <-ticker.C:
+			for _, record := range r.devices.ListDeviceRecords() {
+				if record.Presence.Status == StatusOnline && len(record.Desired.Properties) > 0 {
+					r.trigger(ctx, record.Id)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Reconciler) forget(deviceId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.attempts, deviceId)
+}
+
+// trigger reconciles the device in the background unless that's already happening.
+func (r *Reconciler) trigger(ctx context.Context, deviceId string) {
+	r.mutex.Lock()
+	if r.busy[deviceId] {
+		r.mutex.Unlock()
+		return
+	}
+	r.busy[deviceId] = true
+	r.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			r.mutex.Lock()
+			delete(r.busy, deviceId)
+			r.mutex.Unlock()
+		}()
+		r.Reconcile(ctx, deviceId)
+	}()
+}
+
+// Reconcile sends the setter commands needed to converge one device.
+// Properties without a setter are left alone.
+func (r *Reconciler) Reconcile(ctx context.Context, deviceId string) {
+	shadow, err := r.devices.GetShadow(deviceId)
+	if err != nil || len(shadow.Delta) == 0 {
+		r.forget(deviceId)
+		return
+	}
+
+	record, err := r.devices.GetDeviceRecord(deviceId)
+	if err != nil || record.Presence.Status != StatusOnline || record.Descriptor == nil {
+		return
+	}
+
+	for name, value := range shadow.Delta {
+		spec, ok := record.Descriptor.Property(name)
+		if !ok || spec.Setter == nil || !r.due(deviceId, name, value) {
+			continue
+		}
+
+		cmdCtx, cancel := context.WithTimeout(ctx, r.opts.CommandTimeout)
+		result, err := r.devices.SendCommand(cmdCtx, deviceId, &Command{
+			Name: spec.Setter.Command,
+			Args: map[string]any{spec.Setter.Arg: value},
+		})
+		cancel()
+
+		if err == nil && result != nil && !result.Success {
+			err = &CommandFailedError{Result: *result}
+		}
+		if err != nil {
+			log.Println("failed to reconcile", name, "of device", deviceId, "error", err)
+		}
+		r.record(deviceId, name, value, err)
+	}
+}
+
+// due reports whether the property should be (re)sent now. A command that
+// succeeded still counts as an attempt, the device gets until the next retry
+// to report the new value.
+func (r *Reconciler) due(deviceId, property string, value any) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	a, ok := r.attempts[deviceId][property]
+	if !ok || !sameValue(a.value, value) {
+		return true
+	}
+
+	backoff := r.opts.RetryInterval << min(a.failures, 16)
+	return time.Since(a.at) >= min(backoff, r.opts.MaxRetryInterval)
+}
+
+func (r *Reconciler) record(deviceId, property string, value any, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.attempts[deviceId] == nil {
+		r.attempts[deviceId] = make(map[string]*attempt)
+	}
+	a, ok := r.attempts[deviceId][property]
+	if !ok || !sameValue(a.value, value) {
+		a = &attempt{value: value}
+		r.attempts[deviceId][property] = a
+	}
+	a.at = time.Now()
+	if err != nil {
+		a.failures++
+	} else {
+		a.failures = 0
+	}
+}
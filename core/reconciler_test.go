@@ -0,0 +1,65 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// setterDevice executes set_voltage commands and remembers them
+type setterDevice struct {
+	EmptyDevice
+	mutex    sync.Mutex
+	commands []Command
+}
+
+func (d *setterDevice) Descriptor() *Descriptor {
+	return &Descriptor{
+		Model:    "test",
+		Commands: d.commandSpecs(),
+		Properties: []PropertySpec{
+			{Name: "voltage", Type: TypeNumber, Setter: &PropertySetter{Command: "set_voltage", Arg: "volts"}},
+			{Name: "current", Type: TypeNumber},
+		},
+	}
+}
+
+func (d *setterDevice) commandSpecs() []CommandSpec {
+	return []CommandSpec{{Name: "set_voltage", Args: []ArgSpec{{Name: "volts", Type: ArgNumber, Required: true}}}}
+}
+
+func (d *setterDevice) ListCommands() ([]CommandSpec, error) {
+	return d.commandSpecs(), nil
+}
+
+func (d *setterDevice) SendCommand(ctx context.Context, command *Command) (*CommandResult, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.commands = append(d.commands, *command)
+	return &CommandResult{CorrelationId: command.CorrelationId, Success: true}, nil
+}
+
+func TestReconcileSendsSetterCommands(t *testing.T) {
+	devManager := NewBasicDeviceManager()
+	dev := &setterDevice{EmptyDevice: EmptyDevice{"psu1"}}
+	devManager.AddDevice(dev)
+
+	shadow, err := devManager.UpdateDesiredState("psu1", map[string]any{"voltage": 12.0, "current": 1.0})
+	if err != nil || len(shadow.Delta) != 2 {
+		t.Fatal("Expected a delta of 2 properties, but got", shadow.Delta, err)
+	}
+
+	reconciler := NewReconciler(devManager, ReconcilerOptions{})
+	reconciler.Reconcile(context.Background(), "psu1")
+	// Not due again until the retry interval passes
+	reconciler.Reconcile(context.Background(), "psu1")
+
+	if len(dev.commands) != 1 || dev.commands[0].Name != "set_voltage" || dev.commands[0].Args["volts"] != 12.0 {
+		t.Fatal("Expected a single set_voltage 12 command, but got", dev.commands)
+	}
+
+	shadow, _ = devManager.UpdateDesiredState("psu1", map[string]any{"voltage": nil, "current": nil})
+	if len(shadow.Desired) != 0 || len(shadow.Delta) != 0 {
+		t.Fatal("Expected an empty shadow, but got", shadow)
+	}
+}
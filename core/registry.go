@@ -0,0 +1,118 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type ConnectionStatus string
+
+const (
+	StatusOnline ConnectionStatus = "online"
+	// StatusStale is a connected device that stopped reporting state.
+	StatusStale   ConnectionStatus = "stale"
+	StatusOffline ConnectionStatus = "offline"
+)
+
+var ErrDeviceOffline = errors.New("device is offline")
+
+type Presence struct {
+	Status           ConnectionStatus `json:"status"`
+	LastSeen         time.Time        `json:"lastSeen"`
+	ConnectedAt      *time.Time       `json:"connectedAt,omitempty"`
+	DisconnectedAt   *time.Time       `json:"disconnectedAt,omitempty"`
+	DisconnectReason string           `json:"disconnectReason,omitempty"`
+}
+
+// DeviceRecord is the registry entry of a device. It outlives the device's
+// connection and is only deleted when the device is decommissioned.
+type DeviceRecord struct {
+	Id           string            `json:"id"`
+	Descriptor   *Descriptor       `json:"descriptor,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Presence     Presence          `json:"presence"`
+	LastState    *State            `json:"lastState,omitempty"`
+	Desired      DesiredState      `json:"desired"`
+	RegisteredAt time.Time         `json:"registeredAt"`
+}
+
+func (r *DeviceRecord) markOnline(now time.Time) {
+	r.Presence = Presence{
+		Status:      StatusOnline,
+		LastSeen:    now,
+		ConnectedAt: &now,
+	}
+}
+
+func (r *DeviceRecord) markOffline(now time.Time, reason string) {
+	r.Presence.Status = StatusOffline
+	r.Presence.DisconnectedAt = &now
+	r.Presence.DisconnectReason = reason
+}
+
+// Store persists a collection as a whole.
+type Store[T any] interface {
+	Load() ([]T, error)
+	Save(items []T) error
+}
+
+type DeviceStore = Store[DeviceRecord]
+
+// FileStore keeps a collection as a single JSON file.
+type FileStore[T any] struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewFileStore[T any](path string) *FileStore[T] {
+	return &FileStore[T]{path: path}
+}
+
+func NewFileDeviceStore(path string) *FileStore[DeviceRecord] {
+	return NewFileStore[DeviceRecord](path)
+}
+
+func (s *FileStore[T]) Load() ([]T, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]T, 0)
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (s *FileStore[T]) Save(items []T) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces path with data without ever leaving a partially
+// written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
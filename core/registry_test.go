@@ -0,0 +1,69 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryStore struct {
+	mutex sync.Mutex
+	saves int
+	items []DeviceRecord
+}
+
+func (s *memoryStore) Load() ([]DeviceRecord, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) Save(items []DeviceRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.saves++
+	s.items = items
+	return nil
+}
+
+func (s *memoryStore) saved() (int, []DeviceRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saves, s.items
+}
+
+func TestRegistryPersistsLastState(t *testing.T) {
+	store := &memoryStore{}
+	devManager, _ := NewPersistentDeviceManager(store)
+	dev := &reportingDevice{EmptyDevice: EmptyDevice{IdField: "psu1"}}
+	devManager.AddDevice(dev)
+	if saves, items := store.saved(); saves != 1 || len(items) != 1 {
+		t.Fatal("Expected a new device to be written right away, but got", saves, items)
+	}
+
+	// Reconnects and state reports are written on the next tick
+	devManager.AddDevice(dev)
+	state := NewState(time.Now())
+	state.Set("voltage", 12.0, "V")
+	dev.states.Publish(state)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go devManager.PersistEvery(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, items := store.saved(); len(items) == 1 && items[0].LastState != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the last state to be persisted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Nothing changed, nothing is written
+	saves, _ := store.saved()
+	time.Sleep(50 * time.Millisecond)
+	if again, _ := store.saved(); again != saves {
+		t.Fatal("Expected no writes without changes, but got", again-saves)
+	}
+}
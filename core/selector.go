@@ -0,0 +1,156 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type selectorOp int
+
+const (
+	opEquals selectorOp = iota
+	opNotEquals
+	opIn
+	opNotIn
+	opExists
+	opNotExists
+)
+
+type requirement struct {
+	key    string
+	op     selectorOp
+	values []string
+}
+
+// Selector is a label query such as "site=sofia,rack in (r1,r2),!maintenance".
+// Requirements are separated by commas and must all hold. A bare key matches
+// devices that have the label, whatever its value, so a label with an empty
+// value serves as a plain tag.
+type Selector struct {
+	requirements []requirement
+}
+
+var ErrInvalidSelector = errors.New("invalid selector")
+
+func ParseSelector(s string) (Selector, error) {
+	selector := Selector{}
+	for _, part := range splitRequirements(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		req, err := parseRequirement(part)
+		if err != nil {
+			return Selector{}, fmt.Errorf("%w: %q: %v", ErrInvalidSelector, part, err)
+		}
+		selector.requirements = append(selector.requirements, req)
+	}
+	return selector, nil
+}
+
+// splitRequirements splits on commas that are not inside a value list.
+func splitRequirements(s string) []string {
+	parts := make([]string, 0)
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseRequirement(s string) (requirement, error) {
+	req, err := parseOperator(s)
+	switch {
+	case err != nil:
+	case req.key == "":
+		err = errors.New("missing key")
+	case strings.ContainsAny(req.key, "=!() \t"):
+		err = fmt.Errorf("invalid key %q", req.key)
+	}
+	return req, err
+}
+
+func parseOperator(s string) (requirement, error) {
+	if key, ok := strings.CutPrefix(s, "!"); ok {
+		return requirement{key: strings.TrimSpace(key), op: opNotExists}, nil
+	}
+	if key, value, ok := strings.Cut(s, "!="); ok {
+		return requirement{key: strings.TrimSpace(key), op: opNotEquals, values: []string{strings.TrimSpace(value)}}, nil
+	}
+	if key, value, ok := strings.Cut(s, "="); ok {
+		value = strings.TrimPrefix(value, "=")
+		return requirement{key: strings.TrimSpace(key), op: opEquals, values: []string{strings.TrimSpace(value)}}, nil
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) == 1 {
+		return requirement{key: fields[0], op: opExists}, nil
+	}
+	if len(fields) < 3 || (fields[1] != "in" && fields[1] != "notin") {
+		return requirement{}, errors.New("expected key, key=value, key!=value, key in (...) or key notin (...)")
+	}
+
+	list := strings.TrimSpace(strings.Join(fields[2:], " "))
+	if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+		return requirement{}, errors.New("values must be enclosed in parentheses")
+	}
+	values := make([]string, 0)
+	for _, v := range strings.Split(list[1:len(list)-1], ",") {
+		values = append(values, strings.TrimSpace(v))
+	}
+
+	op := opIn
+	if fields[1] == "notin" {
+		op = opNotIn
+	}
+	return requirement{key: fields[0], op: op, values: values}, nil
+}
+
+func (s Selector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s.requirements {
+		value, hasLabel := labels[req.key]
+		switch req.op {
+		case opEquals:
+			if !hasLabel || value != req.values[0] {
+				return false
+			}
+		case opNotEquals:
+			if hasLabel && value == req.values[0] {
+				return false
+			}
+		case opIn:
+			if !hasLabel || !slices.Contains(req.values, value) {
+				return false
+			}
+		case opNotIn:
+			if hasLabel && slices.Contains(req.values, value) {
+				return false
+			}
+		case opExists:
+			if !hasLabel {
+				return false
+			}
+		case opNotExists:
+			if hasLabel {
+				return false
+			}
+		}
+	}
+	return true
+}
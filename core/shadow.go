@@ -0,0 +1,83 @@
+package core
+
+import (
+	"maps"
+	"reflect"
+	"time"
+)
+
+// Shadow pairs the state a device should be in with the state it last
+// reported. Delta holds the desired values that have not been reached yet.
+type Shadow struct {
+	DeviceId  string         `json:"deviceId"`
+	Desired   map[string]any `json:"desired"`
+	Reported  map[string]any `json:"reported"`
+	Delta     map[string]any `json:"delta"`
+	Version   int64          `json:"version"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+type DesiredStateChangedEvent struct {
+	EventMeta
+	Desired map[string]any `json:"desired"`
+	Version int64          `json:"version"`
+}
+
+func (DesiredStateChangedEvent) Type() EventType { return EventDesiredStateChanged }
+
+func newShadow(r *DeviceRecord) Shadow {
+	shadow := Shadow{
+		DeviceId:  r.Id,
+		Desired:   maps.Clone(r.Desired.Properties),
+		Reported:  make(map[string]any),
+		Delta:     make(map[string]any),
+		Version:   r.Desired.Version,
+		UpdatedAt: r.Desired.UpdatedAt,
+	}
+	if shadow.Desired == nil {
+		shadow.Desired = make(map[string]any)
+	}
+	if r.LastState != nil {
+		for name, p := range r.LastState.Properties {
+			shadow.Reported[name] = p.Value
+		}
+		if r.LastState.ReceivedAt.After(shadow.UpdatedAt) {
+			shadow.UpdatedAt = r.LastState.ReceivedAt
+		}
+	}
+
+	for name, desired := range shadow.Desired {
+		reported, ok := shadow.Reported[name]
+		if !ok || !sameValue(desired, reported) {
+			shadow.Delta[name] = desired
+		}
+	}
+	return shadow
+}
+
+func sameValue(a, b any) bool {
+	return valuesEqual(a, b) || reflect.DeepEqual(a, b)
+}
+
+// DesiredState is the persisted half of a device shadow.
+type DesiredState struct {
+	Properties map[string]any `json:"properties,omitempty"`
+	Version    int64          `json:"version"`
+	UpdatedAt  time.Time      `json:"updatedAt"`
+}
+
+// merge applies a partial update. A nil value removes the property.
+func (d *DesiredState) merge(update map[string]any, now time.Time) {
+	if d.Properties == nil {
+		d.Properties = make(map[string]any)
+	}
+	for name, value := range update {
+		if value == nil {
+			delete(d.Properties, name)
+		} else {
+			d.Properties[name] = value
+		}
+	}
+	d.Version++
+	d.UpdatedAt = now
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type ValueType string
+
+const (
+	TypeNull   ValueType = "null"
+	TypeNumber ValueType = "number"
+	TypeBool   ValueType = "bool"
+	TypeString ValueType = "string"
+	TypeObject ValueType = "object"
+	TypeArray  ValueType = "array"
+)
+
+// TypeOf reports the state value type of v. Values are expected to be in the
+// shape produced by encoding/json when decoding into an interface{}.
+func TypeOf(v any) ValueType {
+	switch v.(type) {
+	case nil:
+		return TypeNull
+	case float64, float32, int, int32, int64, uint, uint32, uint64:
+		return TypeNumber
+	case bool:
+		return TypeBool
+	case string:
+		return TypeString
+	case map[string]any:
+		return TypeObject
+	case []any:
+		return TypeArray
+	}
+	return TypeNull
+}
+
+type Property struct {
+	Value any       `json:"value"`
+	Type  ValueType `json:"type"`
+	Unit  string    `json:"unit,omitempty"`
+}
+
+type State struct {
+	Properties map[string]Property `json:"properties"`
+	// ReportedAt is the timestamp the device put in the payload, if any.
+	ReportedAt *time.Time `json:"reportedAt,omitempty"`
+	// ReceivedAt is the time the server received the payload.
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+func NewState(receivedAt time.Time) *State {
+	return &State{
+		Properties: make(map[string]Property),
+		ReceivedAt: receivedAt,
+	}
+}
+
+func (s *State) Set(name string, value any, unit string) {
+	s.Properties[name] = Property{Value: value, Type: TypeOf(value), Unit: unit}
+}
+
+func (s *State) Get(name string) (Property, bool) {
+	if s == nil {
+		return Property{}, false
+	}
+	p, ok := s.Properties[name]
+	return p, ok
+}
+
+var ErrInvalidState = errors.New("invalid state payload")
+
+// stateEnvelope is the extended state payload format. Devices that don't need
+// timestamps or units can publish a flat JSON object of properties instead.
+type stateEnvelope struct {
+	Timestamp  json.RawMessage   `json:"timestamp"`
+	Properties map[string]any    `json:"properties"`
+	Units      map[string]string `json:"units"`
+}
+
+// ParseState decodes a JSON state payload. Two forms are accepted:
+//
+//	{"voltage": 12.1, "output": true}
+//	{"timestamp": "2024-05-01T10:00:00Z", "properties": {"voltage": 12.1}, "units": {"voltage": "V"}}
+//
+// The timestamp may be an RFC 3339 string or Unix milliseconds.
+func ParseState(payload []byte, receivedAt time.Time) (*State, error) {
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+
+	state := NewState(receivedAt)
+	if props, ok := raw["properties"]; ok && bytes.HasPrefix(bytes.TrimSpace(props), []byte("{")) {
+		env := stateEnvelope{}
+		if err := json.Unmarshal(payload, &env); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+		}
+		for name, value := range env.Properties {
+			state.Set(name, value, env.Units[name])
+		}
+		if len(env.Timestamp) > 0 {
+			ts, err := parseTimestamp(env.Timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+			}
+			state.ReportedAt = &ts
+		}
+		return state, nil
+	}
+
+	for name, rawValue := range raw {
+		var value any
+		if err := json.Unmarshal(rawValue, &value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+		}
+		state.Set(name, value, "")
+	}
+	return state, nil
+}
+
+func parseTimestamp(raw json.RawMessage) (time.Time, error) {
+	var millis int64
+	if err := json.Unmarshal(raw, &millis); err == nil {
+		return time.UnixMilli(millis).UTC(), nil
+	}
+
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return time.Time{}, fmt.Errorf("unsupported timestamp %s", raw)
+	}
+	return time.Parse(time.RFC3339Nano, str)
+}
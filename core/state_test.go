@@ -0,0 +1,65 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseFlatState(t *testing.T) {
+	received := time.Now()
+	state, err := ParseState([]byte(`{"voltage": 12.5, "output": true, "mode": "cv", "channels": [{"v": 1}], "meta": {"fw": "1.0"}}`), received)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	expectedTypes := map[string]ValueType{
+		"voltage":  TypeNumber,
+		"output":   TypeBool,
+		"mode":     TypeString,
+		"channels": TypeArray,
+		"meta":     TypeObject,
+	}
+	for name, expected := range expectedTypes {
+		p, ok := state.Get(name)
+		if !ok || p.Type != expected {
+			t.Fatal("Expected property", name, "of type", expected, ", but got", p)
+		}
+	}
+
+	if state.ReportedAt != nil || !state.ReceivedAt.Equal(received) {
+		t.Fatal("Unexpected timestamps", state.ReportedAt, state.ReceivedAt)
+	}
+}
+
+func TestParseStateEnvelope(t *testing.T) {
+	payload := []byte(`{"timestamp": 1714557600000, "properties": {"voltage": 230.4}, "units": {"voltage": "V"}}`)
+	state, err := ParseState(payload, time.Now())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	p, _ := state.Get("voltage")
+	if p.Value != 230.4 || p.Unit != "V" {
+		t.Fatal("Expected 230.4 V, but got", p)
+	}
+	if state.ReportedAt == nil || state.ReportedAt.UnixMilli() != 1714557600000 {
+		t.Fatal("Expected reported timestamp, but got", state.ReportedAt)
+	}
+
+	out, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	decoded := State{}
+	json.Unmarshal(out, &decoded)
+	if decoded.Properties["voltage"].Unit != "V" || decoded.Properties["voltage"].Value != 230.4 {
+		t.Fatal("State did not survive serialization:", string(out))
+	}
+}
+
+func TestParseInvalidState(t *testing.T) {
+	if _, err := ParseState([]byte(`[1, 2]`), time.Now()); err == nil {
+		t.Fatal("Expected an error for a non-object payload")
+	}
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens when a subscriber's buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest buffered message to make room.
+	// It is the default, a slow subscriber never holds up the publisher.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowBlock makes the publisher wait until the subscriber catches up
+	// or goes away. Every other subscriber waits along with it.
+	OverflowBlock
+	// OverflowDropNewest discards the message being published.
+	OverflowDropNewest
+	// OverflowDisconnect closes the subscription.
+	OverflowDisconnect
+)
+
+const DefaultSubscriptionBuffer = 16
+
+type SubscriptionOptions struct {
+	BufferSize int
+	Overflow   OverflowPolicy
+}
+
+// Subscription is a bounded stream of messages. The channel returned by C is
+// closed once the subscription is closed, either explicitly, through its
+// context, by the overflow policy or because the publisher went away.
+type Subscription[T any] struct {
+	ch        chan T
+	done      chan struct{}
+	overflow  OverflowPolicy
+	mutex     sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+	onClose   func()
+	dropped   atomic.Uint64
+}
+
+func newSubscription[T any](opts SubscriptionOptions) *Subscription[T] {
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultSubscriptionBuffer
+	}
+	return &Subscription[T]{
+		ch:       make(chan T, size),
+		done:     make(chan struct{}),
+		overflow: opts.Overflow,
+	}
+}
+
+func (s *Subscription[T]) C() <-chan T {
+	return s.ch
+}
+
+func (s *Subscription[T]) Done() <-chan struct{} {
+	return s.done
+}
+
+// Dropped returns how many messages were discarded by the overflow policy.
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription[T]) Close() {
+	s.closeOnce.Do(func() {
+		// Closing done first releases a publisher blocked in deliver
+		close(s.done)
+		s.mutex.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mutex.Unlock()
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+}
+
+func (s *Subscription[T]) deliver(v T) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+
+	disconnect := false
+	switch s.overflow {
+	case OverflowBlock:
+		select {
+		case s.ch <- v:
+		case <-s.done:
+		}
+	case OverflowDropNewest:
+		select {
+		case s.ch <- v:
+		default:
+			s.dropped.Add(1)
+		}
+	case OverflowDropOldest:
+		for sent := false; !sent; {
+			select {
+			case s.ch <- v:
+				sent = true
+			default:
+				select {
+				case <-s.ch:
+					s.dropped.Add(1)
+				default:
+				}
+			}
+		}
+	case OverflowDisconnect:
+		select {
+		case s.ch <- v:
+		default:
+			disconnect = true
+		}
+	}
+	s.mutex.Unlock()
+
+	if disconnect {
+		s.Close()
+	}
+}
+
+// Broadcaster fans messages out to any number of subscriptions. The zero value
+// is ready to use.
+type Broadcaster[T any] struct {
+	mutex     sync.RWMutex
+	receivers map[any]func(T)
+	closers   map[any]func()
+	closed    bool
+}
+
+func (b *Broadcaster[T]) Subscribe(ctx context.Context, opts SubscriptionOptions) *Subscription[T] {
+	return SubscribeFunc(b, ctx, opts, func(v T) (T, bool) {
+		return v, true
+	})
+}
+
+// SubscribeFunc subscribes to b, converting every message with fn. Messages
+// for which fn returns false are skipped.
+func SubscribeFunc[T, U any](b *Broadcaster[T], ctx context.Context, opts SubscriptionOptions,
+	fn func(T) (U, bool)) *Subscription[U] {
+
+	sub := newSubscription[U](opts)
+	sub.onClose = func() {
+		b.remove(sub)
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		sub.Close()
+		return sub
+	}
+	if b.receivers == nil {
+		b.receivers = make(map[any]func(T))
+		b.closers = make(map[any]func())
+	}
+	b.receivers[sub] = func(v T) {
+		if u, ok := fn(v); ok {
+			sub.deliver(u)
+		}
+	}
+	b.closers[sub] = sub.Close
+	b.mutex.Unlock()
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				sub.Close()
+			case <-sub.done:
+			}
+		}()
+	}
+	return sub
+}
+
+func (b *Broadcaster[T]) remove(key any) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.receivers, key)
+	delete(b.closers, key)
+}
+
+func (b *Broadcaster[T]) Publish(v T) {
+	b.mutex.RLock()
+	receivers := make([]func(T), 0, len(b.receivers))
+	for _, r := range b.receivers {
+		receivers = append(receivers, r)
+	}
+	b.mutex.RUnlock()
+
+	for _, r := range receivers {
+		r(v)
+	}
+}
+
+// Len returns the number of open subscriptions.
+func (b *Broadcaster[T]) Len() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return len(b.receivers)
+}
+
+// Close closes all subscriptions. Subscribing afterwards yields closed
+// subscriptions.
+func (b *Broadcaster[T]) Close() {
+	b.mutex.Lock()
+	b.closed = true
+	closers := make([]func(), 0, len(b.closers))
+	for _, c := range b.closers {
+		closers = append(closers, c)
+	}
+	b.mutex.Unlock()
+
+	for _, c := range closers {
+		c()
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func drain[T any](sub *Subscription[T]) []T {
+	values := make([]T, 0)
+	for {
+		select {
+		case v, ok := <-sub.C():
+			if !ok {
+				return values
+			}
+			values = append(values, v)
+		default:
+			return values
+		}
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	b := Broadcaster[int]{}
+	dropOldest := b.Subscribe(context.Background(), SubscriptionOptions{BufferSize: 2, Overflow: OverflowDropOldest})
+	dropNewest := b.Subscribe(context.Background(), SubscriptionOptions{BufferSize: 2, Overflow: OverflowDropNewest})
+	disconnect := b.Subscribe(context.Background(), SubscriptionOptions{BufferSize: 2, Overflow: OverflowDisconnect})
+	byDefault := b.Subscribe(context.Background(), SubscriptionOptions{BufferSize: 2})
+
+	for i := range 4 {
+		b.Publish(i)
+	}
+
+	if got := drain(dropOldest); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatal("Expected [2 3] from drop-oldest, but got", got)
+	}
+	if got := drain(byDefault); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatal("Expected subscriptions to drop the oldest by default, but got", got)
+	}
+	if got := drain(dropNewest); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatal("Expected [0 1] from drop-newest, but got", got)
+	}
+	if dropNewest.Dropped() != 2 {
+		t.Fatal("Expected 2 dropped messages, but got", dropNewest.Dropped())
+	}
+
+	select {
+	case <-disconnect.Done():
+	default:
+		t.Fatal("Expected the overflowing subscription to be closed")
+	}
+	if b.Len() != 3 {
+		t.Fatal("Expected 3 remaining subscriptions, but got", b.Len())
+	}
+}
+
+func TestBlockingSubscriptionReleasedOnClose(t *testing.T) {
+	b := Broadcaster[int]{}
+	sub := b.Subscribe(context.Background(), SubscriptionOptions{BufferSize: 1, Overflow: OverflowBlock})
+
+	published := make(chan struct{})
+	go func() {
+		b.Publish(1)
+		b.Publish(2)
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		t.Fatal("Expected the publisher to block on a full subscription")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sub.Close()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the publisher to be released when the subscription closed")
+	}
+}
+
+func TestSubscriptionEndsWithContext(t *testing.T) {
+	b := Broadcaster[int]{}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := b.Subscribe(ctx, SubscriptionOptions{})
+	cancel()
+
+	select {
+	case _, ok := <-sub.C():
+		if ok {
+			t.Fatal("Expected no messages")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the subscription to close with its context")
+	}
+	if b.Len() != 0 {
+		t.Fatal("Expected no subscriptions, but got", b.Len())
+	}
+}
+
+func TestBroadcasterClose(t *testing.T) {
+	b := Broadcaster[int]{}
+	sub := b.Subscribe(context.Background(), SubscriptionOptions{})
+	b.Close()
+
+	if _, ok := <-sub.C(); ok {
+		t.Fatal("Expected the subscription to be closed")
+	}
+	late := b.Subscribe(context.Background(), SubscriptionOptions{})
+	if _, ok := <-late.C(); ok {
+		t.Fatal("Expected subscriptions after Close to be closed")
+	}
+}
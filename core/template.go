@@ -0,0 +1,71 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var templateVar = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// RenderTemplate substitutes {name} with the value of the variable.
+func RenderTemplate(template string, vars map[string]string) (string, error) {
+	var missing []string
+	rendered := templateVar.ReplaceAllStringFunc(template, func(v string) string {
+		value, ok := vars[v[1:len(v)-1]]
+		if !ok {
+			missing = append(missing, v)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no value for %s in %q", strings.Join(missing, ", "), template)
+	}
+	return rendered, nil
+}
+
+// FormatValue writes a value for a template or a plain text payload,
+// numbers without exponents or trailing zeros.
+func FormatValue(value any) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+var pathToken = regexp.MustCompile(`^(?:\.([^.\[]+)|\[(\d+)\]|\['([^']*)'\])`)
+
+// JSONPath reads the value at a JSONPath-like path in decoded JSON: $ followed
+// by .name, ['name'] and [index] steps.
+func JSONPath(value any, path string) (any, error) {
+	rest := strings.TrimPrefix(path, "$")
+	for rest != "" {
+		token := pathToken.FindStringSubmatch(rest)
+		if token == nil {
+			return nil, fmt.Errorf("invalid path %s", path)
+		}
+		rest = rest[len(token[0]):]
+
+		switch v := value.(type) {
+		case map[string]any:
+			key := token[1] + token[3]
+			if token[2] != "" {
+				key = token[2]
+			}
+			value = v[key]
+		case []any:
+			i, err := strconv.Atoi(token[2])
+			if err != nil || i >= len(v) {
+				return nil, fmt.Errorf("no element %s at %s", token[0], path)
+			}
+			value = v[i]
+		default:
+			value = nil
+		}
+		if value == nil {
+			return nil, fmt.Errorf("nothing at %s", path)
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,125 @@
+// Package devicetest provides a fake device for the tests of the packages
+// that drive devices through the device manager.
+package devicetest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+// PowerCommand switches the output of a power supply, as in power on.
+var PowerCommand = core.CommandSpec{Name: "power", Args: []core.ArgSpec{{Name: "state", Type: core.ArgString}}}
+
+// Device reports the states it is given and records the commands it gets. It
+// takes the commands of its descriptor.
+type Device struct {
+	id         string
+	descriptor *core.Descriptor
+	states     core.Broadcaster[*core.State]
+	errors     core.Broadcaster[error]
+	mutex      sync.Mutex
+	state      *core.State
+	commands   []core.Command
+	// received is closed and replaced when a command is received
+	received chan struct{}
+	// OnCommand, if set, is called with each command, as in to report the
+	// state the device switches to.
+	OnCommand func(command core.Command)
+}
+
+// NewDevice creates a device, descriptor may be nil.
+func NewDevice(id string, descriptor *core.Descriptor) *Device {
+	return &Device{id: id, descriptor: descriptor, received: make(chan struct{})}
+}
+
+func (d *Device) Id() string { return d.id }
+
+func (d *Device) Descriptor() *core.Descriptor { return d.descriptor }
+
+func (d *Device) ListCommands() ([]core.CommandSpec, error) {
+	if d.descriptor == nil {
+		return nil, nil
+	}
+	return d.descriptor.Commands, nil
+}
+
+func (d *Device) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	d.mutex.Lock()
+	d.commands = append(d.commands, *command)
+	close(d.received)
+	d.received = make(chan struct{})
+	d.mutex.Unlock()
+	if d.OnCommand != nil {
+		d.OnCommand(*command)
+	}
+	return &core.CommandResult{CorrelationId: command.CorrelationId, Success: true}, nil
+}
+
+func (d *Device) GetState() *core.State {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.state
+}
+
+// Report makes state the state of the device and publishes it.
+func (d *Device) Report(state *core.State) {
+	d.mutex.Lock()
+	d.state = state
+	d.mutex.Unlock()
+	d.states.Publish(state)
+}
+
+func (d *Device) SubscribeToStateChanges(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[*core.State], error) {
+	return d.states.Subscribe(ctx, opts), nil
+}
+
+func (d *Device) SubscribeToErrors(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[error], error) {
+	return d.errors.Subscribe(ctx, opts), nil
+}
+
+// Commands returns the commands received so far.
+func (d *Device) Commands() []core.Command {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]core.Command(nil), d.commands...)
+}
+
+// WaitCommands waits for the device to have received n commands and returns
+// them, or those received until timeout.
+func (d *Device) WaitCommands(n int, timeout time.Duration) []core.Command {
+	deadline := time.After(timeout)
+	for {
+		d.mutex.Lock()
+		commands, received := append([]core.Command(nil), d.commands...), d.received
+		d.mutex.Unlock()
+		if len(commands) >= n {
+			return commands
+		}
+		select {
+		case <-received:
+		case <-deadline:
+			return commands
+		}
+	}
+}
+
+// WaitFor waits for condition to hold, checking it every few milliseconds,
+// and fails the test if it doesn't within a second. It is meant for what is
+// done in the background and has no event to wait for.
+func WaitFor(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(time.Second)
+	for !condition() {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			t.Fatal("Expected", what)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package history
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Bucket aggregates the points of a step.
+type Bucket struct {
+	Time  time.Time `json:"time"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Last  float64   `json:"last"`
+	Count int       `json:"count"`
+	// sum is kept so that buckets can be merged without the rounding of Avg
+	sum float64
+	// lastAt is the time of Last, late points don't change it
+	lastAt time.Time
+}
+
+func newBucket(start time.Time) Bucket {
+	return Bucket{Time: start, Min: math.Inf(1), Max: math.Inf(-1)}
+}
+
+func (b *Bucket) add(t time.Time, value float64) {
+	b.merge(Bucket{Min: value, Max: value, Last: value, Count: 1, sum: value, lastAt: t})
+}
+
+func (b *Bucket) merge(other Bucket) {
+	if other.Count == 0 {
+		return
+	}
+	b.Min = math.Min(b.Min, other.Min)
+	b.Max = math.Max(b.Max, other.Max)
+	if b.Count == 0 || !other.lastAt.Before(b.lastAt) {
+		b.Last = other.Last
+		b.lastAt = other.lastAt
+	}
+	b.Count += other.Count
+	b.sum += other.sum
+	b.Avg = b.sum / float64(b.Count)
+}
+
+// Aggregate groups points, oldest first, into buckets of step aligned to from.
+// Steps without points are left out.
+func Aggregate(points []Point, from time.Time, step time.Duration) []Bucket {
+	var buckets []Bucket
+	for _, p := range points {
+		start := from.Add(p.Time.Sub(from) / step * step)
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Time.Equal(start) {
+			buckets = append(buckets, newBucket(start))
+		}
+		buckets[len(buckets)-1].add(p.Time, p.Value)
+	}
+	return buckets
+}
+
+// rebucket merges buckets into buckets of step aligned to from. Partial buckets
+// of the same step are merged too.
+func rebucket(buckets []Bucket, from time.Time, step time.Duration) []Bucket {
+	sort.SliceStable(buckets, func(i, j int) bool { return buckets[i].Time.Before(buckets[j].Time) })
+	var merged []Bucket
+	for _, b := range buckets {
+		start := from.Add(b.Time.Sub(from) / step * step)
+		if len(merged) == 0 || !merged[len(merged)-1].Time.Equal(start) {
+			merged = append(merged, newBucket(start))
+		}
+		merged[len(merged)-1].merge(b)
+	}
+	return merged
+}
@@ -0,0 +1,276 @@
+package history
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Segments hold blocks of rows, one block per flush. A block is stored by
+// column: the times, in milliseconds, with delta-of-delta encoding, then each
+// column of values with XOR encoding, as in Facebook's Gorilla. Readings of a
+// device at a steady rate take a bit or two per time and few bits per value
+// that changes slowly.
+
+var errCorruptBlock = errors.New("corrupt block")
+
+// blockHeaderSize is the length of the block body and its number of rows.
+const blockHeaderSize = 8
+
+type bitWriter struct {
+	buf []byte
+	// free is the number of unused bits of the last byte
+	free int
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for n > 0 {
+		if w.free == 0 {
+			w.buf = append(w.buf, 0)
+			w.free = 8
+		}
+		take := min(n, w.free)
+		chunk := byte(v>>(n-take)) & (1<<take - 1)
+		w.buf[len(w.buf)-1] |= chunk << (w.free - take)
+		w.free -= take
+		n -= take
+	}
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if bit {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+// align starts the next column on a byte boundary.
+func (w *bitWriter) align() {
+	w.free = 0
+}
+
+type bitReader struct {
+	data []byte
+	// pos is in bits
+	pos int
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	if r.pos+n > len(r.data)*8 {
+		return 0, errCorruptBlock
+	}
+	var v uint64
+	for n > 0 {
+		used := r.pos % 8
+		take := min(n, 8-used)
+		chunk := r.data[r.pos/8] >> (8 - used - take) & (1<<take - 1)
+		v = v<<take | uint64(chunk)
+		r.pos += take
+		n -= take
+	}
+	return v, nil
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	bit, err := r.readBits(1)
+	return bit == 1, err
+}
+
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) / 8 * 8
+}
+
+// dodClasses are the bit lengths of zigzag encoded delta-of-deltas, after a
+// prefix of as many ones as the class and a zero. A zero delta-of-delta is a
+// single zero bit.
+var dodClasses = []int{7, 12, 20, 32, 64}
+
+func encodeTimes(w *bitWriter, times []int64) {
+	var previous, delta int64
+	for i, t := range times {
+		if i == 0 {
+			w.writeBits(uint64(t), 64)
+			previous = t
+			continue
+		}
+		dod := (t - previous) - delta
+		delta = t - previous
+		previous = t
+		if dod == 0 {
+			w.writeBit(false)
+			continue
+		}
+		zigzag := uint64(dod<<1) ^ uint64(dod>>63)
+		for class, n := range dodClasses {
+			if n == 64 || zigzag < 1<<n {
+				w.writeBits(1<<(class+1)-1, class+1)
+				if class < len(dodClasses)-1 {
+					w.writeBit(false)
+				}
+				w.writeBits(zigzag, n)
+				break
+			}
+		}
+	}
+}
+
+func decodeTimes(r *bitReader, count int) ([]int64, error) {
+	times := make([]int64, 0, count)
+	var previous, delta int64
+	for i := 0; i < count; i++ {
+		if i == 0 {
+			t, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			previous = int64(t)
+			times = append(times, previous)
+			continue
+		}
+		class := 0
+		for class < len(dodClasses) {
+			one, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if !one {
+				break
+			}
+			class++
+		}
+		var dod int64
+		if class > 0 {
+			zigzag, err := r.readBits(dodClasses[class-1])
+			if err != nil {
+				return nil, err
+			}
+			dod = int64(zigzag>>1) ^ -int64(zigzag&1)
+		}
+		delta += dod
+		previous += delta
+		times = append(times, previous)
+	}
+	return times, nil
+}
+
+func encodeValues(w *bitWriter, values []float64) {
+	var previous uint64
+	leading, trailing := -1, 0
+	for i, value := range values {
+		v := math.Float64bits(value)
+		if i == 0 {
+			w.writeBits(v, 64)
+			previous = v
+			continue
+		}
+		xor := v ^ previous
+		previous = v
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+		l, t := min(bits.LeadingZeros64(xor), 31), bits.TrailingZeros64(xor)
+		if leading >= 0 && l >= leading && t >= trailing {
+			// The changed bits fit the window of the previous value
+			w.writeBit(false)
+			w.writeBits(xor>>trailing, 64-leading-trailing)
+			continue
+		}
+		leading, trailing = l, t
+		w.writeBit(true)
+		w.writeBits(uint64(leading), 5)
+		w.writeBits(uint64(64-leading-trailing-1), 6)
+		w.writeBits(xor>>trailing, 64-leading-trailing)
+	}
+}
+
+func decodeValues(r *bitReader, count int) ([]float64, error) {
+	values := make([]float64, 0, count)
+	var previous uint64
+	leading, trailing := 0, 0
+	for i := 0; i < count; i++ {
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			previous = v
+			values = append(values, math.Float64frombits(v))
+			continue
+		}
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			newWindow, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if newWindow {
+				l, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				length, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				leading, trailing = int(l), 64-int(l)-int(length)-1
+				if trailing < 0 {
+					return nil, errCorruptBlock
+				}
+			}
+			xor, err := r.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			previous ^= xor << trailing
+		}
+		values = append(values, math.Float64frombits(previous))
+	}
+	return values, nil
+}
+
+// appendBlock encodes rows of times and value columns, all of the same length.
+func appendBlock(buf []byte, times []int64, columns ...[]float64) []byte {
+	w := &bitWriter{}
+	encodeTimes(w, times)
+	for _, column := range columns {
+		w.align()
+		encodeValues(w, column)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(w.buf)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(times)))
+	return append(buf, w.buf...)
+}
+
+// readBlocks decodes the blocks of a segment, calling fn with the rows of each.
+// A torn last block of a crashed write is skipped.
+func readBlocks(data []byte, columnCount int, fn func(times []int64, columns [][]float64)) error {
+	for len(data) >= blockHeaderSize {
+		length := int(binary.BigEndian.Uint32(data))
+		count := int(binary.BigEndian.Uint32(data[4:]))
+		if len(data) < blockHeaderSize+length {
+			return nil
+		}
+		r := &bitReader{data: data[blockHeaderSize : blockHeaderSize+length]}
+		times, err := decodeTimes(r, count)
+		if err != nil {
+			return err
+		}
+		columns := make([][]float64, columnCount)
+		for i := range columns {
+			r.align()
+			if columns[i], err = decodeValues(r, count); err != nil {
+				return err
+			}
+		}
+		fn(times, columns)
+		data = data[blockHeaderSize+length:]
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package history
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBlockEncoding(t *testing.T) {
+	times := []int64{1000, 2000, 3000, 4001, 3500, 1 << 40, 5}
+	values := []float64{24, 24, 24.1, -3.5, math.Inf(1), 0, 1e-300}
+	counts := []float64{1, 2, 3, 4, 5, 6, 7}
+	data := appendBlock(nil, times, values, counts)
+	// A torn block is skipped
+	data = append(data, appendBlock(nil, times[:2], values[:2], counts[:2])[:12]...)
+
+	blocks := 0
+	err := readBlocks(data, 2, func(decoded []int64, columns [][]float64) {
+		blocks++
+		for i := range times {
+			if decoded[i] != times[i] || columns[0][i] != values[i] || columns[1][i] != counts[i] {
+				t.Fatal("Expected", times[i], values[i], counts[i], ", but got", decoded[i], columns[0][i], columns[1][i])
+			}
+		}
+	})
+	if err != nil || blocks != 1 {
+		t.Fatal("Expected a block, but got", blocks, err)
+	}
+}
+
+func TestBlockCompression(t *testing.T) {
+	var times []int64
+	var values []float64
+	for i := 0; i < 3600; i++ {
+		times = append(times, 1_700_000_000_000+int64(i)*1000)
+		values = append(values, 24+float64(i%4)*0.5)
+	}
+	if size := len(appendBlock(nil, times, values)); size > 3600*16/4 {
+		t.Fatal("Expected an hour of readings to take a quarter of 16 bytes a point, but got", size)
+	}
+}
@@ -0,0 +1,62 @@
+package history
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+// Record appends the numeric and bool properties of every state a device
+// reports, at the time the device reported it if it did, until ctx is done.
+// A state republished with the time of the last one isn't recorded again.
+func (s *Store) Record(ctx context.Context, devMan core.DeviceManager) {
+	sub := devMan.SubscribeToEvents(ctx, core.EventFilter{Types: []core.EventType{core.EventStateChanged}},
+		core.SubscriptionOptions{BufferSize: 1024, Overflow: core.OverflowDropOldest})
+	defer sub.Close()
+
+	for event := range sub.C() {
+		if changed, ok := event.(core.StateChangedEvent); ok && changed.NewState != nil {
+			s.record(changed)
+		}
+	}
+}
+
+func (s *Store) record(changed core.StateChangedEvent) {
+	at := reportTime(changed.NewState)
+	if changed.OldState != nil && reportTime(changed.OldState).Equal(at) {
+		return
+	}
+	for name, p := range changed.NewState.Properties {
+		value, ok := numeric(p.Value)
+		if !ok {
+			continue
+		}
+		if err := s.Append(changed.EventMeta.Device, name, at, value); err != nil {
+			log.Println("failed to record", name, "of device", changed.EventMeta.Device, "-", err)
+		}
+	}
+}
+
+// reportTime is when the device reported a state, or else when it was received.
+func reportTime(state *core.State) time.Time {
+	if state.ReportedAt != nil {
+		return *state.ReportedAt
+	}
+	return state.ReceivedAt
+}
+
+// numeric reads bools as 0 and 1 so that they can be charted and aggregated.
+func numeric(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
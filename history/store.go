@@ -0,0 +1,651 @@
+// Package history keeps the telemetry of devices in an embedded time-series
+// store, one series per device property, with rollups of each series.
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRetention     = 7 * 24 * time.Hour
+	DefaultFlushInterval = time.Second
+	segmentSpan          = 24 * time.Hour
+	// segmentBuckets is about how many buckets a rollup segment holds.
+	segmentBuckets = 1000
+	segmentExt     = ".tsz"
+	dayFormat      = "2006-01-02"
+	rawTier        = "raw"
+)
+
+var (
+	ErrInvalidSeries = errors.New("invalid series")
+	ErrInvalidTier   = errors.New("invalid rollup tier")
+)
+
+// DefaultTiers roll series up to minutes, hours and days.
+var DefaultTiers = []Tier{
+	{Step: time.Minute, Retention: 30 * 24 * time.Hour},
+	{Step: time.Hour, Retention: 365 * 24 * time.Hour},
+	{Step: 24 * time.Hour, Retention: 5 * 365 * 24 * time.Hour},
+}
+
+// Tier keeps a series aggregated into buckets of Step.
+type Tier struct {
+	Step      time.Duration `json:"step"`
+	Retention time.Duration `json:"retention"`
+}
+
+func (t Tier) name() string {
+	if t.Step == 0 {
+		return rawTier
+	}
+	name := t.Step.String()
+	for _, zero := range []string{"0s", "0m"} {
+		if strings.HasSuffix(name, "m"+zero) || strings.HasSuffix(name, "h"+zero) {
+			name = strings.TrimSuffix(name, zero)
+		}
+	}
+	return name
+}
+
+// span is the time a segment of the tier covers.
+func (t Tier) span() time.Duration {
+	return max(segmentSpan, t.Step*segmentBuckets)
+}
+
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type Options struct {
+	// Retention is how long raw points are kept, whole days at a time.
+	Retention time.Duration
+	// Tiers are the rollups of every series, DefaultTiers if nil.
+	Tiers         []Tier
+	FlushInterval time.Duration
+}
+
+// Store keeps each series in a directory of its own with a directory per tier,
+// <dir>/<device>/<property>/<tier>/2006-01-02.tsz. Raw points go to a segment
+// per UTC day. Appended points are folded into the rollups right away and
+// buffered, Run writes them and the completed buckets every FlushInterval.
+// The buckets being filled are written by Close. If the store isn't closed,
+// Open rebuilds them from the raw points.
+type Store struct {
+	dir     string
+	opts    Options
+	mutex   sync.Mutex
+	pending map[seriesKey]*pendingSeries
+	// fileMutex keeps queries from reading a segment that is being appended to
+	fileMutex sync.RWMutex
+}
+
+type seriesKey struct {
+	device   string
+	property string
+}
+
+type pendingSeries struct {
+	points []Point
+	// open holds the bucket being filled for each tier
+	open []Bucket
+	// closed holds the buckets to write for each tier
+	closed [][]Bucket
+}
+
+func Open(dir string, opts Options) (*Store, error) {
+	if opts.Retention <= 0 {
+		opts.Retention = DefaultRetention
+	}
+	if opts.Tiers == nil {
+		opts.Tiers = DefaultTiers
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	opts.Tiers = append([]Tier(nil), opts.Tiers...)
+	sort.Slice(opts.Tiers, func(i, j int) bool { return opts.Tiers[i].Step < opts.Tiers[j].Step })
+	for i, tier := range opts.Tiers {
+		if tier.Step <= 0 || tier.Retention <= 0 {
+			return nil, fmt.Errorf("%w: step %s, retention %s", ErrInvalidTier, tier.Step, tier.Retention)
+		}
+		if i > 0 && tier.Step == opts.Tiers[i-1].Step {
+			return nil, fmt.Errorf("%w: two tiers of %s", ErrInvalidTier, tier.Step)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, opts: opts, pending: make(map[seriesKey]*pendingSeries)}
+	if err := s.rebuild(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// pathName makes a device id or property name safe to use as a directory.
+func pathName(name string) string {
+	escaped := url.PathEscape(name)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
+
+func (s *Store) segmentPath(key seriesKey, tier Tier, start time.Time) string {
+	return filepath.Join(s.dir, pathName(key.device), pathName(key.property), tier.name(), start.Format(dayFormat)+segmentExt)
+}
+
+func (s *Store) Append(deviceId string, property string, t time.Time, value float64) error {
+	if deviceId == "" || property == "" {
+		return ErrInvalidSeries
+	}
+	t = t.UTC().Truncate(time.Millisecond)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	series := s.pendingSeries(seriesKey{deviceId, property})
+	series.points = append(series.points, Point{t, value})
+	for i, tier := range s.opts.Tiers {
+		series.add(i, tier, t, value)
+	}
+	return nil
+}
+
+// pendingSeries must be called with mutex held
+func (s *Store) pendingSeries(key seriesKey) *pendingSeries {
+	series, ok := s.pending[key]
+	if !ok {
+		series = &pendingSeries{open: make([]Bucket, len(s.opts.Tiers)), closed: make([][]Bucket, len(s.opts.Tiers))}
+		s.pending[key] = series
+	}
+	return series
+}
+
+// add folds a point into the buckets of the i-th tier.
+func (series *pendingSeries) add(i int, tier Tier, t time.Time, value float64) {
+	start := t.Truncate(tier.Step)
+	open := &series.open[i]
+	switch {
+	case open.Count > 0 && start.Equal(open.Time):
+		open.add(t, value)
+	case open.Count > 0 && start.Before(open.Time):
+		// A late point goes in a bucket of its own, queries merge it
+		late := newBucket(start)
+		late.add(t, value)
+		series.closed[i] = append(series.closed[i], late)
+	default:
+		if open.Count > 0 {
+			series.closed[i] = append(series.closed[i], *open)
+		}
+		*open = newBucket(start)
+		open.add(t, value)
+	}
+}
+
+// rebuild folds the raw points that are newer than the last point in the
+// rollups of a series into its buckets again. Those are the points of the
+// buckets that were being filled when the store wasn't closed.
+func (s *Store) rebuild(now time.Time) error {
+	devices, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		deviceId, err := url.PathUnescape(device.Name())
+		if err != nil || !device.IsDir() {
+			continue
+		}
+		properties, err := s.Series(deviceId)
+		if err != nil {
+			return err
+		}
+		for _, property := range properties {
+			// A damaged segment shouldn't keep the store from opening
+			if err := s.rebuildSeries(seriesKey{deviceId, property}, now); err != nil {
+				log.Println("failed to rebuild the rollups of", deviceId, property, "-", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) rebuildSeries(key seriesKey, now time.Time) error {
+	// rolledUp is the time of the last point in the rollups of each tier
+	rolledUp := make([]time.Time, len(s.opts.Tiers))
+	from := now
+	for i, tier := range s.opts.Tiers {
+		start, ok, err := s.lastSegment(key, tier)
+		if err != nil {
+			return err
+		}
+		if ok {
+			err = s.read(key, tier, start, start.Add(tier.span()), bucketColumns, func(t time.Time, values []float64) {
+				if lastAt := time.UnixMilli(int64(values[5])).UTC(); lastAt.After(rolledUp[i]) {
+					rolledUp[i] = lastAt
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if rolledUp[i].Before(from) {
+			from = rolledUp[i]
+		}
+	}
+
+	if retained := s.retentionStart(Tier{}, now); from.Before(retained) {
+		from = retained
+	}
+	var points []Point
+	err := s.read(key, Tier{}, from, now.Add(segmentSpan), 1, func(t time.Time, values []float64) {
+		points = append(points, Point{t, values[0]})
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, p := range points {
+		for i, tier := range s.opts.Tiers {
+			if p.Time.After(rolledUp[i]) {
+				s.pendingSeries(key).add(i, tier, p.Time, p.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// lastSegment finds the start of the newest segment of a tier. That holds the
+// last point, late points go to the buckets they belong in.
+func (s *Store) lastSegment(key seriesKey, tier Tier) (time.Time, bool, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, pathName(key.device), pathName(key.property), tier.name()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var last time.Time
+	for _, e := range entries {
+		start, err := time.Parse(dayFormat, strings.TrimSuffix(e.Name(), segmentExt))
+		if err == nil && filepath.Ext(e.Name()) == segmentExt && start.After(last) {
+			last = start
+		}
+	}
+	return last, !last.IsZero(), nil
+}
+
+// Flush writes the buffered points and completed buckets to their segments.
+func (s *Store) Flush() error {
+	return s.flush(false)
+}
+
+// Close writes what is buffered, the buckets being filled included. Those are
+// merged with the rest of their buckets when queried.
+func (s *Store) Close() error {
+	return s.flush(true)
+}
+
+func (s *Store) flush(all bool) error {
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+	s.mutex.Lock()
+	flushed := make(map[seriesKey]*pendingSeries, len(s.pending))
+	for key, series := range s.pending {
+		flushed[key] = &pendingSeries{points: series.points, closed: series.closed}
+		series.points = nil
+		series.closed = make([][]Bucket, len(s.opts.Tiers))
+		if all {
+			for i, open := range series.open {
+				if open.Count > 0 {
+					flushed[key].closed[i] = append(flushed[key].closed[i], open)
+				}
+			}
+			delete(s.pending, key)
+		}
+	}
+	s.mutex.Unlock()
+
+	var errs []error
+	for key, series := range flushed {
+		if err := s.write(key, Tier{}, pointRows(series.points)); err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %w", key.device, key.property, err))
+		}
+		for i, tier := range s.opts.Tiers {
+			if err := s.write(key, tier, bucketRows(series.closed[i])); err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s/%s: %w", key.device, key.property, tier.name(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rows are the times and value columns of the points or buckets of a block.
+type rows struct {
+	times   []time.Time
+	columns [][]float64
+}
+
+func pointRows(points []Point) rows {
+	r := rows{columns: make([][]float64, 1)}
+	for _, p := range points {
+		r.times = append(r.times, p.Time)
+		r.columns[0] = append(r.columns[0], p.Value)
+	}
+	return r
+}
+
+// bucketColumns are the columns of a bucket: min, max, sum, last, count and
+// the time of last in milliseconds.
+const bucketColumns = 6
+
+func bucketRows(buckets []Bucket) rows {
+	r := rows{columns: make([][]float64, bucketColumns)}
+	for _, b := range buckets {
+		r.times = append(r.times, b.Time)
+		for i, v := range []float64{b.Min, b.Max, b.sum, b.Last, float64(b.Count), float64(b.lastAt.UnixMilli())} {
+			r.columns[i] = append(r.columns[i], v)
+		}
+	}
+	return r
+}
+
+// write appends a block to each segment the rows fall in, ordered by time.
+func (s *Store) write(key seriesKey, tier Tier, r rows) error {
+	segments := make(map[time.Time]*rows)
+	for i, t := range r.times {
+		start := t.Truncate(tier.span())
+		segment, ok := segments[start]
+		if !ok {
+			segment = &rows{columns: make([][]float64, len(r.columns))}
+			segments[start] = segment
+		}
+		segment.times = append(segment.times, t)
+		for c := range r.columns {
+			segment.columns[c] = append(segment.columns[c], r.columns[c][i])
+		}
+	}
+
+	for start, segment := range segments {
+		sort.Stable(segment)
+		times := make([]int64, len(segment.times))
+		for i, t := range segment.times {
+			times[i] = t.UnixMilli()
+		}
+		path := s.segmentPath(key, tier, start)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(appendBlock(nil, times, segment.columns...))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rows) Len() int {
+	return len(r.times)
+}
+
+func (r *rows) Less(i, j int) bool {
+	return r.times[i].Before(r.times[j])
+}
+
+func (r *rows) Swap(i, j int) {
+	r.times[i], r.times[j] = r.times[j], r.times[i]
+	for _, column := range r.columns {
+		column[i], column[j] = column[j], column[i]
+	}
+}
+
+// read calls fn with the rows of the tier segments that overlap [from, to).
+func (s *Store) read(key seriesKey, tier Tier, from time.Time, to time.Time, columnCount int, fn func(t time.Time, values []float64)) error {
+	for start := from.UTC().Truncate(tier.span()); start.Before(to); start = start.Add(tier.span()) {
+		data, err := os.ReadFile(s.segmentPath(key, tier, start))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		values := make([]float64, columnCount)
+		err = readBlocks(data, columnCount, func(times []int64, columns [][]float64) {
+			for i, millis := range times {
+				for c := range columns {
+					values[c] = columns[c][i]
+				}
+				fn(time.UnixMilli(millis).UTC(), values)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.segmentPath(key, tier, start), err)
+		}
+	}
+	return nil
+}
+
+// Query returns the raw points of a series in [from, to), oldest first.
+func (s *Store) Query(deviceId string, property string, from time.Time, to time.Time) ([]Point, error) {
+	key := seriesKey{deviceId, property}
+	var points []Point
+	in := func(t time.Time) bool { return !t.Before(from) && t.Before(to) }
+
+	// Holding fileMutex until the pending points are read keeps a flush from
+	// moving points out of sight in between
+	s.fileMutex.RLock()
+	defer s.fileMutex.RUnlock()
+	err := s.read(key, Tier{}, from, to, 1, func(t time.Time, values []float64) {
+		if in(t) {
+			points = append(points, Point{t, values[0]})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	if series, ok := s.pending[key]; ok {
+		for _, p := range series.points {
+			if in(p.Time) {
+				points = append(points, p)
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	// Devices can report late, so points aren't appended in order
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// Retains tells whether raw points as old as t are still kept.
+func (s *Store) Retains(t time.Time) bool {
+	return !t.Before(s.retentionStart(Tier{}, time.Now()))
+}
+
+// tier picks the tier to aggregate [from, ...) into buckets of step: the
+// coarsest whose buckets fit in step among those that still hold from. Raw
+// points are a tier of step 0. When none does, or the step is 0, it is the
+// finest rollup that holds from, and else the rollup kept the longest.
+func (s *Store) tier(from time.Time, step time.Duration) Tier {
+	now := time.Now()
+	holds := func(tier Tier) bool { return !from.Before(s.retentionStart(tier, now)) }
+	var best *Tier
+	for _, tier := range append([]Tier{{}}, s.opts.Tiers...) {
+		if step > 0 && tier.Step <= step && (tier.Step == 0 || step%tier.Step == 0) && holds(tier) {
+			best = &tier
+		}
+	}
+	if best != nil {
+		return *best
+	}
+	// Coarser buckets than asked for beat none
+	var longest Tier
+	for _, tier := range s.opts.Tiers {
+		if holds(tier) {
+			return tier
+		}
+		if tier.Retention >= longest.Retention {
+			longest = tier
+		}
+	}
+	return longest
+}
+
+// Buckets aggregates a series into buckets of step in [from, to), reading the
+// tier that fits best, and returns the step of the buckets. That is the step of
+// the tier read when it doesn't fit in step, or step is 0. Buckets are aligned
+// to multiples of the step.
+func (s *Store) Buckets(deviceId string, property string, from time.Time, to time.Time, step time.Duration) ([]Bucket, time.Duration, error) {
+	tier := s.tier(from, step)
+	if tier.Step > 0 && (step == 0 || step%tier.Step != 0) {
+		step = tier.Step
+	}
+	if step == 0 {
+		// No rollups
+		return nil, 0, nil
+	}
+	from = from.UTC().Truncate(step)
+	if tier.Step == 0 {
+		points, err := s.Query(deviceId, property, from, to)
+		if err != nil {
+			return nil, 0, err
+		}
+		return Aggregate(points, from, step), step, nil
+	}
+
+	key := seriesKey{deviceId, property}
+	var buckets []Bucket
+	in := func(t time.Time) bool { return !t.Before(from) && t.Before(to) }
+
+	s.fileMutex.RLock()
+	defer s.fileMutex.RUnlock()
+	err := s.read(key, tier, from, to, bucketColumns, func(t time.Time, values []float64) {
+		if in(t) {
+			buckets = append(buckets, Bucket{
+				Time: t, Min: values[0], Max: values[1], sum: values[2], Last: values[3], Count: int(values[4]),
+				lastAt: time.UnixMilli(int64(values[5])).UTC(),
+			})
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.mutex.Lock()
+	if series, ok := s.pending[key]; ok {
+		i := sort.Search(len(s.opts.Tiers), func(i int) bool { return s.opts.Tiers[i].Step >= tier.Step })
+		for _, b := range series.closed[i] {
+			if in(b.Time) {
+				buckets = append(buckets, b)
+			}
+		}
+		if open := series.open[i]; open.Count > 0 && in(open.Time) {
+			buckets = append(buckets, open)
+		}
+	}
+	s.mutex.Unlock()
+
+	return rebucket(buckets, from, step), step, nil
+}
+
+// Series lists the properties with history for a device.
+func (s *Store) Series(deviceId string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, pathName(deviceId)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var properties []string
+	for _, e := range entries {
+		if name, err := url.PathUnescape(e.Name()); err == nil && e.IsDir() {
+			properties = append(properties, name)
+		}
+	}
+	return properties, nil
+}
+
+// retentionStart is the start of the oldest segment of the tier that is kept.
+func (s *Store) retentionStart(tier Tier, now time.Time) time.Time {
+	retention := tier.Retention
+	if tier.Step == 0 {
+		retention = s.opts.Retention
+	}
+	return now.UTC().Add(-retention).Truncate(tier.span())
+}
+
+// expire removes the segments that are entirely older than the retention of
+// their tier.
+func (s *Store) expire(now time.Time) error {
+	tiers := map[string]Tier{rawTier: {}}
+	for _, tier := range s.opts.Tiers {
+		tiers[tier.name()] = tier
+	}
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+	return filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != segmentExt {
+			return err
+		}
+		tier, ok := tiers[filepath.Base(filepath.Dir(path))]
+		if !ok {
+			// A tier that is no longer configured is left alone
+			return nil
+		}
+		start, err := time.Parse(dayFormat, strings.TrimSuffix(d.Name(), segmentExt))
+		if err == nil && start.Before(s.retentionStart(tier, now)) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// Run flushes the buffered points and expires old segments until ctx is done.
+// What is still buffered then is written by Close.
+func (s *Store) Run(ctx context.Context) {
+	flush := time.NewTicker(s.opts.FlushInterval)
+	defer flush.Stop()
+	expire := time.NewTicker(time.Hour)
+	defer expire.Stop()
+	if err := s.expire(time.Now()); err != nil {
+		log.Println("failed to expire history:", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			if err := s.Flush(); err != nil {
+				log.Println("failed to flush history:", err)
+			}
+		case now := <-expire.C:
+			if err := s.expire(now); err != nil {
+				log.Println("failed to expire history:", err)
+			}
+		}
+	}
+}
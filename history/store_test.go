@@ -0,0 +1,213 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+func TestStoreQuery(t *testing.T) {
+	store, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)
+	store.Append("psu-1", "voltage", day.Add(2*time.Minute), 24.2)
+	store.Append("psu-1", "voltage", day, 24.0)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Pending points are queried along with the flushed ones
+	store.Append("psu-1", "voltage", day.Add(time.Minute), 24.1)
+
+	points, err := store.Query("psu-1", "voltage", day, day.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 || points[0].Value != 24.0 || points[1].Value != 24.1 || points[2].Value != 24.2 {
+		t.Fatal("Expected 24.0, 24.1 and 24.2 across two segments, but got", points)
+	}
+	points, _ = store.Query("psu-1", "voltage", day.Add(time.Minute), day.Add(2*time.Minute))
+	if len(points) != 1 || points[0].Value != 24.1 {
+		t.Fatal("Expected from to be inclusive and to exclusive, but got", points)
+	}
+	series, _ := store.Series("psu-1")
+	if len(series) != 1 || series[0] != "voltage" {
+		t.Fatal("Expected the voltage series, but got", series)
+	}
+}
+
+func TestStoreExpire(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := Open(dir, Options{Retention: 48 * time.Hour, Tiers: []Tier{{Step: time.Minute, Retention: 30 * 24 * time.Hour}}})
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	for days := 0; days < 5; days++ {
+		store.Append("../psu", "voltage", now.Add(-time.Duration(days)*24*time.Hour), float64(days))
+	}
+	store.Close()
+	if err := store.expire(now); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*", "voltage", "raw", "*.tsz"))
+	if len(segments) != 3 {
+		t.Fatal("Expected the segments of the last 3 days, but got", segments)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*", "voltage", "1m", "*.tsz")); len(segments) != 5 {
+		t.Fatal("Expected the minute rollups of all 5 days, but got", segments)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "%2E.%2Fpsu")); err != nil {
+		t.Fatal("Expected the device id to be escaped, but got", err)
+	}
+	points, _ := store.Query("../psu", "voltage", now.Add(-5*24*time.Hour), now.Add(time.Hour))
+	if len(points) != 3 || points[0].Value != 2 {
+		t.Fatal("Expected 3 points from 2 days ago on, but got", points)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	points := []Point{
+		{from.Add(10 * time.Second), 1},
+		{from.Add(50 * time.Second), 3},
+		{from.Add(3*time.Minute + time.Second), 7},
+	}
+	buckets := Aggregate(points, from, time.Minute)
+	if len(buckets) != 2 {
+		t.Fatal("Expected 2 buckets without the empty steps, but got", buckets)
+	}
+	b := buckets[0]
+	if !b.Time.Equal(from) || b.Min != 1 || b.Max != 3 || b.Avg != 2 || b.Last != 3 || b.Count != 2 {
+		t.Fatal("Expected min 1, max 3, avg 2, last 3 and count 2, but got", b)
+	}
+	if !buckets[1].Time.Equal(from.Add(3*time.Minute)) || buckets[1].Count != 1 {
+		t.Fatal("Expected a bucket at 00:03, but got", buckets[1])
+	}
+}
+
+func TestStoreRollups(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := Open(dir, Options{})
+	// The rollups are read while they hold the range
+	from := time.Now().UTC().Truncate(24 * time.Hour).Add(-48 * time.Hour)
+	for i := 0; i < 3*3600; i++ {
+		store.Append("psu-1", "voltage", from.Add(time.Duration(i)*time.Second), float64(i%60))
+	}
+	// A late point of the first minute
+	store.Append("psu-1", "voltage", from.Add(30*time.Second), 100)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, step, err := store.Buckets("psu-1", "voltage", from, from.Add(3*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step != time.Hour || len(buckets) != 3 {
+		t.Fatal("Expected 3 hourly buckets, but got", step, buckets)
+	}
+	if b := buckets[0]; b.Count != 3601 || b.Min != 0 || b.Max != 100 || b.Last != 59 {
+		t.Fatal("Expected the late point in the first hour, but got", b)
+	}
+	// The last hour is still being filled and is read from memory
+	if b := buckets[2]; b.Count != 3600 || b.Avg != 29.5 {
+		t.Fatal("Expected the open hour to be queried, but got", b)
+	}
+
+	buckets, _, _ = store.Buckets("psu-1", "voltage", from, from.Add(time.Hour), 5*time.Minute)
+	if len(buckets) != 12 || buckets[0].Count != 301 || buckets[1].Count != 300 {
+		t.Fatal("Expected 12 buckets of 5 minutes, but got", buckets)
+	}
+	if tier := store.tier(from, 5*time.Minute); tier.Step != time.Minute {
+		t.Fatal("Expected 5 minute buckets from the minute rollup, but got", tier)
+	}
+	if tier := store.tier(time.Now().Add(-time.Hour), 90*time.Second); tier.Step != 0 {
+		t.Fatal("Expected 90 second buckets from raw points, but got", tier)
+	}
+	buckets, step, _ = store.Buckets("psu-1", "voltage", from.Add(-60*24*time.Hour), from.Add(time.Hour), time.Minute)
+	if step != time.Hour || len(buckets) != 1 {
+		t.Fatal("Expected a range past the minute rollup to be read from hours, but got", step, buckets)
+	}
+	if _, step, _ = store.Buckets("psu-1", "voltage", from.Add(-60*24*time.Hour), from, 0); step != time.Hour {
+		t.Fatal("Expected the finest rollup holding the range to be picked, but got", step)
+	}
+
+	// The open buckets are written on close and merged on reopening
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, _ = Open(dir, Options{})
+	store.Append("psu-1", "voltage", from.Add(3*time.Hour-time.Second), 1000)
+	buckets, _, _ = store.Buckets("psu-1", "voltage", from.Add(2*time.Hour), from.Add(3*time.Hour), time.Hour)
+	if len(buckets) != 1 || buckets[0].Count != 3601 || buckets[0].Max != 1000 {
+		t.Fatal("Expected the partial buckets of an hour to be merged, but got", buckets)
+	}
+}
+
+func TestStoreRebuildsOpenBuckets(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := Open(dir, Options{})
+	from := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	for i := 0; i < 90; i++ {
+		store.Append("psu-1", "voltage", from.Add(time.Duration(i)*time.Minute), float64(i))
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The process dies without closing the store
+	expect := func(store *Store) {
+		t.Helper()
+		buckets, _, _ := store.Buckets("psu-1", "voltage", from, from.Add(2*time.Hour), time.Hour)
+		if len(buckets) != 2 || buckets[0].Count != 60 || buckets[1].Count != 30 || buckets[1].Last != 89 {
+			t.Fatal("Expected hours of 60 and 30 points, but got", buckets)
+		}
+		buckets, _, _ = store.Buckets("psu-1", "voltage", from, from.Add(2*time.Hour), 24*time.Hour)
+		if len(buckets) != 1 || buckets[0].Count != 90 {
+			t.Fatal("Expected a day of 90 points, but got", buckets)
+		}
+	}
+	store, _ = Open(dir, Options{})
+	expect(store)
+
+	// Once written, the buckets aren't rebuilt again
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, _ = Open(dir, Options{})
+	expect(store)
+}
+
+func TestRecordStates(t *testing.T) {
+	store, _ := Open(t.TempDir(), Options{})
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	var last *core.State
+	report := func(current float64) {
+		state := core.NewState(at)
+		state.Set("voltage", 24.0, "V")
+		state.Set("current", current, "A")
+		state.Set("mode", "cv", "")
+		store.record(core.StateChangedEvent{EventMeta: core.EventMeta{Device: "psu-1"}, OldState: last, NewState: state})
+		last = state
+	}
+	report(1)
+	at = at.Add(time.Second)
+	report(2)
+	// Republished with the time of the last report
+	report(2)
+	at = at.Add(time.Second)
+	report(3)
+
+	// A steady value is sampled with every report
+	voltage, _ := store.Query("psu-1", "voltage", at.Add(-time.Hour), at.Add(time.Second))
+	current, _ := store.Query("psu-1", "current", at.Add(-time.Hour), at.Add(time.Second))
+	if len(voltage) != 3 || len(current) != 3 || current[2].Value != 3 {
+		t.Fatal("Expected 3 voltage and current points, but got", voltage, current)
+	}
+	if mode, _ := store.Query("psu-1", "mode", at.Add(-time.Hour), at.Add(time.Second)); len(mode) != 0 {
+		t.Fatal("Expected a string property not to be recorded, but got", mode)
+	}
+}
@@ -0,0 +1,119 @@
+// Package httpdevice drives devices that speak HTTP: devices polled through
+// their REST API and devices that push their state to an ingest endpoint.
+package httpdevice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+// device holds the state of an HTTP device, the way it is exposed to the
+// DeviceManager.
+type device struct {
+	id         string
+	descriptor *core.Descriptor
+	properties map[string]string
+	state      *core.State
+	stateMutex sync.RWMutex
+	states     core.Broadcaster[*core.State]
+	errors     core.Broadcaster[error]
+}
+
+func newDevice(deviceId string, descriptor *core.Descriptor, properties map[string]string) *device {
+	return &device{
+		id:         deviceId,
+		descriptor: descriptor,
+		properties: properties,
+		state:      core.NewState(time.Now()),
+	}
+}
+
+// describe defaults the descriptor of a configured device.
+func describe(descriptor *core.Descriptor, deviceType string) *core.Descriptor {
+	if descriptor == nil {
+		return &core.Descriptor{Model: deviceType, DeviceType: deviceType}
+	}
+	d := *descriptor
+	if d.DeviceType == "" {
+		d.DeviceType = deviceType
+	}
+	return &d
+}
+
+// receive reads a JSON document into the state. Without configured property
+// paths it is read like the state of an MQTT device.
+func (d *device) receive(payload []byte, source string) error {
+	state, err := d.parse(payload)
+	if err != nil {
+		d.errors.Publish(core.NewMalformedPayloadError(d.id, source, payload, err))
+		return err
+	}
+	for name, p := range state.Properties {
+		if p.Unit == "" {
+			p.Unit = d.descriptor.PropertyUnit(name)
+			state.Properties[name] = p
+		}
+	}
+
+	d.stateMutex.Lock()
+	d.state = state
+	d.stateMutex.Unlock()
+	d.states.Publish(state)
+	return nil
+}
+
+func (d *device) parse(payload []byte) (*core.State, error) {
+	if len(d.properties) == 0 {
+		return core.ParseState(payload, time.Now())
+	}
+	var document any
+	if err := json.Unmarshal(payload, &document); err != nil {
+		return nil, fmt.Errorf("%w: %v", core.ErrInvalidState, err)
+	}
+	state := core.NewState(time.Now())
+	for name, path := range d.properties {
+		value, err := core.JSONPath(document, path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", core.ErrInvalidState, name, err)
+		}
+		state.Set(name, value, "")
+	}
+	return state, nil
+}
+
+func (d *device) Id() string {
+	return d.id
+}
+
+func (d *device) Descriptor() *core.Descriptor {
+	return d.descriptor
+}
+
+func (d *device) ListCommands() ([]core.CommandSpec, error) {
+	return d.descriptor.Commands, nil
+}
+
+func (d *device) GetState() *core.State {
+	d.stateMutex.RLock()
+	defer d.stateMutex.RUnlock()
+	return d.state
+}
+
+func (d *device) SubscribeToStateChanges(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[*core.State], error) {
+	return d.states.Subscribe(ctx, opts), nil
+}
+
+func (d *device) SubscribeToErrors(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[error], error) {
+	return d.errors.Subscribe(ctx, opts), nil
+}
+
+func (d *device) Close() error {
+	d.states.Close()
+	d.errors.Close()
+	return nil
+}
@@ -0,0 +1,123 @@
+package httpdevice
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const IngestDeviceType = "webhook"
+
+// IngestConfig describes a device that POSTs its state to /ingest/<id>,
+// authenticated with "Authorization: Bearer <token>".
+type IngestConfig struct {
+	Id         string            `json:"id"`
+	Token      string            `json:"token"`
+	Descriptor *core.Descriptor  `json:"descriptor,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	// ReportInterval is how often the device pushes its state, a duration
+	// such as "15m". The presence watchdog derives its timeouts from it.
+	ReportInterval string `json:"reportInterval,omitempty"`
+}
+
+// IngestDevice is a device that pushes its state. It takes no commands.
+type IngestDevice struct {
+	*device
+}
+
+func (d *IngestDevice) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	return nil, core.NewUnknownCommandError(command.Name)
+}
+
+// Ingest registers a device with the first state it pushes, and again after
+// it went offline.
+type Ingest struct {
+	devMan  core.DeviceManager
+	configs map[string]IngestConfig
+	mutex   sync.Mutex
+	devices map[string]*IngestDevice
+}
+
+func NewIngest(devMan core.DeviceManager, configs []IngestConfig) (*Ingest, error) {
+	i := &Ingest{
+		devMan:  devMan,
+		configs: make(map[string]IngestConfig),
+		devices: make(map[string]*IngestDevice),
+	}
+	for _, config := range configs {
+		if config.Id == "" || config.Token == "" {
+			return nil, fmt.Errorf("%w: an ingest device needs an id and a token", core.ErrInvalidDescriptor)
+		}
+		config.Descriptor = describe(config.Descriptor, IngestDeviceType)
+		interval, err := core.ParseDuration("report interval", config.ReportInterval, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+		}
+		if interval > 0 {
+			config.Descriptor.SetReportInterval(interval)
+		}
+		i.configs[config.Id] = config
+	}
+	return i, nil
+}
+
+func (i *Ingest) RegisterRoutes(e *echo.Echo) {
+	e.POST("/ingest/:deviceId", i.handlePush)
+}
+
+func (i *Ingest) handlePush(c echo.Context) error {
+	config, ok := i.configs[c.Param("deviceId")]
+	// Unknown devices get the same answer as wrong tokens
+	token, _ := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+		return c.String(http.StatusUnauthorized, "invalid device token")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxResponseSize))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	// Devices that don't speak JSON send their payload with its content type
+	codec, err := core.CodecFor(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return c.String(http.StatusUnsupportedMediaType, err.Error())
+	}
+	payload, err := core.ToJSON(codec, body)
+	if err == nil {
+		err = i.device(config).receive(payload, c.Path())
+	}
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// device returns the device of config, registering it unless it is registered
+// and online. Devices are closed when they go offline or are removed.
+func (i *Ingest) device(config IngestConfig) *IngestDevice {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	dev, ok := i.devices[config.Id]
+	record, err := i.devMan.GetDeviceRecord(config.Id)
+	if ok && err == nil && record.Presence.Status != core.StatusOffline {
+		return dev
+	}
+	dev = &IngestDevice{newDevice(config.Id, config.Descriptor, config.Properties)}
+	i.devices[config.Id] = dev
+	if err := i.devMan.AddDevice(dev); err != nil {
+		log.Println("Failed to add ingest device", config.Id, "- Error:", err)
+	} else {
+		log.Println("New ingest device added", config.Id)
+	}
+	return dev
+}
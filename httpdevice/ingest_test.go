@@ -0,0 +1,60 @@
+package httpdevice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/ilievs/fibers/core"
+)
+
+func TestIngest(t *testing.T) {
+	devMan := core.NewBasicDeviceManager()
+	ingest, err := NewIngest(devMan, []IngestConfig{{Id: "meter-7", Token: "s3cret", ReportInterval: "15m"}})
+	if err != nil {
+		t.Fatal("Expected an ingest, but got", err)
+	}
+	e := echo.New()
+	ingest.RegisterRoutes(e)
+
+	push := func(deviceId string, token string, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/ingest/"+deviceId, strings.NewReader(body))
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := push("meter-7", "wrong", `{"energy": 1}`); code != http.StatusUnauthorized {
+		t.Fatal("Expected 401 for a wrong token, but got", code)
+	}
+	if code := push("meter-8", "s3cret", `{"energy": 1}`); code != http.StatusUnauthorized {
+		t.Fatal("Expected 401 for an unknown device, but got", code)
+	}
+	if code := push("meter-7", "s3cret", `{"properties": {"energy": 12.5}, "units": {"energy": "kWh"}}`); code != http.StatusNoContent {
+		t.Fatal("Expected 204, but got", code)
+	}
+
+	dev, err := devMan.GetDevice("meter-7")
+	if err != nil {
+		t.Fatal("Expected device meter-7, but got", err)
+	}
+	if p, _ := dev.GetState().Get("energy"); p.Value != 12.5 || p.Unit != "kWh" {
+		t.Fatal("Expected energy 12.5 kWh, but got", p)
+	}
+	if record, _ := devMan.GetDeviceRecord("meter-7"); record.Descriptor.ReportInterval != 900 {
+		t.Fatal("Expected a report interval of 900s, but got", record.Descriptor)
+	}
+	if code := push("meter-7", "s3cret", `not json`); code != http.StatusBadRequest {
+		t.Fatal("Expected 400 for a malformed payload, but got", code)
+	}
+
+	devMan.SetDeviceOffline("meter-7", "test")
+	push("meter-7", "s3cret", `{"energy": 13}`)
+	if record, _ := devMan.GetDeviceRecord("meter-7"); record.Presence.Status != core.StatusOnline {
+		t.Fatal("Expected meter-7 back online, but got", record.Presence.Status)
+	}
+}
@@ -0,0 +1,191 @@
+package httpdevice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	PollDeviceType      = "http"
+	DefaultPollInterval = 30 * time.Second
+	DefaultTimeout      = 10 * time.Second
+	// maxResponseSize bounds what is read from a device.
+	maxResponseSize = 1 << 20
+)
+
+// PollConfig describes a device that is polled with a GET of its URL.
+type PollConfig struct {
+	Id      string            `json:"id"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Interval and Timeout are durations such as "30s".
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+	// Descriptor lists the commands and units of the device.
+	Descriptor *core.Descriptor `json:"descriptor,omitempty"`
+	// Properties map property names to JSON paths in the response, as in
+	// $.output.voltage. The response is read as a device state when empty.
+	Properties map[string]string `json:"properties,omitempty"`
+	Commands   []HTTPCommand     `json:"commands,omitempty"`
+}
+
+// HTTPCommand maps a command of the descriptor to an HTTP request. The URL
+// and body are templates of the command arguments, {state} and the like. The
+// arguments are sent as a JSON object when there is no body template.
+type HTTPCommand struct {
+	Command string `json:"command"`
+	Method  string `json:"method,omitempty"`
+	URL     string `json:"url"`
+	Body    string `json:"body,omitempty"`
+}
+
+// PollDevice is a device behind a REST API.
+type PollDevice struct {
+	*device
+	config   PollConfig
+	interval time.Duration
+	client   *http.Client
+}
+
+func NewPollDevice(config PollConfig) (*PollDevice, error) {
+	if config.Id == "" || config.URL == "" {
+		return nil, fmt.Errorf("%w: a polled device needs an id and a url", core.ErrInvalidDescriptor)
+	}
+	interval, err := core.ParseDuration("interval", config.Interval, DefaultPollInterval)
+	if err == nil && interval == 0 {
+		err = errors.New("interval of 0")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+	}
+	timeout, err := core.ParseDuration("timeout", config.Timeout, DefaultTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+	}
+	descriptor := describe(config.Descriptor, PollDeviceType)
+	descriptor.SetReportInterval(interval)
+	for _, cmd := range config.Commands {
+		if _, ok := core.FindCommandSpec(descriptor.Commands, cmd.Command); !ok {
+			return nil, fmt.Errorf("%w: command %s is not in the descriptor", core.ErrInvalidDescriptor, cmd.Command)
+		}
+	}
+	return &PollDevice{
+		device:   newDevice(config.Id, descriptor, config.Properties),
+		config:   config,
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (d *PollDevice) do(ctx context.Context, method string, url string, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range d.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if len(body) > 0 && json.Valid(body) {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	return resp, payload, err
+}
+
+func (d *PollDevice) PollInterval() time.Duration {
+	return d.interval
+}
+
+func (d *PollDevice) Poll(ctx context.Context) error {
+	resp, payload, err := d.do(ctx, http.MethodGet, d.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", d.config.URL, resp.Status)
+	}
+	return d.receive(payload, d.config.URL)
+}
+
+func (d *PollDevice) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	var mapping *HTTPCommand
+	for i := range d.config.Commands {
+		if d.config.Commands[i].Command == command.Name {
+			mapping = &d.config.Commands[i]
+		}
+	}
+	if mapping == nil {
+		return nil, core.NewUnknownCommandError(command.Name)
+	}
+	if command.CorrelationId == "" {
+		command.CorrelationId = core.NewCorrelationId()
+	}
+
+	vars := make(map[string]string, len(command.Args))
+	for name, value := range command.Args {
+		vars[name] = core.FormatValue(value)
+	}
+	url, err := core.RenderTemplate(mapping.URL, vars)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if mapping.Body != "" {
+		rendered, err := core.RenderTemplate(mapping.Body, vars)
+		if err != nil {
+			return nil, err
+		}
+		body = []byte(rendered)
+	} else if body, err = json.Marshal(command.Args); err != nil {
+		return nil, err
+	}
+	method := mapping.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	return d.call(ctx, command, method, url, body)
+}
+
+// call makes the request of a command. The response body, if JSON, becomes
+// the result payload.
+func (d *PollDevice) call(ctx context.Context, command *core.Command, method string, url string, body []byte) (*core.CommandResult, error) {
+	resp, payload, err := d.do(ctx, method, url, body)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, core.ErrCommandTimeout
+		}
+		deviceErr := core.NewDeviceError(d.id, core.ErrorPublishFailed, err)
+		d.errors.Publish(deviceErr)
+		return nil, deviceErr
+	}
+
+	result := &core.CommandResult{CorrelationId: command.CorrelationId, Success: resp.StatusCode < 300}
+	if !result.Success {
+		result.Error = resp.Status
+	}
+	if json.Valid(payload) {
+		result.Payload = payload
+	}
+	return result, nil
+}
+
+// NewPoller creates a poller for the configured devices.
+func NewPoller(devMan core.DeviceManager, configs []PollConfig) *core.Poller[PollConfig] {
+	return core.NewPoller(devMan, "HTTP", configs, func(config PollConfig) (core.PolledDevice, error) {
+		return NewPollDevice(config)
+	})
+}
@@ -0,0 +1,88 @@
+package httpdevice
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+func TestPollDevice(t *testing.T) {
+	commands := make(chan string, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /status":
+			io.WriteString(w, `{"output": {"voltage": 24.1, "enabled": true}}`)
+		case "PUT /output/1":
+			body, _ := io.ReadAll(r.Body)
+			commands <- string(body)
+			io.WriteString(w, `{"ok": true}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer api.Close()
+
+	dev, err := NewPollDevice(PollConfig{
+		Id:      "psu-http",
+		URL:     api.URL + "/status",
+		Headers: map[string]string{"X-Api-Key": "secret"},
+		Descriptor: &core.Descriptor{Model: "psu", Commands: []core.CommandSpec{
+			{Name: "power", Args: []core.ArgSpec{{Name: "state", Type: core.ArgString}, {Name: "channel", Type: core.ArgInteger}}},
+		}, Properties: []core.PropertySpec{{Name: "voltage", Unit: "V"}}},
+		Properties: map[string]string{"voltage": "$.output.voltage", "enabled": "$.output.enabled"},
+		Commands: []HTTPCommand{
+			{Command: "power", Method: http.MethodPut, URL: api.URL + "/output/{channel}", Body: `{"enabled": "{state}"}`},
+		},
+	})
+	if err != nil {
+		t.Fatal("Expected a device, but got", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dev.Poll(ctx); err != nil {
+		t.Fatal("Expected the poll to succeed, but got", err)
+	}
+	if p, _ := dev.GetState().Get("voltage"); p.Value != 24.1 || p.Unit != "V" {
+		t.Fatal("Expected voltage 24.1 V, but got", p)
+	}
+	if p, _ := dev.GetState().Get("enabled"); p.Value != true {
+		t.Fatal("Expected enabled, but got", p)
+	}
+
+	result, err := dev.SendCommand(ctx, &core.Command{Name: "power", Args: map[string]any{"state": "on", "channel": 1.0}})
+	if err != nil || !result.Success || string(result.Payload) != `{"ok": true}` {
+		t.Fatal("Expected a successful result, but got", result, err)
+	}
+	if body := <-commands; body != `{"enabled": "on"}` {
+		t.Fatal(`Expected {"enabled": "on"}, but got`, body)
+	}
+
+	result, _ = dev.SendCommand(ctx, &core.Command{Name: "power", Args: map[string]any{"state": "on", "channel": 2.0}})
+	if result == nil || result.Success || result.Error != "404 Not Found" {
+		t.Fatal("Expected a failed result, but got", result)
+	}
+}
+
+func TestPollConfigDurations(t *testing.T) {
+	dev, err := NewPollDevice(PollConfig{Id: "psu-http", URL: "http://psu.local/status", Interval: "1m"})
+	if err != nil || dev.PollInterval() != time.Minute {
+		t.Fatal("Expected a poll interval of 1m, but got", dev, err)
+	}
+	for _, config := range []PollConfig{{Interval: "30"}, {Interval: "0s"}, {Timeout: "-5s"}} {
+		config.Id, config.URL = "psu-http", "http://psu.local/status"
+		if _, err := NewPollDevice(config); !errors.Is(err, core.ErrInvalidDescriptor) {
+			t.Fatal("Expected", core.ErrInvalidDescriptor, "for", config, ", but got", err)
+		}
+	}
+}
@@ -6,8 +6,8 @@ import (
 
 func main() {
 
-	RunApplication()
+	cleanup := RunApplication()
 
 	system.WaitForOsSignal()
-	// Cleanup
+	cleanup()
 }
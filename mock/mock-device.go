@@ -3,13 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -31,6 +32,10 @@ func main() {
 	deviceName := "psu1"
 	commandTopic := "devices/" + deviceName + "/command"
 	stateTopic := "devices/" + deviceName + "/state"
+	resultTopic := "devices/" + deviceName + "/command/result"
+	descriptorTopic := "devices/" + deviceName + "/descriptor"
+	errorTopic := "devices/" + deviceName + "/error"
+	statusTopic := "devices/" + deviceName + "/status"
 
 	cliCfg := autopaho.ClientConfig{
 		ConnectUsername: "psu1",
@@ -44,6 +49,13 @@ func main() {
 		// the server will not queue messages while it is down. The specific setting will depend upon your needs
 		// (60 = 1 minute, 3600 = 1 hour, 86400 = one day, 0xFFFFFFFE = 136 years, 0xFFFFFFFF = don't expire)
 		SessionExpiryInterval: 60,
+		// The broker publishes the will if the connection drops without a DISCONNECT
+		WillMessage: &paho.WillMessage{
+			Retain:  true,
+			QoS:     1,
+			Topic:   statusTopic,
+			Payload: []byte("offline"),
+		},
 		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
 			fmt.Println("mqtt connection up")
 			// Subscribing in the OnConnectionUp callback is recommended (ensures the subscription is reestablished if
@@ -56,6 +68,15 @@ func main() {
 				fmt.Printf("failed to subscribe (%s). This is likely to mean no messages will be received.", err)
 			}
 			fmt.Println("mqtt subscription made")
+
+			if _, err := cm.Publish(context.Background(), &paho.Publish{
+				QoS:     1,
+				Retain:  true,
+				Topic:   descriptorTopic,
+				Payload: descriptor,
+			}); err != nil {
+				fmt.Printf("failed to publish descriptor (%s)\n", err)
+			}
 		},
 		OnConnectError: func(err error) {
 			 fmt.Printf("error whilst attempting connection: %s\n", err)
@@ -69,6 +90,8 @@ func main() {
 			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
 				func(pr paho.PublishReceived) (bool, error) {
 					fmt.Printf("received message on topic %s; body: %s (retain: %t)\n", pr.Packet.Topic, pr.Packet.Payload, pr.Packet.Retain)
+					// Publishing from within the callback would block the client, so reply asynchronously
+					go replyToCommand(pr.Client, resultTopic, errorTopic, pr.Packet)
 					return true, nil
 				}},
 			OnClientError: func(err error) { fmt.Printf("client error: %s\n", err) },
@@ -92,7 +115,6 @@ func main() {
 			panic(err)
 		}
 
-		state := make(map[string]string)
 		ticker := time.NewTicker(time.Second)
 		msgCount := 0
 		defer ticker.Stop()
@@ -101,10 +123,27 @@ func main() {
 			case <-ticker.C:
 				msgCount++
 
-				state["voltage"] = strconv.Itoa(rand.Intn(200) + 50)
-				state["current"] = strconv.Itoa(rand.Intn(5) + 1)
+				psu.mutex.Lock()
+				state := map[string]any{
+					"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+					"properties": map[string]any{
+						"voltage":          psu.voltage(),
+						"current":          1 + rand.Float64()*4,
+						"power":            psu.power,
+						"voltage_setpoint": psu.setpoint,
+						"channels": []any{
+							map[string]any{"voltage": 12 + rand.Float64(), "current": rand.Float64()},
+							map[string]any{"voltage": 5 + rand.Float64(), "current": rand.Float64()},
+						},
+					},
+					"units": map[string]string{
+						"voltage": "V",
+						"current": "A",
+					},
+				}
 
 				payload, err := json.Marshal(state)
+				psu.mutex.Unlock()
 				if err != nil {
 					log.Println("Failed to convert state", state, "to string")
 					continue
@@ -134,3 +173,120 @@ func main() {
 		}
 	}
 }
+
+var descriptor = []byte(`{
+	"model": "mock-psu",
+	"firmware": "1.0.0",
+	"deviceType": "psu",
+	"commands": [
+		{"name": "power", "args": [{"name": "state", "type": "string", "required": true, "enum": ["on", "off"]}]},
+		{"name": "set_voltage", "args": [
+			{"name": "volts", "type": "number", "required": true, "min": 0, "max": 250},
+			{"name": "channel", "type": "integer", "default": 0, "min": 0, "max": 1}
+		]}
+	],
+	"properties": [
+		{"name": "voltage", "type": "number", "unit": "V"},
+		{"name": "current", "type": "number", "unit": "A"},
+		{"name": "power", "type": "string", "setter": {"command": "power", "arg": "state"}},
+		{"name": "voltage_setpoint", "type": "number", "unit": "V", "setter": {"command": "set_voltage", "arg": "volts"}},
+		{"name": "channels", "type": "array"}
+	]
+}`)
+
+var errOvervoltage = errors.New("setpoint above the overvoltage protection limit")
+
+// simulatedPsu is the state of the mock power supply, changed by the commands it receives
+type simulatedPsu struct {
+	mutex    sync.Mutex
+	power    string
+	setpoint float64
+}
+
+var psu = &simulatedPsu{power: "on", setpoint: 120}
+
+// voltage must be called with the mutex held
+func (p *simulatedPsu) voltage() float64 {
+	if p.power != "on" {
+		return 0
+	}
+	return p.setpoint + rand.Float64() - 0.5
+}
+
+// execute must be called with the mutex held
+func (p *simulatedPsu) execute(name string, args map[string]any) error {
+	switch name {
+	case "power":
+		state, _ := args["state"].(string)
+		p.power = state
+	case "set_voltage":
+		volts, ok := args["volts"].(float64)
+		if !ok {
+			return fmt.Errorf("volts must be a number")
+		}
+		if volts > 240 {
+			return errOvervoltage
+		}
+		p.setpoint = volts
+	default:
+		return fmt.Errorf("unknown command %s", name)
+	}
+	return nil
+}
+
+func publishFault(client *paho.Client, errorTopic string, code string, message string) {
+	payload, _ := json.Marshal(map[string]string{
+		"code":      code,
+		"message":   message,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if _, err := client.Publish(context.Background(), &paho.Publish{Topic: errorTopic, Payload: payload}); err != nil {
+		log.Println("failed to publish fault:", err)
+	}
+}
+
+func replyToCommand(client *paho.Client, resultTopic string, errorTopic string, pk *paho.Publish) {
+	command := struct {
+		Name          string         `json:"name"`
+		Args          map[string]any `json:"args"`
+		CorrelationId string         `json:"correlationId"`
+	}{}
+
+	result := map[string]any{}
+	if err := json.Unmarshal(pk.Payload, &command); err != nil {
+		result["success"] = false
+		result["error"] = err.Error()
+	} else {
+		result["correlationId"] = command.CorrelationId
+		psu.mutex.Lock()
+		err := psu.execute(command.Name, command.Args)
+		psu.mutex.Unlock()
+		if errors.Is(err, errOvervoltage) {
+			publishFault(client, errorTopic, "overvoltage_protection", err.Error())
+		}
+		if err != nil {
+			result["success"] = false
+			result["error"] = err.Error()
+		} else {
+			result["success"] = true
+			result["payload"] = map[string]any{"executed": command.Name, "args": command.Args}
+		}
+	}
+
+	payload, _ := json.Marshal(result)
+	reply := &paho.Publish{
+		QoS:     0,
+		Topic:   resultTopic,
+		Payload: payload,
+	}
+	if pk.Properties != nil {
+		if pk.Properties.ResponseTopic != "" {
+			reply.Topic = pk.Properties.ResponseTopic
+		}
+		reply.Properties = &paho.PublishProperties{CorrelationData: pk.Properties.CorrelationData}
+	}
+
+	if _, err := client.Publish(context.Background(), reply); err != nil {
+		log.Println("failed to publish command result:", err)
+	}
+}
@@ -0,0 +1,159 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultTimeout = 3 * time.Second
+
+// Client talks to a single unit behind a Modbus TCP address. Requests are
+// sent one at a time; the connection is dialed on the first request and again
+// after it failed.
+type Client struct {
+	address     string
+	unitId      byte
+	timeout     time.Duration
+	mutex       sync.Mutex
+	conn        net.Conn
+	transaction uint16
+}
+
+func NewClient(address string, unitId byte, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Client{address: address, unitId: unitId, timeout: timeout}
+}
+
+func (c *Client) request(ctx context.Context, function byte, data []byte) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if c.conn == nil {
+		dialer := net.Dialer{Deadline: deadline}
+		conn, err := dialer.DialContext(ctx, "tcp", c.address)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+
+	c.transaction++
+	req := frame{transaction: c.transaction, unitId: c.unitId, function: function, data: data}
+	c.conn.SetDeadline(deadline)
+	if _, err := c.conn.Write(req.marshal()); err != nil {
+		c.reset()
+		return nil, err
+	}
+	for {
+		resp, err := readFrame(c.conn)
+		if err != nil {
+			c.reset()
+			return nil, err
+		}
+		// A response to a request that timed out earlier
+		if resp.transaction != req.transaction {
+			continue
+		}
+		switch {
+		case resp.function == function|0x80 && len(resp.data) == 1:
+			return nil, &Exception{Function: function, Code: resp.data[0]}
+		case resp.function != function:
+			return nil, ErrInvalidResponse
+		}
+		return resp.data, nil
+	}
+}
+
+// reset drops a connection that is out of step with the device
+func (c *Client) reset() {
+	c.conn.Close()
+	c.conn = nil
+}
+
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *Client) ReadHoldingRegisters(ctx context.Context, address uint16, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(ctx, FuncReadHoldingRegisters, address, quantity)
+}
+
+func (c *Client) ReadInputRegisters(ctx context.Context, address uint16, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(ctx, FuncReadInputRegisters, address, quantity)
+}
+
+func (c *Client) readRegisters(ctx context.Context, function byte, address uint16, quantity uint16) ([]uint16, error) {
+	data, err := c.request(ctx, function, addressQuantity(address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1+2*int(quantity) || int(data[0]) != 2*int(quantity) {
+		return nil, fmt.Errorf("%w: %d bytes for %d registers", ErrInvalidResponse, len(data), quantity)
+	}
+	registers := make([]uint16, quantity)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(data[1+2*i:])
+	}
+	return registers, nil
+}
+
+func (c *Client) ReadCoils(ctx context.Context, address uint16, quantity uint16) ([]bool, error) {
+	data, err := c.request(ctx, FuncReadCoils, addressQuantity(address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 1+(int(quantity)+7)/8 {
+		return nil, fmt.Errorf("%w: %d bytes for %d coils", ErrInvalidResponse, len(data), quantity)
+	}
+	coils := make([]bool, quantity)
+	for i := range coils {
+		coils[i] = data[1+i/8]&(1<<(i%8)) != 0
+	}
+	return coils, nil
+}
+
+func (c *Client) WriteSingleCoil(ctx context.Context, address uint16, value bool) error {
+	var v uint16
+	if value {
+		v = 0xFF00
+	}
+	_, err := c.request(ctx, FuncWriteSingleCoil, addressQuantity(address, v))
+	return err
+}
+
+func (c *Client) WriteSingleRegister(ctx context.Context, address uint16, value uint16) error {
+	_, err := c.request(ctx, FuncWriteSingleRegister, addressQuantity(address, value))
+	return err
+}
+
+func (c *Client) WriteMultipleRegisters(ctx context.Context, address uint16, values []uint16) error {
+	data := addressQuantity(address, uint16(len(values)))
+	data = append(data, byte(2*len(values)))
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	_, err := c.request(ctx, FuncWriteMultipleRegisters, data)
+	return err
+}
+
+func addressQuantity(address uint16, quantity uint16) []byte {
+	data := binary.BigEndian.AppendUint16(nil, address)
+	return binary.BigEndian.AppendUint16(data, quantity)
+}
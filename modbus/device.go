@@ -0,0 +1,346 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	DeviceType          = "modbus"
+	DefaultPollInterval = 10 * time.Second
+)
+
+type RegisterKind string
+
+const (
+	Holding RegisterKind = "holding"
+	Input   RegisterKind = "input"
+	Coil    RegisterKind = "coil"
+)
+
+type DataType string
+
+const (
+	Uint16  DataType = "uint16"
+	Int16   DataType = "int16"
+	Uint32  DataType = "uint32"
+	Int32   DataType = "int32"
+	Float32 DataType = "float32"
+)
+
+// WordOrder is the order of the registers of 32 bit values. Most devices
+// send the high word first.
+type WordOrder string
+
+const (
+	HighWordFirst WordOrder = "high_first"
+	LowWordFirst  WordOrder = "low_first"
+)
+
+// RegisterSpec maps a register, or a pair of registers for 32 bit types, to a
+// property. The property is raw*Scale + Offset. Coils are bools and ignore
+// the type and scaling.
+type RegisterSpec struct {
+	Property  string       `json:"property"`
+	Kind      RegisterKind `json:"kind"`
+	Address   uint16       `json:"address"`
+	Type      DataType     `json:"type,omitempty"`
+	WordOrder WordOrder    `json:"wordOrder,omitempty"`
+	Scale     float64      `json:"scale,omitempty"`
+	Offset    float64      `json:"offset,omitempty"`
+	Unit      string       `json:"unit,omitempty"`
+	// Writable holding registers and coils get a set_<property> command.
+	Writable bool `json:"writable,omitempty"`
+}
+
+type DeviceConfig struct {
+	Id      string `json:"id"`
+	Model   string `json:"model"`
+	Address string `json:"address"`
+	UnitId  byte   `json:"unitId"`
+	// PollInterval and Timeout are durations such as "10s". PollInterval
+	// defaults to DefaultPollInterval.
+	PollInterval string         `json:"pollInterval,omitempty"`
+	Timeout      string         `json:"timeout,omitempty"`
+	Registers    []RegisterSpec `json:"registers"`
+}
+
+// Device polls the registers of a Modbus TCP device into its state and turns
+// set_<property> commands into register and coil writes.
+type Device struct {
+	config       DeviceConfig
+	pollInterval time.Duration
+	client       *Client
+	descriptor   *core.Descriptor
+	state        *core.State
+	stateMutex   sync.RWMutex
+	states       core.Broadcaster[*core.State]
+	errors       core.Broadcaster[error]
+}
+
+func NewDevice(config DeviceConfig) (*Device, error) {
+	if config.Id == "" || config.Address == "" {
+		return nil, fmt.Errorf("%w: a modbus device needs an id and an address", core.ErrInvalidDescriptor)
+	}
+	pollInterval, err := core.ParseDuration("poll interval", config.PollInterval, DefaultPollInterval)
+	if err == nil && pollInterval == 0 {
+		err = errors.New("poll interval of 0")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+	}
+	timeout, err := core.ParseDuration("timeout", config.Timeout, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+	}
+	descriptor := &core.Descriptor{Model: config.Model, DeviceType: DeviceType}
+	descriptor.SetReportInterval(pollInterval)
+	if descriptor.Model == "" {
+		descriptor.Model = "modbus"
+	}
+	for _, r := range config.Registers {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%w: register %s: %v", core.ErrInvalidDescriptor, r.Property, err)
+		}
+		spec := core.PropertySpec{Name: r.Property, Type: core.TypeNumber, Unit: r.Unit}
+		arg := core.ArgSpec{Name: "value", Type: core.ArgNumber, Required: true}
+		if r.Kind == Coil {
+			spec.Type, arg.Type = core.TypeBool, core.ArgBool
+		}
+		if r.Writable {
+			cmd := core.CommandSpec{Name: "set_" + r.Property, Description: "Write " + r.Property, Args: []core.ArgSpec{arg}}
+			descriptor.Commands = append(descriptor.Commands, cmd)
+			spec.Setter = &core.PropertySetter{Command: cmd.Name, Arg: "value"}
+		}
+		descriptor.Properties = append(descriptor.Properties, spec)
+	}
+
+	return &Device{
+		config:       config,
+		pollInterval: pollInterval,
+		client:       NewClient(config.Address, config.UnitId, timeout),
+		descriptor:   descriptor,
+		state:        core.NewState(time.Now()),
+	}, nil
+}
+
+func (r *RegisterSpec) validate() error {
+	switch r.Kind {
+	case Holding, Input, Coil:
+	default:
+		return fmt.Errorf("unknown register kind %q", r.Kind)
+	}
+	switch r.Type {
+	case "", Uint16, Int16, Uint32, Int32, Float32:
+	default:
+		return fmt.Errorf("unknown data type %q", r.Type)
+	}
+	if r.Writable && r.Kind == Input {
+		return errors.New("input registers are read-only")
+	}
+	return nil
+}
+
+// registers is the number of registers a value spans.
+func (r *RegisterSpec) registers() uint16 {
+	switch r.Type {
+	case Uint32, Int32, Float32:
+		return 2
+	}
+	return 1
+}
+
+func (r *RegisterSpec) scale() float64 {
+	if r.Scale == 0 {
+		return 1
+	}
+	return r.Scale
+}
+
+// decode turns the raw registers into the property value.
+func (r *RegisterSpec) decode(registers []uint16) float64 {
+	var raw float64
+	switch r.Type {
+	case Int16:
+		raw = float64(int16(registers[0]))
+	case Uint32, Int32, Float32:
+		hi, lo := registers[0], registers[1]
+		if r.WordOrder == LowWordFirst {
+			hi, lo = lo, hi
+		}
+		bits := uint32(hi)<<16 | uint32(lo)
+		switch r.Type {
+		case Uint32:
+			raw = float64(bits)
+		case Int32:
+			raw = float64(int32(bits))
+		case Float32:
+			raw = float64(math.Float32frombits(bits))
+		}
+	default:
+		raw = float64(registers[0])
+	}
+	return raw*r.scale() + r.Offset
+}
+
+// encode turns a property value into the registers to write.
+func (r *RegisterSpec) encode(value float64) ([]uint16, error) {
+	raw := (value - r.Offset) / r.scale()
+	var bits uint32
+	switch r.Type {
+	case Float32:
+		bits = math.Float32bits(float32(raw))
+	default:
+		raw = math.Round(raw)
+		min, max := r.rawRange()
+		if raw < min || raw > max {
+			return nil, fmt.Errorf("%v is out of range for %s", value, r.Property)
+		}
+		if raw < 0 {
+			bits = uint32(int32(raw))
+		} else {
+			bits = uint32(raw)
+		}
+	}
+	if r.registers() == 1 {
+		return []uint16{uint16(bits)}, nil
+	}
+	hi, lo := uint16(bits>>16), uint16(bits)
+	if r.WordOrder == LowWordFirst {
+		hi, lo = lo, hi
+	}
+	return []uint16{hi, lo}, nil
+}
+
+func (r *RegisterSpec) rawRange() (float64, float64) {
+	switch r.Type {
+	case Int16:
+		return math.MinInt16, math.MaxInt16
+	case Uint32:
+		return 0, math.MaxUint32
+	case Int32:
+		return math.MinInt32, math.MaxInt32
+	}
+	return 0, math.MaxUint16
+}
+
+func (d *Device) PollInterval() time.Duration {
+	return d.pollInterval
+}
+
+// Poll reads all registers. A failed register fails the whole poll, so the
+// state always comes from a single pass.
+func (d *Device) Poll(ctx context.Context) error {
+	state := core.NewState(time.Now())
+	for _, r := range d.config.Registers {
+		var value any
+		switch r.Kind {
+		case Coil:
+			coils, err := d.client.ReadCoils(ctx, r.Address, 1)
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", r.Property, err)
+			}
+			value = coils[0]
+		default:
+			read := d.client.ReadHoldingRegisters
+			if r.Kind == Input {
+				read = d.client.ReadInputRegisters
+			}
+			registers, err := read(ctx, r.Address, r.registers())
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", r.Property, err)
+			}
+			value = r.decode(registers)
+		}
+		state.Set(r.Property, value, r.Unit)
+	}
+
+	d.stateMutex.Lock()
+	d.state = state
+	d.stateMutex.Unlock()
+	d.states.Publish(state)
+	return nil
+}
+
+func (d *Device) Id() string {
+	return d.config.Id
+}
+
+func (d *Device) Descriptor() *core.Descriptor {
+	return d.descriptor
+}
+
+func (d *Device) ListCommands() ([]core.CommandSpec, error) {
+	return d.descriptor.Commands, nil
+}
+
+func (d *Device) GetState() *core.State {
+	d.stateMutex.RLock()
+	defer d.stateMutex.RUnlock()
+	return d.state
+}
+
+func (d *Device) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	var register *RegisterSpec
+	for i := range d.config.Registers {
+		if r := &d.config.Registers[i]; r.Writable && "set_"+r.Property == command.Name {
+			register = r
+		}
+	}
+	if register == nil {
+		return nil, core.NewUnknownCommandError(command.Name)
+	}
+	if command.CorrelationId == "" {
+		command.CorrelationId = core.NewCorrelationId()
+	}
+
+	var err error
+	switch value := command.Args["value"].(type) {
+	case bool:
+		err = d.client.WriteSingleCoil(ctx, register.Address, value)
+	case float64:
+		var registers []uint16
+		if registers, err = register.encode(value); err != nil {
+			return nil, &core.CommandValidationError{Command: command.Name, Errors: []core.ArgError{{Arg: "value", Message: err.Error()}}}
+		}
+		if len(registers) == 1 {
+			err = d.client.WriteSingleRegister(ctx, register.Address, registers[0])
+		} else {
+			err = d.client.WriteMultipleRegisters(ctx, register.Address, registers)
+		}
+	default:
+		return nil, &core.CommandValidationError{Command: command.Name, Errors: []core.ArgError{{Arg: "value", Message: "expected a number or a bool"}}}
+	}
+
+	// Modbus writes are acknowledged, so the result is known either way
+	var exception *Exception
+	switch {
+	case errors.As(err, &exception):
+		return &core.CommandResult{CorrelationId: command.CorrelationId, Error: exception.Error()}, nil
+	case err != nil:
+		deviceErr := core.NewDeviceError(d.config.Id, core.ErrorPublishFailed, err)
+		d.errors.Publish(deviceErr)
+		return nil, deviceErr
+	}
+	return &core.CommandResult{CorrelationId: command.CorrelationId, Success: true}, nil
+}
+
+func (d *Device) SubscribeToStateChanges(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[*core.State], error) {
+	return d.states.Subscribe(ctx, opts), nil
+}
+
+func (d *Device) SubscribeToErrors(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[error], error) {
+	return d.errors.Subscribe(ctx, opts), nil
+}
+
+func (d *Device) Close() error {
+	d.states.Close()
+	d.errors.Close()
+	return d.client.Close()
+}
@@ -0,0 +1,134 @@
+package modbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/devicetest"
+)
+
+func startSimulator(t *testing.T) *Simulator {
+	sim := NewSimulator()
+	if err := sim.Start("127.0.0.1:0"); err != nil {
+		t.Fatal("Expected the simulator to start, but got", err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	return sim
+}
+
+func TestRegisterDecoding(t *testing.T) {
+	bits := math.Float32bits(230.5)
+	for _, test := range []struct {
+		spec      RegisterSpec
+		registers []uint16
+		expected  float64
+	}{
+		{RegisterSpec{Type: Uint16, Scale: 0.1}, []uint16{2415}, 241.5},
+		{RegisterSpec{Type: Int16}, []uint16{0xFFF6}, -10},
+		{RegisterSpec{Type: Int32}, []uint16{0xFFFF, 0xFFFE}, -2},
+		{RegisterSpec{Type: Uint32, WordOrder: LowWordFirst}, []uint16{0x0002, 0x0001}, 0x10002},
+		{RegisterSpec{Type: Float32, WordOrder: LowWordFirst}, []uint16{uint16(bits), uint16(bits >> 16)}, 230.5},
+		{RegisterSpec{Type: Int16, Scale: 0.5, Offset: -40}, []uint16{100}, 10},
+	} {
+		if value := test.spec.decode(test.registers); math.Abs(value-test.expected) > 1e-9 {
+			t.Fatal("Expected", test.expected, ", but got", value, "for", test.spec)
+		}
+		registers, err := test.spec.encode(test.expected)
+		if err != nil || registers[0] != test.registers[0] {
+			t.Fatal("Expected", test.registers, ", but got", registers, err, "for", test.spec)
+		}
+	}
+	if _, err := (&RegisterSpec{Type: Uint16}).encode(-1); err == nil {
+		t.Fatal("Expected an error for a negative uint16")
+	}
+}
+
+func TestDevice(t *testing.T) {
+	sim := startSimulator(t)
+	sim.SetInputRegisters(0, 2305)
+	sim.SetHoldingRegisters(10, 0, 48)
+	sim.SetCoil(3, true)
+
+	dev, err := NewDevice(DeviceConfig{
+		Id:      "psu-1",
+		Address: sim.Addr(),
+		Registers: []RegisterSpec{
+			{Property: "voltage", Kind: Input, Address: 0, Scale: 0.1, Unit: "V"},
+			{Property: "limit", Kind: Holding, Address: 10, Type: Uint32, Writable: true},
+			{Property: "output", Kind: Coil, Address: 3, Writable: true},
+		},
+	})
+	if err != nil {
+		t.Fatal("Expected a device, but got", err)
+	}
+	defer dev.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dev.Poll(ctx); err != nil {
+		t.Fatal("Expected the poll to succeed, but got", err)
+	}
+	state := dev.GetState()
+	if p, _ := state.Get("voltage"); math.Abs(p.Value.(float64)-230.5) > 1e-9 || p.Unit != "V" {
+		t.Fatal("Expected voltage 230.5 V, but got", p)
+	}
+	if p, _ := state.Get("limit"); p.Value != 48.0 {
+		t.Fatal("Expected limit 48, but got", p)
+	}
+	if p, _ := state.Get("output"); p.Value != true {
+		t.Fatal("Expected output true, but got", p)
+	}
+
+	result, err := dev.SendCommand(ctx, &core.Command{Name: "set_limit", Args: map[string]any{"value": 70000.0}})
+	if err != nil || !result.Success {
+		t.Fatal("Expected a successful write, but got", result, err)
+	}
+	if registers := sim.HoldingRegisters(10, 2); registers[0] != 1 || registers[1] != 4464 {
+		t.Fatal("Expected registers [1 4464], but got", registers)
+	}
+	if _, err := dev.SendCommand(ctx, &core.Command{Name: "set_output", Args: map[string]any{"value": false}}); err != nil || sim.Coil(3) {
+		t.Fatal("Expected the coil to be cleared, but got", err)
+	}
+}
+
+func TestDeviceConfig(t *testing.T) {
+	var config DeviceConfig
+	if err := json.Unmarshal([]byte(`{"id":"meter","address":"10.0.0.5:502","pollInterval":"2s"}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	dev, err := NewDevice(config)
+	if err != nil || dev.PollInterval() != 2*time.Second || dev.Descriptor().ReportInterval != 2 {
+		t.Fatal("Expected a poll interval of 2s, but got", dev, err)
+	}
+	for _, interval := range []string{"10", "-1s", "0s"} {
+		config.PollInterval = interval
+		if _, err := NewDevice(config); !errors.Is(err, core.ErrInvalidDescriptor) {
+			t.Fatal("Expected", core.ErrInvalidDescriptor, "for", interval, ", but got", err)
+		}
+	}
+}
+
+func TestDriverRegistersDevices(t *testing.T) {
+	sim := startSimulator(t)
+	sim.SetHoldingRegisters(0, 7)
+	devMan := core.NewBasicDeviceManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DeviceConfig{Id: "meter", Address: sim.Addr(), PollInterval: "10ms",
+		Registers: []RegisterSpec{{Property: "count", Kind: Holding}}}
+	if err := NewDriver(devMan, []DeviceConfig{config}).Start(ctx); err != nil {
+		t.Fatal("Expected the driver to start, but got", err)
+	}
+	devMan.SetDeviceOffline("meter", "test")
+
+	devicetest.WaitFor(t, "the device to come back online", func() bool {
+		record, err := devMan.GetDeviceRecord("meter")
+		return err == nil && record.Presence.Status == core.StatusOnline && record.LastState != nil
+	})
+}
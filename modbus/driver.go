@@ -0,0 +1,12 @@
+package modbus
+
+import (
+	"github.com/ilievs/fibers/core"
+)
+
+// NewDriver creates a poller for the configured Modbus devices.
+func NewDriver(devMan core.DeviceManager, configs []DeviceConfig) *core.Poller[DeviceConfig] {
+	return core.NewPoller(devMan, "Modbus", configs, func(config DeviceConfig) (core.PolledDevice, error) {
+		return NewDevice(config)
+	})
+}
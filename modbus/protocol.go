@@ -0,0 +1,81 @@
+// Package modbus polls Modbus TCP devices and exposes them as fibers devices.
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	FuncReadCoils              byte = 0x01
+	FuncReadHoldingRegisters   byte = 0x03
+	FuncReadInputRegisters     byte = 0x04
+	FuncWriteSingleCoil        byte = 0x05
+	FuncWriteSingleRegister    byte = 0x06
+	FuncWriteMultipleRegisters byte = 0x10
+)
+
+const (
+	ExceptionIllegalFunction    byte = 0x01
+	ExceptionIllegalDataAddress byte = 0x02
+	ExceptionIllegalDataValue   byte = 0x03
+	ExceptionDeviceFailure      byte = 0x04
+)
+
+// maxPDU is the largest protocol data unit, function code included.
+const maxPDU = 253
+
+var ErrInvalidResponse = errors.New("invalid modbus response")
+
+// Exception is the error a device answers a request with.
+type Exception struct {
+	Function byte
+	Code     byte
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("modbus exception %d for function %d", e.Code, e.Function)
+}
+
+// frame is a Modbus TCP application data unit: the MBAP header followed by
+// the function code and its data.
+type frame struct {
+	transaction uint16
+	unitId      byte
+	function    byte
+	data        []byte
+}
+
+func (f *frame) marshal() []byte {
+	buf := make([]byte, 8+len(f.data))
+	binary.BigEndian.PutUint16(buf[0:], f.transaction)
+	// buf[2:4] is the protocol id, always 0
+	binary.BigEndian.PutUint16(buf[4:], uint16(2+len(f.data)))
+	buf[6] = f.unitId
+	buf[7] = f.function
+	copy(buf[8:], f.data)
+	return buf
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > maxPDU+1 {
+		return nil, ErrInvalidResponse
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return nil, err
+	}
+	return &frame{
+		transaction: binary.BigEndian.Uint16(header[0:]),
+		unitId:      header[6],
+		function:    pdu[0],
+		data:        pdu[1:],
+	}, nil
+}
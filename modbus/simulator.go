@@ -0,0 +1,202 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// Simulator is an in-process Modbus TCP server holding coils, holding and
+// input registers in memory, for running the driver without real equipment.
+// Registers that were never set read as 0. Every unit id is answered alike.
+type Simulator struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	coils    map[uint16]bool
+	holding  map[uint16]uint16
+	input    map[uint16]uint16
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+func NewSimulator() *Simulator {
+	return &Simulator{
+		coils:   make(map[uint16]bool),
+		holding: make(map[uint16]uint16),
+		input:   make(map[uint16]uint16),
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// Start listens on address, use 127.0.0.1:0 for any free port.
+func (s *Simulator) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("modbus simulator stopped accepting connections:", err)
+				}
+				return
+			}
+			s.mutex.Lock()
+			s.conns[conn] = struct{}{}
+			s.mutex.Unlock()
+			s.wg.Add(1)
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *Simulator) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops listening and drops the open connections.
+func (s *Simulator) Close() error {
+	err := s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Simulator) SetCoil(address uint16, value bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.coils[address] = value
+}
+
+func (s *Simulator) Coil(address uint16) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.coils[address]
+}
+
+func (s *Simulator) SetHoldingRegisters(address uint16, values ...uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, v := range values {
+		s.holding[address+uint16(i)] = v
+	}
+}
+
+func (s *Simulator) HoldingRegisters(address uint16, quantity uint16) []uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return readMap(s.holding, address, quantity)
+}
+
+func (s *Simulator) SetInputRegisters(address uint16, values ...uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, v := range values {
+		s.input[address+uint16(i)] = v
+	}
+}
+
+func readMap(registers map[uint16]uint16, address uint16, quantity uint16) []uint16 {
+	values := make([]uint16, quantity)
+	for i := range values {
+		values[i] = registers[address+uint16(i)]
+	}
+	return values
+}
+
+func (s *Simulator) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		req, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		resp := frame{transaction: req.transaction, unitId: req.unitId, function: req.function}
+		data, exception := s.handle(req.function, req.data)
+		if exception != 0 {
+			resp.function |= 0x80
+			data = []byte{exception}
+		}
+		resp.data = data
+		if _, err := conn.Write(resp.marshal()); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a request, or returns the exception code to answer it with.
+func (s *Simulator) handle(function byte, data []byte) ([]byte, byte) {
+	if len(data) < 4 {
+		return nil, ExceptionIllegalDataValue
+	}
+	address := binary.BigEndian.Uint16(data)
+	quantity := binary.BigEndian.Uint16(data[2:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch function {
+	case FuncReadCoils:
+		if quantity == 0 || quantity > 2000 {
+			return nil, ExceptionIllegalDataValue
+		}
+		resp := make([]byte, 1+(quantity+7)/8)
+		resp[0] = byte(len(resp) - 1)
+		for i := uint16(0); i < quantity; i++ {
+			if s.coils[address+i] {
+				resp[1+i/8] |= 1 << (i % 8)
+			}
+		}
+		return resp, 0
+	case FuncReadHoldingRegisters, FuncReadInputRegisters:
+		if quantity == 0 || quantity > 125 {
+			return nil, ExceptionIllegalDataValue
+		}
+		registers := s.holding
+		if function == FuncReadInputRegisters {
+			registers = s.input
+		}
+		resp := []byte{byte(2 * quantity)}
+		for _, v := range readMap(registers, address, quantity) {
+			resp = binary.BigEndian.AppendUint16(resp, v)
+		}
+		return resp, 0
+	case FuncWriteSingleCoil:
+		if quantity != 0xFF00 && quantity != 0 {
+			return nil, ExceptionIllegalDataValue
+		}
+		s.coils[address] = quantity == 0xFF00
+		return data[:4], 0
+	case FuncWriteSingleRegister:
+		s.holding[address] = quantity
+		return data[:4], 0
+	case FuncWriteMultipleRegisters:
+		if quantity == 0 || len(data) != 5+2*int(quantity) || int(data[4]) != 2*int(quantity) {
+			return nil, ExceptionIllegalDataValue
+		}
+		for i := uint16(0); i < quantity; i++ {
+			s.holding[address+i] = binary.BigEndian.Uint16(data[5+2*i:])
+		}
+		return data[:4], 0
+	}
+	return nil, ExceptionIllegalFunction
+}
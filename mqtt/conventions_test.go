@@ -0,0 +1,140 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+// sendCommand sends a command through a manager, which waits for the reply.
+func sendCommand(dev core.SimpleDevice, command *core.Command) (*core.CommandResult, error) {
+	devMan := core.NewBasicDeviceManager()
+	devMan.AddDevice(dev)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return devMan.SendCommand(ctx, dev.Id(), command)
+}
+
+func TestTasmotaDevice(t *testing.T) {
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	dev, err := NewTasmotaDevice(server, "DVES_1A2B3C", "plug1")
+	if err != nil {
+		t.Fatal("Expected a device, but got", err)
+	}
+	defer dev.Close()
+
+	server.Publish("tele/plug1/SENSOR", []byte(`{"Time":"2024-05-01T10:00:00","ENERGY":{"Power":42,"Voltage":230},"TempUnit":"C"}`), false, 0)
+	server.Publish("stat/plug1/POWER", []byte("ON"), false, 0)
+
+	state := dev.GetState()
+	if p, _ := state.Get("energy_power"); p.Value != 42.0 || p.Unit != "W" {
+		t.Fatal("Expected energy_power 42 W, but got", p)
+	}
+	if p, _ := state.Get("power1"); p.Value != "on" {
+		t.Fatal("Expected power1 on, but got", p)
+	}
+
+	// Reply to commands like the device would
+	server.Subscribe("cmnd/plug1/+", nextSubscriptionId(), func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		go server.Publish("stat/plug1/RESULT", []byte(`{"POWER2":"`+string(pk.Payload)+`"}`), false, 0)
+	})
+	result, err := sendCommand(dev, &core.Command{Name: "power", Args: map[string]any{"state": "off", "relay": 2.0}})
+	if err != nil || !result.Success {
+		t.Fatal("Expected a successful result, but got", result, err)
+	}
+	if p, _ := dev.GetState().Get("power2"); p.Value != "off" {
+		t.Fatal("Expected power2 off, but got", p)
+	}
+}
+
+func TestShellyDevice(t *testing.T) {
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	dev, err := NewShellyDevice(server, "shelly1pm-A4CF12", "shelly1pm-A4CF12")
+	if err != nil {
+		t.Fatal("Expected a device, but got", err)
+	}
+	defer dev.Close()
+	if dev.Descriptor().Model != "shelly1pm" {
+		t.Fatal("Expected model shelly1pm, but got", dev.Descriptor().Model)
+	}
+
+	server.Publish("shellies/shelly1pm-A4CF12/relay/0/power", []byte("12.5"), false, 0)
+	if p, _ := dev.GetState().Get("relay_0_power"); p.Value != 12.5 || p.Unit != "W" {
+		t.Fatal("Expected relay_0_power 12.5 W, but got", p)
+	}
+
+	server.Subscribe("shellies/shelly1pm-A4CF12/relay/0/command", nextSubscriptionId(), func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		go server.Publish("shellies/shelly1pm-A4CF12/relay/0", pk.Payload, false, 0)
+	})
+	result, err := sendCommand(dev, &core.Command{Name: "relay", Args: map[string]any{"state": "on", "channel": 0.0}})
+	if err != nil || !result.Success {
+		t.Fatal("Expected a successful result, but got", result, err)
+	}
+	if p, _ := dev.GetState().Get("relay_0"); p.Value != "on" {
+		t.Fatal("Expected relay_0 on, but got", p)
+	}
+}
+
+func TestHomieDevice(t *testing.T) {
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	for topic, payload := range map[string]string{
+		"homie/thermostat/$homie":                       "4.0.0",
+		"homie/thermostat/$name":                        "Thermostat",
+		"homie/thermostat/$nodes":                       "heater",
+		"homie/thermostat/heater/$properties":           "temperature,target,mode",
+		"homie/thermostat/heater/temperature/$datatype": "float",
+		"homie/thermostat/heater/temperature/$unit":     "°C",
+		"homie/thermostat/heater/temperature":           "21.5",
+		"homie/thermostat/heater/target/$datatype":      "integer",
+		"homie/thermostat/heater/target/$settable":      "true",
+		"homie/thermostat/heater/target/$format":        "5:30",
+		"homie/thermostat/heater/target":                "20",
+		"homie/thermostat/heater/mode/$datatype":        "enum",
+		"homie/thermostat/heater/mode/$format":          "off,eco,comfort",
+		"homie/thermostat/heater/mode/$settable":        "true",
+		"homie/thermostat/$state":                       "ready",
+	} {
+		server.Publish(topic, []byte(payload), true, 0)
+	}
+
+	dev, err := NewHomieDevice(server, "thermostat")
+	if err != nil {
+		t.Fatal("Expected a device, but got", err)
+	}
+	defer dev.Close()
+	if dev.Descriptor().Model != "Thermostat" || len(dev.Descriptor().Commands) != 2 {
+		t.Fatal("Expected a Thermostat with 2 commands, but got", dev.Descriptor())
+	}
+	if p, _ := dev.GetState().Get("heater_temperature"); p.Value != 21.5 || p.Unit != "°C" {
+		t.Fatal("Expected heater_temperature 21.5 °C, but got", p)
+	}
+	// Homie only publishes changes, the retained values are all there is
+	devMan := core.NewBasicDeviceManager()
+	devMan.AddDevice(dev)
+	record, _ := devMan.GetDeviceRecord("thermostat")
+	if p, _ := record.LastState.Get("heater_target"); p.Value != 20.0 {
+		t.Fatal("Expected the retained values to be the last known state, but got", record.LastState)
+	}
+	spec, _ := core.FindCommandSpec(dev.Descriptor().Commands, "set_heater_target")
+	target := spec.Args[0]
+	if target.Type != core.ArgInteger || *target.Min != 5 || *target.Max != 30 {
+		t.Fatal("Expected an integer between 5 and 30, but got", target)
+	}
+
+	// Confirm like the device would
+	server.Subscribe("homie/thermostat/heater/target/set", nextSubscriptionId(), func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		go server.Publish("homie/thermostat/heater/target", pk.Payload, true, 0)
+	})
+	result, err := sendCommand(dev, &core.Command{Name: "set_heater_target", Args: map[string]any{"value": 23.0}})
+	if err != nil || !result.Success {
+		t.Fatal("Expected a successful result, but got", result, err)
+	}
+	if p, _ := dev.GetState().Get("heater_target"); p.Value != 23.0 {
+		t.Fatal("Expected heater_target 23, but got", p)
+	}
+}
@@ -2,7 +2,10 @@ package mqtt
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"log"
+	"time"
 
 	mochi "github.com/mochi-mqtt/server/v2"
 	mqtt "github.com/mochi-mqtt/server/v2"
@@ -11,15 +14,27 @@ import (
 	"github.com/ilievs/fibers/core"
 )
 
+const (
+	DefaultDescriptorTimeout = 5 * time.Second
+	// DefaultTemplate is the template key used when a device's model has no template of its own.
+	DefaultTemplate = "default"
+)
+
 type HookOptions struct {
 	MqttClient *MochiClient
 	DeviceManager core.DeviceManager
+	// DescriptorTimeout is how long to wait for a device to publish its descriptor.
+	DescriptorTimeout time.Duration
+	// Templates are used for devices that don't publish a descriptor, keyed by model.
+	Templates map[string]*core.Descriptor
 }
 
 type AddNewDeviceHook struct {
 	mochi.HookBase
 	mqttClient *MochiClient
 	devMan     core.DeviceManager
+	descriptorTimeout time.Duration
+	templates map[string]*core.Descriptor
 }
 
 // ID returns the ID of the hook.
@@ -32,6 +47,7 @@ func (h *AddNewDeviceHook) ID() string {
 func (h *AddNewDeviceHook) Provides(b byte) bool {
 	return bytes.Contains([]byte{
 		mochi.OnSessionEstablished,
+		mochi.OnWillSent,
 		mqtt.OnDisconnect,
 	}, []byte{b})
 }
@@ -50,32 +66,179 @@ func (h *AddNewDeviceHook) Init(config any) error {
 	opt := config.(*HookOptions)
 	h.mqttClient = opt.MqttClient
 	h.devMan = opt.DeviceManager
+	h.descriptorTimeout = opt.DescriptorTimeout
+	if h.descriptorTimeout <= 0 {
+		h.descriptorTimeout = DefaultDescriptorTimeout
+	}
+	h.templates = opt.Templates
 
 	return nil
 }
 
 // OnSessionEstablished is called when a new client establishes a session (after OnConnect).
 func (h *AddNewDeviceHook) OnSessionEstablished(cl *mochi.Client, pk packets.Packet) {
-	deviceCommands := []core.Command{
-		{Name: "power", Arguments: []string{"on", "off"}},
+	// Edge nodes and Homie devices register through their adapters
+	if isSparkplugClient(cl) || isHomieClient(cl) {
+		return
 	}
+	ensureWill(cl)
+	if err := h.mqttClient.server.Publish(statusTopic(cl.ID), []byte(StatusPayloadOnline), true, 0); err != nil {
+		log.Println("Failed to publish status of device", cl.ID, "-", err)
+	}
+
+	// Waiting for the descriptor must not block the client's session
+	go h.addDevice(cl)
+}
 
-	dev, err := core.NewRelayDevice(h.mqttClient.server, cl.ID, deviceCommands)
+func (h *AddNewDeviceHook) addDevice(cl *mochi.Client) {
+	if dev, ok, err := h.conventionDevice(cl); ok {
+		if err != nil {
+			log.Println("Failed to add device with ID", cl.ID, "- Error:", err)
+			h.devMan.ReportError(core.NewDeviceError(cl.ID, core.ErrorRegistration, err))
+			return
+		}
+		h.devMan.AddDevice(dev)
+		log.Println("New device added", cl.ID, "type", dev.Descriptor().DeviceType)
+		return
+	}
+
+	descriptor, err := h.awaitDescriptor(cl)
+	if cl.Closed() {
+		return
+	}
+	if err != nil {
+		log.Println("No descriptor from device", cl.ID, "-", err)
+		if errors.Is(err, core.ErrInvalidDescriptor) {
+			h.devMan.ReportError(core.NewDeviceError(cl.ID, core.ErrorMalformedPayload, err))
+		}
+		descriptor = h.templateFor(cl)
+	}
+	if descriptor == nil {
+		log.Println("No descriptor or template for device", cl.ID, "- Closing connection!")
+		h.devMan.ReportError(core.NewDeviceError(cl.ID, core.ErrorRegistration, core.ErrInvalidDescriptor))
+		cl.Stop(core.ErrInvalidDescriptor)
+		return
+	}
+
+	dev, err := core.NewJsonCommDevice(h.mqttClient.server, cl.ID, descriptor)
 	if err != nil {
 		log.Println("Failed to add new device with ID", cl.ID,
 			"- Error:", err, "- Closing connection!")
-		cl.Net.Conn.Close()
-		// TODO publish the error event somewhere
+		h.devMan.ReportError(core.NewDeviceError(cl.ID, core.ErrorRegistration, err))
+		cl.Stop(err)
 		return
 	}
 	h.devMan.AddDevice(dev)
 
-	log.Println("New device added", cl.ID)
+	log.Println("New device added", cl.ID, "model", descriptor.Model)
+}
+
+// conventionDevice recognizes off-the-shelf firmware by the will it
+// registers. Such devices don't publish a descriptor.
+func (h *AddNewDeviceHook) conventionDevice(cl *mochi.Client) (conventionDevice, bool, error) {
+	if topic, ok := detectTasmota(cl); ok {
+		dev, err := NewTasmotaDevice(h.mqttClient.server, cl.ID, topic)
+		return dev, true, err
+	}
+	if id, ok := detectShelly(cl); ok {
+		dev, err := NewShellyDevice(h.mqttClient.server, cl.ID, id)
+		return dev, true, err
+	}
+	return nil, false, nil
+}
+
+type conventionDevice interface {
+	core.SimpleDevice
+	core.DescribedDevice
+}
+
+// awaitDescriptor waits for the device's retained descriptor. A descriptor
+// published before the device connected is delivered right away.
+func (h *AddNewDeviceHook) awaitDescriptor(cl *mochi.Client) (*core.Descriptor, error) {
+	topic := fmt.Sprintf("devices/%s/descriptor", cl.ID)
+	subscriptionId := nextSubscriptionId()
+	received := make(chan packets.Packet, 1)
+
+	err := h.mqttClient.server.Subscribe(topic, subscriptionId,
+		func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+			select {
+			case received <- pk:
+			default:
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer h.mqttClient.server.Unsubscribe(topic, subscriptionId)
+
+	select {
+	case pk := <-received:
+		// Devices that don't speak JSON can publish the descriptor with an MQTT 5 content type
+		codec, err := core.CodecFor(pk.Properties.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+		}
+		payload, err := core.ToJSON(codec, pk.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", core.ErrInvalidDescriptor, err)
+		}
+		return core.ParseDescriptor(payload)
+	case <-time.After(h.descriptorTimeout):
+		return nil, errors.New("timed out waiting for descriptor")
+	}
+}
+
+// templateFor picks a template by the model the client announced in its
+// CONNECT user properties, falling back to its username and then to the
+// default template.
+func (h *AddNewDeviceHook) templateFor(cl *mochi.Client) *core.Descriptor {
+	for _, prop := range cl.Properties.Props.User {
+		if prop.Key == "model" {
+			if t, ok := h.templates[prop.Val]; ok {
+				return t
+			}
+		}
+	}
+	if t, ok := h.templates[string(cl.Properties.Username)]; ok {
+		return t
+	}
+	return h.templates[DefaultTemplate]
+}
+
+// OnWillSent is called when the broker published a client's Last Will, before
+// OnDisconnect.
+func (h *AddNewDeviceHook) OnWillSent(cl *mochi.Client, pk packets.Packet) {
+	// The will of a taken over session is published after the device reconnected
+	if errors.Is(cl.StopCause(), packets.ErrSessionTakenOver) || isSparkplugClient(cl) || isHomieClient(cl) {
+		return
+	}
+	if err := h.devMan.SetDeviceOffline(cl.ID, "last will"); err != nil {
+		log.Println("Failed to mark device", cl.ID, "offline:", err)
+		return
+	}
+	log.Println("Device offline", cl.ID, "- last will")
 }
 
 // OnDisconnect is called when a client is disconnected for any reason.
 func (h *AddNewDeviceHook) OnDisconnect(cl *mochi.Client, err error, expire bool) {
-	// remove the device from the internal state of the server
-	h.devMan.RemoveDevice(cl.ID)
-	log.Println("Device removed", cl.ID)
+	// A reconnecting device takes over its old session, it never went offline
+	if errors.Is(cl.StopCause(), packets.ErrSessionTakenOver) {
+		return
+	}
+
+	// Not a registered device, or the will or the watchdog got there first
+	record, lookupErr := h.devMan.GetDeviceRecord(cl.ID)
+	if lookupErr != nil || record.Presence.Status == core.StatusOffline {
+		return
+	}
+
+	reason := "disconnected"
+	if err != nil {
+		reason = err.Error()
+	}
+	if err := h.devMan.SetDeviceOffline(cl.ID, reason); err != nil {
+		log.Println("Failed to mark device", cl.ID, "offline:", err)
+		return
+	}
+	log.Println("Device offline", cl.ID, "-", reason)
 }
@@ -0,0 +1,390 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	DefaultDiscoveryPrefix = "homeassistant"
+	DefaultHATopicPrefix   = "fibers/ha"
+
+	haOnline  = "online"
+	haOffline = "offline"
+)
+
+type HomeAssistantOptions struct {
+	// DiscoveryPrefix is the prefix Home Assistant watches for configs.
+	DiscoveryPrefix string
+	// TopicPrefix is where the bridge publishes state and availability and
+	// listens for commands, as <prefix>/<device>/...
+	TopicPrefix string
+}
+
+// HomeAssistantBridge publishes Home Assistant MQTT discovery configs for the
+// devices in the DeviceManager. Numeric, bool and string properties become
+// sensors, properties with a setter become switches, numbers or selects, and
+// commands without required arguments become buttons.
+type HomeAssistantBridge struct {
+	server *mochi.Server
+	devMan core.DeviceManager
+	opts   HomeAssistantOptions
+	mutex  sync.Mutex
+	// configs are the discovery topics published per device, so entities
+	// that disappear from a descriptor can be removed
+	configs map[string][]string
+}
+
+// haEntity is a discovered entity. Its object id is the sanitized name of
+// the property or command it was derived from.
+type haEntity struct {
+	component string
+	objectId  string
+	config    map[string]any
+}
+
+func NewHomeAssistantBridge(server *mochi.Server, devMan core.DeviceManager, opts HomeAssistantOptions) *HomeAssistantBridge {
+	if opts.DiscoveryPrefix == "" {
+		opts.DiscoveryPrefix = DefaultDiscoveryPrefix
+	}
+	if opts.TopicPrefix == "" {
+		opts.TopicPrefix = DefaultHATopicPrefix
+	}
+	return &HomeAssistantBridge{
+		server:  server,
+		devMan:  devMan,
+		opts:    opts,
+		configs: make(map[string][]string),
+	}
+}
+
+func (b *HomeAssistantBridge) Start(ctx context.Context) error {
+	commandFilter := b.opts.TopicPrefix + "/+/+/set"
+	commandSubscriptionId := nextSubscriptionId()
+	if err := b.server.Subscribe(commandFilter, commandSubscriptionId, b.receiveCommand); err != nil {
+		return err
+	}
+	// Home Assistant announces itself after a restart, it needs the configs again
+	statusTopic := b.opts.DiscoveryPrefix + "/status"
+	statusSubscriptionId := nextSubscriptionId()
+	err := b.server.Subscribe(statusTopic, statusSubscriptionId, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		if string(pk.Payload) == haOnline {
+			go b.publishAll()
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	sub := b.devMan.SubscribeToEvents(ctx, core.EventFilter{
+		Types: []core.EventType{core.EventDeviceConnected, core.EventDeviceDisconnected,
+			core.EventDeviceRemoved, core.EventStateChanged},
+	}, core.SubscriptionOptions{BufferSize: 256, Overflow: core.OverflowDropOldest})
+	b.publishAll()
+
+	go func() {
+		defer b.server.Unsubscribe(commandFilter, commandSubscriptionId)
+		defer b.server.Unsubscribe(statusTopic, statusSubscriptionId)
+		for e := range sub.C() {
+			switch e := e.(type) {
+			case core.DeviceConnectedEvent:
+				if record, err := b.devMan.GetDeviceRecord(e.DeviceId()); err == nil {
+					b.publishDevice(record)
+				}
+			case core.DeviceDisconnectedEvent:
+				b.publish(b.deviceTopic(e.DeviceId(), "availability"), []byte(haOffline))
+			case core.DeviceRemovedEvent:
+				b.removeDevice(e.DeviceId())
+			case core.StateChangedEvent:
+				b.publishState(e.DeviceId(), e.NewState)
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *HomeAssistantBridge) publishAll() {
+	for _, record := range b.devMan.ListDeviceRecords() {
+		b.publishDevice(record)
+	}
+}
+
+func (b *HomeAssistantBridge) publishDevice(record core.DeviceRecord) {
+	if record.Descriptor == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	published := make(map[string]bool)
+	for _, entity := range b.entities(record) {
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", b.opts.DiscoveryPrefix, entity.component, haObjectId(record.Id), entity.objectId)
+		payload, err := json.Marshal(entity.config)
+		if err != nil {
+			continue
+		}
+		b.publish(topic, payload)
+		published[topic] = true
+	}
+	for _, topic := range b.configs[record.Id] {
+		if !published[topic] {
+			b.publish(topic, nil)
+		}
+	}
+	b.configs[record.Id] = make([]string, 0, len(published))
+	for topic := range published {
+		b.configs[record.Id] = append(b.configs[record.Id], topic)
+	}
+
+	availability := haOffline
+	if record.Presence.Status != core.StatusOffline {
+		availability = haOnline
+	}
+	b.publish(b.deviceTopic(record.Id, "availability"), []byte(availability))
+	if record.LastState != nil {
+		b.publishState(record.Id, record.LastState)
+	}
+}
+
+// removeDevice clears the retained configs, which removes the entities from Home Assistant.
+func (b *HomeAssistantBridge) removeDevice(deviceId string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, topic := range b.configs[deviceId] {
+		b.publish(topic, nil)
+	}
+	delete(b.configs, deviceId)
+	b.publish(b.deviceTopic(deviceId, "availability"), nil)
+	b.publish(b.deviceTopic(deviceId, "state"), nil)
+}
+
+// publishState publishes the property values as a flat JSON object, read by
+// the entities' value templates.
+func (b *HomeAssistantBridge) publishState(deviceId string, state *core.State) {
+	values := make(map[string]any, len(state.Properties))
+	for name, p := range state.Properties {
+		values[haObjectId(name)] = p.Value
+	}
+	payload, err := json.Marshal(values)
+	if err != nil {
+		return
+	}
+	b.publish(b.deviceTopic(deviceId, "state"), payload)
+}
+
+func (b *HomeAssistantBridge) publish(topic string, payload []byte) {
+	if err := b.server.Publish(topic, payload, true, 0); err != nil {
+		log.Println("failed to publish home assistant topic", topic, "error", err)
+	}
+}
+
+func (b *HomeAssistantBridge) deviceTopic(deviceId string, suffix string) string {
+	return fmt.Sprintf("%s/%s/%s", b.opts.TopicPrefix, haObjectId(deviceId), suffix)
+}
+
+func (b *HomeAssistantBridge) entities(record core.DeviceRecord) []haEntity {
+	descriptor := record.Descriptor
+	device := map[string]any{
+		"identifiers":  []string{"fibers_" + haObjectId(record.Id)},
+		"name":         record.Id,
+		"model":        descriptor.Model,
+		"manufacturer": "fibers",
+	}
+	if descriptor.Firmware != "" {
+		device["sw_version"] = descriptor.Firmware
+	}
+
+	newEntity := func(component string, name string) haEntity {
+		objectId := haObjectId(name)
+		return haEntity{component, objectId, map[string]any{
+			"name":               name,
+			"unique_id":          "fibers_" + haObjectId(record.Id) + "_" + objectId,
+			"device":             device,
+			"availability_topic": b.deviceTopic(record.Id, "availability"),
+		}}
+	}
+
+	var entities []haEntity
+	for _, p := range descriptor.Properties {
+		template := fmt.Sprintf("{{ value_json['%s'] }}", haObjectId(p.Name))
+		var entity haEntity
+		if arg, ok := setterArg(descriptor, p); ok {
+			entity = haSettable(newEntity, p, arg)
+			entity.config["command_topic"] = b.deviceTopic(record.Id, entity.objectId+"/set")
+		} else {
+			switch p.Type {
+			case core.TypeNumber, core.TypeString:
+				entity = newEntity("sensor", p.Name)
+				if p.Unit != "" {
+					entity.config["unit_of_measurement"] = p.Unit
+				}
+				if p.Type == core.TypeNumber {
+					entity.config["state_class"] = "measurement"
+				}
+			case core.TypeBool:
+				entity = newEntity("binary_sensor", p.Name)
+				template = fmt.Sprintf("{{ 'ON' if value_json['%s'] else 'OFF' }}", haObjectId(p.Name))
+			default:
+				continue
+			}
+		}
+		entity.config["state_topic"] = b.deviceTopic(record.Id, "state")
+		entity.config["value_template"] = template
+		entities = append(entities, entity)
+	}
+
+	for _, cmd := range descriptor.Commands {
+		if slices.ContainsFunc(cmd.Args, func(a core.ArgSpec) bool { return a.Required && a.Default == nil }) {
+			continue
+		}
+		entity := newEntity("button", cmd.Name)
+		entity.objectId = "cmd_" + entity.objectId
+		entity.config["unique_id"] = entity.config["unique_id"].(string) + "_cmd"
+		entity.config["command_topic"] = b.deviceTopic(record.Id, entity.objectId+"/set")
+		entities = append(entities, entity)
+	}
+	return entities
+}
+
+// haSettable maps a property with a setter to a switch for bool and on/off
+// arguments, a select for other enums and a number for numeric arguments.
+func haSettable(newEntity func(component string, name string) haEntity, p core.PropertySpec, arg core.ArgSpec) haEntity {
+	var entity haEntity
+	switch {
+	case arg.Type == core.ArgBool:
+		entity = newEntity("switch", p.Name)
+		entity.config["payload_on"], entity.config["payload_off"] = "true", "false"
+		entity.config["state_on"], entity.config["state_off"] = "True", "False"
+	case isOnOff(arg.Enum):
+		entity = newEntity("switch", p.Name)
+		entity.config["payload_on"], entity.config["payload_off"] = "on", "off"
+		entity.config["state_on"], entity.config["state_off"] = "on", "off"
+	case len(arg.Enum) > 0:
+		entity = newEntity("select", p.Name)
+		options := make([]string, len(arg.Enum))
+		for i, e := range arg.Enum {
+			options[i] = fmt.Sprint(e)
+		}
+		entity.config["options"] = options
+	case arg.Type == core.ArgNumber || arg.Type == core.ArgInteger:
+		entity = newEntity("number", p.Name)
+		if arg.Min != nil {
+			entity.config["min"] = *arg.Min
+		}
+		if arg.Max != nil {
+			entity.config["max"] = *arg.Max
+		}
+		if arg.Type == core.ArgNumber {
+			entity.config["step"] = 0.1
+		}
+		if p.Unit != "" {
+			entity.config["unit_of_measurement"] = p.Unit
+		}
+	default:
+		entity = newEntity("text", p.Name)
+	}
+	return entity
+}
+
+func isOnOff(enum []any) bool {
+	if len(enum) != 2 {
+		return false
+	}
+	values := []string{strings.ToLower(fmt.Sprint(enum[0])), strings.ToLower(fmt.Sprint(enum[1]))}
+	slices.Sort(values)
+	return values[0] == "off" && values[1] == "on"
+}
+
+// setterArg returns the spec of the argument that sets property p.
+func setterArg(descriptor *core.Descriptor, p core.PropertySpec) (core.ArgSpec, bool) {
+	if p.Setter == nil {
+		return core.ArgSpec{}, false
+	}
+	cmd, ok := core.FindCommandSpec(descriptor.Commands, p.Setter.Command)
+	if !ok {
+		return core.ArgSpec{}, false
+	}
+	for _, arg := range cmd.Args {
+		if arg.Name == p.Setter.Arg {
+			return arg, true
+		}
+	}
+	return core.ArgSpec{}, false
+}
+
+// receiveCommand routes <prefix>/<device>/<entity>/set to SendCommand.
+func (b *HomeAssistantBridge) receiveCommand(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+	parts := strings.Split(strings.TrimPrefix(pk.TopicName, b.opts.TopicPrefix+"/"), "/")
+	if len(parts) != 3 {
+		return
+	}
+	objectId, entityId := parts[0], parts[1]
+
+	var record *core.DeviceRecord
+	for _, r := range b.devMan.ListDeviceRecords() {
+		if haObjectId(r.Id) == objectId {
+			record = &r
+			break
+		}
+	}
+	if record == nil || record.Descriptor == nil {
+		log.Println("home assistant command for unknown device", objectId)
+		return
+	}
+
+	command, err := haCommand(record.Descriptor, entityId, string(pk.Payload))
+	if err != nil {
+		log.Println("invalid home assistant command for device", record.Id, "entity", entityId, "error", err)
+		return
+	}
+	// Home Assistant doesn't wait for results, state updates confirm the command
+	if err := b.devMan.SendCommandAsync(record.Id, command); err != nil {
+		log.Println("failed to send home assistant command to device", record.Id, "error", err)
+	}
+}
+
+func haCommand(descriptor *core.Descriptor, entityId string, payload string) (*core.Command, error) {
+	if name, ok := strings.CutPrefix(entityId, "cmd_"); ok {
+		for _, cmd := range descriptor.Commands {
+			if haObjectId(cmd.Name) == name {
+				return &core.Command{Name: cmd.Name}, nil
+			}
+		}
+	}
+	for _, p := range descriptor.Properties {
+		if haObjectId(p.Name) != entityId {
+			continue
+		}
+		arg, ok := setterArg(descriptor, p)
+		if !ok {
+			break
+		}
+		value, err := arg.ParseArg(payload)
+		if err != nil {
+			return nil, err
+		}
+		return &core.Command{Name: p.Setter.Command, Args: map[string]any{arg.Name: value}}, nil
+	}
+	return nil, fmt.Errorf("no command for entity %s", entityId)
+}
+
+// haObjectId makes a name safe for topics and entity ids.
+func haObjectId(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,94 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/devicetest"
+)
+
+var psuDescriptor = &core.Descriptor{
+	Model: "psu",
+	Commands: []core.CommandSpec{
+		{Name: "power", Args: []core.ArgSpec{{Name: "state", Type: core.ArgString, Required: true, Enum: []any{"on", "off"}}}},
+		{Name: "set_voltage", Args: []core.ArgSpec{{Name: "volts", Type: core.ArgNumber, Required: true}}},
+		{Name: "reset"},
+	},
+	Properties: []core.PropertySpec{
+		{Name: "voltage", Type: core.TypeNumber, Unit: "V"},
+		{Name: "power", Type: core.TypeString, Setter: &core.PropertySetter{Command: "power", Arg: "state"}},
+		{Name: "voltage_setpoint", Type: core.TypeNumber, Setter: &core.PropertySetter{Command: "set_voltage", Arg: "volts"}},
+		{Name: "channels", Type: core.TypeArray},
+	},
+}
+
+func TestHomeAssistantEntities(t *testing.T) {
+	bridge := NewHomeAssistantBridge(nil, nil, HomeAssistantOptions{})
+	entities := bridge.entities(core.DeviceRecord{Id: "psu1", Descriptor: psuDescriptor})
+
+	expected := map[string]string{"voltage": "sensor", "power": "switch", "voltage_setpoint": "number", "cmd_reset": "button"}
+	if len(entities) != len(expected) {
+		t.Fatal("Expected entities", expected, ", but got", entities)
+	}
+	for _, e := range entities {
+		if expected[e.objectId] != e.component {
+			t.Fatal("Expected", e.objectId, "to be a", expected[e.objectId], ", but got", e.component)
+		}
+	}
+}
+
+func TestHomeAssistantCommands(t *testing.T) {
+	cmd, err := haCommand(psuDescriptor, "power", "off")
+	if err != nil || cmd.Name != "power" || cmd.Args["state"] != "off" {
+		t.Fatal("Expected a power off command, but got", cmd, err)
+	}
+	cmd, err = haCommand(psuDescriptor, "voltage_setpoint", "12.5")
+	if err != nil || cmd.Name != "set_voltage" || cmd.Args["volts"] != 12.5 {
+		t.Fatal("Expected a set_voltage command, but got", cmd, err)
+	}
+	if cmd, err = haCommand(psuDescriptor, "cmd_reset", "PRESS"); err != nil || cmd.Name != "reset" {
+		t.Fatal("Expected a reset command, but got", cmd, err)
+	}
+	if _, err = haCommand(psuDescriptor, "voltage", "1"); err == nil {
+		t.Fatal("Expected an error for a read only property")
+	}
+}
+
+func TestHomeAssistantBridge(t *testing.T) {
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	devMan := core.NewBasicDeviceManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dev := devicetest.NewDevice("psu1", psuDescriptor)
+	devMan.AddDevice(dev)
+	if err := NewHomeAssistantBridge(server, devMan, HomeAssistantOptions{}).Start(ctx); err != nil {
+		t.Fatal("Expected the bridge to start, but got", err)
+	}
+
+	configs := make(chan packets.Packet, 10)
+	server.Subscribe("homeassistant/switch/psu1/power/config", nextSubscriptionId(), func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		configs <- pk
+	})
+	select {
+	case pk := <-configs:
+		config := map[string]any{}
+		json.Unmarshal(pk.Payload, &config)
+		if config["command_topic"] != "fibers/ha/psu1/power/set" {
+			t.Fatal("Expected the power switch command topic, but got", config)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a retained switch config")
+	}
+
+	server.Publish("fibers/ha/psu1/power/set", []byte("off"), false, 0)
+	if commands := dev.WaitCommands(1, time.Second); len(commands) != 1 || commands[0].Name != "power" || commands[0].Args["state"] != "off" {
+		t.Fatal("Expected a power off command, but got", commands)
+	}
+}
@@ -0,0 +1,286 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	homieRoot        = "homie"
+	HomieDeviceType  = "homie"
+	homieStateFilter = homieRoot + "/+/$state"
+)
+
+// isHomieClient tells Homie devices, whose will marks them lost, apart from
+// devices the AddNewDeviceHook should register.
+func isHomieClient(cl *mochi.Client) bool {
+	parts := strings.Split(cl.Properties.Will.TopicName, "/")
+	return len(parts) == 3 && parts[0] == homieRoot && parts[2] == "$state"
+}
+
+// HomieAdapter registers devices that follow the Homie convention. A device is
+// (re)registered whenever its $state becomes ready, from the retained
+// attributes of its nodes and properties. Lifecycle states drive its presence.
+type HomieAdapter struct {
+	server *mochi.Server
+	devMan core.DeviceManager
+	states chan homieState
+}
+
+type homieState struct {
+	deviceId string
+	state    string
+}
+
+func NewHomieAdapter(server *mochi.Server, devMan core.DeviceManager) *HomieAdapter {
+	return &HomieAdapter{server, devMan, make(chan homieState, 64)}
+}
+
+func (a *HomieAdapter) Start(ctx context.Context) error {
+	subscriptionId := nextSubscriptionId()
+	err := a.server.Subscribe(homieStateFilter, subscriptionId, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		a.states <- homieState{strings.Split(pk.TopicName, "/")[1], string(pk.Payload)}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Lifecycle changes are handled in order, and outside of the broker's
+	// delivery, since registering subscribes to the device's topics
+	go func() {
+		defer a.server.Unsubscribe(homieStateFilter, subscriptionId)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-a.states:
+				a.lifecycle(s.deviceId, s.state)
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *HomieAdapter) lifecycle(deviceId string, state string) {
+	switch state {
+	case "ready":
+		dev, err := NewHomieDevice(a.server, deviceId)
+		if err != nil {
+			log.Println("Failed to add homie device", deviceId, "- Error:", err)
+			a.devMan.ReportError(core.NewDeviceError(deviceId, core.ErrorRegistration, err))
+			return
+		}
+		a.devMan.AddDevice(dev)
+		log.Println("New homie device added", deviceId)
+	case "disconnected", "lost":
+		if err := a.devMan.SetDeviceOffline(deviceId, "homie "+state); err != nil && err != core.ErrDeviceNotFound {
+			log.Println("Failed to mark device", deviceId, "offline:", err)
+		}
+	case "sleeping":
+		a.devMan.MarkDeviceStale(deviceId, "sleeping")
+	case "alert":
+		a.devMan.ReportError(&core.DeviceError{
+			DeviceId: deviceId,
+			Kind:     core.ErrorFault,
+			Code:     "alert",
+			Message:  "device reported the homie alert state",
+			Time:     time.Now(),
+		})
+	}
+}
+
+// HomieDevice exposes the properties of a Homie device's nodes as <node>_<property>,
+// which is unambiguous since Homie ids can't contain underscores. Settable
+// properties get a set_<node>_<property> command with a single value argument.
+type HomieDevice struct {
+	*topicDevice
+	prefix     string
+	attrsMutex sync.Mutex
+	attrs      map[string]string
+	properties map[string]homieProperty
+}
+
+type homieProperty struct {
+	name     string
+	datatype string
+}
+
+func NewHomieDevice(server *mochi.Server, homieId string) (*HomieDevice, error) {
+	dev := &HomieDevice{
+		prefix: fmt.Sprintf("%s/%s/", homieRoot, homieId),
+		attrs:  make(map[string]string),
+	}
+	dev.topicDevice = newTopicDevice(server, homieId, &core.Descriptor{})
+
+	// The retained attributes are delivered while subscribing
+	if err := dev.subscribe(dev.prefix+"#", dev.receive); err != nil {
+		return nil, err
+	}
+	descriptor, properties := dev.describe()
+	if len(properties) == 0 {
+		dev.Close()
+		return nil, fmt.Errorf("%w: homie device without properties", core.ErrInvalidDescriptor)
+	}
+
+	dev.attrsMutex.Lock()
+	dev.descriptor, dev.properties = descriptor, properties
+	values := make(map[string]any)
+	for path, p := range properties {
+		if raw, ok := dev.attrs[path]; ok {
+			values[p.name] = homieValue(p.datatype, raw)
+		}
+	}
+	dev.attrsMutex.Unlock()
+	// The manager takes the retained values as the last known state when the
+	// device is added
+	dev.update(values, nil, nil)
+	return dev, nil
+}
+
+func (d *HomieDevice) receive(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+	path := strings.TrimPrefix(pk.TopicName, d.prefix)
+	if strings.HasSuffix(path, "/set") {
+		return
+	}
+
+	d.attrsMutex.Lock()
+	d.attrs[path] = string(pk.Payload)
+	p, ok := d.properties[path]
+	d.attrsMutex.Unlock()
+
+	if ok {
+		d.update(map[string]any{p.name: homieValue(p.datatype, string(pk.Payload))}, nil, nil)
+		d.reply(path, pk)
+	}
+}
+
+// describe builds the descriptor from the $nodes, $properties and property attributes.
+func (d *HomieDevice) describe() (*core.Descriptor, map[string]homieProperty) {
+	d.attrsMutex.Lock()
+	defer d.attrsMutex.Unlock()
+
+	descriptor := &core.Descriptor{
+		Model:      d.attrs["$name"],
+		Firmware:   d.attrs["$fw/version"],
+		DeviceType: HomieDeviceType,
+	}
+	if descriptor.Model == "" {
+		descriptor.Model = "homie"
+	}
+
+	properties := make(map[string]homieProperty)
+	for _, node := range homieList(d.attrs["$nodes"]) {
+		for _, prop := range homieList(d.attrs[node+"/$properties"]) {
+			path := node + "/" + prop
+			p := homieProperty{node + "_" + prop, d.attrs[path+"/$datatype"]}
+			properties[path] = p
+
+			spec := core.PropertySpec{
+				Name:        p.name,
+				Type:        homieValueType(p.datatype),
+				Unit:        d.attrs[path+"/$unit"],
+				Description: d.attrs[path+"/$name"],
+			}
+			if d.attrs[path+"/$settable"] == "true" {
+				cmd := core.CommandSpec{
+					Name:        "set_" + p.name,
+					Description: "Set " + path,
+					Args:        []core.ArgSpec{homieArg(p.datatype, d.attrs[path+"/$format"])},
+				}
+				descriptor.Commands = append(descriptor.Commands, cmd)
+				spec.Setter = &core.PropertySetter{Command: cmd.Name, Arg: "value"}
+			}
+			descriptor.Properties = append(descriptor.Properties, spec)
+		}
+	}
+	return descriptor, properties
+}
+
+func (d *HomieDevice) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	var path string
+	for p, prop := range d.properties {
+		if "set_"+prop.name == command.Name {
+			path = p
+		}
+	}
+	if path == "" {
+		return nil, core.NewUnknownCommandError(command.Name)
+	}
+
+	payload := core.FormatValue(command.Args["value"])
+	// The device confirms by publishing the new value of the property
+	return d.send(command, d.prefix+path+"/set", []byte(payload), path, func(pk packets.Packet) *core.CommandResult {
+		return &core.CommandResult{Success: true}
+	})
+}
+
+func homieList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		// Homie 3 marks array nodes as node[]
+		if item = strings.TrimSuffix(strings.TrimSpace(item), "[]"); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func homieValueType(datatype string) core.ValueType {
+	switch datatype {
+	case "integer", "float":
+		return core.TypeNumber
+	case "boolean":
+		return core.TypeBool
+	}
+	return core.TypeString
+}
+
+func homieValue(datatype string, raw string) any {
+	switch datatype {
+	case "integer", "float":
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		return raw == "true"
+	}
+	return raw
+}
+
+// homieArg derives the value argument of a set command from the property's
+// datatype and $format, a range like 0:100 for numbers or the values of an enum.
+func homieArg(datatype string, format string) core.ArgSpec {
+	arg := core.ArgSpec{Name: "value", Type: core.ArgString, Required: true}
+	switch datatype {
+	case "integer", "float":
+		arg.Type = core.ArgNumber
+		if datatype == "integer" {
+			arg.Type = core.ArgInteger
+		}
+		if from, to, ok := strings.Cut(format, ":"); ok {
+			if min, err := strconv.ParseFloat(from, 64); err == nil {
+				arg.Min = &min
+			}
+			if max, err := strconv.ParseFloat(to, 64); err == nil {
+				arg.Max = &max
+			}
+		}
+	case "boolean":
+		arg.Type = core.ArgBool
+	case "enum":
+		for _, value := range strings.Split(format, ",") {
+			arg.Enum = append(arg.Enum, value)
+		}
+	}
+	return arg
+}
@@ -0,0 +1,11 @@
+package mqtt
+
+import "sync/atomic"
+
+// Inline subscription IDs only need to be unique per topic filter, but a
+// single counter keeps them unique across all the hooks and bridges.
+var subscriptionIds atomic.Int32
+
+func nextSubscriptionId() int {
+	return int(subscriptionIds.Add(1))
+}
@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	StatusPayloadOnline  = "online"
+	StatusPayloadOffline = "offline"
+
+	DefaultStaleAfter    = 30 * time.Second
+	DefaultOfflineAfter  = 2 * time.Minute
+	DefaultCheckInterval = 5 * time.Second
+
+	// Devices that tell how often they report are stale after missing
+	// staleReports reports and offline after missing offlineReports.
+	staleReports   = 3
+	offlineReports = 10
+)
+
+// errHeartbeatTimeout is the reason given to devices the watchdog disconnects.
+var errHeartbeatTimeout = packets.Code{Code: packets.ErrKeepAliveTimeout.Code, Reason: "heartbeat timeout"}
+
+func statusTopic(deviceId string) string {
+	return fmt.Sprintf("devices/%s/status", deviceId)
+}
+
+// HeartbeatTimeout is how long a device may go without reporting state
+// before it is considered stale, and then offline.
+type HeartbeatTimeout struct {
+	StaleAfter   time.Duration
+	OfflineAfter time.Duration
+	// Disabled leaves presence to devices that announce it themselves.
+	Disabled bool
+}
+
+type WatchdogOptions struct {
+	// Default applies to device types without a timeout of their own. Devices
+	// whose descriptor has a report interval get longer timeouts if they
+	// report less often.
+	Default HeartbeatTimeout
+	// DeviceTypes are keyed by the descriptor's device type.
+	DeviceTypes   map[string]HeartbeatTimeout
+	CheckInterval time.Duration
+}
+
+// PresenceWatchdog marks devices stale, then offline, when they stop reporting
+// state without disconnecting. Dropped connections are handled by the Last
+// Will, see AddNewDeviceHook.OnWillSent.
+type PresenceWatchdog struct {
+	server *mochi.Server
+	devMan core.DeviceManager
+	opts   WatchdogOptions
+}
+
+func NewPresenceWatchdog(server *mochi.Server, devMan core.DeviceManager, opts WatchdogOptions) *PresenceWatchdog {
+	if opts.Default.StaleAfter <= 0 {
+		opts.Default.StaleAfter = DefaultStaleAfter
+	}
+	if opts.Default.OfflineAfter <= 0 {
+		opts.Default.OfflineAfter = DefaultOfflineAfter
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = DefaultCheckInterval
+	}
+	return &PresenceWatchdog{server, devMan, opts}
+}
+
+// Run checks the devices' heartbeats until ctx is done.
+func (w *PresenceWatchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.check(now)
+		}
+	}
+}
+
+func (w *PresenceWatchdog) timeoutFor(record core.DeviceRecord) HeartbeatTimeout {
+	timeout := w.opts.Default
+	if record.Descriptor == nil {
+		return timeout
+	}
+	if record.Descriptor.ReportInterval > 0 {
+		interval := time.Duration(record.Descriptor.ReportInterval) * time.Second
+		timeout.StaleAfter = max(timeout.StaleAfter, staleReports*interval)
+		timeout.OfflineAfter = max(timeout.OfflineAfter, offlineReports*interval)
+	}
+	if t, ok := w.opts.DeviceTypes[record.Descriptor.DeviceType]; ok {
+		timeout.Disabled = t.Disabled
+		if t.StaleAfter > 0 {
+			timeout.StaleAfter = t.StaleAfter
+		}
+		if t.OfflineAfter > 0 {
+			timeout.OfflineAfter = t.OfflineAfter
+		}
+	}
+	return timeout
+}
+
+func (w *PresenceWatchdog) check(now time.Time) {
+	for _, record := range w.devMan.ListDeviceRecords() {
+		if record.Presence.Status == core.StatusOffline {
+			continue
+		}
+		timeout := w.timeoutFor(record)
+		if timeout.Disabled {
+			continue
+		}
+		silence := now.Sub(record.Presence.LastSeen)
+
+		switch {
+		case silence >= timeout.OfflineAfter:
+			w.disconnect(record.Id)
+		case silence >= timeout.StaleAfter && record.Presence.Status == core.StatusOnline:
+			reason := fmt.Sprintf("no state for %s", silence.Truncate(time.Second))
+			if err := w.devMan.MarkDeviceStale(record.Id, reason); err != nil {
+				log.Println("Failed to mark device", record.Id, "stale:", err)
+				continue
+			}
+			log.Println("Device stale", record.Id, "-", reason)
+		}
+	}
+}
+
+// disconnect drops a hung device's connection so it has to register again
+// once it recovers.
+func (w *PresenceWatchdog) disconnect(deviceId string) {
+	if err := w.devMan.SetDeviceOffline(deviceId, errHeartbeatTimeout.Reason); err != nil {
+		log.Println("Failed to mark device", deviceId, "offline:", err)
+		return
+	}
+	log.Println("Device offline", deviceId, "-", errHeartbeatTimeout.Reason)
+	if cl, ok := w.server.Clients.Get(deviceId); ok && !cl.Closed() {
+		_ = w.server.DisconnectClient(cl, errHeartbeatTimeout)
+	}
+}
+
+// ensureWill gives devices that connect without a Last Will one that
+// publishes "offline" on their retained devices/<id>/status topic.
+func ensureWill(cl *mochi.Client) {
+	if cl.Properties.Will.Flag != 0 {
+		return
+	}
+	cl.Properties.Will = mochi.Will{
+		TopicName: statusTopic(cl.ID),
+		Payload:   []byte(StatusPayloadOffline),
+		Retain:    true,
+		Flag:      1,
+	}
+}
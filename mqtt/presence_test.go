@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/devicetest"
+)
+
+func TestPresenceWatchdog(t *testing.T) {
+	devMan := core.NewBasicDeviceManager()
+	// The devices never report state, only the watchdog changes their presence
+	for id, descriptor := range map[string]*core.Descriptor{
+		"psu1":      {Model: "psu"},
+		"plug1":     shellyDescriptor("shelly1"),
+		"sensor1":   {Model: "sensor", ReportInterval: 600},
+		"plant:gw1": {Model: SparkplugNodeType, DeviceType: SparkplugNodeType},
+	} {
+		devMan.AddDevice(devicetest.NewDevice(id, descriptor))
+	}
+	watchdog := NewPresenceWatchdog(mochi.New(nil), devMan, WatchdogOptions{
+		DeviceTypes: map[string]HeartbeatTimeout{SparkplugNodeType: {Disabled: true}},
+	})
+
+	expect := func(statuses map[string]core.ConnectionStatus) {
+		t.Helper()
+		for id, status := range statuses {
+			if record, _ := devMan.GetDeviceRecord(id); record.Presence.Status != status {
+				t.Fatal("Expected", id, "to be", status, ", but got", record.Presence.Status)
+			}
+		}
+	}
+
+	// Shelly reports every 30s, missing a single report doesn't make it stale
+	now := time.Now()
+	watchdog.check(now.Add(DefaultStaleAfter + time.Second))
+	expect(map[string]core.ConnectionStatus{
+		"psu1": core.StatusStale, "plug1": core.StatusOnline, "sensor1": core.StatusOnline, "plant:gw1": core.StatusOnline,
+	})
+
+	watchdog.check(now.Add(DefaultOfflineAfter + time.Second))
+	expect(map[string]core.ConnectionStatus{
+		"psu1": core.StatusOffline, "plug1": core.StatusStale, "sensor1": core.StatusOnline, "plant:gw1": core.StatusOnline,
+	})
+
+	// The sensor reports every 10 minutes
+	watchdog.check(now.Add(31 * time.Minute))
+	expect(map[string]core.ConnectionStatus{
+		"plug1": core.StatusOffline, "sensor1": core.StatusStale, "plant:gw1": core.StatusOnline,
+	})
+	watchdog.check(now.Add(101 * time.Minute))
+	expect(map[string]core.ConnectionStatus{"sensor1": core.StatusOffline, "plant:gw1": core.StatusOnline})
+}
@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const shadowUpdateFilter = "devices/+/shadow/update"
+
+// ShadowBridge exposes device shadows over MQTT. The current shadow is
+// retained on devices/<id>/shadow and desired state updates are accepted on
+// devices/<id>/shadow/update as {"desired": {...}}.
+type ShadowBridge struct {
+	server *mochi.Server
+	devMan core.DeviceManager
+}
+
+func NewShadowBridge(server *mochi.Server, devMan core.DeviceManager) *ShadowBridge {
+	return &ShadowBridge{server, devMan}
+}
+
+func (b *ShadowBridge) Start(ctx context.Context) error {
+	subscriptionId := nextSubscriptionId()
+	err := b.server.Subscribe(shadowUpdateFilter, subscriptionId, b.receiveUpdate)
+	if err != nil {
+		return err
+	}
+
+	sub := b.devMan.SubscribeToEvents(ctx, core.EventFilter{
+		Types: []core.EventType{core.EventStateChanged, core.EventDesiredStateChanged, core.EventDeviceConnected},
+	}, core.SubscriptionOptions{BufferSize: 256, Overflow: core.OverflowDropOldest})
+
+	go func() {
+		defer b.server.Unsubscribe(shadowUpdateFilter, subscriptionId)
+		for e := range sub.C() {
+			b.publish(e.DeviceId())
+		}
+	}()
+	return nil
+}
+
+func (b *ShadowBridge) publish(deviceId string) {
+	shadow, err := b.devMan.GetShadow(deviceId)
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(shadow)
+	if err != nil {
+		return
+	}
+	if err := b.server.Publish(fmt.Sprintf("devices/%s/shadow", deviceId), payload, true, 0); err != nil {
+		log.Println("failed to publish shadow of device", deviceId, "error", err)
+	}
+}
+
+func (b *ShadowBridge) receiveUpdate(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+	deviceId := strings.Split(pk.TopicName, "/")[1]
+	update := struct {
+		Desired map[string]any `json:"desired"`
+	}{}
+	if err := json.Unmarshal(pk.Payload, &update); err != nil {
+		log.Println("invalid shadow update from client", cl.ID, "topic", pk.TopicName, "error", err)
+		return
+	}
+
+	if _, err := b.devMan.UpdateDesiredState(deviceId, update.Desired); err != nil {
+		log.Println("failed to update shadow of device", deviceId, "error", err)
+	}
+}
@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	ShellyDeviceType = "shelly"
+	// shellyReportInterval is how often, in seconds, Gen1 devices publish
+	// their readings by default
+	shellyReportInterval = 30
+)
+
+// shellyUnits are keyed by the last topic segment of a reading.
+var shellyUnits = map[string]string{
+	"power":       "W",
+	"energy":      "Wmin",
+	"voltage":     "V",
+	"current":     "A",
+	"temperature": "°C",
+	"humidity":    "%",
+}
+
+// ShellyDevice follows the Shelly Gen1 MQTT layout under shellies/<id>/.
+// Every reading gets its own topic, relay/0/power becomes the relay_0_power
+// property. Relays are switched through shellies/<id>/relay/<n>/command.
+type ShellyDevice struct {
+	*topicDevice
+	shellyId string
+}
+
+func shellyDescriptor(model string) *core.Descriptor {
+	channel := core.ArgSpec{Name: "channel", Type: core.ArgInteger, Default: 0.0, Min: ptr(0.0), Max: ptr(3.0)}
+	return &core.Descriptor{
+		Model:          model,
+		DeviceType:     ShellyDeviceType,
+		ReportInterval: shellyReportInterval,
+		Commands: []core.CommandSpec{
+			{Name: "relay", Description: "Switch a relay", Args: []core.ArgSpec{
+				{Name: "state", Type: core.ArgString, Required: true, Enum: []any{"on", "off"}},
+				channel,
+			}},
+			{Name: "toggle", Description: "Toggle a relay", Args: []core.ArgSpec{channel}},
+		},
+		Properties: []core.PropertySpec{
+			{Name: "relay_0", Type: core.TypeString, Setter: &core.PropertySetter{Command: "relay", Arg: "state"}},
+			{Name: "relay_0_power", Type: core.TypeNumber, Unit: "W"},
+		},
+	}
+}
+
+// detectShelly returns the id of a client that registered the standard
+// shellies/<id>/online will.
+func detectShelly(cl *mochi.Client) (string, bool) {
+	parts := strings.Split(cl.Properties.Will.TopicName, "/")
+	if len(parts) == 3 && parts[0] == "shellies" && parts[2] == "online" {
+		return parts[1], true
+	}
+	return "", false
+}
+
+// NewShellyDevice registers a Shelly whose topics live under shellies/<shellyId>/.
+// Its model is taken from the id, as in shelly1-A4CF12.
+func NewShellyDevice(server *mochi.Server, deviceId string, shellyId string) (*ShellyDevice, error) {
+	model, _, _ := strings.Cut(shellyId, "-")
+	dev := &ShellyDevice{newTopicDevice(server, deviceId, shellyDescriptor(model)), shellyId}
+
+	prefix := fmt.Sprintf("shellies/%s/", shellyId)
+	err := dev.subscribe(prefix+"#", func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		dev.receive(strings.TrimPrefix(pk.TopicName, prefix), pk)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Have the device report its relays rather than wait for the next update
+	dev.publish(prefix+"command", []byte("update"))
+	return dev, nil
+}
+
+func (d *ShellyDevice) receive(path string, pk packets.Packet) {
+	segments := strings.Split(path, "/")
+	last := segments[len(segments)-1]
+	switch last {
+	case "command", "online", "info", "announce":
+		return
+	}
+
+	name := strings.Join(segments, "_")
+	d.update(map[string]any{name: parseScalar(pk.Payload)}, map[string]string{name: shellyUnits[last]}, nil)
+	if segments[0] == "relay" && len(segments) == 2 {
+		d.reply(path, pk)
+	}
+}
+
+func (d *ShellyDevice) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	payload := "toggle"
+	switch command.Name {
+	case "relay":
+		payload = fmt.Sprint(command.Args["state"])
+	case "toggle":
+	default:
+		return nil, core.NewUnknownCommandError(command.Name)
+	}
+
+	// The device confirms by reporting the new relay state
+	relay := fmt.Sprintf("relay/%v", command.Args["channel"])
+	topic := fmt.Sprintf("shellies/%s/%s/command", d.shellyId, relay)
+	return d.send(command, topic, []byte(payload), relay, func(pk packets.Packet) *core.CommandResult {
+		state, _ := json.Marshal(map[string]string{"state": string(pk.Payload)})
+		return &core.CommandResult{Success: true, Payload: state}
+	})
+}
@@ -0,0 +1,525 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	sparkplugNamespace = "spBv1.0"
+
+	DefaultSparkplugHostId = "fibers"
+
+	SparkplugNodeType   = "sparkplug-node"
+	SparkplugDeviceType = "sparkplug-device"
+
+	spNodeBirth   = "NBIRTH"
+	spNodeDeath   = "NDEATH"
+	spNodeData    = "NDATA"
+	spNodeCommand = "NCMD"
+	spDevBirth    = "DBIRTH"
+	spDevDeath    = "DDEATH"
+	spDevData     = "DDATA"
+	spDevCommand  = "DCMD"
+
+	spBdSeq   = "bdSeq"
+	spRebirth = "Node Control/Rebirth"
+
+	// rebirthInterval keeps a misbehaving node from being flooded with rebirth requests
+	rebirthInterval = 5 * time.Second
+)
+
+// isSparkplugClient tells Sparkplug edge nodes, which must register an NDEATH
+// will, apart from devices the AddNewDeviceHook should register.
+func isSparkplugClient(cl *mochi.Client) bool {
+	return strings.HasPrefix(cl.Properties.Will.TopicName, sparkplugNamespace+"/")
+}
+
+type SparkplugOptions struct {
+	// HostId is the Sparkplug host application id, announced on spBv1.0/STATE/<id>.
+	HostId string
+}
+
+// SparkplugAdapter maps Sparkplug B edge nodes, and the devices behind them,
+// into the DeviceManager. Nodes get the id <group>:<node> and their devices
+// <group>:<node>:<device>.
+type SparkplugAdapter struct {
+	server *mochi.Server
+	devMan core.DeviceManager
+	hostId string
+	mutex  sync.Mutex
+	nodes  map[string]*sparkplugNode
+}
+
+// sparkplugNode tracks the birth/death and message sequence numbers of an edge node.
+type sparkplugNode struct {
+	group         string
+	id            string
+	bdSeq         uint64
+	seq           uint64
+	online        bool
+	device        *SparkplugDevice
+	devices       map[string]*SparkplugDevice
+	rebirthSentAt time.Time
+}
+
+func NewSparkplugAdapter(server *mochi.Server, devMan core.DeviceManager, opts SparkplugOptions) *SparkplugAdapter {
+	if opts.HostId == "" {
+		opts.HostId = DefaultSparkplugHostId
+	}
+	return &SparkplugAdapter{
+		server: server,
+		devMan: devMan,
+		hostId: opts.HostId,
+		nodes:  make(map[string]*sparkplugNode),
+	}
+}
+
+func (a *SparkplugAdapter) Start(ctx context.Context) error {
+	filter := sparkplugNamespace + "/#"
+	subscriptionId := nextSubscriptionId()
+	if err := a.server.Subscribe(filter, subscriptionId, a.receive); err != nil {
+		return err
+	}
+	a.publishHostState(true)
+
+	go func() {
+		<-ctx.Done()
+		a.publishHostState(false)
+		a.server.Unsubscribe(filter, subscriptionId)
+	}()
+	return nil
+}
+
+// publishHostState tells edge nodes whether the host application is online,
+// so they can hold back data while it is not.
+func (a *SparkplugAdapter) publishHostState(online bool) {
+	payload, _ := json.Marshal(map[string]any{"online": online, "timestamp": time.Now().UnixMilli()})
+	topic := fmt.Sprintf("%s/STATE/%s", sparkplugNamespace, a.hostId)
+	if err := a.server.Publish(topic, payload, true, 1); err != nil {
+		log.Println("failed to publish sparkplug host state:", err)
+	}
+}
+
+func (a *SparkplugAdapter) receive(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+	// spBv1.0/<group>/<type>/<node>[/<device>]
+	parts := strings.Split(pk.TopicName, "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[1] == "STATE" {
+		return
+	}
+	group, msgType, nodeId := parts[1], parts[2], parts[3]
+	deviceId := ""
+	if len(parts) == 5 {
+		deviceId = parts[4]
+	}
+	if msgType == spNodeCommand || msgType == spDevCommand {
+		return
+	}
+
+	payload, err := parseSparkplugPayload(pk.Payload)
+	if err != nil {
+		id := sparkplugId(group, nodeId, deviceId)
+		log.Println("invalid sparkplug payload from", id, "topic", pk.TopicName, "error", err)
+		a.devMan.ReportError(core.NewMalformedPayloadError(id, pk.TopicName, pk.Payload, err))
+		return
+	}
+
+	// The manager is told about births and deaths once the adapter lock is
+	// released, it must not be called back into while the lock is held
+	changes := &registryChanges{}
+	a.mutex.Lock()
+	a.apply(changes, group, msgType, nodeId, deviceId, payload)
+	a.mutex.Unlock()
+	changes.commit(a.devMan)
+}
+
+// registryChanges are the manager calls a message leads to, made in order.
+type registryChanges struct {
+	offline []offlineChange
+	added   []*SparkplugDevice
+}
+
+type offlineChange struct {
+	id     string
+	reason string
+}
+
+func (c *registryChanges) setOffline(id string, reason string) {
+	c.offline = append(c.offline, offlineChange{id, reason})
+}
+
+func (c *registryChanges) add(dev *SparkplugDevice) {
+	c.added = append(c.added, dev)
+}
+
+func (c *registryChanges) commit(devMan core.DeviceManager) {
+	for _, change := range c.offline {
+		if err := devMan.SetDeviceOffline(change.id, change.reason); err != nil {
+			log.Println("Failed to mark device", change.id, "offline:", err)
+		}
+	}
+	for _, dev := range c.added {
+		if err := devMan.AddDevice(dev); err != nil {
+			log.Println("Failed to add sparkplug device", dev.id, "- Error:", err)
+		}
+	}
+}
+
+// apply updates the node a message is about. It must be called with mutex held.
+func (a *SparkplugAdapter) apply(changes *registryChanges, group string, msgType string, nodeId string, deviceId string, payload *spPayload) {
+	key := sparkplugId(group, nodeId, "")
+	node, ok := a.nodes[key]
+	if msgType == spNodeBirth {
+		a.nodeBirth(changes, group, nodeId, node, payload)
+		return
+	}
+	if !ok {
+		// Typically a node that was already connected when we started
+		node = &sparkplugNode{group: group, id: nodeId}
+		a.nodes[key] = node
+	}
+
+	if msgType == spNodeDeath {
+		a.nodeDeath(changes, node, payload)
+		return
+	}
+	if !node.online {
+		a.requestRebirth(node, "message before NBIRTH")
+		return
+	}
+	if !a.checkSeq(node, payload) {
+		return
+	}
+
+	switch msgType {
+	case spNodeData:
+		node.device.update(payload)
+	case spDevBirth:
+		a.deviceBirth(changes, node, deviceId, payload)
+	case spDevDeath:
+		if dev, ok := node.devices[deviceId]; ok {
+			delete(node.devices, deviceId)
+			changes.setOffline(dev.id, "device death")
+		}
+	case spDevData:
+		dev, ok := node.devices[deviceId]
+		if !ok {
+			a.requestRebirth(node, "DDATA before DBIRTH of "+deviceId)
+			return
+		}
+		if !dev.update(payload) {
+			a.requestRebirth(node, "unknown metric alias from "+deviceId)
+		}
+	}
+}
+
+// checkSeq verifies a node's messages arrive in order. A gap means messages
+// were lost, so the node has to publish its births again.
+func (a *SparkplugAdapter) checkSeq(node *sparkplugNode, payload *spPayload) bool {
+	expected := (node.seq + 1) % 256
+	node.seq = payload.Seq
+	if payload.Seq != expected {
+		a.requestRebirth(node, fmt.Sprintf("expected seq %d, got %d", expected, payload.Seq))
+		return false
+	}
+	return true
+}
+
+func (a *SparkplugAdapter) nodeBirth(changes *registryChanges, group string, nodeId string, old *sparkplugNode, payload *spPayload) {
+	node := &sparkplugNode{
+		group:   group,
+		id:      nodeId,
+		seq:     payload.Seq,
+		online:  true,
+		devices: make(map[string]*SparkplugDevice),
+	}
+	for _, m := range payload.Metrics {
+		if m.Name == spBdSeq {
+			if v, ok := m.Value.(float64); ok {
+				node.bdSeq = uint64(v)
+			}
+		}
+	}
+	// A rebirth invalidates the node's devices until they are born again
+	if old != nil {
+		node.rebirthSentAt = old.rebirthSentAt
+		for _, dev := range old.devices {
+			changes.setOffline(dev.id, "node rebirth")
+		}
+	}
+
+	node.device = newSparkplugDevice(a, node, "", payload)
+	a.nodes[sparkplugId(group, nodeId, "")] = node
+	changes.add(node.device)
+	log.Println("Sparkplug node born", node.device.id, "bdSeq", node.bdSeq)
+}
+
+func (a *SparkplugAdapter) nodeDeath(changes *registryChanges, node *sparkplugNode, payload *spPayload) {
+	if node.device == nil {
+		return
+	}
+	for _, m := range payload.Metrics {
+		if v, ok := m.Value.(float64); ok && m.Name == spBdSeq && uint64(v) != node.bdSeq {
+			// The will of a connection the node already replaced
+			log.Println("Ignoring stale NDEATH of", node.device.id, "bdSeq", uint64(v))
+			return
+		}
+	}
+	node.online = false
+	for _, dev := range node.devices {
+		changes.setOffline(dev.id, "node death")
+	}
+	node.devices = make(map[string]*SparkplugDevice)
+	changes.setOffline(node.device.id, "node death")
+}
+
+func (a *SparkplugAdapter) deviceBirth(changes *registryChanges, node *sparkplugNode, deviceId string, payload *spPayload) {
+	dev := newSparkplugDevice(a, node, deviceId, payload)
+	node.devices[deviceId] = dev
+	changes.add(dev)
+	log.Println("Sparkplug device born", dev.id)
+}
+
+// requestRebirth asks a node to publish its NBIRTH and DBIRTHs again.
+func (a *SparkplugAdapter) requestRebirth(node *sparkplugNode, reason string) {
+	if time.Since(node.rebirthSentAt) < rebirthInterval {
+		return
+	}
+	node.rebirthSentAt = time.Now()
+	log.Println("Requesting rebirth of sparkplug node", sparkplugId(node.group, node.id, ""), "-", reason)
+
+	err := a.publishCommand(node.group, node.id, "", []spMetric{{Name: spRebirth, DataType: spBoolean, Value: true}})
+	if err != nil {
+		log.Println("failed to request rebirth:", err)
+	}
+}
+
+func (a *SparkplugAdapter) publishCommand(group string, nodeId string, deviceId string, metrics []spMetric) error {
+	topic := fmt.Sprintf("%s/%s/%s/%s", sparkplugNamespace, group, spNodeCommand, nodeId)
+	if deviceId != "" {
+		topic = fmt.Sprintf("%s/%s/%s/%s/%s", sparkplugNamespace, group, spDevCommand, nodeId, deviceId)
+	}
+	payload := &spPayload{Timestamp: uint64(time.Now().UnixMilli()), Metrics: metrics}
+	return a.server.Publish(topic, payload.marshal(), false, 0)
+}
+
+func sparkplugId(group string, nodeId string, deviceId string) string {
+	if deviceId == "" {
+		return group + ":" + nodeId
+	}
+	return group + ":" + nodeId + ":" + deviceId
+}
+
+// SparkplugDevice is an edge node, or a device behind one, described by its
+// birth certificate. Writes to its metrics are sent as NCMD/DCMD messages.
+type SparkplugDevice struct {
+	id         string
+	adapter    *SparkplugAdapter
+	group      string
+	nodeId     string
+	deviceId   string
+	descriptor *core.Descriptor
+	metrics    map[string]spMetric
+	aliases    map[uint64]string
+	state      *core.State
+	stateMutex sync.RWMutex
+	states     core.Broadcaster[*core.State]
+	errors     core.Broadcaster[error]
+}
+
+const (
+	spWriteCommand   = "write"
+	spRebirthCommand = "rebirth"
+)
+
+func newSparkplugDevice(adapter *SparkplugAdapter, node *sparkplugNode, deviceId string, birth *spPayload) *SparkplugDevice {
+	dev := &SparkplugDevice{
+		id:       sparkplugId(node.group, node.id, deviceId),
+		adapter:  adapter,
+		group:    node.group,
+		nodeId:   node.id,
+		deviceId: deviceId,
+		metrics:  make(map[string]spMetric),
+		aliases:  make(map[uint64]string),
+		state:    core.NewState(time.Now()),
+	}
+
+	descriptor := &core.Descriptor{Model: SparkplugDeviceType, DeviceType: SparkplugDeviceType}
+	if deviceId == "" {
+		descriptor.Model, descriptor.DeviceType = SparkplugNodeType, SparkplugNodeType
+		descriptor.Commands = append(descriptor.Commands, core.CommandSpec{
+			Name:        spRebirthCommand,
+			Description: "Ask the node to publish its birth certificates again",
+		})
+	}
+	write := core.CommandSpec{Name: spWriteCommand, Description: "Write metric values"}
+
+	for _, m := range birth.Metrics {
+		if m.Name == spBdSeq || strings.HasPrefix(m.Name, "Node Control/") {
+			continue
+		}
+		switch m.Name {
+		case "Properties/Hardware Model":
+			if model, ok := m.Value.(string); ok {
+				descriptor.Model = model
+			}
+		case "Properties/FW":
+			descriptor.Firmware, _ = m.Value.(string)
+		}
+
+		dev.metrics[m.Name] = m
+		if m.HasAlias {
+			dev.aliases[m.Alias] = m.Name
+		}
+		spec := core.PropertySpec{Name: m.Name, Type: spValueType(m.DataType), Unit: m.Unit}
+		if argType, ok := spArgType(m.DataType); ok && !strings.HasPrefix(m.Name, "Properties/") {
+			write.Args = append(write.Args, core.ArgSpec{Name: m.Name, Type: argType})
+			spec.Setter = &core.PropertySetter{Command: spWriteCommand, Arg: m.Name}
+		}
+		descriptor.Properties = append(descriptor.Properties, spec)
+	}
+	if len(write.Args) > 0 {
+		descriptor.Commands = append(descriptor.Commands, write)
+	}
+	dev.descriptor = descriptor
+
+	dev.update(birth)
+	return dev
+}
+
+func spValueType(dataType uint32) core.ValueType {
+	switch dataType {
+	case spBoolean:
+		return core.TypeBool
+	case spString, spText, spUUID, spDateTime, spBytes:
+		return core.TypeString
+	case spFloat, spDouble, spInt8, spInt16, spInt32, spInt64, spUInt8, spUInt16, spUInt32, spUInt64:
+		return core.TypeNumber
+	}
+	return core.TypeObject
+}
+
+func spArgType(dataType uint32) (core.ArgType, bool) {
+	switch dataType {
+	case spBoolean:
+		return core.ArgBool, true
+	case spString, spText, spUUID:
+		return core.ArgString, true
+	case spFloat, spDouble:
+		return core.ArgNumber, true
+	case spInt8, spInt16, spInt32, spInt64, spUInt8, spUInt16, spUInt32, spUInt64:
+		return core.ArgInteger, true
+	}
+	return "", false
+}
+
+// update applies a birth or data message to the device state. It reports
+// false if the message used an alias the birth certificate didn't define.
+func (d *SparkplugDevice) update(payload *spPayload) bool {
+	d.stateMutex.Lock()
+	state := core.NewState(time.Now())
+	for name, p := range d.state.Properties {
+		state.Properties[name] = p
+	}
+	if payload.Timestamp != 0 {
+		ts := time.UnixMilli(int64(payload.Timestamp)).UTC()
+		state.ReportedAt = &ts
+	}
+
+	known := true
+	for _, m := range payload.Metrics {
+		name := m.Name
+		if name == "" && m.HasAlias {
+			name = d.aliases[m.Alias]
+		}
+		birth, ok := d.metrics[name]
+		if !ok {
+			if name == "" {
+				known = false
+			}
+			continue
+		}
+		if m.DataType == 0 {
+			m.DataType = birth.DataType
+		}
+		state.Set(name, m.stateValue(), birth.Unit)
+	}
+	d.state = state
+	d.stateMutex.Unlock()
+
+	d.states.Publish(state)
+	return known
+}
+
+func (d *SparkplugDevice) Id() string {
+	return d.id
+}
+
+func (d *SparkplugDevice) Descriptor() *core.Descriptor {
+	return d.descriptor
+}
+
+func (d *SparkplugDevice) ListCommands() ([]core.CommandSpec, error) {
+	return d.descriptor.Commands, nil
+}
+
+// SendCommand publishes an NCMD or DCMD. Sparkplug has no command results, the
+// commands stay unconfirmed.
+func (d *SparkplugDevice) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	if command.CorrelationId == "" {
+		command.CorrelationId = core.NewCorrelationId()
+	}
+
+	var metrics []spMetric
+	switch command.Name {
+	case spRebirthCommand:
+		metrics = []spMetric{{Name: spRebirth, DataType: spBoolean, Value: true}}
+	case spWriteCommand:
+		for name, value := range command.Args {
+			birth, ok := d.metrics[name]
+			if !ok {
+				return nil, &core.CommandValidationError{Command: command.Name, Errors: []core.ArgError{{Arg: name, Message: "unknown metric"}}}
+			}
+			metrics = append(metrics, spMetric{Name: name, Alias: birth.Alias, HasAlias: birth.HasAlias, DataType: birth.DataType, Value: value})
+		}
+	default:
+		return nil, core.NewUnknownCommandError(command.Name)
+	}
+
+	if err := d.adapter.publishCommand(d.group, d.nodeId, d.deviceId, metrics); err != nil {
+		deviceErr := core.NewDeviceError(d.id, core.ErrorPublishFailed, err)
+		d.errors.Publish(deviceErr)
+		return nil, deviceErr
+	}
+	return nil, nil
+}
+
+func (d *SparkplugDevice) GetState() *core.State {
+	d.stateMutex.RLock()
+	defer d.stateMutex.RUnlock()
+	return d.state
+}
+
+func (d *SparkplugDevice) SubscribeToStateChanges(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[*core.State], error) {
+	return d.states.Subscribe(ctx, opts), nil
+}
+
+func (d *SparkplugDevice) SubscribeToErrors(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[error], error) {
+	return d.errors.Subscribe(ctx, opts), nil
+}
+
+func (d *SparkplugDevice) Close() error {
+	d.states.Close()
+	d.errors.Close()
+	return nil
+}
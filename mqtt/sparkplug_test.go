@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+func TestSparkplugPayloadRoundTrip(t *testing.T) {
+	payload := &spPayload{
+		Timestamp: 1714557600000,
+		Seq:       7,
+		HasSeq:    true,
+		Metrics: []spMetric{
+			{Name: "temperature", Alias: 1, HasAlias: true, DataType: spDouble, Value: 21.5},
+			{Name: "offset", DataType: spInt16, Value: float64(-3)},
+			{Name: "count", DataType: spUInt64, Value: float64(1 << 40)},
+			{Name: "running", DataType: spBoolean, Value: true},
+			{Name: "mode", DataType: spString, Value: "auto"},
+			{Name: "setpoint", DataType: spDouble, IsNull: true},
+		},
+	}
+
+	parsed, err := parseSparkplugPayload(payload.marshal())
+	if err != nil {
+		t.Fatal("Expected a valid payload, but got", err)
+	}
+	if !reflect.DeepEqual(parsed, payload) {
+		t.Fatal("Expected", payload, ", but got", parsed)
+	}
+}
+
+func TestSparkplugAdapter(t *testing.T) {
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	devMan := core.NewBasicDeviceManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := NewSparkplugAdapter(server, devMan, SparkplugOptions{}).Start(ctx); err != nil {
+		t.Fatal("Expected the adapter to start, but got", err)
+	}
+
+	rebirths := make(chan packets.Packet, 10)
+	server.Subscribe("spBv1.0/plant/NCMD/gw1", nextSubscriptionId(), func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		rebirths <- pk
+	})
+	publish := func(topic string, seq uint64, metrics ...spMetric) {
+		payload := &spPayload{Timestamp: uint64(time.Now().UnixMilli()), Seq: seq, HasSeq: true, Metrics: metrics}
+		if err := server.Publish(topic, payload.marshal(), false, 0); err != nil {
+			t.Fatal("Expected to publish", topic, ", but got", err)
+		}
+	}
+
+	publish("spBv1.0/plant/NBIRTH/gw1", 0, spMetric{Name: spBdSeq, DataType: spInt64, Value: float64(3)})
+	publish("spBv1.0/plant/DBIRTH/gw1/pump", 1,
+		spMetric{Name: "speed", Alias: 10, HasAlias: true, DataType: spFloat, Value: float64(0)})
+	record, _ := devMan.GetDeviceRecord("plant:gw1:pump")
+	if p, ok := record.LastState.Get("speed"); !ok || p.Value != float64(0) {
+		t.Fatal("Expected the birth to be the last known state, but got", record.LastState)
+	}
+	publish("spBv1.0/plant/DDATA/gw1/pump", 2, spMetric{Alias: 10, HasAlias: true, Value: float64(1500)})
+
+	dev, err := devMan.GetDevice("plant:gw1:pump")
+	if err != nil {
+		t.Fatal("Expected the pump to be registered, but got", err)
+	}
+	if p, _ := dev.GetState().Get("speed"); p.Value != float64(1500) {
+		t.Fatal("Expected speed 1500, but got", p)
+	}
+
+	// A gap in the sequence numbers asks the node to rebirth
+	publish("spBv1.0/plant/DDATA/gw1/pump", 5, spMetric{Alias: 10, HasAlias: true, Value: float64(1600)})
+	select {
+	case pk := <-rebirths:
+		cmd, _ := parseSparkplugPayload(pk.Payload)
+		if len(cmd.Metrics) != 1 || cmd.Metrics[0].Name != spRebirth || cmd.Metrics[0].Value != true {
+			t.Fatal("Expected a rebirth request, but got", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a rebirth request")
+	}
+
+	// Only the death certificate of the current birth takes the node offline
+	publish("spBv1.0/plant/NDEATH/gw1", 0, spMetric{Name: spBdSeq, DataType: spInt64, Value: float64(2)})
+	if _, err := devMan.GetDevice("plant:gw1"); err != nil {
+		t.Fatal("Expected a stale NDEATH to be ignored, but got", err)
+	}
+	publish("spBv1.0/plant/NDEATH/gw1", 0, spMetric{Name: spBdSeq, DataType: spInt64, Value: float64(3)})
+	for _, id := range []string{"plant:gw1", "plant:gw1:pump"} {
+		if record, _ := devMan.GetDeviceRecord(id); record.Presence.Status != core.StatusOffline {
+			t.Fatal("Expected", id, "to be offline, but got", record.Presence.Status)
+		}
+	}
+}
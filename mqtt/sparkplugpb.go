@@ -0,0 +1,299 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B metric data types
+const (
+	spInt8     uint32 = 1
+	spInt16    uint32 = 2
+	spInt32    uint32 = 3
+	spInt64    uint32 = 4
+	spUInt8    uint32 = 5
+	spUInt16   uint32 = 6
+	spUInt32   uint32 = 7
+	spUInt64   uint32 = 8
+	spFloat    uint32 = 9
+	spDouble   uint32 = 10
+	spBoolean  uint32 = 11
+	spString   uint32 = 12
+	spDateTime uint32 = 13
+	spText     uint32 = 14
+	spUUID     uint32 = 15
+	spBytes    uint32 = 17
+)
+
+var errSparkplugPayload = errors.New("invalid sparkplug payload")
+
+// spPayload is the subset of the Sparkplug B protobuf payload we use:
+//
+//	message Payload { uint64 timestamp = 1; repeated Metric metrics = 2; uint64 seq = 3; }
+type spPayload struct {
+	Timestamp uint64
+	Metrics   []spMetric
+	Seq       uint64
+	HasSeq    bool
+}
+
+// spMetric is a Sparkplug B metric. Value holds a float64, bool, string or
+// []byte, depending on the data type, or nil when the metric is null.
+type spMetric struct {
+	Name      string
+	Alias     uint64
+	HasAlias  bool
+	Timestamp uint64
+	DataType  uint32
+	IsNull    bool
+	Value     any
+	// Unit is the "engUnit" property of the metric, if any.
+	Unit string
+}
+
+// stateValue converts the metric value to the shape used in core.State.
+func (m spMetric) stateValue() any {
+	switch v := m.Value.(type) {
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case float64:
+		if m.DataType == spDateTime {
+			return time.UnixMilli(int64(v)).UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return m.Value
+}
+
+func (p *spPayload) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.Timestamp)
+	for _, m := range p.Metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.marshal())
+	}
+	if p.HasSeq {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, p.Seq)
+	}
+	return b
+}
+
+func (m *spMetric) marshal() []byte {
+	var b []byte
+	if m.Name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.HasAlias {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Alias)
+	}
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Timestamp)
+	}
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.DataType))
+	if m.IsNull || m.Value == nil {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		return protowire.AppendVarint(b, 1)
+	}
+
+	switch v := m.Value.(type) {
+	case bool:
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case []byte:
+		b = protowire.AppendTag(b, 16, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	case float64:
+		switch m.DataType {
+		case spInt8, spInt16, spInt32:
+			b = protowire.AppendTag(b, 10, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(uint32(int32(v))))
+		case spUInt8, spUInt16, spUInt32:
+			b = protowire.AppendTag(b, 10, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(uint32(v)))
+		case spInt64:
+			b = protowire.AppendTag(b, 11, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(int64(v)))
+		case spUInt64, spDateTime:
+			b = protowire.AppendTag(b, 11, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		case spFloat:
+			b = protowire.AppendTag(b, 12, protowire.Fixed32Type)
+			b = protowire.AppendFixed32(b, math.Float32bits(float32(v)))
+		default:
+			b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(v))
+		}
+	}
+	return b
+}
+
+func parseSparkplugPayload(data []byte) (*spPayload, error) {
+	p := &spPayload{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, scalar uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			p.Timestamp = scalar
+		case num == 2 && typ == protowire.BytesType:
+			m, err := parseSparkplugMetric(value)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, *m)
+		case num == 3 && typ == protowire.VarintType:
+			p.Seq = scalar
+			p.HasSeq = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseSparkplugMetric(data []byte) (*spMetric, error) {
+	m := &spMetric{}
+	var intValue, longValue uint64
+	var hasInt, hasLong bool
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, scalar uint64) error {
+		switch num {
+		case 1:
+			m.Name = string(value)
+		case 2:
+			m.Alias = scalar
+			m.HasAlias = true
+		case 3:
+			m.Timestamp = scalar
+		case 4:
+			m.DataType = uint32(scalar)
+		case 7:
+			m.IsNull = scalar != 0
+		case 9:
+			m.Unit = parseEngUnit(value)
+		case 10:
+			intValue, hasInt = scalar, true
+		case 11:
+			longValue, hasLong = scalar, true
+		case 12:
+			m.Value = float64(math.Float32frombits(uint32(scalar)))
+		case 13:
+			m.Value = math.Float64frombits(scalar)
+		case 14:
+			m.Value = scalar != 0
+		case 15:
+			m.Value = string(value)
+		case 16:
+			m.Value = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Signed types are sent as their two's complement in the unsigned fields
+	switch {
+	case hasInt:
+		switch m.DataType {
+		case spInt8:
+			m.Value = float64(int8(intValue))
+		case spInt16:
+			m.Value = float64(int16(intValue))
+		case spInt32:
+			m.Value = float64(int32(intValue))
+		default:
+			m.Value = float64(uint32(intValue))
+		}
+	case hasLong:
+		if m.DataType == spInt64 {
+			m.Value = float64(int64(longValue))
+		} else {
+			m.Value = float64(longValue)
+		}
+	}
+	if m.IsNull {
+		m.Value = nil
+	}
+	return m, nil
+}
+
+// parseEngUnit picks the "engUnit" entry out of a metric's PropertySet:
+//
+//	message PropertySet { repeated string keys = 1; repeated PropertyValue values = 2; }
+//	message PropertyValue { ...; string string_value = 8; }
+func parseEngUnit(data []byte) string {
+	var keys, values []string
+	_ = consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, scalar uint64) error {
+		switch num {
+		case 1:
+			keys = append(keys, string(value))
+		case 2:
+			str := ""
+			_ = consumeFields(value, func(num protowire.Number, typ protowire.Type, value []byte, scalar uint64) error {
+				if num == 8 {
+					str = string(value)
+				}
+				return nil
+			})
+			values = append(values, str)
+		}
+		return nil
+	})
+	for i, key := range keys {
+		if key == "engUnit" && i < len(values) {
+			return values[i]
+		}
+	}
+	return ""
+}
+
+// consumeFields walks a protobuf message. value is set for length delimited
+// fields, scalar for everything else.
+func consumeFields(data []byte, field func(num protowire.Number, typ protowire.Type, value []byte, scalar uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", errSparkplugPayload, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		var value []byte
+		var scalar uint64
+		switch typ {
+		case protowire.VarintType:
+			scalar, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(data)
+			scalar = uint64(v)
+		case protowire.Fixed64Type:
+			scalar, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: %v", errSparkplugPayload, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		if err := field(num, typ, value, scalar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const TasmotaDeviceType = "tasmota"
+
+// tasmotaUnits are the units of the readings Tasmota reports in tele/<topic>/SENSOR
+var tasmotaUnits = map[string]string{
+	"voltage":       "V",
+	"current":       "A",
+	"power":         "W",
+	"apparentpower": "VA",
+	"reactivepower": "var",
+	"total":         "kWh",
+	"today":         "kWh",
+	"yesterday":     "kWh",
+	"temperature":   "°C",
+	"humidity":      "%",
+	"pressure":      "hPa",
+}
+
+// TasmotaDevice follows the default Tasmota topic layout: commands go to
+// cmnd/<topic>/<command>, replies come on stat/<topic>/RESULT and telemetry on
+// tele/<topic>/STATE and tele/<topic>/SENSOR. Relays are reported as power1,
+// power2, ... with "on" or "off".
+type TasmotaDevice struct {
+	*topicDevice
+	topic string
+}
+
+var tasmotaDescriptor = core.Descriptor{
+	Model:      "tasmota",
+	DeviceType: TasmotaDeviceType,
+	Commands: []core.CommandSpec{
+		{Name: "power", Description: "Switch a relay", Args: []core.ArgSpec{
+			{Name: "state", Type: core.ArgString, Required: true, Enum: []any{"on", "off"}},
+			{Name: "relay", Type: core.ArgInteger, Default: 1.0, Min: ptr(1.0), Max: ptr(8.0)},
+		}},
+		{Name: "toggle", Description: "Toggle a relay", Args: []core.ArgSpec{
+			{Name: "relay", Type: core.ArgInteger, Default: 1.0, Min: ptr(1.0), Max: ptr(8.0)},
+		}},
+		{Name: "command", Description: "Send a raw Tasmota command", Args: []core.ArgSpec{
+			{Name: "name", Type: core.ArgString, Required: true},
+			{Name: "value", Type: core.ArgString, Default: ""},
+		}},
+	},
+	Properties: []core.PropertySpec{
+		{Name: "power1", Type: core.TypeString, Setter: &core.PropertySetter{Command: "power", Arg: "state"}},
+	},
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// detectTasmota returns the Tasmota topic of a client that registered the
+// standard tele/<topic>/LWT will.
+func detectTasmota(cl *mochi.Client) (string, bool) {
+	parts := strings.Split(cl.Properties.Will.TopicName, "/")
+	if len(parts) == 3 && parts[0] == "tele" && parts[2] == "LWT" {
+		return parts[1], true
+	}
+	return "", false
+}
+
+func NewTasmotaDevice(server *mochi.Server, deviceId string, topic string) (*TasmotaDevice, error) {
+	descriptor := tasmotaDescriptor
+	dev := &TasmotaDevice{newTopicDevice(server, deviceId, &descriptor), topic}
+
+	if err := dev.subscribe(fmt.Sprintf("stat/%s/+", topic), dev.receiveStat); err != nil {
+		return nil, err
+	}
+	if err := dev.subscribe(fmt.Sprintf("tele/%s/+", topic), dev.receiveTele); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	// Ask for the relay states rather than waiting for the next telemetry period
+	dev.publish(dev.commandTopic("STATE"), nil)
+	return dev, nil
+}
+
+func (d *TasmotaDevice) commandTopic(command string) string {
+	return fmt.Sprintf("cmnd/%s/%s", d.topic, command)
+}
+
+func (d *TasmotaDevice) receiveStat(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+	name := pk.TopicName[strings.LastIndex(pk.TopicName, "/")+1:]
+	switch {
+	case name == "RESULT" || name == "STATE":
+		d.receiveJson(pk)
+		d.reply("RESULT", pk)
+	case strings.HasPrefix(name, "POWER"):
+		d.update(map[string]any{relayName(name): strings.ToLower(string(pk.Payload))}, nil, nil)
+	}
+}
+
+func (d *TasmotaDevice) receiveTele(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+	name := pk.TopicName[strings.LastIndex(pk.TopicName, "/")+1:]
+	if name == "STATE" || name == "SENSOR" {
+		d.receiveJson(pk)
+	}
+}
+
+func (d *TasmotaDevice) receiveJson(pk packets.Packet) {
+	payload := map[string]any{}
+	if err := json.Unmarshal(pk.Payload, &payload); err != nil {
+		log.Println("failed to parse tasmota payload from", d.id, "topic", pk.TopicName, "error", err)
+		d.errors.Publish(core.NewMalformedPayloadError(d.id, pk.TopicName, pk.Payload, err))
+		return
+	}
+
+	var reportedAt *time.Time
+	if ts, ok := payload["Time"].(string); ok {
+		// Tasmota reports local time without a zone
+		if t, err := time.ParseInLocation("2006-01-02T15:04:05", ts, time.Local); err == nil {
+			reportedAt = &t
+		}
+	}
+	delete(payload, "Time")
+
+	values := make(map[string]any)
+	units := make(map[string]string)
+	tempUnit, _ := payload["TempUnit"].(string)
+	delete(payload, "TempUnit")
+	flattenTasmota("", payload, values, units, tempUnit)
+	if len(values) > 0 {
+		d.update(values, units, reportedAt)
+	}
+}
+
+// flattenTasmota turns nested telemetry like {"ENERGY": {"Power": 12}} into
+// energy_power properties.
+func flattenTasmota(prefix string, payload map[string]any, values map[string]any, units map[string]string, tempUnit string) {
+	for key, value := range payload {
+		if strings.HasPrefix(key, "POWER") && prefix == "" {
+			if s, ok := value.(string); ok {
+				values[relayName(key)] = strings.ToLower(s)
+			}
+			continue
+		}
+
+		name := strings.ToLower(key)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		if nested, ok := value.(map[string]any); ok {
+			flattenTasmota(name, nested, values, units, tempUnit)
+			continue
+		}
+		values[name] = value
+
+		unit := tasmotaUnits[strings.ToLower(key)]
+		if unit == "°C" && tempUnit != "" {
+			unit = "°" + tempUnit
+		}
+		if unit != "" {
+			units[name] = unit
+		}
+	}
+}
+
+// relayName maps POWER and POWER<n> to power1 and power<n>.
+func relayName(key string) string {
+	n := strings.TrimPrefix(key, "POWER")
+	if n == "" {
+		n = "1"
+	}
+	return "power" + n
+}
+
+func (d *TasmotaDevice) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	var topic, payload string
+	switch command.Name {
+	case "power", "toggle":
+		topic = d.commandTopic(fmt.Sprintf("POWER%v", command.Args["relay"]))
+		payload = "TOGGLE"
+		if state, ok := command.Args["state"].(string); ok {
+			payload = strings.ToUpper(state)
+		}
+	case "command":
+		topic = d.commandTopic(fmt.Sprint(command.Args["name"]))
+		payload = fmt.Sprint(command.Args["value"])
+	default:
+		return nil, core.NewUnknownCommandError(command.Name)
+	}
+
+	return d.send(command, topic, []byte(payload), "RESULT", tasmotaResult)
+}
+
+// tasmotaResult reads a stat/<topic>/RESULT reply. Tasmota answers commands
+// it doesn't understand with {"Command": "Unknown"}.
+func tasmotaResult(pk packets.Packet) *core.CommandResult {
+	result := &core.CommandResult{Success: true, Payload: json.RawMessage(pk.Payload)}
+	reply := struct {
+		Command string
+	}{}
+	if json.Unmarshal(pk.Payload, &reply) == nil && reply.Command != "" {
+		result.Success = false
+		result.Error = "command " + strings.ToLower(reply.Command)
+	}
+	if !json.Valid(pk.Payload) {
+		result.Payload, _ = json.Marshal(string(pk.Payload))
+	}
+	return result
+}
@@ -0,0 +1,223 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+// topicDevice is the plumbing shared by devices that follow a topic layout of
+// their own rather than devices/<id>/...: inline subscriptions, merged state
+// and turning command replies into results.
+type topicDevice struct {
+	id            string
+	server        *mochi.Server
+	descriptor    *core.Descriptor
+	subscriptions []topicSubscription
+	state         *core.State
+	stateMutex    sync.RWMutex
+	states        core.Broadcaster[*core.State]
+	errors        core.Broadcaster[error]
+	results       core.Broadcaster[*core.CommandResult]
+	repliesMutex  sync.Mutex
+	replies       map[string][]expectedReply
+}
+
+// expectedReply is a command whose result is the next message with a key.
+type expectedReply struct {
+	correlationId string
+	sentAt        time.Time
+	result        func(pk packets.Packet) *core.CommandResult
+}
+
+const (
+	// replyTimeout is how long after a command a message still counts as its
+	// reply.
+	replyTimeout = time.Minute
+	// maxExpectedReplies bounds the commands waiting for a reply with a key.
+	maxExpectedReplies = 16
+)
+
+type topicSubscription struct {
+	filter string
+	id     int
+}
+
+func newTopicDevice(server *mochi.Server, deviceId string, descriptor *core.Descriptor) *topicDevice {
+	return &topicDevice{
+		id:         deviceId,
+		server:     server,
+		descriptor: descriptor,
+		state:      core.NewState(time.Now()),
+		replies:    make(map[string][]expectedReply),
+	}
+}
+
+func (d *topicDevice) subscribe(filter string, handler mochi.InlineSubFn) error {
+	sub := topicSubscription{filter, nextSubscriptionId()}
+	if err := d.server.Subscribe(filter, sub.id, handler); err != nil {
+		return err
+	}
+	d.subscriptions = append(d.subscriptions, sub)
+	return nil
+}
+
+// update merges values into the device state. Units fall back to the descriptor.
+func (d *topicDevice) update(values map[string]any, units map[string]string, reportedAt *time.Time) {
+	d.stateMutex.Lock()
+	state := core.NewState(time.Now())
+	for name, p := range d.state.Properties {
+		state.Properties[name] = p
+	}
+	state.ReportedAt = reportedAt
+	for name, value := range values {
+		unit := units[name]
+		if unit == "" {
+			unit = d.descriptor.PropertyUnit(name)
+		}
+		state.Set(name, value, unit)
+	}
+	d.state = state
+	d.stateMutex.Unlock()
+
+	d.states.Publish(state)
+}
+
+func (d *topicDevice) publish(topic string, payload []byte) error {
+	if err := d.server.Publish(topic, payload, false, 0); err != nil {
+		deviceErr := core.NewDeviceError(d.id, core.ErrorPublishFailed, err)
+		deviceErr.Topic = topic
+		d.errors.Publish(deviceErr)
+		return deviceErr
+	}
+	return nil
+}
+
+// expectReply registers a command waiting for the next message with key.
+// Devices without correlation ids reply in order, so commands are served
+// first come, first served.
+func (d *topicDevice) expectReply(key string, reply expectedReply) {
+	d.repliesMutex.Lock()
+	defer d.repliesMutex.Unlock()
+	expected := append(d.replies[key], reply)
+	if len(expected) > maxExpectedReplies {
+		expected = expected[len(expected)-maxExpectedReplies:]
+	}
+	d.replies[key] = expected
+}
+
+// reply turns a message into the result of the oldest command waiting for it.
+func (d *topicDevice) reply(key string, pk packets.Packet) {
+	d.repliesMutex.Lock()
+	expected := d.replies[key]
+	for len(expected) > 0 && time.Since(expected[0].sentAt) > replyTimeout {
+		expected = expected[1:]
+	}
+	if len(expected) == 0 {
+		delete(d.replies, key)
+		d.repliesMutex.Unlock()
+		return
+	}
+	reply := expected[0]
+	d.replies[key] = expected[1:]
+	d.repliesMutex.Unlock()
+
+	result := reply.result(pk)
+	result.CorrelationId = reply.correlationId
+	d.results.Publish(result)
+}
+
+func (d *topicDevice) forgetReply(key string, correlationId string) {
+	d.repliesMutex.Lock()
+	defer d.repliesMutex.Unlock()
+	d.replies[key] = slices.DeleteFunc(d.replies[key], func(r expectedReply) bool {
+		return r.correlationId == correlationId
+	})
+}
+
+// send publishes a command payload. The next message with key is its reply,
+// result turns it into the result of the command.
+func (d *topicDevice) send(command *core.Command, topic string, payload []byte,
+	key string, result func(pk packets.Packet) *core.CommandResult) (*core.CommandResult, error) {
+
+	if command.CorrelationId == "" {
+		command.CorrelationId = core.NewCorrelationId()
+	}
+	d.expectReply(key, expectedReply{command.CorrelationId, time.Now(), result})
+	if err := d.publish(topic, payload); err != nil {
+		d.forgetReply(key, command.CorrelationId)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ReportsResult is true for all commands, they are all sent expecting a reply.
+func (d *topicDevice) ReportsResult(command *core.Command) bool {
+	return true
+}
+
+func (d *topicDevice) SubscribeToResults(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[*core.CommandResult], error) {
+	return d.results.Subscribe(ctx, opts), nil
+}
+
+func (d *topicDevice) Id() string {
+	return d.id
+}
+
+func (d *topicDevice) Descriptor() *core.Descriptor {
+	return d.descriptor
+}
+
+func (d *topicDevice) ListCommands() ([]core.CommandSpec, error) {
+	return d.descriptor.Commands, nil
+}
+
+func (d *topicDevice) GetState() *core.State {
+	d.stateMutex.RLock()
+	defer d.stateMutex.RUnlock()
+	return d.state
+}
+
+func (d *topicDevice) SubscribeToStateChanges(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[*core.State], error) {
+	return d.states.Subscribe(ctx, opts), nil
+}
+
+func (d *topicDevice) SubscribeToErrors(ctx context.Context, opts core.SubscriptionOptions) (*core.Subscription[error], error) {
+	return d.errors.Subscribe(ctx, opts), nil
+}
+
+// Close detaches the device from the broker and closes all its subscriptions.
+func (d *topicDevice) Close() error {
+	var errs []error
+	for _, sub := range d.subscriptions {
+		errs = append(errs, d.server.Unsubscribe(sub.filter, sub.id))
+	}
+	d.states.Close()
+	d.errors.Close()
+	d.results.Close()
+	return errors.Join(errs...)
+}
+
+// parseScalar reads a plain text payload as a number or bool if it looks like one.
+func parseScalar(payload []byte) any {
+	text := strings.TrimSpace(string(payload))
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f
+	}
+	switch strings.ToLower(text) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return text
+}
@@ -0,0 +1,318 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+// TopicMapping turns an arbitrary topic layout into devices. Topic templates
+// are matched level by level: {name} captures a level into a variable, + and #
+// match without capturing. Variables are substituted into the device id,
+// property names and the command topics and payloads, as in
+//
+//	State:    plant/{line}/{device}/{property}
+//	DeviceId: {line}-{device}
+//	Command:  plant/{line}/{device}/set/output with payload {state}
+type TopicMapping struct {
+	Name string `json:"name"`
+	// DeviceId is the template of the ids of the mapped devices.
+	DeviceId   string           `json:"deviceId"`
+	Descriptor *core.Descriptor `json:"descriptor"`
+	State      []StateMapping   `json:"state"`
+	Commands   []CommandMapping `json:"commands,omitempty"`
+}
+
+// StateMapping extracts one property from the messages on a topic.
+type StateMapping struct {
+	Topic    string `json:"topic"`
+	Property string `json:"property"`
+	// Path picks the value out of a JSON payload, as in $.readings[0].value.
+	// The whole payload is read as a plain value when empty.
+	Path string `json:"path,omitempty"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// CommandMapping publishes a command of the descriptor. Its arguments can be
+// used in the topic and payload templates alongside the topic variables. The
+// commands aren't confirmed, the state the device reports next tells whether
+// they took effect.
+type CommandMapping struct {
+	Command string `json:"command"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// addRetryInterval is how long a device the manager refused to add is left
+// unregistered before it is added again.
+const addRetryInterval = time.Minute
+
+// TopicMapper registers a device the first time a mapped topic reports state
+// for it, and again when it reports after going offline or being removed.
+type TopicMapper struct {
+	server   *mochi.Server
+	devMan   core.DeviceManager
+	mappings []TopicMapping
+	mutex    sync.Mutex
+	devices  map[string]*MappedDevice
+	// failedAt holds when adding a device last failed
+	failedAt map[string]time.Time
+}
+
+func NewTopicMapper(server *mochi.Server, devMan core.DeviceManager, mappings []TopicMapping) *TopicMapper {
+	return &TopicMapper{
+		server:   server,
+		devMan:   devMan,
+		mappings: mappings,
+		devices:  make(map[string]*MappedDevice),
+		failedAt: make(map[string]time.Time),
+	}
+}
+
+func (m *TopicMapper) Start(ctx context.Context) error {
+	type subscription struct {
+		filter string
+		id     int
+	}
+	var subs []subscription
+	for i := range m.mappings {
+		mapping := &m.mappings[i]
+		if err := validateMapping(mapping); err != nil {
+			return err
+		}
+		for _, sm := range mapping.State {
+			template := parseTopicTemplate(sm.Topic)
+			sub := subscription{template.filter(), nextSubscriptionId()}
+			err := m.server.Subscribe(sub.filter, sub.id, func(cl *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+				if vars, ok := template.match(pk.TopicName); ok {
+					m.receive(mapping, sm, vars, pk)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			subs = append(subs, sub)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, sub := range subs {
+			m.server.Unsubscribe(sub.filter, sub.id)
+		}
+	}()
+	return nil
+}
+
+func validateMapping(mapping *TopicMapping) error {
+	if mapping.DeviceId == "" || len(mapping.State) == 0 {
+		return fmt.Errorf("topic mapping %s: a device id and state topics are required", mapping.Name)
+	}
+	if mapping.Descriptor == nil {
+		mapping.Descriptor = &core.Descriptor{Model: mapping.Name}
+	}
+	for _, cm := range mapping.Commands {
+		if _, ok := core.FindCommandSpec(mapping.Descriptor.Commands, cm.Command); !ok {
+			return fmt.Errorf("topic mapping %s: command %s is not in the descriptor", mapping.Name, cm.Command)
+		}
+	}
+	return nil
+}
+
+func (m *TopicMapper) receive(mapping *TopicMapping, sm StateMapping, vars map[string]string, pk packets.Packet) {
+	deviceId, err := core.RenderTemplate(mapping.DeviceId, vars)
+	if err != nil {
+		log.Println("Failed to map topic", pk.TopicName, "to a device:", err)
+		return
+	}
+	property, err := core.RenderTemplate(sm.Property, vars)
+	if err != nil {
+		log.Println("Failed to map topic", pk.TopicName, "to a property:", err)
+		return
+	}
+
+	dev := m.device(mapping, deviceId, vars)
+	value, err := extractValue(pk.Payload, sm.Path)
+	if err != nil {
+		dev.errors.Publish(core.NewMalformedPayloadError(deviceId, pk.TopicName, pk.Payload, err))
+		return
+	}
+	units := map[string]string{}
+	if sm.Unit != "" {
+		units[property] = sm.Unit
+	}
+	dev.update(map[string]any{property: value}, units, nil)
+}
+
+// device returns the mapped device with the given id, registering it unless it
+// is registered and online.
+func (m *TopicMapper) device(mapping *TopicMapping, deviceId string, vars map[string]string) *MappedDevice {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	dev, ok := m.devices[deviceId]
+	record, err := m.devMan.GetDeviceRecord(deviceId)
+	if ok && err == nil && record.Presence.Status != core.StatusOffline {
+		dev.addVars(vars)
+		return dev
+	}
+	if failedAt, failed := m.failedAt[deviceId]; ok && failed && time.Since(failedAt) < addRetryInterval {
+		dev.addVars(vars)
+		return dev
+	}
+
+	// Devices are closed when they go offline or are removed
+	descriptor := *mapping.Descriptor
+	replacement := &MappedDevice{topicDevice: newTopicDevice(m.server, deviceId, &descriptor), mapping: mapping, vars: vars}
+	if ok {
+		replacement.vars = dev.vars
+		replacement.addVars(vars)
+	}
+	// Each message reports a single property, the others go on from the last
+	// known state rather than looking removed
+	if err == nil && record.LastState != nil {
+		replacement.state = record.LastState
+	}
+	dev = replacement
+	m.devices[deviceId] = dev
+	if err := m.devMan.AddDevice(dev); err != nil {
+		log.Println("Failed to add mapped device", deviceId, "- Error:", err)
+		m.failedAt[deviceId] = time.Now()
+	} else {
+		log.Println("New mapped device added", deviceId)
+		delete(m.failedAt, deviceId)
+	}
+	return dev
+}
+
+// MappedDevice is a device put together from the topics of a TopicMapping.
+type MappedDevice struct {
+	*topicDevice
+	mapping   *TopicMapping
+	varsMutex sync.Mutex
+	vars      map[string]string
+}
+
+func (d *MappedDevice) addVars(vars map[string]string) {
+	d.varsMutex.Lock()
+	defer d.varsMutex.Unlock()
+	merged := make(map[string]string, len(d.vars)+len(vars))
+	for name, value := range d.vars {
+		merged[name] = value
+	}
+	for name, value := range vars {
+		merged[name] = value
+	}
+	d.vars = merged
+}
+
+func (d *MappedDevice) SendCommand(ctx context.Context, command *core.Command) (*core.CommandResult, error) {
+	var mapping *CommandMapping
+	for i := range d.mapping.Commands {
+		if d.mapping.Commands[i].Command == command.Name {
+			mapping = &d.mapping.Commands[i]
+		}
+	}
+	if mapping == nil {
+		return nil, core.NewUnknownCommandError(command.Name)
+	}
+
+	d.varsMutex.Lock()
+	vars := make(map[string]string, len(d.vars)+len(command.Args))
+	for name, value := range d.vars {
+		vars[name] = value
+	}
+	d.varsMutex.Unlock()
+	for name, value := range command.Args {
+		vars[name] = core.FormatValue(value)
+	}
+
+	topic, err := core.RenderTemplate(mapping.Topic, vars)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := core.RenderTemplate(mapping.Payload, vars)
+	if err != nil {
+		return nil, err
+	}
+	if command.CorrelationId == "" {
+		command.CorrelationId = core.NewCorrelationId()
+	}
+	if err := d.server.Publish(topic, []byte(payload), mapping.Retain, 0); err != nil {
+		deviceErr := core.NewDeviceError(d.id, core.ErrorPublishFailed, err)
+		deviceErr.Topic = topic
+		d.errors.Publish(deviceErr)
+		return nil, deviceErr
+	}
+
+	// Mapped devices don't reply, so the command stays unconfirmed
+	return nil, nil
+}
+
+// ReportsResult is false, mapped devices don't reply to commands.
+func (d *MappedDevice) ReportsResult(command *core.Command) bool {
+	return false
+}
+
+type topicTemplate []string
+
+func parseTopicTemplate(template string) topicTemplate {
+	return strings.Split(template, "/")
+}
+
+// filter is the subscription filter matching every topic of the template.
+func (t topicTemplate) filter() string {
+	levels := make([]string, len(t))
+	for i, level := range t {
+		if isTemplateVar(level) {
+			level = "+"
+		}
+		levels[i] = level
+	}
+	return strings.Join(levels, "/")
+}
+
+func (t topicTemplate) match(topic string) (map[string]string, bool) {
+	levels := strings.Split(topic, "/")
+	vars := make(map[string]string)
+	for i, level := range t {
+		switch {
+		case level == "#":
+			return vars, true
+		case i >= len(levels):
+			return nil, false
+		case isTemplateVar(level):
+			vars[level[1:len(level)-1]] = levels[i]
+		case level != "+" && level != levels[i]:
+			return nil, false
+		}
+	}
+	return vars, len(levels) == len(t)
+}
+
+func isTemplateVar(level string) bool {
+	return len(level) > 2 && level[0] == '{' && level[len(level)-1] == '}'
+}
+
+// extractValue reads the value at a JSON path, or the whole payload as a plain
+// value when there is no path.
+func extractValue(payload []byte, path string) (any, error) {
+	if path == "" {
+		return parseScalar(payload), nil
+	}
+	var value any
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, err
+	}
+	return core.JSONPath(value, path)
+}
@@ -0,0 +1,124 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/ilievs/fibers/core"
+)
+
+func TestTopicTemplate(t *testing.T) {
+	template := parseTopicTemplate("plant/{line}/+/{psu}/#")
+	if template.filter() != "plant/+/+/+/#" {
+		t.Fatal("Expected filter plant/+/+/+/#, but got", template.filter())
+	}
+	vars, ok := template.match("plant/line3/rack2/psu7/readings/voltage")
+	if !ok || vars["line"] != "line3" || vars["psu"] != "psu7" {
+		t.Fatal("Expected line3 and psu7, but got", vars)
+	}
+	if _, ok := parseTopicTemplate("plant/{line}/{psu}").match("plant/line3"); ok {
+		t.Fatal("Expected a shorter topic not to match")
+	}
+}
+
+func TestExtractValue(t *testing.T) {
+	payload := []byte(`{"readings": [{"value": 24.1}], "meta": {"serial no": "A7"}}`)
+	for path, expected := range map[string]any{
+		"$.readings[0].value": 24.1,
+		"$.meta['serial no']": "A7",
+		"":                    string(payload),
+	} {
+		value, err := extractValue(payload, path)
+		if err != nil || value != expected {
+			t.Fatal("Expected", expected, "at", path, ", but got", value, err)
+		}
+	}
+	if _, err := extractValue(payload, "$.readings[3].value"); err == nil {
+		t.Fatal("Expected an error for a missing element")
+	}
+}
+
+func TestTopicMapper(t *testing.T) {
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	devMan := core.NewBasicDeviceManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mappings := []TopicMapping{{
+		Name:     "psu",
+		DeviceId: "{line}-{psu}",
+		Descriptor: &core.Descriptor{Model: "psu", Commands: []core.CommandSpec{
+			{Name: "power", Args: []core.ArgSpec{{Name: "state", Type: core.ArgString, Required: true}}},
+		}},
+		State: []StateMapping{
+			{Topic: "plant/{line}/{psu}/voltage", Property: "voltage", Unit: "V"},
+			{Topic: "plant/{line}/{psu}/status", Property: "{psu}_temperature", Path: "$.temp"},
+		},
+		Commands: []CommandMapping{
+			{Command: "power", Topic: "plant/{line}/{psu}/set", Payload: `{"output": "{state}"}`},
+		},
+	}}
+	if err := NewTopicMapper(server, devMan, mappings).Start(ctx); err != nil {
+		t.Fatal("Expected the mapper to start, but got", err)
+	}
+
+	states := devMan.SubscribeToEvents(ctx, core.EventFilter{Types: []core.EventType{core.EventStateChanged}}, core.SubscriptionOptions{})
+	// recorded waits for the registry to record a state with the voltage
+	recorded := func(voltage float64) *core.State {
+		t.Helper()
+		for {
+			select {
+			case event := <-states.C():
+				state := event.(core.StateChangedEvent).NewState
+				if p, _ := state.Get("voltage"); p.Value == voltage {
+					return state
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected a state with voltage", voltage)
+			}
+		}
+	}
+
+	server.Publish("plant/line3/psu7/status", []byte(`{"temp": 41}`), false, 0)
+	server.Publish("plant/line3/psu7/voltage", []byte("24.1"), false, 0)
+	recorded(24.1)
+	dev, err := devMan.GetDevice("line3-psu7")
+	if err != nil {
+		t.Fatal("Expected device line3-psu7, but got", err)
+	}
+	state := dev.GetState()
+	if p, _ := state.Get("voltage"); p.Value != 24.1 || p.Unit != "V" {
+		t.Fatal("Expected voltage 24.1 V, but got", p)
+	}
+	if p, _ := state.Get("psu7_temperature"); p.Value != 41.0 {
+		t.Fatal("Expected psu7_temperature 41, but got", p)
+	}
+
+	devMan.SetDeviceOffline("line3-psu7", "test")
+	server.Publish("plant/line3/psu7/voltage", []byte("24.3"), false, 0)
+	if p, _ := devMan.ListDevices()[0].GetState().Get("voltage"); p.Value != 24.3 {
+		t.Fatal("Expected the device to report again, but got", p)
+	}
+	// The properties not reported again are kept
+	if state := recorded(24.3); len(state.Properties) != 2 {
+		t.Fatal("Expected the last known temperature to be kept, but got", state)
+	}
+
+	received := make(chan string, 1)
+	server.Subscribe("plant/line3/psu7/set", nextSubscriptionId(), func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- string(pk.Payload)
+	})
+	cmdCtx, cmdCancel := context.WithTimeout(ctx, time.Second)
+	defer cmdCancel()
+	result, err := devMan.SendCommand(cmdCtx, "line3-psu7", &core.Command{Name: "power", Args: map[string]any{"state": "off"}})
+	if err != nil || result != nil {
+		t.Fatal("Expected the command to be sent unconfirmed, but got", result, err)
+	}
+	if payload := <-received; payload != `{"output": "off"}` {
+		t.Fatal(`Expected {"output": "off"}, but got`, payload)
+	}
+}
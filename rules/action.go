@@ -0,0 +1,177 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+type ActionType string
+
+const (
+	// ActionCommand sends a command to a device, the device of the condition
+	// unless another is given.
+	ActionCommand ActionType = "command"
+	// ActionAlert reports an alert against the device of the condition.
+	ActionAlert ActionType = "alert"
+	// ActionWebhook POSTs the Firing to a URL as JSON.
+	ActionWebhook ActionType = "webhook"
+	// ActionPublish publishes a message to an MQTT topic.
+	ActionPublish ActionType = "mqtt"
+	// ActionScene starts a run of a scene.
+	ActionScene ActionType = "scene"
+)
+
+// Action is run when a rule fires. Message, Topic and Payload are templates of
+// {rule}, {device}, {property} and {value}. MQTT messages are the Firing as
+// JSON without a Payload.
+type Action struct {
+	Type     ActionType     `json:"type"`
+	DeviceId string         `json:"deviceId,omitempty"`
+	Command  string         `json:"command,omitempty"`
+	Args     map[string]any `json:"args,omitempty"`
+	Code     string         `json:"code,omitempty"`
+	Message  string         `json:"message,omitempty"`
+	URL      string         `json:"url,omitempty"`
+	Topic    string         `json:"topic,omitempty"`
+	Payload  string         `json:"payload,omitempty"`
+	Retain   bool           `json:"retain,omitempty"`
+	SceneId  string         `json:"sceneId,omitempty"`
+}
+
+func (a *Action) validate() error {
+	switch a.Type {
+	case ActionCommand:
+		if a.Command == "" {
+			return errors.New("a command action needs a command")
+		}
+	case ActionAlert:
+	case ActionWebhook:
+		if a.URL == "" {
+			return errors.New("a webhook action needs a url")
+		}
+	case ActionPublish:
+		if a.Topic == "" {
+			return errors.New("an mqtt action needs a topic")
+		}
+	case ActionScene:
+		if a.SceneId == "" {
+			return errors.New("a scene action needs a sceneId")
+		}
+	default:
+		return fmt.Errorf("unknown action type %q", a.Type)
+	}
+	return nil
+}
+
+// Firing is a rule whose condition was met, as posted to webhooks.
+type Firing struct {
+	Rule     string    `json:"rule"`
+	DeviceId string    `json:"deviceId"`
+	Property string    `json:"property"`
+	Value    any       `json:"value"`
+	Time     time.Time `json:"time"`
+}
+
+func (f *Firing) vars() map[string]string {
+	value, _ := json.Marshal(f.Value)
+	if s, ok := f.Value.(string); ok {
+		value = []byte(s)
+	} else if v, ok := f.Value.(float64); ok {
+		value = []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return map[string]string{"rule": f.Rule, "device": f.DeviceId, "property": f.Property, "value": string(value)}
+}
+
+func (e *Engine) run(ctx context.Context, action Action, firing *Firing) error {
+	vars := firing.vars()
+	switch action.Type {
+	case ActionCommand:
+		deviceId := action.DeviceId
+		if deviceId == "" {
+			deviceId = firing.DeviceId
+		}
+		ctx, cancel := context.WithTimeout(ctx, e.opts.CommandTimeout)
+		defer cancel()
+		result, err := e.devMan.SendCommand(ctx, deviceId, &core.Command{Name: action.Command, Args: maps.Clone(action.Args)})
+		if err == nil && result != nil && !result.Success {
+			err = fmt.Errorf("command %s failed: %s", action.Command, result.Error)
+		}
+		return err
+
+	case ActionAlert:
+		template := action.Message
+		if template == "" {
+			template = "rule {rule}: {device}.{property} is {value}"
+		}
+		message, err := core.RenderTemplate(template, vars)
+		if err != nil {
+			return err
+		}
+		e.devMan.ReportError(&core.DeviceError{
+			DeviceId: firing.DeviceId,
+			Kind:     core.ErrorAlert,
+			Code:     action.Code,
+			Message:  message,
+			Time:     firing.Time,
+		})
+		return nil
+
+	case ActionWebhook:
+		body, err := json.Marshal(firing)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, e.opts.WebhookTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, action.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("POST %s: %s", action.URL, resp.Status)
+		}
+		return nil
+
+	case ActionPublish:
+		if e.opts.Publish == nil {
+			return errors.New("no mqtt broker to publish to")
+		}
+		topic, err := core.RenderTemplate(action.Topic, vars)
+		if err != nil {
+			return err
+		}
+		// The firing is published as JSON without a payload template
+		payload, err := json.Marshal(firing)
+		if action.Payload != "" {
+			var rendered string
+			rendered, err = core.RenderTemplate(action.Payload, vars)
+			payload = []byte(rendered)
+		}
+		if err != nil {
+			return err
+		}
+		return e.opts.Publish(topic, payload, action.Retain)
+
+	case ActionScene:
+		if e.opts.StartScene == nil {
+			return errors.New("no scenes to start")
+		}
+		return e.opts.StartScene(action.SceneId)
+	}
+	return fmt.Errorf("unknown action type %q", action.Type)
+}
@@ -0,0 +1,121 @@
+// Package rules runs user-defined rules against the state devices report:
+// when a condition on a property has held long enough, the actions of the
+// rule are executed.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCondition = errors.New("invalid condition")
+
+type Operator string
+
+const (
+	Greater        Operator = ">"
+	GreaterOrEqual Operator = ">="
+	Less           Operator = "<"
+	LessOrEqual    Operator = "<="
+	Equal          Operator = "=="
+	NotEqual       Operator = "!="
+)
+
+// Condition compares a property of a device with a value, and may have to
+// hold for a while, as in
+//
+//	psu1.voltage > 240 for 10s
+//	door.open == true
+//	psu1.mode != "standby"
+type Condition struct {
+	DeviceId string
+	Property string
+	Operator Operator
+	Value    any
+	For      time.Duration
+}
+
+var conditionPattern = regexp.MustCompile(`^\s*([^\s.]+)\.(\S+?)\s*(>=|<=|==|!=|>|<)\s*(.+?)(?:\s+for\s+(\S+))?\s*$`)
+
+func ParseCondition(expr string) (*Condition, error) {
+	m := conditionPattern.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, fmt.Errorf("%w: expected <device>.<property> <operator> <value> [for <duration>], but got %q", ErrInvalidCondition, expr)
+	}
+	c := &Condition{DeviceId: m[1], Property: m[2], Operator: Operator(m[3])}
+
+	// Values are JSON, a word that isn't is taken as a string
+	if err := json.Unmarshal([]byte(m[4]), &c.Value); err != nil {
+		if strings.ContainsAny(m[4], " \"'") {
+			return nil, fmt.Errorf("%w: invalid value %s", ErrInvalidCondition, m[4])
+		}
+		c.Value = m[4]
+	}
+	switch c.Value.(type) {
+	case float64:
+	case string, bool, nil:
+		if c.Operator != Equal && c.Operator != NotEqual {
+			return nil, fmt.Errorf("%w: %s only compares numbers", ErrInvalidCondition, c.Operator)
+		}
+	default:
+		return nil, fmt.Errorf("%w: invalid value %s", ErrInvalidCondition, m[4])
+	}
+
+	if m[5] != "" {
+		d, err := time.ParseDuration(m[5])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("%w: invalid duration %s", ErrInvalidCondition, m[5])
+		}
+		c.For = d
+	}
+	return c, nil
+}
+
+// Holds tells whether value meets the condition. Values of another type than
+// the condition's never do, nor do they equal it.
+func (c *Condition) Holds(value any) bool {
+	return c.compare(value, 0)
+}
+
+// Clears tells whether value is far enough from meeting the condition for it
+// to be cleared: beyond the threshold by hysteresis for the orderings.
+func (c *Condition) Clears(value any, hysteresis float64) bool {
+	return !c.compare(value, -hysteresis)
+}
+
+// compare is Holds with the threshold of the orderings moved by offset, which
+// narrows the values that hold. Clearing widens them by the hysteresis.
+func (c *Condition) compare(value any, offset float64) bool {
+	threshold, ok := c.Value.(float64)
+	if !ok {
+		// Objects and arrays aren't comparable, and never equal
+		equal := false
+		switch value.(type) {
+		case string, bool, nil:
+			equal = value == c.Value
+		}
+		return equal == (c.Operator == Equal)
+	}
+	v, ok := value.(float64)
+	if !ok {
+		return c.Operator == NotEqual
+	}
+	switch c.Operator {
+	case Greater:
+		return v > threshold+offset
+	case GreaterOrEqual:
+		return v >= threshold+offset
+	case Less:
+		return v < threshold-offset
+	case LessOrEqual:
+		return v <= threshold-offset
+	case Equal:
+		return v == threshold
+	default:
+		return v != threshold
+	}
+}
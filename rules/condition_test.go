@@ -0,0 +1,46 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCondition(t *testing.T) {
+	c, err := ParseCondition("psu1.voltage > 240 for 10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DeviceId != "psu1" || c.Property != "voltage" || c.Operator != Greater || c.Value != 240.0 || c.For != 10*time.Second {
+		t.Fatal("Expected psu1.voltage > 240 for 10s, but got", c)
+	}
+	c, err = ParseCondition(`psu1.mode != "standby"`)
+	if err != nil || c.Value != "standby" || c.For != 0 {
+		t.Fatal("Expected a quoted string, but got", c, err)
+	}
+	if c, _ := ParseCondition("door.open==true"); c == nil || c.Value != true {
+		t.Fatal("Expected a bool, but got", c)
+	}
+	for _, expr := range []string{"voltage > 240", "psu1.mode > standby", "psu1.voltage > 240 for ever", "psu1.voltage ~ 3"} {
+		if _, err := ParseCondition(expr); err == nil {
+			t.Fatal("Expected", expr, "to be invalid")
+		}
+	}
+}
+
+func TestConditionHysteresis(t *testing.T) {
+	over, _ := ParseCondition("psu1.voltage > 240")
+	if !over.Holds(241.0) || over.Holds(240.0) || over.Holds("241") {
+		t.Fatal("Expected only numbers over 240 to hold")
+	}
+	if over.Clears(236.0, 5) || !over.Clears(235.0, 5) || !over.Clears(240.0, 0) {
+		t.Fatal("Expected voltage > 240 to clear at 235 with a hysteresis of 5")
+	}
+	under, _ := ParseCondition("psu1.current <= 1")
+	if under.Clears(2.0, 1) || !under.Clears(2.5, 1) {
+		t.Fatal("Expected current <= 1 to clear over 2 with a hysteresis of 1")
+	}
+	notStandby, _ := ParseCondition("psu1.mode != standby")
+	if !notStandby.Holds(map[string]any{}) || notStandby.Holds("standby") {
+		t.Fatal("Expected objects not to equal standby")
+	}
+}
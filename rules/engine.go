@@ -0,0 +1,348 @@
+package rules
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	DefaultCommandTimeout = 10 * time.Second
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
+var (
+	ErrRuleNotFound = errors.New("rule not found")
+	ErrInvalidRule  = errors.New("invalid rule")
+)
+
+// Rule runs its actions when its condition starts to hold, and once more only
+// after the condition cleared. With a hysteresis, a condition on a number
+// clears only once the value is that far past the threshold.
+type Rule struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name,omitempty"`
+	Condition  string   `json:"condition"`
+	Hysteresis float64  `json:"hysteresis,omitempty"`
+	Disabled   bool     `json:"disabled,omitempty"`
+	Actions    []Action `json:"actions"`
+}
+
+type RuleStore = core.Store[Rule]
+
+// Status is how a rule is doing since it was last enabled or changed. It
+// isn't persisted.
+type Status struct {
+	Active bool `json:"active"`
+	// PendingSince is when the condition started to hold, while it has to
+	// hold for a while before the rule fires.
+	PendingSince *time.Time `json:"pendingSince,omitempty"`
+	LastFiredAt  *time.Time `json:"lastFiredAt,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+type RuleStatus struct {
+	Rule
+	Status Status `json:"status"`
+}
+
+type Options struct {
+	// Publish publishes the messages of MQTT actions.
+	Publish func(topic string, payload []byte, retain bool) error
+	// StartScene starts the scenes of scene actions.
+	StartScene     func(sceneId string) error
+	CommandTimeout time.Duration
+	WebhookTimeout time.Duration
+}
+
+type rule struct {
+	Rule
+	condition *Condition
+	status    Status
+	// value is the latest value of the property while the rule is pending
+	value any
+	timer *time.Timer
+	// pending tells the timer of the current pending period from stopped ones
+	pending int
+}
+
+// Engine evaluates the enabled rules against the state changes of the devices.
+type Engine struct {
+	devMan core.DeviceManager
+	store  RuleStore
+	opts   Options
+	rules  map[string]*rule
+	mutex  sync.Mutex
+}
+
+func NewEngine(devMan core.DeviceManager, store RuleStore, opts Options) (*Engine, error) {
+	if opts.CommandTimeout <= 0 {
+		opts.CommandTimeout = DefaultCommandTimeout
+	}
+	if opts.WebhookTimeout <= 0 {
+		opts.WebhookTimeout = DefaultWebhookTimeout
+	}
+	e := &Engine{devMan: devMan, store: store, opts: opts, rules: make(map[string]*rule)}
+	if store == nil {
+		return e, nil
+	}
+
+	rules, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		condition, err := ParseCondition(r.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Id, err)
+		}
+		e.rules[r.Id] = &rule{Rule: r, condition: condition}
+	}
+	return e, nil
+}
+
+func validate(r Rule) (*Condition, error) {
+	if r.Id == "" {
+		return nil, errors.Join(ErrInvalidRule, errors.New("missing id"))
+	}
+	condition, err := ParseCondition(r.Condition)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidRule, err)
+	}
+	if r.Hysteresis < 0 {
+		return nil, errors.Join(ErrInvalidRule, errors.New("negative hysteresis"))
+	}
+	if len(r.Actions) == 0 {
+		return nil, errors.Join(ErrInvalidRule, errors.New("no actions"))
+	}
+	for _, action := range r.Actions {
+		if err := action.validate(); err != nil {
+			return nil, errors.Join(ErrInvalidRule, err)
+		}
+	}
+	return condition, nil
+}
+
+// persist must be called with mutex held
+func (e *Engine) persist() error {
+	if e.store == nil {
+		return nil
+	}
+	rules := make([]Rule, 0, len(e.rules))
+	for _, r := range e.rules {
+		rules = append(rules, r.Rule)
+	}
+	slices.SortFunc(rules, func(a, b Rule) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return e.store.Save(rules)
+}
+
+// PutRule creates or replaces a rule. It is evaluated against the last state
+// of its device right away, if the device is online.
+func (e *Engine) PutRule(r Rule) error {
+	condition, err := validate(r)
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if old, ok := e.rules[r.Id]; ok {
+		old.stop()
+	}
+	e.rules[r.Id] = &rule{Rule: r, condition: condition}
+	if err := e.persist(); err != nil {
+		return err
+	}
+	e.evaluateLastState(e.rules[r.Id])
+	return nil
+}
+
+func (e *Engine) GetRule(id string) (RuleStatus, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	r, ok := e.rules[id]
+	if !ok {
+		return RuleStatus{}, ErrRuleNotFound
+	}
+	return RuleStatus{r.Rule, r.status}, nil
+}
+
+func (e *Engine) ListRules() []RuleStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	rules := make([]RuleStatus, 0, len(e.rules))
+	for _, r := range e.rules {
+		rules = append(rules, RuleStatus{r.Rule, r.status})
+	}
+	slices.SortFunc(rules, func(a, b RuleStatus) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return rules
+}
+
+func (e *Engine) RemoveRule(id string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	r, ok := e.rules[id]
+	if !ok {
+		return ErrRuleNotFound
+	}
+	r.stop()
+	delete(e.rules, id)
+	return e.persist()
+}
+
+// SetEnabled enables or disables a rule. Enabling starts it afresh.
+func (e *Engine) SetEnabled(id string, enabled bool) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	r, ok := e.rules[id]
+	if !ok {
+		return ErrRuleNotFound
+	}
+	if r.Disabled == !enabled {
+		return nil
+	}
+	r.stop()
+	r.status = Status{}
+	r.Disabled = !enabled
+	if err := e.persist(); err != nil {
+		return err
+	}
+	e.evaluateLastState(r)
+	return nil
+}
+
+// Run evaluates the rules until ctx is done. A rule waiting for its condition
+// to hold for a while starts over when its device goes offline.
+func (e *Engine) Run(ctx context.Context) {
+	sub := e.devMan.SubscribeToEvents(ctx, core.EventFilter{Types: []core.EventType{
+		core.EventStateChanged, core.EventDeviceDisconnected, core.EventDeviceRemoved,
+	}}, core.SubscriptionOptions{BufferSize: 256, Overflow: core.OverflowDropOldest})
+	defer sub.Close()
+
+	e.mutex.Lock()
+	for _, r := range e.rules {
+		e.evaluateLastState(r)
+	}
+	e.mutex.Unlock()
+
+	for event := range sub.C() {
+		e.mutex.Lock()
+		for _, r := range e.rules {
+			if r.condition.DeviceId != event.DeviceId() {
+				continue
+			}
+			if changed, ok := event.(core.StateChangedEvent); !ok {
+				r.stop()
+			} else if p, ok := changed.NewState.Get(r.condition.Property); ok {
+				e.evaluate(r, p.Value)
+			}
+		}
+		e.mutex.Unlock()
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, r := range e.rules {
+		r.stop()
+	}
+}
+
+// evaluateLastState must be called with mutex held. The last state of a
+// device that isn't online can be days old, it mustn't fire rules.
+func (e *Engine) evaluateLastState(r *rule) {
+	record, err := e.devMan.GetDeviceRecord(r.condition.DeviceId)
+	if err != nil || record.Presence.Status != core.StatusOnline {
+		return
+	}
+	if p, ok := record.LastState.Get(r.condition.Property); ok {
+		e.evaluate(r, p.Value)
+	}
+}
+
+// evaluate must be called with mutex held
+func (e *Engine) evaluate(r *rule, value any) {
+	if r.Disabled {
+		return
+	}
+	if r.status.Active {
+		if r.condition.Clears(value, r.Hysteresis) {
+			r.status.Active = false
+			log.Println("Rule", r.Id, "cleared")
+		}
+		return
+	}
+	if !r.condition.Holds(value) {
+		r.stop()
+		return
+	}
+
+	r.value = value
+	if r.status.PendingSince != nil {
+		return
+	}
+	now := time.Now()
+	r.status.PendingSince = &now
+	if r.condition.For == 0 {
+		e.fire(r)
+		return
+	}
+	pending := r.pending
+	r.timer = time.AfterFunc(r.condition.For, func() {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		if e.rules[r.Id] == r && r.pending == pending {
+			e.fire(r)
+		}
+	})
+}
+
+// stop ends a pending period.
+func (r *rule) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.pending++
+	r.status.PendingSince = nil
+}
+
+// fire must be called with mutex held. The actions run one after the other,
+// a failing one doesn't stop the rest.
+func (e *Engine) fire(r *rule) {
+	r.stop()
+	now := time.Now()
+	r.status.Active = true
+	r.status.LastFiredAt = &now
+	r.status.LastError = ""
+	firing := &Firing{Rule: r.Id, DeviceId: r.condition.DeviceId, Property: r.condition.Property, Value: r.value, Time: now}
+	log.Println("Rule", r.Id, "fired,", firing.DeviceId+"."+firing.Property, "is", firing.Value)
+
+	go func() {
+		var errs []error
+		for i, action := range r.Actions {
+			if err := e.run(context.Background(), action, firing); err != nil {
+				log.Println("Rule", r.Id, "action", i, "failed:", err)
+				errs = append(errs, fmt.Errorf("action %d (%s): %w", i, action.Type, err))
+			}
+		}
+		if len(errs) == 0 {
+			return
+		}
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		if e.rules[r.Id] == r && r.status.LastFiredAt == &now {
+			r.status.LastError = errors.Join(errs...).Error()
+		}
+	}()
+}
@@ -0,0 +1,182 @@
+package rules
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/devicetest"
+)
+
+var psuDescriptor = &core.Descriptor{Commands: []core.CommandSpec{devicetest.PowerCommand}}
+
+func report(dev *devicetest.Device, voltage float64) {
+	state := core.NewState(time.Now())
+	state.Set("voltage", voltage, "V")
+	dev.Report(state)
+}
+
+// start starts engine once the registry recorded the voltage dev reports, so
+// it starts out evaluating it, and waits for rule to be pending.
+func start(t *testing.T, ctx context.Context, devMan core.DeviceManager, engine *Engine, dev *devicetest.Device, rule string, voltage float64) time.Time {
+	t.Helper()
+	states := devMan.SubscribeToEvents(ctx, core.EventFilter{Types: []core.EventType{core.EventStateChanged}}, core.SubscriptionOptions{})
+	defer states.Close()
+	report(dev, voltage)
+	<-states.C()
+	go engine.Run(ctx)
+	return pending(t, engine, rule, time.Time{})
+}
+
+// pending waits for rule to be pending since after since and returns when it
+// started to be.
+func pending(t *testing.T, engine *Engine, rule string, since time.Time) time.Time {
+	t.Helper()
+	var pendingSince time.Time
+	devicetest.WaitFor(t, "rule "+rule+" to be pending", func() bool {
+		status, _ := engine.GetRule(rule)
+		if status.Status.PendingSince == nil || !status.Status.PendingSince.After(since) {
+			return false
+		}
+		pendingSince = *status.Status.PendingSince
+		return true
+	})
+	return pendingSince
+}
+
+// notPublished fails the test if anything is published within wait.
+func notPublished(t *testing.T, published chan string, wait time.Duration, why string) {
+	t.Helper()
+	select {
+	case message := <-published:
+		t.Fatal("Expected", why, ", but got", message)
+	case <-time.After(wait):
+	}
+}
+
+func TestEngine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	devMan := core.NewBasicDeviceManager()
+	dev := devicetest.NewDevice("psu1", psuDescriptor)
+	devMan.AddDevice(dev)
+
+	published := make(chan string, 10)
+	engine, _ := NewEngine(devMan, nil, Options{Publish: func(topic string, payload []byte, retain bool) error {
+		published <- topic + " " + string(payload)
+		return nil
+	}})
+	err := engine.PutRule(Rule{
+		Id:         "overvoltage",
+		Condition:  "psu1.voltage > 240 for 100ms",
+		Hysteresis: 5,
+		Actions: []Action{
+			{Type: ActionCommand, Command: "power", Args: map[string]any{"state": "off"}},
+			{Type: ActionPublish, Topic: "alerts/{device}", Payload: "{property} at {value}"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.PutRule(Rule{Id: "broken", Condition: "psu1.voltage >", Actions: []Action{{Type: ActionAlert}}}); err == nil {
+		t.Fatal("Expected an invalid condition to be rejected")
+	}
+	pendingSince := start(t, ctx, devMan, engine, dev, "overvoltage", 250)
+
+	// A dip resets the period the condition has to hold for
+	report(dev, 230)
+	report(dev, 245)
+	pendingSince = pending(t, engine, "overvoltage", pendingSince)
+	select {
+	case message := <-published:
+		if message != "alerts/psu1 voltage at 245" {
+			t.Fatal("Expected the voltage to be published, but got", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the rule to fire")
+	}
+	rule, _ := engine.GetRule("overvoltage")
+	if !rule.Status.Active || rule.Status.LastFiredAt == nil {
+		t.Fatal("Expected the rule to be active, but got", rule.Status)
+	}
+	if held := rule.Status.LastFiredAt.Sub(pendingSince); held < 100*time.Millisecond {
+		t.Fatal("Expected the rule to fire 100ms after the dip, but it fired after", held)
+	}
+
+	// Within the hysteresis the rule stays active and doesn't fire again
+	firedAt := *rule.Status.LastFiredAt
+	report(dev, 238)
+	report(dev, 250)
+	report(dev, 234)
+	devicetest.WaitFor(t, "the rule to clear at 234", func() bool {
+		rule, _ = engine.GetRule("overvoltage")
+		return !rule.Status.Active
+	})
+	if !rule.Status.LastFiredAt.Equal(firedAt) {
+		t.Fatal("Expected the rule not to fire again, but it fired at", rule.Status.LastFiredAt)
+	}
+
+	// A disabled rule doesn't fire
+	engine.SetEnabled("overvoltage", false)
+	report(dev, 250)
+	notPublished(t, published, 200*time.Millisecond, "a disabled rule not to fire")
+	if commands := dev.WaitCommands(1, time.Second); len(commands) != 1 || commands[0].Name != "power" {
+		t.Fatal("Expected a power command, but got", commands)
+	}
+}
+
+func TestEngineOfflineDevice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	devMan := core.NewBasicDeviceManager()
+	dev := devicetest.NewDevice("psu1", psuDescriptor)
+	devMan.AddDevice(dev)
+
+	published := make(chan string, 10)
+	engine, _ := NewEngine(devMan, nil, Options{Publish: func(topic string, payload []byte, retain bool) error {
+		published <- topic
+		return nil
+	}})
+	rule := Rule{
+		Id:        "overvoltage",
+		Condition: "psu1.voltage > 240 for 100ms",
+		Actions:   []Action{{Type: ActionPublish, Topic: "alerts/{device}"}},
+	}
+	engine.PutRule(rule)
+	start(t, ctx, devMan, engine, dev, "overvoltage", 250)
+
+	// The device going offline ends the pending period
+	devMan.SetDeviceOffline("psu1", "test")
+	devicetest.WaitFor(t, "the pending period to end", func() bool {
+		status, _ := engine.GetRule("overvoltage")
+		return status.Status.PendingSince == nil
+	})
+	notPublished(t, published, 150*time.Millisecond, "the rule not to fire for an offline device")
+
+	// Nor does the last state of an offline device start one
+	engine.PutRule(rule)
+	if status, _ := engine.GetRule("overvoltage"); status.Status.PendingSince != nil {
+		t.Fatal("Expected the last state of an offline device to be skipped, but got", status.Status)
+	}
+	notPublished(t, published, 150*time.Millisecond, "the last state of an offline device to be skipped")
+}
+
+func TestEnginePersistence(t *testing.T) {
+	store := core.NewFileStore[Rule](t.TempDir() + "/rules.json")
+	engine, _ := NewEngine(core.NewBasicDeviceManager(), store, Options{})
+	engine.PutRule(Rule{Id: "door", Condition: "door.open == true", Actions: []Action{{Type: ActionAlert}}})
+	engine.SetEnabled("door", false)
+
+	engine, err := NewEngine(core.NewBasicDeviceManager(), store, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := engine.ListRules()
+	if len(rules) != 1 || rules[0].Id != "door" || !rules[0].Disabled {
+		t.Fatal("Expected the disabled door rule, but got", rules)
+	}
+	if err := engine.RemoveRule("door"); err != nil || len(engine.ListRules()) != 0 {
+		t.Fatal("Expected the rule to be removed, but got", err)
+	}
+}
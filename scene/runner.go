@@ -0,0 +1,446 @@
+package scene
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+var (
+	ErrRunNotFound = errors.New("scene run not found")
+	ErrRunFinished = errors.New("scene run already finished")
+)
+
+const (
+	// runsKept is how many finished runs are kept, of all scenes.
+	runsKept = 100
+	// maxSteps bounds the steps a run executes, for scenes that go back to
+	// earlier steps on failure.
+	maxSteps = 1000
+)
+
+type RunState string
+
+const (
+	RunRunning   RunState = "running"
+	RunSucceeded RunState = "succeeded"
+	RunFailed    RunState = "failed"
+	RunCancelled RunState = "cancelled"
+)
+
+// StepResult is a step executed by a run. A step that is gone back to is
+// executed, and listed, again.
+type StepResult struct {
+	Step       int                        `json:"step"`
+	Label      string                     `json:"label,omitempty"`
+	Type       StepType                   `json:"type"`
+	StartedAt  time.Time                  `json:"startedAt"`
+	FinishedAt time.Time                  `json:"finishedAt"`
+	Success    bool                       `json:"success"`
+	Error      string                     `json:"error,omitempty"`
+	Outcomes   []core.GroupCommandOutcome `json:"outcomes,omitempty"`
+}
+
+// Run is an execution of a scene. It runs the steps of the scene as it was
+// when the run started. Runs aren't persisted.
+type Run struct {
+	Id      string   `json:"id"`
+	SceneId string   `json:"sceneId"`
+	State   RunState `json:"state"`
+	// Step is the step being executed while running
+	Step       int          `json:"step"`
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Steps      []StepResult `json:"steps"`
+}
+
+type run struct {
+	Run
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// snapshot must be called with mutex held
+func (r *run) snapshot() Run {
+	s := r.Run
+	s.Steps = slices.Clone(r.Steps)
+	return s
+}
+
+// Runner keeps the scenes and runs them against the devices, any number at a
+// time.
+type Runner struct {
+	devMan   core.DeviceManager
+	groupMan *core.GroupManager
+	store    SceneStore
+	scenes   map[string]*plan
+	runs     map[string]*run
+	// finished are the ids of the finished runs, oldest first
+	finished []string
+	mutex    sync.Mutex
+}
+
+func NewRunner(devMan core.DeviceManager, groupMan *core.GroupManager, store SceneStore) (*Runner, error) {
+	r := &Runner{
+		devMan:   devMan,
+		groupMan: groupMan,
+		store:    store,
+		scenes:   make(map[string]*plan),
+		runs:     make(map[string]*run),
+	}
+	if store == nil {
+		return r, nil
+	}
+
+	scenes, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, scene := range scenes {
+		p, err := newPlan(scene)
+		if err != nil {
+			return nil, fmt.Errorf("scene %s: %w", scene.Id, err)
+		}
+		r.scenes[scene.Id] = p
+	}
+	return r, nil
+}
+
+// persist must be called with mutex held
+func (r *Runner) persist() error {
+	if r.store == nil {
+		return nil
+	}
+	scenes := make([]Scene, 0, len(r.scenes))
+	for _, p := range r.scenes {
+		scenes = append(scenes, p.Scene)
+	}
+	slices.SortFunc(scenes, func(a, b Scene) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return r.store.Save(scenes)
+}
+
+// PutScene creates or replaces a scene. Runs already started keep the steps
+// they started with.
+func (r *Runner) PutScene(scene Scene) error {
+	p, err := newPlan(scene)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.scenes[scene.Id] = p
+	return r.persist()
+}
+
+func (r *Runner) GetScene(id string) (Scene, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.scenes[id]
+	if !ok {
+		return Scene{}, ErrSceneNotFound
+	}
+	return p.Scene, nil
+}
+
+func (r *Runner) ListScenes() []Scene {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	scenes := make([]Scene, 0, len(r.scenes))
+	for _, p := range r.scenes {
+		scenes = append(scenes, p.Scene)
+	}
+	slices.SortFunc(scenes, func(a, b Scene) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return scenes
+}
+
+// RemoveScene deletes a scene. Its runs go on.
+func (r *Runner) RemoveScene(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.scenes[id]; !ok {
+		return ErrSceneNotFound
+	}
+	delete(r.scenes, id)
+	return r.persist()
+}
+
+func newRunId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Start starts a run of a scene and returns it as it started.
+func (r *Runner) Start(sceneId string) (Run, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.scenes[sceneId]
+	if !ok {
+		return Run{}, ErrSceneNotFound
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &run{
+		Run:    Run{Id: newRunId(), SceneId: sceneId, State: RunRunning, StartedAt: time.Now(), Steps: []StepResult{}},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	r.runs[run.Id] = run
+	log.Println("Starting scene", sceneId, "run", run.Id)
+	go r.execute(ctx, run, p)
+	return run.snapshot(), nil
+}
+
+func (r *Runner) GetRun(id string) (Run, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return Run{}, ErrRunNotFound
+	}
+	return run.snapshot(), nil
+}
+
+// ListRuns lists the runs of a scene, or of all scenes if sceneId is empty,
+// newest first.
+func (r *Runner) ListRuns(sceneId string) []Run {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	runs := make([]Run, 0)
+	for _, run := range r.runs {
+		if sceneId == "" || run.SceneId == sceneId {
+			runs = append(runs, run.snapshot())
+		}
+	}
+	slices.SortFunc(runs, func(a, b Run) int {
+		return b.StartedAt.Compare(a.StartedAt)
+	})
+	return runs
+}
+
+// Cancel stops a run. The step being executed is interrupted, a command
+// already sent to a device isn't undone.
+func (r *Runner) Cancel(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return ErrRunNotFound
+	}
+	if run.State != RunRunning {
+		return ErrRunFinished
+	}
+	run.cancel()
+	return nil
+}
+
+// Wait waits for a run to finish and returns it, or returns ctx.Err().
+func (r *Runner) Wait(ctx context.Context, id string) (Run, error) {
+	r.mutex.Lock()
+	run, ok := r.runs[id]
+	r.mutex.Unlock()
+	if !ok {
+		return Run{}, ErrRunNotFound
+	}
+	select {
+	case <-run.done:
+		return r.GetRun(id)
+	case <-ctx.Done():
+		return Run{}, ctx.Err()
+	}
+}
+
+func (r *Runner) execute(ctx context.Context, run *run, p *plan) {
+	defer run.cancel()
+	state, message := RunSucceeded, ""
+	for i, executed := 0, 0; i < len(p.steps); executed++ {
+		if executed == maxSteps {
+			state, message = RunFailed, fmt.Sprintf("gave up after %d steps", maxSteps)
+			break
+		}
+		step := p.steps[i]
+		r.mutex.Lock()
+		run.Step = i
+		r.mutex.Unlock()
+
+		result := StepResult{Step: i, Label: step.Label, Type: step.Type, StartedAt: time.Now()}
+		result.Outcomes, result.Error = r.executeStep(ctx, step)
+		result.Success = result.Error == "" && ctx.Err() == nil
+		result.FinishedAt = time.Now()
+		r.mutex.Lock()
+		run.Steps = append(run.Steps, result)
+		r.mutex.Unlock()
+
+		if ctx.Err() != nil {
+			state, message = RunCancelled, ""
+			break
+		}
+		if result.Success {
+			i++
+			continue
+		}
+		if step.onFailure < 0 {
+			state, message = RunFailed, fmt.Sprintf("step %d: %s", i, result.Error)
+			break
+		}
+		log.Println("Scene", p.Id, "run", run.Id, "step", i, "failed:", result.Error)
+		i = step.onFailure
+	}
+
+	if state == RunFailed {
+		log.Println("Scene", p.Id, "run", run.Id, "failed:", message)
+	} else {
+		log.Println("Scene", p.Id, "run", run.Id, string(state))
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	run.State, run.Error, run.FinishedAt = state, message, &now
+	close(run.done)
+	r.finished = append(r.finished, run.Id)
+	if len(r.finished) > runsKept {
+		delete(r.runs, r.finished[0])
+		r.finished = r.finished[1:]
+	}
+}
+
+// executeStep returns the error of a failed step as it is reported.
+func (r *Runner) executeStep(ctx context.Context, step plannedStep) ([]core.GroupCommandOutcome, string) {
+	var err error
+	switch step.Type {
+	case StepCommand:
+		return r.command(ctx, step)
+	case StepWait:
+		select {
+		case <-time.After(step.duration):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	case StepWaitUntil:
+		err = r.waitUntil(ctx, step)
+	}
+	if err != nil {
+		return nil, err.Error()
+	}
+	return nil, ""
+}
+
+func (r *Runner) command(ctx context.Context, step plannedStep) ([]core.GroupCommandOutcome, string) {
+	ctx, cancel := context.WithTimeout(ctx, step.timeout)
+	defer cancel()
+	command := &core.Command{Name: step.Command, Args: maps.Clone(step.Args)}
+
+	if step.GroupId != "" {
+		if r.groupMan == nil {
+			return nil, "no groups to send commands to"
+		}
+		outcomes, err := r.groupMan.SendCommandToGroup(ctx, step.GroupId, command)
+		if err != nil {
+			return outcomes, err.Error()
+		}
+		failed := 0
+		for _, outcome := range outcomes {
+			if !outcome.Success {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return outcomes, fmt.Sprintf("%d of %d devices failed", failed, len(outcomes))
+		}
+		return outcomes, ""
+	}
+
+	result, err := r.devMan.SendCommand(ctx, step.DeviceId, command)
+	outcome := core.GroupCommandOutcome{DeviceId: step.DeviceId, Result: result}
+	switch {
+	case err != nil:
+		outcome.Error = err.Error()
+	case result != nil && !result.Success:
+		outcome.Error = result.Error
+		if outcome.Error == "" {
+			outcome.Error = "command failed"
+		}
+	default:
+		outcome.Success = true
+	}
+	return []core.GroupCommandOutcome{outcome}, outcome.Error
+}
+
+// globEscaper quotes a device id for use as an EventFilter.DevicePattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+// waitUntil waits for the condition of a step to hold, for as long as it
+// says, on the last state of the device if it is online and on the states it
+// reports next. The device going offline starts the wait for over.
+func (r *Runner) waitUntil(ctx context.Context, step plannedStep) error {
+	condition := step.condition
+	waitCtx, cancel := context.WithTimeout(ctx, step.timeout)
+	defer cancel()
+	// Subscribed before looking at the last state so as not to miss a change
+	sub := r.devMan.SubscribeToEvents(waitCtx, core.EventFilter{
+		Types:         []core.EventType{core.EventStateChanged, core.EventDeviceDisconnected},
+		DevicePattern: globEscaper.Replace(condition.DeviceId),
+	}, core.SubscriptionOptions{BufferSize: 64, Overflow: core.OverflowDropOldest})
+	defer sub.Close()
+
+	var held <-chan time.Time
+	holding := false
+	check := func(state *core.State) bool {
+		p, ok := state.Get(condition.Property)
+		if !ok || !condition.Holds(p.Value) {
+			holding, held = false, nil
+			return false
+		}
+		if !holding {
+			holding = true
+			if condition.For == 0 {
+				return true
+			}
+			held = time.After(condition.For)
+		}
+		return false
+	}
+
+	record, err := r.devMan.GetDeviceRecord(condition.DeviceId)
+	if err == nil && record.Presence.Status == core.StatusOnline && check(record.LastState) {
+		return nil
+	}
+	events := sub.C()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			changed, ok := event.(core.StateChangedEvent)
+			if !ok {
+				holding, held = false, nil
+			} else if check(changed.NewState) {
+				return nil
+			}
+		case <-held:
+			return nil
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("%s didn't hold within %s", step.Condition, step.timeout)
+		}
+	}
+}
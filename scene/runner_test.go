@@ -0,0 +1,162 @@
+package scene
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/devicetest"
+)
+
+// newDevice creates a device that switches its output a little after it is
+// told to.
+func newDevice() *devicetest.Device {
+	dev := devicetest.NewDevice("psu1", &core.Descriptor{Commands: []core.CommandSpec{devicetest.PowerCommand}})
+	dev.OnCommand = func(command core.Command) {
+		time.AfterFunc(20*time.Millisecond, func() {
+			state := core.NewState(time.Now())
+			state.Set("output", command.Args["state"], "")
+			dev.Report(state)
+		})
+	}
+	return dev
+}
+
+// sent lists the commands dev got as in power on.
+func sent(dev *devicetest.Device) []string {
+	var sent []string
+	for _, command := range dev.Commands() {
+		sent = append(sent, command.Name+" "+command.Args["state"].(string))
+	}
+	return sent
+}
+
+func power(state string) Step {
+	return Step{Type: StepCommand, DeviceId: "psu1", Command: "power", Args: map[string]any{"state": state}}
+}
+
+func TestRunner(t *testing.T) {
+	devMan := core.NewBasicDeviceManager()
+	dev := newDevice()
+	devMan.AddDevice(dev)
+	runner, _ := NewRunner(devMan, nil, nil)
+
+	err := runner.PutScene(Scene{Id: "startup", Steps: []Step{
+		power("on"),
+		{Type: StepWaitUntil, Condition: "psu1.output == on", Timeout: "1s"},
+		{Type: StepWait, Duration: "10ms"},
+		// Never holds, so the scene goes on from the shutdown step
+		{Type: StepWaitUntil, Condition: "psu1.output == standby", Timeout: "50ms", OnFailure: "shutdown"},
+		power("standby"),
+		{Label: "shutdown", Type: StepCommand, DeviceId: "psu1", Command: "power", Args: map[string]any{"state": "off"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	run, err := runner.Start("startup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != RunRunning {
+		t.Fatal("Expected the run to be running, but got", run.State)
+	}
+	run, err = runner.Wait(ctx, run.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.State != RunSucceeded || run.FinishedAt == nil {
+		t.Fatal("Expected the run to succeed, but got", run.State, run.Error)
+	}
+	if len(run.Steps) != 5 || run.Steps[3].Success || run.Steps[4].Step != 5 {
+		t.Fatal("Expected steps 0 to 3 and 5 with step 3 failed, but got", run.Steps)
+	}
+	if sent := sent(dev); len(sent) != 2 || sent[0] != "power on" || sent[1] != "power off" {
+		t.Fatal("Expected power on and off, but got", sent)
+	}
+	if runs := runner.ListRuns("startup"); len(runs) != 1 || runs[0].Id != run.Id {
+		t.Fatal("Expected the run to be listed, but got", runs)
+	}
+}
+
+func TestRunnerAbortsAndCancels(t *testing.T) {
+	devMan := core.NewBasicDeviceManager()
+	dev := newDevice()
+	devMan.AddDevice(dev)
+	runner, _ := NewRunner(devMan, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	runner.PutScene(Scene{Id: "check", Steps: []Step{
+		{Type: StepWaitUntil, Condition: "psu1.output == on", Timeout: "30ms"},
+		power("on"),
+	}})
+	run, _ := runner.Start("check")
+	run, _ = runner.Wait(ctx, run.Id)
+	if run.State != RunFailed || len(run.Steps) != 1 || run.Error == "" {
+		t.Fatal("Expected the run to fail at the first step, but got", run.State, run.Steps)
+	}
+	if sent := sent(dev); len(sent) != 0 {
+		t.Fatal("Expected no commands, but got", sent)
+	}
+
+	runner.PutScene(Scene{Id: "slow", Steps: []Step{{Type: StepWait, Duration: "10s"}, power("on")}})
+	run, _ = runner.Start("slow")
+	if err := runner.Cancel(run.Id); err != nil {
+		t.Fatal(err)
+	}
+	run, _ = runner.Wait(ctx, run.Id)
+	if run.State != RunCancelled || len(run.Steps) != 1 {
+		t.Fatal("Expected the run to be cancelled in the first step, but got", run.State, run.Steps)
+	}
+	if err := runner.Cancel(run.Id); !errors.Is(err, ErrRunFinished) {
+		t.Fatal("Expected", ErrRunFinished, ", but got", err)
+	}
+	if _, err := runner.Start("missing"); !errors.Is(err, ErrSceneNotFound) {
+		t.Fatal("Expected", ErrSceneNotFound, ", but got", err)
+	}
+}
+
+func TestRunnerWaitsForOnlineDevice(t *testing.T) {
+	devMan := core.NewBasicDeviceManager()
+	dev := newDevice()
+	devMan.AddDevice(dev)
+	runner, _ := NewRunner(devMan, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	state := core.NewState(time.Now())
+	state.Set("output", "on", "")
+	states := devMan.SubscribeToEvents(ctx, core.EventFilter{Types: []core.EventType{core.EventStateChanged}}, core.SubscriptionOptions{})
+	dev.Report(state)
+	<-states.C()
+	devMan.SetDeviceOffline("psu1", "test")
+
+	runner.PutScene(Scene{Id: "check", Steps: []Step{{Type: StepWaitUntil, Condition: "psu1.output == on", Timeout: "50ms"}}})
+	run, _ := runner.Start("check")
+	run, _ = runner.Wait(ctx, run.Id)
+	if run.State != RunFailed {
+		t.Fatal("Expected the last state of an offline device not to count, but got", run.State)
+	}
+}
+
+func TestInvalidScenes(t *testing.T) {
+	runner, _ := NewRunner(core.NewBasicDeviceManager(), nil, nil)
+	for _, steps := range [][]Step{
+		nil,
+		{{Type: "reboot"}},
+		{{Type: StepCommand, Command: "power"}},
+		{{Type: StepWait, Duration: "soon"}},
+		{{Type: StepWaitUntil, Condition: "psu1.output"}},
+		{{Type: StepWait, Duration: "1s", OnFailure: "nowhere"}},
+		{{Type: StepWait, Duration: "1s", Label: "a"}, {Type: StepWait, Duration: "1s", Label: "a"}},
+	} {
+		if err := runner.PutScene(Scene{Id: "bad", Steps: steps}); !errors.Is(err, ErrInvalidScene) {
+			t.Fatal("Expected", steps, "to be invalid, but got", err)
+		}
+	}
+}
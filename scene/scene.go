@@ -0,0 +1,157 @@
+// Package scene runs scenes: named sequences of commands, waits and checks of
+// device state, such as powering up a rack in order.
+package scene
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/rules"
+)
+
+var (
+	ErrSceneNotFound = errors.New("scene not found")
+	ErrInvalidScene  = errors.New("invalid scene")
+)
+
+const (
+	DefaultCommandTimeout = 10 * time.Second
+	DefaultWaitTimeout    = 30 * time.Second
+)
+
+type StepType string
+
+const (
+	// StepCommand sends a command to a device or a group. It fails when the
+	// command does on any device.
+	StepCommand StepType = "command"
+	// StepWait waits for Duration.
+	StepWait StepType = "wait"
+	// StepWaitUntil waits for a condition on the state of a device, as in
+	// "psu1.voltage >= 11.5 for 2s". It fails if the condition isn't met
+	// within Timeout.
+	StepWaitUntil StepType = "wait_until"
+)
+
+// OnFailure values other than these are the label of the step to go on from.
+const (
+	OnFailureAbort    = "abort"
+	OnFailureContinue = "continue"
+)
+
+// Step is a step of a scene. Durations are such as "500ms" or "2m". What to do
+// when the step fails is OnFailure: abort the scene, the default, continue
+// with the next step, or go on from the step with that label.
+type Step struct {
+	Type  StepType `json:"type"`
+	Label string   `json:"label,omitempty"`
+
+	DeviceId string         `json:"deviceId,omitempty"`
+	GroupId  string         `json:"groupId,omitempty"`
+	Command  string         `json:"command,omitempty"`
+	Args     map[string]any `json:"args,omitempty"`
+
+	Duration  string `json:"duration,omitempty"`
+	Condition string `json:"condition,omitempty"`
+	Timeout   string `json:"timeout,omitempty"`
+
+	OnFailure string `json:"onFailure,omitempty"`
+}
+
+type Scene struct {
+	Id    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Steps []Step `json:"steps"`
+}
+
+type SceneStore = core.Store[Scene]
+
+// plan is a validated scene, ready to run.
+type plan struct {
+	Scene
+	steps []plannedStep
+}
+
+type plannedStep struct {
+	Step
+	duration  time.Duration
+	timeout   time.Duration
+	condition *rules.Condition
+	// onFailure is the index of the step to go on from, -1 to abort
+	onFailure int
+}
+
+func newPlan(scene Scene) (*plan, error) {
+	if scene.Id == "" {
+		return nil, errors.Join(ErrInvalidScene, errors.New("missing id"))
+	}
+	if len(scene.Steps) == 0 {
+		return nil, errors.Join(ErrInvalidScene, errors.New("no steps"))
+	}
+	labels := make(map[string]int)
+	for i, step := range scene.Steps {
+		if step.Label == "" {
+			continue
+		}
+		if _, ok := labels[step.Label]; ok || step.Label == OnFailureAbort || step.Label == OnFailureContinue {
+			return nil, errors.Join(ErrInvalidScene, fmt.Errorf("step %d: label %q is taken", i, step.Label))
+		}
+		labels[step.Label] = i
+	}
+
+	p := &plan{Scene: scene}
+	for i, step := range scene.Steps {
+		planned, err := planStep(step, i, labels)
+		if err != nil {
+			return nil, errors.Join(ErrInvalidScene, fmt.Errorf("step %d: %w", i, err))
+		}
+		p.steps = append(p.steps, planned)
+	}
+	return p, nil
+}
+
+func planStep(step Step, index int, labels map[string]int) (plannedStep, error) {
+	planned := plannedStep{Step: step}
+	var err error
+	switch step.Type {
+	case StepCommand:
+		if (step.DeviceId == "") == (step.GroupId == "") {
+			return planned, errors.New("exactly one of deviceId and groupId is needed")
+		}
+		if step.Command == "" {
+			return planned, errors.New("missing command")
+		}
+		planned.timeout, err = core.ParseDuration("timeout", step.Timeout, DefaultCommandTimeout)
+	case StepWait:
+		if step.Duration == "" {
+			return planned, errors.New("missing duration")
+		}
+		planned.duration, err = core.ParseDuration("duration", step.Duration, 0)
+	case StepWaitUntil:
+		if planned.condition, err = rules.ParseCondition(step.Condition); err != nil {
+			return planned, err
+		}
+		planned.timeout, err = core.ParseDuration("timeout", step.Timeout, DefaultWaitTimeout)
+	default:
+		return planned, fmt.Errorf("unknown step type %q", step.Type)
+	}
+	if err != nil {
+		return planned, err
+	}
+
+	switch step.OnFailure {
+	case "", OnFailureAbort:
+		planned.onFailure = -1
+	case OnFailureContinue:
+		planned.onFailure = index + 1
+	default:
+		target, ok := labels[step.OnFailure]
+		if !ok {
+			return planned, fmt.Errorf("no step labeled %q", step.OnFailure)
+		}
+		planned.onFailure = target
+	}
+	return planned, nil
+}
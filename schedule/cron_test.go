@@ -0,0 +1,67 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	sofia, _ := time.LoadLocation("Europe/Sofia")
+	at := func(s string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", s, sofia)
+		return t
+	}
+	for _, test := range []struct {
+		expr  string
+		after string
+		next  string
+	}{
+		{"*/15 6-22 * * mon-fri", "2024-05-03 22:50", "2024-05-06 06:00"},
+		{"30 7 * * *", "2024-05-03 07:30", "2024-05-04 07:30"},
+		{"0 0 1,15 * *", "2024-05-03 10:00", "2024-05-15 00:00"},
+		// Either day field matches when both are restricted
+		{"0 12 13 * 5", "2024-05-01 00:00", "2024-05-03 12:00"},
+		{"@monthly", "2024-12-31 23:59", "2025-01-01 00:00"},
+		{"0 0 29 feb *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		// 03:30 doesn't exist on the day clocks go forward
+		{"30 3 * * *", "2024-03-31 00:00", "2024-04-01 03:30"},
+	} {
+		cron, err := ParseCron(test.expr)
+		if err != nil {
+			t.Fatal(test.expr, err)
+		}
+		next, ok := cron.Next(at(test.after), sofia)
+		if !ok || !next.Equal(at(test.next)) {
+			t.Fatal("Expected", test.expr, "after", test.after, "at", test.next, ", but got", next)
+		}
+	}
+	if cron, _ := ParseCron("0 0 30 2 *"); cron != nil {
+		if _, ok := cron.Next(at("2024-01-01 00:00"), sofia); ok {
+			t.Fatal("Expected February 30th never to come")
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Fatal("Expected", expr, "to be invalid")
+		}
+	}
+}
+
+func TestSunTimes(t *testing.T) {
+	london, _ := time.LoadLocation("Europe/London")
+	rise, set, ok := SunTimes(2024, 6, 21, Coordinates{51.5074, -0.1278})
+	expectedRise := time.Date(2024, 6, 21, 4, 43, 0, 0, london)
+	expectedSet := time.Date(2024, 6, 21, 21, 21, 0, 0, london)
+	if !ok || rise.Sub(expectedRise).Abs() > 2*time.Minute || set.Sub(expectedSet).Abs() > 2*time.Minute {
+		t.Fatal("Expected sunrise at 04:43 and sunset at 21:21 in London, but got", rise.In(london), set.In(london))
+	}
+	if _, _, ok := SunTimes(2024, 12, 21, Coordinates{78.22, 15.65}); ok {
+		t.Fatal("Expected no sunrise in the polar night")
+	}
+
+	after := time.Date(2024, 6, 21, 22, 0, 0, 0, london)
+	next, ok := nextSunEvent(Sunset, -30*time.Minute, after, Coordinates{51.5074, -0.1278}, london)
+	if !ok || next.Day() != 22 || next.Hour() != 20 || next.Minute() < 50 {
+		t.Fatal("Expected half an hour before sunset on the next day, but got", next)
+	}
+}
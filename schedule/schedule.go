@@ -0,0 +1,149 @@
+// Package schedule sends commands to devices and groups, or starts scenes, at
+// set times: on cron expressions, at fixed intervals, once at a date, or
+// around sunrise and sunset.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrInvalidSchedule  = errors.New("invalid schedule")
+)
+
+// MissedRuns says what to do with the runs a schedule missed while the server
+// was down.
+type MissedRuns string
+
+const (
+	// MissedSkip drops missed runs, the default.
+	MissedSkip MissedRuns = "skip"
+	// MissedOnce runs once for all the missed runs.
+	MissedOnce MissedRuns = "once"
+	// MissedAll runs every missed run, up to maxMissedRuns.
+	MissedAll MissedRuns = "all"
+)
+
+// Schedule sends a command to a device or a group, or starts a scene, on
+// exactly one of Cron, Every, At or Sun. Every and Offset are durations such as "15m" or "-30m";
+// intervals count from when the schedule was created.
+type Schedule struct {
+	Id   string `json:"id"`
+	Name string `json:"name,omitempty"`
+
+	Cron   string     `json:"cron,omitempty"`
+	Every  string     `json:"every,omitempty"`
+	At     *time.Time `json:"at,omitempty"`
+	Sun    SunEvent   `json:"sun,omitempty"`
+	Offset string     `json:"offset,omitempty"`
+
+	DeviceId string         `json:"deviceId,omitempty"`
+	GroupId  string         `json:"groupId,omitempty"`
+	SceneId  string         `json:"sceneId,omitempty"`
+	Command  string         `json:"command,omitempty"`
+	Args     map[string]any `json:"args,omitempty"`
+
+	Missed    MissedRuns `json:"missed,omitempty"`
+	Disabled  bool       `json:"disabled,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	// ActiveSince is when the schedule was last changed or enabled. Runs due
+	// before then aren't made up for.
+	ActiveSince time.Time `json:"activeSince"`
+}
+
+type ScheduleStore = core.Store[Schedule]
+
+// trigger computes the times a schedule runs at.
+type trigger func(after time.Time) (time.Time, bool)
+
+func (s *Schedule) trigger(site Site) (trigger, error) {
+	set := 0
+	for _, isSet := range []bool{s.Cron != "", s.Every != "", s.At != nil, s.Sun != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("exactly one of cron, every, at and sun is needed")
+	}
+
+	switch {
+	case s.Cron != "":
+		cron, err := ParseCron(s.Cron)
+		if err != nil {
+			return nil, err
+		}
+		return func(after time.Time) (time.Time, bool) {
+			return cron.Next(after, site.TimeZone)
+		}, nil
+
+	case s.Every != "":
+		every, err := time.ParseDuration(s.Every)
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("invalid interval %q", s.Every)
+		}
+		start := s.CreatedAt
+		return func(after time.Time) (time.Time, bool) {
+			if after.Before(start) {
+				return start, true
+			}
+			return start.Add((after.Sub(start)/every + 1) * every), true
+		}, nil
+
+	case s.At != nil:
+		at := *s.At
+		return func(after time.Time) (time.Time, bool) {
+			return at, at.After(after)
+		}, nil
+	}
+
+	if s.Sun != Sunrise && s.Sun != Sunset {
+		return nil, fmt.Errorf("unknown sun event %q", s.Sun)
+	}
+	if site.Coordinates == nil {
+		return nil, errors.New("no location is configured for sunrise and sunset")
+	}
+	var offset time.Duration
+	if s.Offset != "" {
+		var err error
+		if offset, err = time.ParseDuration(s.Offset); err != nil {
+			return nil, fmt.Errorf("invalid offset %q", s.Offset)
+		}
+	}
+	return func(after time.Time) (time.Time, bool) {
+		return nextSunEvent(s.Sun, offset, after, *site.Coordinates, site.TimeZone)
+	}, nil
+}
+
+func (s *Schedule) validate(site Site) (trigger, error) {
+	if s.Id == "" {
+		return nil, errors.Join(ErrInvalidSchedule, errors.New("missing id"))
+	}
+	targets := 0
+	for _, id := range []string{s.DeviceId, s.GroupId, s.SceneId} {
+		if id != "" {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return nil, errors.Join(ErrInvalidSchedule, errors.New("exactly one of deviceId, groupId and sceneId is needed"))
+	}
+	if s.Command == "" && s.SceneId == "" {
+		return nil, errors.Join(ErrInvalidSchedule, errors.New("missing command"))
+	}
+	switch s.Missed {
+	case "", MissedSkip, MissedOnce, MissedAll:
+	default:
+		return nil, errors.Join(ErrInvalidSchedule, fmt.Errorf("unknown missed runs policy %q", s.Missed))
+	}
+	trigger, err := s.trigger(site)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidSchedule, err)
+	}
+	return trigger, nil
+}
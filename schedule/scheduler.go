@@ -0,0 +1,430 @@
+package schedule
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+)
+
+const (
+	DefaultCommandTimeout = 30 * time.Second
+	// maxMissedRuns bounds the runs made up for after downtime.
+	maxMissedRuns = 100
+	// runsKept is how many runs of each schedule are kept.
+	runsKept = 50
+	// maxWait is the longest the scheduler sleeps, in case the clock jumps.
+	maxWait = time.Minute
+)
+
+// Site is where the scheduler runs: the time zone of cron expressions and of
+// the days sunrise and sunset are computed for, time.Local if nil, and the
+// coordinates they are computed at.
+type Site struct {
+	Coordinates *Coordinates
+	TimeZone    *time.Location
+}
+
+type Options struct {
+	Site           Site
+	CommandTimeout time.Duration
+	// StartScene starts the scenes of schedules and returns the id of the run.
+	StartScene func(sceneId string) (string, error)
+}
+
+// Run is an execution of a schedule.
+type Run struct {
+	ScheduleId  string    `json:"scheduleId"`
+	ScheduledAt time.Time `json:"scheduledAt"`
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt"`
+	// Missed is a run made up for after downtime.
+	Missed   bool                       `json:"missed,omitempty"`
+	Success  bool                       `json:"success"`
+	Error    string                     `json:"error,omitempty"`
+	Outcomes []core.GroupCommandOutcome `json:"outcomes,omitempty"`
+	// SceneRunId is the run of the scene started, which goes on on its own
+	SceneRunId string `json:"sceneRunId,omitempty"`
+}
+
+type RunStore = core.Store[Run]
+
+type ScheduleStatus struct {
+	Schedule
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	LastRun   *Run       `json:"lastRun,omitempty"`
+}
+
+type entry struct {
+	Schedule
+	trigger trigger
+	// next is zero once a schedule has no more runs
+	next time.Time
+}
+
+func (e *entry) scheduleAfter(t time.Time) {
+	next, ok := e.trigger(t)
+	if !ok {
+		next = time.Time{}
+	}
+	e.next = next
+}
+
+// Scheduler runs the enabled schedules. Schedules and their runs are persisted
+// so that runs missed while the server was down can be made up for.
+type Scheduler struct {
+	devMan    core.DeviceManager
+	groupMan  *core.GroupManager
+	store     ScheduleStore
+	runStore  RunStore
+	opts      Options
+	schedules map[string]*entry
+	// runs are oldest first
+	runs  []Run
+	mutex sync.Mutex
+	wake  chan struct{}
+}
+
+func NewScheduler(devMan core.DeviceManager, groupMan *core.GroupManager, store ScheduleStore, runStore RunStore, opts Options) (*Scheduler, error) {
+	if opts.Site.TimeZone == nil {
+		opts.Site.TimeZone = time.Local
+	}
+	if opts.CommandTimeout <= 0 {
+		opts.CommandTimeout = DefaultCommandTimeout
+	}
+	s := &Scheduler{
+		devMan:    devMan,
+		groupMan:  groupMan,
+		store:     store,
+		runStore:  runStore,
+		opts:      opts,
+		schedules: make(map[string]*entry),
+		wake:      make(chan struct{}, 1),
+	}
+
+	if store != nil {
+		schedules, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+		for _, schedule := range schedules {
+			trigger, err := schedule.validate(opts.Site)
+			if err != nil {
+				return nil, fmt.Errorf("schedule %s: %w", schedule.Id, err)
+			}
+			s.schedules[schedule.Id] = &entry{Schedule: schedule, trigger: trigger}
+		}
+	}
+	if runStore != nil {
+		runs, err := runStore.Load()
+		if err != nil {
+			return nil, err
+		}
+		s.runs = runs
+	}
+	return s, nil
+}
+
+// persist must be called with mutex held
+func (s *Scheduler) persist() error {
+	if s.store == nil {
+		return nil
+	}
+	schedules := make([]Schedule, 0, len(s.schedules))
+	for _, e := range s.schedules {
+		schedules = append(schedules, e.Schedule)
+	}
+	slices.SortFunc(schedules, func(a, b Schedule) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return s.store.Save(schedules)
+}
+
+// persistRuns must be called with mutex held
+func (s *Scheduler) persistRuns() error {
+	if s.runStore == nil {
+		return nil
+	}
+	return s.runStore.Save(s.runs)
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// PutSchedule creates or replaces a schedule. A replaced schedule keeps its
+// creation time, and with it the start of its intervals, but the runs its old
+// trigger missed aren't made up for.
+func (s *Scheduler) PutSchedule(schedule Schedule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	schedule.CreatedAt, schedule.ActiveSince = now, now
+	if old, ok := s.schedules[schedule.Id]; ok {
+		schedule.CreatedAt = old.CreatedAt
+	}
+	trigger, err := schedule.validate(s.opts.Site)
+	if err != nil {
+		return err
+	}
+
+	e := &entry{Schedule: schedule, trigger: trigger}
+	e.scheduleAfter(now)
+	s.schedules[schedule.Id] = e
+	s.notify()
+	return s.persist()
+}
+
+// status must be called with mutex held
+func (s *Scheduler) status(e *entry) ScheduleStatus {
+	status := ScheduleStatus{Schedule: e.Schedule}
+	if !e.Disabled && !e.next.IsZero() {
+		next := e.next
+		status.NextRunAt = &next
+	}
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if s.runs[i].ScheduleId == e.Id {
+			run := s.runs[i]
+			status.LastRun = &run
+			break
+		}
+	}
+	return status
+}
+
+func (s *Scheduler) GetSchedule(id string) (ScheduleStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.schedules[id]
+	if !ok {
+		return ScheduleStatus{}, ErrScheduleNotFound
+	}
+	return s.status(e), nil
+}
+
+func (s *Scheduler) ListSchedules() []ScheduleStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	schedules := make([]ScheduleStatus, 0, len(s.schedules))
+	for _, e := range s.schedules {
+		schedules = append(schedules, s.status(e))
+	}
+	slices.SortFunc(schedules, func(a, b ScheduleStatus) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return schedules
+}
+
+// RemoveSchedule deletes a schedule along with its runs.
+func (s *Scheduler) RemoveSchedule(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.schedules[id]; !ok {
+		return ErrScheduleNotFound
+	}
+	delete(s.schedules, id)
+	s.runs = slices.DeleteFunc(s.runs, func(r Run) bool { return r.ScheduleId == id })
+	return errors.Join(s.persist(), s.persistRuns())
+}
+
+// SetEnabled enables or disables a schedule. The runs missed while it was
+// disabled aren't made up for.
+func (s *Scheduler) SetEnabled(id string, enabled bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.schedules[id]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	if e.Disabled == !enabled {
+		return nil
+	}
+	now := time.Now()
+	e.Disabled = !enabled
+	if enabled {
+		e.ActiveSince = now
+	}
+	e.scheduleAfter(now)
+	s.notify()
+	return s.persist()
+}
+
+// Runs lists the runs of a schedule, newest first.
+func (s *Scheduler) Runs(id string) ([]Run, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.schedules[id]; !ok {
+		return nil, ErrScheduleNotFound
+	}
+	runs := make([]Run, 0)
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if s.runs[i].ScheduleId == id {
+			runs = append(runs, s.runs[i])
+		}
+	}
+	return runs, nil
+}
+
+// Run makes up for the runs missed since the last one recorded, or since the
+// schedule was last changed or enabled if that is later, and then runs
+// the schedules as they come due, until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mutex.Lock()
+	now := time.Now()
+	for _, e := range s.schedules {
+		if !e.Disabled {
+			s.catchUp(ctx, e, now)
+		}
+		e.scheduleAfter(now)
+	}
+	s.mutex.Unlock()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	for {
+		s.mutex.Lock()
+		now := time.Now()
+		wait := maxWait
+		for _, e := range s.schedules {
+			if e.Disabled || e.next.IsZero() {
+				continue
+			}
+			if !e.next.After(now) {
+				go s.execute(ctx, e.Schedule, e.next, false)
+				e.scheduleAfter(now)
+				if e.next.IsZero() {
+					continue
+				}
+			}
+			wait = min(wait, e.next.Sub(now))
+		}
+		s.mutex.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// catchUp must be called with mutex held
+func (s *Scheduler) catchUp(ctx context.Context, e *entry, now time.Time) {
+	if e.Missed == "" || e.Missed == MissedSkip {
+		return
+	}
+	last := e.CreatedAt
+	if e.ActiveSince.After(last) {
+		last = e.ActiveSince
+	}
+	for _, run := range s.runs {
+		if run.ScheduleId == e.Id && run.ScheduledAt.After(last) {
+			last = run.ScheduledAt
+		}
+	}
+
+	var missed []time.Time
+	for t, ok := e.trigger(last); ok && !t.After(now) && len(missed) < maxMissedRuns; t, ok = e.trigger(t) {
+		missed = append(missed, t)
+		if e.Missed == MissedOnce {
+			break
+		}
+	}
+	if len(missed) == 0 {
+		return
+	}
+	log.Println("Making up for", len(missed), "missed runs of schedule", e.Id)
+	go func() {
+		for _, t := range missed {
+			s.execute(ctx, e.Schedule, t, true)
+		}
+	}()
+}
+
+// execute sends the command of a schedule, or starts its scene, and records
+// the run.
+func (s *Scheduler) execute(ctx context.Context, schedule Schedule, scheduledAt time.Time, missed bool) {
+	run := Run{ScheduleId: schedule.Id, ScheduledAt: scheduledAt, StartedAt: time.Now(), Missed: missed}
+	ctx, cancel := context.WithTimeout(ctx, s.opts.CommandTimeout)
+	defer cancel()
+	command := &core.Command{Name: schedule.Command, Args: maps.Clone(schedule.Args)}
+
+	switch {
+	case schedule.SceneId != "":
+		var err error
+		if s.opts.StartScene == nil {
+			err = errors.New("no scenes to start")
+		} else {
+			run.SceneRunId, err = s.opts.StartScene(schedule.SceneId)
+		}
+		if err != nil {
+			run.Error = err.Error()
+		} else {
+			run.Success = true
+		}
+	case schedule.GroupId != "":
+		outcomes, err := s.groupMan.SendCommandToGroup(ctx, schedule.GroupId, command)
+		run.Outcomes = outcomes
+		failed := 0
+		for _, outcome := range outcomes {
+			if !outcome.Success {
+				failed++
+			}
+		}
+		switch {
+		case err != nil:
+			run.Error = err.Error()
+		case failed > 0:
+			run.Error = fmt.Sprintf("%d of %d devices failed", failed, len(outcomes))
+		default:
+			run.Success = true
+		}
+	default:
+		result, err := s.devMan.SendCommand(ctx, schedule.DeviceId, command)
+		outcome := core.GroupCommandOutcome{DeviceId: schedule.DeviceId, Result: result}
+		switch {
+		case err != nil:
+			outcome.Error = err.Error()
+		case result != nil && !result.Success:
+			outcome.Error = result.Error
+		default:
+			outcome.Success = true
+		}
+		run.Outcomes = []core.GroupCommandOutcome{outcome}
+		run.Success, run.Error = outcome.Success, outcome.Error
+	}
+	run.FinishedAt = time.Now()
+	if !run.Success {
+		log.Println("Schedule", schedule.Id, "failed:", run.Error)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.schedules[schedule.Id]; !ok {
+		return
+	}
+	s.runs = append(s.runs, run)
+	kept := 0
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if s.runs[i].ScheduleId == schedule.Id {
+			if kept++; kept > runsKept {
+				s.runs = slices.Delete(s.runs, i, i+1)
+			}
+		}
+	}
+	if err := s.persistRuns(); err != nil {
+		log.Println("Failed to save the runs of schedule", schedule.Id, "-", err)
+	}
+}
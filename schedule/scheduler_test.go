@@ -0,0 +1,126 @@
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ilievs/fibers/core"
+	"github.com/ilievs/fibers/devicetest"
+)
+
+var psuDescriptor = &core.Descriptor{Commands: []core.CommandSpec{devicetest.PowerCommand}}
+
+func TestScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	devMan := core.NewBasicDeviceManager()
+	psu1, psu2 := devicetest.NewDevice("psu1", psuDescriptor), devicetest.NewDevice("psu2", psuDescriptor)
+	devMan.AddDevice(psu1)
+	devMan.AddDevice(psu2)
+	groupMan, _ := core.NewGroupManager(devMan, nil)
+	groupMan.PutGroup(core.Group{Id: "rack", Members: []string{"psu1", "psu2"}})
+
+	scheduler, _ := NewScheduler(devMan, groupMan, nil, nil, Options{StartScene: func(sceneId string) (string, error) {
+		return "run-of-" + sceneId, nil
+	}})
+	go scheduler.Run(ctx)
+
+	err := scheduler.PutSchedule(Schedule{Id: "tick", Every: "1s", DeviceId: "psu1", Command: "power", Args: map[string]any{"state": "on"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(500 * time.Millisecond)
+	scheduler.PutSchedule(Schedule{Id: "once", At: &at, GroupId: "rack", Command: "power", Args: map[string]any{"state": "off"}})
+	scheduler.PutSchedule(Schedule{Id: "scene", At: &at, SceneId: "startup"})
+	for _, invalid := range []Schedule{
+		{Id: "both", Every: "1s", Cron: "* * * * *", DeviceId: "psu1", Command: "power"},
+		{Id: "sun", Sun: Sunrise, DeviceId: "psu1", Command: "power"},
+		{Id: "nobody", Every: "1s", Command: "power"},
+		{Id: "two", Every: "1s", DeviceId: "psu1", SceneId: "startup", Command: "power"},
+	} {
+		if err := scheduler.PutSchedule(invalid); err == nil {
+			t.Fatal("Expected schedule", invalid.Id, "to be invalid")
+		}
+	}
+
+	psu1Commands, psu2Commands := psu1.WaitCommands(3, 3*time.Second), psu2.WaitCommands(1, time.Second)
+	if len(psu1Commands) != 3 || len(psu2Commands) != 1 {
+		t.Fatal("Expected 2 ticks and a group command on psu1, but got", psu1Commands, psu2Commands)
+	}
+	devicetest.WaitFor(t, "the runs of once and scene", func() bool {
+		once, _ := scheduler.Runs("once")
+		scene, _ := scheduler.Runs("scene")
+		return len(once) > 0 && len(scene) > 0
+	})
+	runs, _ := scheduler.Runs("once")
+	if len(runs) != 1 || !runs[0].Success || len(runs[0].Outcomes) != 2 {
+		t.Fatal("Expected a successful run on both devices, but got", runs)
+	}
+	if runs, _ := scheduler.Runs("scene"); len(runs) != 1 || !runs[0].Success || runs[0].SceneRunId != "run-of-startup" {
+		t.Fatal("Expected the scene to be started, but got", runs)
+	}
+	if status, _ := scheduler.GetSchedule("once"); status.NextRunAt != nil || status.LastRun == nil {
+		t.Fatal("Expected a one-shot schedule to be done, but got", status)
+	}
+
+	scheduler.SetEnabled("tick", false)
+	if commands := psu1.WaitCommands(4, 1100*time.Millisecond); len(commands) != 3 {
+		t.Fatal("Expected a disabled schedule not to run, but got", commands)
+	}
+	// The runs missed while disabled aren't made up for after a restart
+	enabledAt := time.Now()
+	scheduler.SetEnabled("tick", true)
+	if status, _ := scheduler.GetSchedule("tick"); status.ActiveSince.Before(enabledAt) {
+		t.Fatal("Expected the schedule to be active since it was enabled, but got", status.ActiveSince)
+	}
+}
+
+func TestMissedRuns(t *testing.T) {
+	dir := t.TempDir()
+	devMan := core.NewBasicDeviceManager()
+	psu1 := devicetest.NewDevice("psu1", psuDescriptor)
+	devMan.AddDevice(psu1)
+	created := time.Now().Add(-10*time.Minute - 30*time.Second)
+	store := core.NewFileStore[Schedule](dir + "/schedules.json")
+	store.Save([]Schedule{
+		{Id: "all", Every: "1m", DeviceId: "psu1", Command: "power", Missed: MissedAll, CreatedAt: created},
+		{Id: "once", Every: "1m", DeviceId: "psu1", Command: "power", Missed: MissedOnce, CreatedAt: created},
+		{Id: "skip", Every: "1m", DeviceId: "psu1", Command: "power", CreatedAt: created},
+		// Enabled again 2 and a half minutes ago
+		{Id: "enabled", Every: "1m", DeviceId: "psu1", Command: "power", Missed: MissedAll, CreatedAt: created,
+			ActiveSince: created.Add(8 * time.Minute)},
+	})
+	runStore := core.NewFileStore[Run](dir + "/runs.json")
+	// The last run of all was 3 minutes ago
+	runStore.Save([]Run{{ScheduleId: "all", ScheduledAt: created.Add(7 * time.Minute), Success: true}})
+
+	scheduler, err := NewScheduler(devMan, nil, store, runStore, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go scheduler.Run(ctx)
+	defer cancel()
+	// 3 runs of all, 1 of once and 2 of enabled
+	if commands := psu1.WaitCommands(6, time.Second); len(commands) != 6 {
+		t.Fatal("Expected 6 missed runs to be made up for, but got", commands)
+	}
+	devicetest.WaitFor(t, "the missed runs to be saved", func() bool {
+		saved, _ := runStore.Load()
+		return len(saved) == 7
+	})
+
+	for id, expected := range map[string]int{"all": 3, "once": 1, "skip": 0, "enabled": 2} {
+		runs, _ := scheduler.Runs(id)
+		missed := 0
+		for _, run := range runs {
+			if run.Missed {
+				missed++
+			}
+		}
+		if missed != expected {
+			t.Fatal("Expected", expected, "missed runs of", id, ", but got", missed)
+		}
+	}
+}
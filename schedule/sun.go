@@ -0,0 +1,79 @@
+package schedule
+
+import (
+	"math"
+	"time"
+)
+
+type SunEvent string
+
+const (
+	Sunrise SunEvent = "sunrise"
+	Sunset  SunEvent = "sunset"
+)
+
+// Coordinates are where sunrise and sunset are computed for. Latitude is north
+// positive, longitude east positive, in degrees.
+type Coordinates struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// j2000 is noon of 2000-01-01 UTC, the epoch of the sunrise equation.
+var j2000 = time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// SunTimes computes sunrise and sunset on a calendar day with the sunrise
+// equation, to within a couple of minutes away from the poles. It reports
+// false on days the sun doesn't rise or doesn't set.
+func SunTimes(year int, month time.Month, day int, at Coordinates) (rise time.Time, set time.Time, ok bool) {
+	// Days since J2000 at the solar noon of the day at the longitude
+	n := float64(time.Date(year, month, day, 12, 0, 0, 0, time.UTC).Sub(j2000)/(24*time.Hour)) - at.Longitude/360
+
+	anomaly := math.Mod(357.5291+0.98560028*n, 360)
+	m := radians(anomaly)
+	center := 1.9148*math.Sin(m) + 0.02*math.Sin(2*m) + 0.0003*math.Sin(3*m)
+	ecliptic := radians(math.Mod(anomaly+center+180+102.9372, 360))
+	transit := n + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*ecliptic)
+
+	declination := math.Asin(math.Sin(ecliptic) * math.Sin(radians(23.4397)))
+	latitude := radians(at.Latitude)
+	// The sun is up when its center is 0.833 degrees below the horizon, for
+	// refraction and the size of its disc
+	cosHourAngle := (math.Sin(radians(-0.833)) - math.Sin(latitude)*math.Sin(declination)) /
+		(math.Cos(latitude) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	at2000 := func(days float64) time.Time {
+		return j2000.Add(time.Duration(days * float64(24*time.Hour))).Round(time.Second)
+	}
+	return at2000(transit - hourAngle/360), at2000(transit + hourAngle/360), true
+}
+
+// nextSunEvent returns the first sunrise or sunset, moved by offset, after
+// after. Days are those of loc.
+func nextSunEvent(event SunEvent, offset time.Duration, after time.Time, at Coordinates, loc *time.Location) (time.Time, bool) {
+	local := after.In(loc)
+	// A day back for negative offsets, a year ahead for polar nights
+	for day := -1; day <= 366; day++ {
+		y, m, d := local.AddDate(0, 0, day).Date()
+		rise, set, ok := SunTimes(y, m, d, at)
+		if !ok {
+			continue
+		}
+		t := rise
+		if event == Sunset {
+			t = set
+		}
+		if t = t.Add(offset); t.After(after) {
+			return t.In(loc), true
+		}
+	}
+	return time.Time{}, false
+}